@@ -0,0 +1,692 @@
+package ccds
+
+import (
+  "bytes"
+  "context"
+  "encoding/base64"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "io"
+  "net/http"
+  "net/url"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+
+  "github.com/korlando/ccds/server"
+)
+
+const DefaultBaseURL = "https://airk.ai"
+
+// encoding used to send hashes to the server; raw argon2 output is not
+// valid utf8, so it has to be encoded losslessly
+const DefaultEncoding = server.EncodingHex
+
+// client used by Compromised, CompromisedBatch and CompromisedRange
+var DefaultClient = NewClient(DefaultBaseURL)
+
+// a username and password pair
+type Cred struct{
+  Username string
+  Password string
+}
+
+// returned by Negotiate when the server supports none of Client.Supported
+var ErrNoCommonParams = errors.New("The server supports none of the client's Argon2 parameter sets.")
+
+// the costliest parameters negotiate accepts, whatever Supported says, so
+// that a misconfigured or hostile server can't make the client allocate
+// unbounded memory
+const MaxNegotiatedMemory = 4 << 20 // KiB
+const MaxNegotiatedIterations = 64
+
+// returned when the server answers with a status other than 2xx
+type StatusError struct{
+  StatusCode int
+  // the server's error message, or the status text if it sent none
+  Message    string
+}
+
+func (e *StatusError) Error() string {
+  return "CCDS server responded " + strconv.Itoa(e.StatusCode) + ": " + e.Message
+}
+
+// Client checks credentials against a CCDS server. It is safe for
+// concurrent use once configured.
+type Client struct{
+  // scheme and host of the server, without the /v1 prefix
+  BaseURL        string
+  HTTPClient     *http.Client
+  // name of the server.ParamSet to check against; if empty, the first
+  // request calls Negotiate
+  ParamSet       string
+  // must match the parameters of ParamSet
+  Params         Argon2Params
+  // sets Negotiate may pick from; empty means any set the server serves
+  // within MaxNegotiatedMemory and MaxNegotiatedIterations
+  Supported      []server.ParamSet
+  Encoding       string
+  // must match the server's --range-prefix; between 1 and the length of
+  // the hex encoded hash
+  RangePrefixLen int
+  // sent as a bearer token if set
+  APIKey         string
+  // the tenant's blocklist salt, see FetchBlocklistSalt; if set, checks
+  // also hash the password alone, doubling their cost, and match the
+  // tenant's blocklist
+  BlocklistSalt  []byte
+  // guards ParamSet and Params, which requests may negotiate
+  mu             sync.Mutex
+  // whether ParamSet came from Negotiate, in which case it is negotiated
+  // again if the server stops serving it
+  negotiated     bool
+}
+
+// returns a client for the server at baseURL with a 7s timeout that
+// supports server.DefaultParamSet; it negotiates on its first request
+func NewClient(baseURL string) *Client {
+  return &Client{
+    BaseURL: strings.TrimSuffix(baseURL, "/"),
+    HTTPClient: &http.Client{
+      Timeout: time.Second * 7,
+    },
+    Params: DefaultArgon2Params,
+    Supported: []server.ParamSet{server.DefaultParamSet},
+    Encoding: DefaultEncoding,
+    RangePrefixLen: server.DefaultRangePrefixLen,
+  }
+}
+
+func Compromised(u, pw string) (bool, error) {
+  return DefaultClient.CheckCredential(context.Background(), u, pw)
+}
+
+// like Compromised, but also returns where the credential leaked
+func CompromisedDetails(u, pw string) (server.CredDetailsRes, error) {
+  return DefaultClient.CredentialDetails(context.Background(), u, pw)
+}
+
+// checks many credentials at once; compromised[i] is the result for creds[i]
+func CompromisedBatch(creds []Cred) (compromised []bool, err error) {
+  return DefaultClient.CheckCredentials(context.Background(), creds)
+}
+
+// returns how many times pw appeared in breaches, whoever it belonged to,
+// so that widely reused passwords can be banned
+func PasswordCompromised(pw string) (int64, error) {
+  return DefaultClient.CheckPassword(context.Background(), pw)
+}
+
+// like Compromised, but only a prefix of the hash leaves the process
+func CompromisedRange(u, pw string) (bool, error) {
+  return DefaultClient.CheckCredentialRange(context.Background(), u, pw)
+}
+
+// asks the server which parameter sets it serves and switches the client
+// to the strongest one that is also in Supported
+func (c *Client) Negotiate(ctx context.Context) (p server.ParamSet, err error) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return c.negotiate(ctx)
+}
+
+// must hold mu
+func (c *Client) negotiate(ctx context.Context) (p server.ParamSet, err error) {
+  paramsRes, err := c.ParamSets(ctx)
+  if err != nil {
+    return
+  }
+  found := false
+  for _, serverSet := range paramsRes.Sets {
+    if !c.supports(serverSet) {
+      continue
+    }
+    if !found || serverSet.Stronger(p) {
+      p = serverSet
+      found = true
+    }
+  }
+  if !found {
+    return p, ErrNoCommonParams
+  }
+  c.ParamSet = p.Name
+  c.Params = Argon2ParamsFor(p)
+  c.negotiated = true
+  return p, nil
+}
+
+func (c *Client) supports(p server.ParamSet) bool {
+  // the name must agree with the fields, which are what the client hashes with
+  parsed, err := server.ParseParamSet(p.Name)
+  if err != nil || parsed != p || p.Memory > MaxNegotiatedMemory || p.Iterations > MaxNegotiatedIterations {
+    return false
+  }
+  if len(c.Supported) == 0 {
+    return true
+  }
+  for _, clientSet := range c.Supported {
+    if p == clientSet {
+      return true
+    }
+  }
+  return false
+}
+
+// returns the parameter set to hash with, negotiating one first if
+// ParamSet is empty
+func (c *Client) paramSet(ctx context.Context) (name string, params Argon2Params, err error) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  if c.ParamSet == "" {
+    if _, err = c.negotiate(ctx); err != nil {
+      return
+    }
+  }
+  return c.ParamSet, c.Params, nil
+}
+
+// calls do with the parameter set to hash with; if the server no longer
+// serves a negotiated set, negotiates again and calls do once more
+func (c *Client) withParamSet(ctx context.Context, do func(name string, params Argon2Params) error) error {
+  name, params, err := c.paramSet(ctx)
+  if err != nil {
+    return err
+  }
+  err = do(name, params)
+  statusErr, ok := err.(*StatusError)
+  if !ok || statusErr.StatusCode != http.StatusBadRequest || !strings.HasPrefix(statusErr.Message, server.UnsupportedParamSet) {
+    return err
+  }
+  c.mu.Lock()
+  if !c.negotiated {
+    c.mu.Unlock()
+    return err
+  }
+  // unless another request already negotiated again
+  if c.ParamSet == name {
+    c.ParamSet = ""
+  }
+  c.mu.Unlock()
+  name, params, err = c.paramSet(ctx)
+  if err != nil {
+    return err
+  }
+  return do(name, params)
+}
+
+// returns how often and in which breaches the credential leaked
+func (c *Client) CredentialDetails(ctx context.Context, u, pw string) (details server.CredDetailsRes, err error) {
+  err = c.withParamSet(ctx, func(name string, params Argon2Params) error {
+    reqBody, err := c.credReqBody(name, params, u, pw)
+    if err != nil {
+      return err
+    }
+    return c.postJSON(ctx, "/v2/cred", reqBody, &details)
+  })
+  return
+}
+
+// registers a made up credential as a canary; looking it up raises an
+// alert. Needs an admin API key.
+func (c *Client) AddCanary(ctx context.Context, u, pw, label string) (canary server.Canary, err error) {
+  err = c.withParamSet(ctx, func(name string, params Argon2Params) error {
+    encoded, err := server.EncodeHash(hashCred(params, u, pw), c.Encoding)
+    if err != nil {
+      return err
+    }
+    reqBody := server.CanaryReqBody{Hash: encoded, Encoding: c.Encoding, Params: name, Label: label}
+    return c.postJSON(ctx, "/admin/canaries", reqBody, &canary)
+  })
+  return
+}
+
+func (c *Client) ListCanaries(ctx context.Context) (canaries []server.Canary, err error) {
+  var res server.CanariesRes
+  err = c.getJSON(ctx, "/admin/canaries", &res)
+  return res.Canaries, err
+}
+
+func (c *Client) DeleteCanary(ctx context.Context, id string) (err error) {
+  req, err := http.NewRequestWithContext(ctx, "DELETE", c.BaseURL + "/admin/canaries/" + url.PathEscape(id), nil)
+  if err != nil {
+    return
+  }
+  res, err := c.do(req)
+  if err != nil {
+    return
+  }
+  return res.Body.Close()
+}
+
+// adds creds to the tenant's watchlist, so that the webhook set with
+// SetWebhook is called if they turn up in a later breach; returns whether
+// each is already compromised
+func (c *Client) Watch(ctx context.Context, creds []Cred) (compromised []bool, err error) {
+  var credsRes server.CredsRes
+  err = c.withParamSet(ctx, func(name string, params Argon2Params) error {
+    reqBody, err := c.watchReqBody(name, params, creds)
+    if err != nil {
+      return err
+    }
+    return c.postJSON(ctx, "/v1/watch", reqBody, &credsRes)
+  })
+  if err != nil {
+    return
+  }
+  for _, res := range credsRes.Results {
+    compromised = append(compromised, res.Compromised)
+  }
+  return compromised, nil
+}
+
+func (c *Client) Unwatch(ctx context.Context, creds []Cred) (err error) {
+  return c.withParamSet(ctx, func(name string, params Argon2Params) error {
+    reqBody, err := c.watchReqBody(name, params, creds)
+    if err != nil {
+      return err
+    }
+    req, err := c.newJSONRequest(ctx, "DELETE", "/v1/watch", reqBody)
+    if err != nil {
+      return err
+    }
+    res, err := c.do(req)
+    if err != nil {
+      return err
+    }
+    return res.Body.Close()
+  })
+}
+
+func (c *Client) watchReqBody(name string, params Argon2Params, creds []Cred) (reqBody server.WatchReqBody, err error) {
+  reqBody = server.WatchReqBody{Encoding: c.Encoding, Params: name}
+  for _, cred := range creds {
+    encoded, err := server.EncodeHash(hashCred(params, cred.Username, cred.Password), c.Encoding)
+    if err != nil {
+      return reqBody, err
+    }
+    reqBody.Hashes = append(reqBody.Hashes, encoded)
+  }
+  return
+}
+
+// registers the webhook watchlist matches are POSTed to; the returned
+// secret verifies their signatures, see server.VerifyWebhook
+func (c *Client) SetWebhook(ctx context.Context, webhookURL string) (h server.Webhook, err error) {
+  req, err := c.newJSONRequest(ctx, "PUT", "/v1/watch/webhook", server.WebhookReqBody{URL: webhookURL})
+  if err != nil {
+    return
+  }
+  err = c.doJSON(req, &h)
+  return
+}
+
+// fetches the tenant's blocklist salt into BlocklistSalt, so that later
+// checks also match the tenant's blocklist
+func (c *Client) FetchBlocklistSalt(ctx context.Context) (err error) {
+  var res server.BlocklistRes
+  err = c.withParamSet(ctx, func(name string, params Argon2Params) error {
+    return c.getJSON(ctx, "/v1/blocklist?params=" + url.QueryEscape(name) + "&encoding=" + server.EncodingHex, &res)
+  })
+  if err != nil {
+    return
+  }
+  c.BlocklistSalt, err = hex.DecodeString(res.Salt)
+  return
+}
+
+// adds passwords, such as the company name, to the tenant's blocklist;
+// only their salted hashes are sent
+func (c *Client) BlockPasswords(ctx context.Context, passwords []string) (err error) {
+  return c.sendBlocklist(ctx, "POST", passwords)
+}
+
+func (c *Client) UnblockPasswords(ctx context.Context, passwords []string) (err error) {
+  return c.sendBlocklist(ctx, "DELETE", passwords)
+}
+
+func (c *Client) sendBlocklist(ctx context.Context, method string, passwords []string) (err error) {
+  if c.BlocklistSalt == nil {
+    if err = c.FetchBlocklistSalt(ctx); err != nil {
+      return
+    }
+  }
+  name, params, err := c.paramSet(ctx)
+  if err != nil {
+    return
+  }
+  for start := 0; start < len(passwords); start += server.DefaultMaxBatchSize {
+    end := start + server.DefaultMaxBatchSize
+    if end > len(passwords) {
+      end = len(passwords)
+    }
+    reqBody := server.CredsReqBody{Encoding: c.Encoding, Params: name}
+    for _, pw := range passwords[start:end] {
+      encoded, err := c.encodedPasswordHash(params, pw)
+      if err != nil {
+        return err
+      }
+      reqBody.Hashes = append(reqBody.Hashes, encoded)
+    }
+    req, err := c.newJSONRequest(ctx, method, "/v1/blocklist", reqBody)
+    if err != nil {
+      return err
+    }
+    res, err := c.do(req)
+    if err != nil {
+      return err
+    }
+    res.Body.Close()
+  }
+  return nil
+}
+
+// returns the parameter sets the server serves
+func (c *Client) ParamSets(ctx context.Context) (paramsRes server.ParamsRes, err error) {
+  err = c.getJSON(ctx, "/v1/params", &paramsRes)
+  return
+}
+
+// returns up to limit of the hashes the server numbered after since, from
+// the table of params or, if oprf is set, of its OPRF outputs; APIKey must
+// be an admin key
+func (c *Client) Sync(ctx context.Context, params string, oprf bool, since uint64, limit int) (syncRes server.SyncRes, err error) {
+  path := "/v1/sync"
+  if oprf {
+    path = "/v2/oprf/sync"
+  }
+  query := url.Values{}
+  query.Set("since", strconv.FormatUint(since, 10))
+  if limit > 0 {
+    query.Set("limit", strconv.Itoa(limit))
+  }
+  if params != "" {
+    query.Set("params", params)
+  }
+  err = c.getJSON(ctx, path + "?" + query.Encode(), &syncRes)
+  return
+}
+
+// hashes a credential the way the server's table was built, with the
+// current Params
+func (c *Client) Hash(u, pw string) []byte {
+  c.mu.Lock()
+  params := c.Params
+  c.mu.Unlock()
+  return hashCred(params, u, pw)
+}
+
+func hashCred(params Argon2Params, u, pw string) []byte {
+  hash, _ := params.Hash([]byte(pw), []byte(strings.ToLower(u)))
+  return hash
+}
+
+// hashes pw alone with the tenant's blocklist salt and the current Params
+func (c *Client) PasswordHash(pw string) []byte {
+  c.mu.Lock()
+  params := c.Params
+  c.mu.Unlock()
+  hash, _ := params.Hash([]byte(pw), c.BlocklistSalt)
+  return hash
+}
+
+// returns the blocklist hash of pw, or "" if BlocklistSalt isn't set
+func (c *Client) encodedPasswordHash(params Argon2Params, pw string) (string, error) {
+  if c.BlocklistSalt == nil {
+    return "", nil
+  }
+  hash, _ := params.Hash([]byte(pw), c.BlocklistSalt)
+  return server.EncodeHash(hash, c.Encoding)
+}
+
+func (c *Client) credReqBody(name string, params Argon2Params, u, pw string) (reqBody server.CredReqBody, err error) {
+  reqBody = server.CredReqBody{Encoding: c.Encoding, Params: name}
+  if reqBody.Hash, err = server.EncodeHash(hashCred(params, u, pw), c.Encoding); err != nil {
+    return
+  }
+  reqBody.PasswordHash, err = c.encodedPasswordHash(params, pw)
+  return
+}
+
+// returns how many times pw appeared in breaches; only the hash of pw
+// with server.PasswordSalt is sent
+func (c *Client) CheckPassword(ctx context.Context, pw string) (count int64, err error) {
+  var res server.PasswordRes
+  err = c.withParamSet(ctx, func(name string, params Argon2Params) error {
+    hash, _ := params.Hash([]byte(pw), server.PasswordSalt)
+    encoded, err := server.EncodeHash(hash, c.Encoding)
+    if err != nil {
+      return err
+    }
+    return c.postJSON(ctx, "/v1/password", server.CredReqBody{Hash: encoded, Encoding: c.Encoding, Params: name}, &res)
+  })
+  return res.Count, err
+}
+
+func (c *Client) CheckCredential(ctx context.Context, u, pw string) (compromised bool, err error) {
+  var credRes server.CredRes
+  err = c.withParamSet(ctx, func(name string, params Argon2Params) error {
+    reqBody, err := c.credReqBody(name, params, u, pw)
+    if err != nil {
+      return err
+    }
+    return c.postJSON(ctx, "/v1/cred", reqBody, &credRes)
+  })
+  if err != nil {
+    return
+  }
+  return credRes.Compromised, nil
+}
+
+// checks many credentials at once; compromised[i] is the result for creds[i].
+// creds are sent in chunks of server.DefaultMaxBatchSize
+func (c *Client) CheckCredentials(ctx context.Context, creds []Cred) (compromised []bool, err error) {
+  err = c.withParamSet(ctx, func(name string, params Argon2Params) (err error) {
+    compromised, err = c.checkCredentials(ctx, name, params, creds)
+    return
+  })
+  return
+}
+
+func (c *Client) checkCredentials(ctx context.Context, name string, params Argon2Params, creds []Cred) (compromised []bool, err error) {
+  compromised = make([]bool, 0, len(creds))
+  for start := 0; start < len(creds); start += server.DefaultMaxBatchSize {
+    end := start + server.DefaultMaxBatchSize
+    if end > len(creds) {
+      end = len(creds)
+    }
+    reqBody := server.CredsReqBody{Encoding: c.Encoding, Params: name}
+    for _, cred := range creds[start:end] {
+      encoded, err := server.EncodeHash(hashCred(params, cred.Username, cred.Password), c.Encoding)
+      if err != nil {
+        return nil, err
+      }
+      reqBody.Hashes = append(reqBody.Hashes, encoded)
+      if c.BlocklistSalt != nil {
+        encoded, err = c.encodedPasswordHash(params, cred.Password)
+        if err != nil {
+          return nil, err
+        }
+        reqBody.PasswordHashes = append(reqBody.PasswordHashes, encoded)
+      }
+    }
+    var credsRes server.CredsRes
+    err = c.postJSON(ctx, "/v1/creds", reqBody, &credsRes)
+    if err != nil {
+      return nil, err
+    }
+    if len(credsRes.Results) != end - start {
+      return nil, errors.New("Expected " + strconv.Itoa(end - start) + " results. Got " + strconv.Itoa(len(credsRes.Results)) + ".")
+    }
+    for _, res := range credsRes.Results {
+      compromised = append(compromised, res.Compromised)
+    }
+  }
+  return compromised, nil
+}
+
+// only the first RangePrefixLen hex characters of the hash are sent; the
+// server returns every stored hash sharing that prefix and the comparison
+// is finished locally
+func (c *Client) CheckCredentialRange(ctx context.Context, u, pw string) (compromised bool, err error) {
+  err = c.withParamSet(ctx, func(name string, params Argon2Params) (err error) {
+    compromised, err = c.checkRange(ctx, "/v1/range/", name, hex.EncodeToString(hashCred(params, u, pw)))
+    return
+  })
+  return
+}
+
+// asks the range endpoint at path for the prefix of hexHash, made with the
+// set called name, and looks for its suffix in the response
+func (c *Client) checkRange(ctx context.Context, path, name, hexHash string) (compromised bool, err error) {
+  err = server.CheckRangePrefixLen(c.RangePrefixLen, len(hexHash))
+  if err != nil {
+    return
+  }
+  prefix := hexHash[:c.RangePrefixLen]
+  var rangeRes server.RangeRes
+  path += prefix
+  if name != "" {
+    path += "?params=" + url.QueryEscape(name)
+  }
+  err = c.getJSON(ctx, path, &rangeRes)
+  if err != nil {
+    return
+  }
+  suffix := hexHash[len(prefix):]
+  for _, s := range rangeRes.Suffixes {
+    if s == suffix {
+      return true, nil
+    }
+  }
+  return false, nil
+}
+
+// the strongest privacy option: the hash is blinded before it is sent, so
+// the server learns nothing about it, and the unblinded OPRF output is
+// compared locally against a range of stored outputs
+func (c *Client) CheckCredentialOPRF(ctx context.Context, u, pw string) (compromised bool, err error) {
+  err = c.withParamSet(ctx, func(name string, params Argon2Params) (err error) {
+    compromised, err = c.checkCredentialOPRF(ctx, name, hashCred(params, u, pw))
+    return
+  })
+  return
+}
+
+func (c *Client) checkCredentialOPRF(ctx context.Context, name string, hash []byte) (compromised bool, err error) {
+  blind, blinded, err := server.OPRFBlind(hash)
+  if err != nil {
+    return
+  }
+  reqBody := server.OPRFReqBody{Elements: []string{base64.StdEncoding.EncodeToString(blinded)}}
+  var oprfRes server.OPRFRes
+  err = c.postJSON(ctx, "/v2/oprf/evaluate", reqBody, &oprfRes)
+  if err != nil {
+    return
+  }
+  if len(oprfRes.Elements) != 1 {
+    return false, errors.New("Expected 1 evaluated element. Got " + strconv.Itoa(len(oprfRes.Elements)) + ".")
+  }
+  evaluated, err := base64.StdEncoding.DecodeString(oprfRes.Elements[0])
+  if err != nil {
+    return
+  }
+  output, err := server.OPRFFinalize(hash, blind, evaluated)
+  if err != nil {
+    return
+  }
+  return c.checkRange(ctx, "/v2/oprf/range/", name, hex.EncodeToString(output))
+}
+
+// downloads the server's offline filter for c.ParamSet and copies it to w;
+// load it with LoadOfflineChecker
+func (c *Client) DownloadFilter(ctx context.Context, w io.Writer) (err error) {
+  name, _, err := c.paramSet(ctx)
+  if err != nil {
+    return
+  }
+  path := "/v1/filter"
+  if name != "" {
+    path += "?params=" + url.QueryEscape(name)
+  }
+  req, err := http.NewRequestWithContext(ctx, "GET", c.BaseURL + path, nil)
+  if err != nil {
+    return
+  }
+  res, err := c.do(req)
+  if err != nil {
+    return
+  }
+  defer res.Body.Close()
+  _, err = io.Copy(w, res.Body)
+  return
+}
+
+// GETs path and decodes the JSON response into v
+func (c *Client) getJSON(ctx context.Context, path string, v interface{}) (err error) {
+  req, err := http.NewRequestWithContext(ctx, "GET", c.BaseURL + path, nil)
+  if err != nil {
+    return
+  }
+  return c.doJSON(req, v)
+}
+
+// POSTs reqBody as JSON to path and decodes the response into v
+func (c *Client) postJSON(ctx context.Context, path string, reqBody, v interface{}) (err error) {
+  req, err := c.newJSONRequest(ctx, "POST", path, reqBody)
+  if err != nil {
+    return
+  }
+  return c.doJSON(req, v)
+}
+
+func (c *Client) newJSONRequest(ctx context.Context, method, path string, reqBody interface{}) (req *http.Request, err error) {
+  b, err := json.Marshal(reqBody)
+  if err != nil {
+    return
+  }
+  req, err = http.NewRequestWithContext(ctx, method, c.BaseURL + path, bytes.NewBuffer(b))
+  if err != nil {
+    return
+  }
+  req.Header.Set("Content-Type", "application/json")
+  return
+}
+
+func (c *Client) doJSON(req *http.Request, v interface{}) (err error) {
+  res, err := c.do(req)
+  if err != nil {
+    return
+  }
+  defer res.Body.Close()
+  return server.DecodeBody(res.Body, v)
+}
+
+// sends req with the API key; the caller must close the body of the
+// response, which is only returned for 2xx statuses
+func (c *Client) do(req *http.Request) (res *http.Response, err error) {
+  if c.APIKey != "" {
+    req.Header.Set("Authorization", "Bearer " + c.APIKey)
+  }
+  httpClient := c.HTTPClient
+  if httpClient == nil {
+    httpClient = http.DefaultClient
+  }
+  res, err = httpClient.Do(req)
+  if err != nil {
+    return
+  }
+  if res.StatusCode < 200 || res.StatusCode >= 300 {
+    defer res.Body.Close()
+    statusErr := &StatusError{StatusCode: res.StatusCode, Message: http.StatusText(res.StatusCode)}
+    var errRes struct{
+      Err string `json:"err"`
+    }
+    if server.DecodeBody(res.Body, &errRes) == nil && errRes.Err != "" {
+      statusErr.Message = errRes.Err
+    }
+    return nil, statusErr
+  }
+  return res, nil
+}
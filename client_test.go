@@ -0,0 +1,380 @@
+package ccds
+
+import (
+  "bytes"
+  "context"
+  "crypto/ed25519"
+  "encoding/hex"
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "sync/atomic"
+  "testing"
+
+  "github.com/korlando/ccds/server"
+)
+
+// cheap parameters so tests don't allocate 64MiB per hash
+var testParams = Argon2Params{1, 64, 1, 64}
+
+var testFilterKey = ed25519.NewKeyFromSeed(bytes.Repeat([]byte{7}, ed25519.SeedSize))
+
+// cheap stand-ins for server.DefaultParamSet and a stronger set
+var testSet, _ = server.ParseParamSet("1_1_1_64")
+var strongSet, _ = server.ParseParamSet("2_1_1_64")
+
+func newTestClient(t *testing.T, creds ...Cred) (*Client, *httptest.Server) {
+  c, ts, _ := newTestClientKeys(t, creds...)
+  return c, ts
+}
+
+// like newTestClient, but also returns the server's API keys
+func newTestClientKeys(t *testing.T, creds ...Cred) (*Client, *httptest.Server, server.APIKeyStore) {
+  store := server.NewMemStore()
+  oprfStore := server.NewMemStore()
+  key, err := server.DeriveOPRFKey([]byte("test seed test seed test seed 32"), nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+  apiKeys := server.NewMemAPIKeyStore()
+  apiKey, _, err := server.CreateAPIKey(apiKeys, "test")
+  if err != nil {
+    t.Fatal(err)
+  }
+  a := server.App{OPRFKey: key, APIKeys: apiKeys, FilterKey: testFilterKey, Sync: true, Blocklist: server.NewMemBlocklistStore()}
+  a.Initialize(store)
+  a.RegisterOPRF(server.DefaultParamSet, oprfStore)
+  passwords := server.NewMemPasswordStore()
+  a.RegisterPasswords(server.DefaultParamSet, passwords)
+  a.Register(testSet, server.NewMemStore())
+  a.Register(strongSet, server.NewMemStore())
+  ts := httptest.NewServer(a.Router)
+  c := NewClient(ts.URL)
+  c.HTTPClient = ts.Client()
+  // testParams stand in for the default set's
+  c.ParamSet = server.DefaultParamSet.Name
+  c.Params = testParams
+  c.APIKey = apiKey
+  for _, cred := range creds {
+    hash := c.Hash(cred.Username, cred.Password)
+    store.Insert(hash)
+    oprfStore.Insert(key.Evaluate(hash))
+    pwHash, _ := c.Params.Hash([]byte(cred.Password), server.PasswordSalt)
+    passwords.AddPassword(pwHash, 0)
+  }
+  return c, ts, apiKeys
+}
+
+func TestCheckCredential(t *testing.T) {
+  c, ts := newTestClient(t, Cred{"Alice", "hunter2"})
+  defer ts.Close()
+  ctx := context.Background()
+  checks := []struct{
+    cred        Cred
+    compromised bool
+  }{
+    {Cred{"alice", "hunter2"}, true},
+    {Cred{"alice", "hunter3"}, false},
+    {Cred{"bob", "hunter2"}, false},
+  }
+  for _, check := range checks {
+    compromised, err := c.CheckCredential(ctx, check.cred.Username, check.cred.Password)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if compromised != check.compromised {
+      t.Errorf("%v: expected compromised to be %v. Got %v\n", check.cred, check.compromised, compromised)
+    }
+    compromised, err = c.CheckCredentialRange(ctx, check.cred.Username, check.cred.Password)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if compromised != check.compromised {
+      t.Errorf("%v: expected range compromised to be %v. Got %v\n", check.cred, check.compromised, compromised)
+    }
+    compromised, err = c.CheckCredentialOPRF(ctx, check.cred.Username, check.cred.Password)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if compromised != check.compromised {
+      t.Errorf("%v: expected OPRF compromised to be %v. Got %v\n", check.cred, check.compromised, compromised)
+    }
+  }
+  creds := make([]Cred, len(checks))
+  for i, check := range checks {
+    creds[i] = check.cred
+  }
+  results, err := c.CheckCredentials(ctx, creds)
+  if err != nil {
+    t.Fatal(err)
+  }
+  for i, check := range checks {
+    if results[i] != check.compromised {
+      t.Errorf("%v: expected batch compromised to be %v. Got %v\n", check.cred, check.compromised, results[i])
+    }
+  }
+}
+
+func TestCheckCredentialStatusError(t *testing.T) {
+  c, ts := newTestClient(t)
+  defer ts.Close()
+  // the server only accepts 64 byte hashes
+  c.Params.KeyLen = 32
+  _, err := c.CheckCredential(context.Background(), "alice", "hunter2")
+  statusErr, ok := err.(*StatusError)
+  if !ok {
+    t.Fatalf("Expected a *StatusError. Got %v\n", err)
+  }
+  if statusErr.StatusCode != 400 || statusErr.Message == "" {
+    t.Errorf("Expected a 400 with a message. Got %v\n", statusErr)
+  }
+}
+
+func TestCheckCredentialRangePrefixLen(t *testing.T) {
+  c, ts := newTestClient(t)
+  defer ts.Close()
+  for _, prefixLen := range []int{0, -1, 129} {
+    c.RangePrefixLen = prefixLen
+    if _, err := c.CheckCredentialRange(context.Background(), "alice", "hunter2"); err == nil {
+      t.Errorf("Expected an error for a range prefix of %d\n", prefixLen)
+    }
+  }
+}
+
+func TestNegotiate(t *testing.T) {
+  c, ts := newTestClient(t)
+  defer ts.Close()
+  ctx := context.Background()
+  c.Supported = []server.ParamSet{testSet, strongSet}
+  p, err := c.Negotiate(ctx)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if p != strongSet || c.ParamSet != strongSet.Name || c.Params != Argon2ParamsFor(strongSet) {
+    t.Errorf("Expected to negotiate %v. Got %v\n", strongSet, p)
+  }
+  _, err = c.CheckCredential(ctx, "alice", "hunter2")
+  if err != nil {
+    t.Fatal(err)
+  }
+  unsupported, _ := server.ParseParamSet("3_1_1_64")
+  c.Supported = []server.ParamSet{unsupported}
+  _, err = c.Negotiate(ctx)
+  if err != ErrNoCommonParams {
+    t.Errorf("Expected ErrNoCommonParams. Got %v\n", err)
+  }
+}
+
+func TestNegotiateCeiling(t *testing.T) {
+  costly, _ := server.ParseParamSet("1_8192_1_64")
+  // a set whose fields don't match its name
+  mislabeled := testSet
+  mislabeled.KeyLen = 1 << 30
+  ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(server.ParamsRes{Default: testSet.Name, Sets: []server.ParamSet{costly, mislabeled, testSet}})
+  }))
+  defer ts.Close()
+  c := NewClient(ts.URL)
+  if _, err := c.Negotiate(context.Background()); err != ErrNoCommonParams {
+    t.Errorf("Expected the default client to support only the default set. Got %v\n", err)
+  }
+  // even with any set allowed, the costly and mislabeled ones are skipped
+  c.Supported = nil
+  p, err := c.Negotiate(context.Background())
+  if err != nil || p != testSet {
+    t.Errorf("Expected to negotiate %v. Got %v, %v\n", testSet, p, err)
+  }
+}
+
+func TestNegotiateLazily(t *testing.T) {
+  // the first app serves strongSet, the second has dropped it
+  var apps [2]*server.App
+  for i, sets := range [][]server.ParamSet{{testSet, strongSet}, {testSet}} {
+    apps[i] = &server.App{}
+    apps[i].Initialize(server.NewMemStore())
+    for _, p := range sets {
+      store := server.NewMemStore()
+      store.Insert(hashCred(Argon2ParamsFor(p), "alice", "hunter2"))
+      apps[i].Register(p, store)
+    }
+  }
+  var current atomic.Int32
+  ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    apps[current.Load()].Router.ServeHTTP(w, r)
+  }))
+  defer ts.Close()
+  c := NewClient(ts.URL)
+  c.HTTPClient = ts.Client()
+  // the default set would allocate 64MiB per hash
+  c.Supported = []server.ParamSet{testSet, strongSet}
+  ctx := context.Background()
+  compromised, err := c.CheckCredential(ctx, "alice", "hunter2")
+  if err != nil || !compromised {
+    t.Fatalf("Expected a compromised credential. Got %v, %v\n", compromised, err)
+  }
+  if c.ParamSet != strongSet.Name || c.Params != Argon2ParamsFor(strongSet) {
+    t.Errorf("Expected the first check to negotiate %s. Got %s\n", strongSet.Name, c.ParamSet)
+  }
+  current.Store(1)
+  compromised, err = c.CheckCredential(ctx, "alice", "hunter2")
+  if err != nil || !compromised {
+    t.Fatalf("Expected a compromised credential after the server dropped the set. Got %v, %v\n", compromised, err)
+  }
+  if c.ParamSet != testSet.Name {
+    t.Errorf("Expected to negotiate %s again. Got %s\n", testSet.Name, c.ParamSet)
+  }
+}
+
+func TestCheckCredentialUnauthorized(t *testing.T) {
+  c, ts := newTestClient(t)
+  defer ts.Close()
+  c.APIKey = "ccds_wrong"
+  _, err := c.CheckCredential(context.Background(), "alice", "hunter2")
+  statusErr, ok := err.(*StatusError)
+  if !ok || statusErr.StatusCode != 401 {
+    t.Errorf("Expected a 401 *StatusError. Got %v\n", err)
+  }
+}
+
+func TestOfflineChecker(t *testing.T) {
+  c, ts := newTestClient(t, Cred{"Alice", "hunter2"})
+  defer ts.Close()
+  var buf bytes.Buffer
+  err := c.DownloadFilter(context.Background(), &buf)
+  if err != nil {
+    t.Fatal(err)
+  }
+  file := buf.Bytes()
+  pub := testFilterKey.Public().(ed25519.PublicKey)
+  checker, err := LoadOfflineChecker(bytes.NewReader(file), pub)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if checker.Header.Params != server.DefaultParamSet || checker.Header.Entries != 1 {
+    t.Errorf("Unexpected header %+v\n", checker.Header)
+  }
+  checker.Params = testParams
+  if !checker.Compromised("alice", "hunter2") {
+    t.Error("Expected alice:hunter2 to be compromised")
+  }
+  if checker.Compromised("alice", "hunter3") {
+    t.Error("Expected alice:hunter3 not to be compromised")
+  }
+  otherKey := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{8}, ed25519.SeedSize))
+  _, err = LoadOfflineChecker(bytes.NewReader(file), otherKey.Public().(ed25519.PublicKey))
+  if err == nil {
+    t.Error("Expected a filter signed by another key to be rejected")
+  }
+  tampered := append([]byte{}, file...)
+  tampered[len(tampered) - 1] ^= 1
+  _, err = LoadOfflineChecker(bytes.NewReader(tampered), pub)
+  if err == nil {
+    t.Error("Expected a tampered filter to be rejected")
+  }
+}
+
+func TestSync(t *testing.T) {
+  c, ts, apiKeys := newTestClientKeys(t, Cred{"alice", "hunter2"}, Cred{"bob", "hunter2"})
+  defer ts.Close()
+  ctx := context.Background()
+  // sync hands out every hash, so tenant keys may not use it
+  for _, oprf := range []bool{false, true} {
+    _, err := c.Sync(ctx, "", oprf, 0, 0)
+    if statusErr, ok := err.(*StatusError); !ok || statusErr.StatusCode != 403 {
+      t.Fatalf("Expected a 403 for a tenant key. Got %v\n", err)
+    }
+  }
+  var err error
+  c.APIKey, _, err = server.CreateAdminAPIKey(apiKeys, "mirror")
+  if err != nil {
+    t.Fatal(err)
+  }
+  var since uint64
+  var hashes []string
+  for page := 0; page < 3; page += 1 {
+    res, err := c.Sync(ctx, "", false, since, 1)
+    if err != nil {
+      t.Fatal(err)
+    }
+    for _, e := range res.Entries {
+      if e.Seq <= since {
+        t.Errorf("Expected sequence numbers after %d. Got %d\n", since, e.Seq)
+      }
+      hashes = append(hashes, e.Hash)
+    }
+    since = res.Next
+    if !res.More {
+      break
+    }
+  }
+  expected := []string{hex.EncodeToString(c.Hash("alice", "hunter2")), hex.EncodeToString(c.Hash("bob", "hunter2"))}
+  if len(hashes) != 2 || hashes[0] != expected[0] || hashes[1] != expected[1] {
+    t.Errorf("Expected %v in insertion order. Got %v\n", expected, hashes)
+  }
+  res, err := c.Sync(ctx, "", true, 0, 0)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(res.Entries) != 2 || res.More {
+    t.Errorf("Expected 2 OPRF outputs. Got %+v\n", res)
+  }
+}
+
+func TestBlocklist(t *testing.T) {
+  c, ts := newTestClient(t, Cred{"Alice", "hunter2"})
+  defer ts.Close()
+  ctx := context.Background()
+  if err := c.BlockPasswords(ctx, []string{"Acme2024!"}); err != nil {
+    t.Fatal(err)
+  }
+  if c.BlocklistSalt == nil {
+    t.Fatal("Expected BlockPasswords to fetch the salt")
+  }
+  creds := []Cred{{"Alice", "hunter2"}, {"bob", "Acme2024!"}, {"carol", "correct horse"}}
+  compromised, err := c.CheckCredentials(ctx, creds)
+  if err != nil {
+    t.Fatal(err)
+  }
+  for i, expected := range []bool{true, true, false} {
+    if compromised[i] != expected {
+      t.Errorf("Expected %+v to be compromised=%v. Got %v\n", creds[i], expected, compromised[i])
+    }
+  }
+  details, err := c.CredentialDetails(ctx, "dave", "Acme2024!")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if !details.Compromised || details.MatchedBy != server.MatchedTenant {
+    t.Errorf("Expected a tenant match. Got %+v\n", details)
+  }
+  details, _ = c.CredentialDetails(ctx, "Alice", "hunter2")
+  if details.MatchedBy != server.MatchedGlobal {
+    t.Errorf("Expected a global match. Got %+v\n", details)
+  }
+  if err = c.UnblockPasswords(ctx, []string{"Acme2024!"}); err != nil {
+    t.Fatal(err)
+  }
+  if compromised, _ := c.CheckCredential(ctx, "bob", "Acme2024!"); compromised {
+    t.Error("Expected an unblocked password to pass")
+  }
+}
+
+func TestCheckPassword(t *testing.T) {
+  c, ts := newTestClient(t, Cred{"Alice", "hunter2"}, Cred{"bob", "hunter2"}, Cred{"carol", "s3cret"})
+  defer ts.Close()
+  ctx := context.Background()
+  for pw, expected := range map[string]int64{"hunter2": 2, "s3cret": 1, "correct horse": 0} {
+    count, err := c.CheckPassword(ctx, pw)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if count != expected {
+      t.Errorf("Expected %q to be seen %d times. Got %d\n", pw, expected, count)
+    }
+  }
+  c.ParamSet = testSet.Name
+  if _, err := c.CheckPassword(ctx, "hunter2"); err == nil {
+    t.Error("Expected an error for a parameter set without a password table")
+  }
+}
@@ -2,6 +2,7 @@ package main
 
 import (
   "bufio"
+  "database/sql"
   "encoding/json"
   "flag"
   "fmt"
@@ -14,15 +15,26 @@ import (
   "time"
 
   _ "github.com/go-sql-driver/mysql"
+  _ "github.com/lib/pq"
   "github.com/korlando/ccds"
   "github.com/korlando/ccds/server"
+  _ "modernc.org/sqlite"
 )
 
-const (
-  dataPath = "../../data/data.tsv"
-  statsPath = "../../data/pw-stats.json"
-  pwDataTable = "pw_data_helper"
-)
+const pwDataTable = "pw_data_helper"
+
+// unique passwords seen once the cache is full
+var pwDataTableCreate = map[string]string{
+  server.BackendMySQL: "CREATE TABLE IF NOT EXISTS " + pwDataTable + " (pw varchar(255) NOT NULL, PRIMARY KEY (pw)) ENGINE=InnoDB DEFAULT CHARSET=utf8",
+  server.BackendPostgres: "CREATE TABLE IF NOT EXISTS " + pwDataTable + " (pw text NOT NULL, PRIMARY KEY (pw))",
+  server.BackendSQLite: "CREATE TABLE IF NOT EXISTS " + pwDataTable + " (pw TEXT NOT NULL PRIMARY KEY)",
+}
+
+var pwDataInsert = map[string]string{
+  server.BackendMySQL: "INSERT IGNORE INTO " + pwDataTable + " (pw) VALUES (?)",
+  server.BackendPostgres: "INSERT INTO " + pwDataTable + " (pw) VALUES ($1) ON CONFLICT DO NOTHING",
+  server.BackendSQLite: "INSERT INTO " + pwDataTable + " (pw) VALUES (?) ON CONFLICT DO NOTHING",
+}
 
 var empty struct{}
 
@@ -79,6 +91,9 @@ type stat struct{
 }
 
 type options struct{
+  config  string
+  print   bool
+  dsn     string
   path    string
   limit   int
   offset  int
@@ -87,8 +102,8 @@ type options struct{
   unique  bool
 }
 
-func analysisThread(path string, limit, offset int, unique bool, dbMode *bool, helperChan chan *statHelper, cacheChan chan *map[string]struct{}, errChan chan error) {
-  h, cache, err := analyzeAll(path, limit, offset, unique, dbMode)
+func analysisThread(db *sql.DB, backend, path string, limit, offset int, unique bool, dbMode *bool, helperChan chan *statHelper, cacheChan chan *map[string]struct{}, errChan chan error) {
+  h, cache, err := analyzeAll(db, backend, path, limit, offset, unique, dbMode)
   helperChan <- &h
   cacheChan <- &cache
   if err != nil {
@@ -99,16 +114,7 @@ func analysisThread(path string, limit, offset int, unique bool, dbMode *bool, h
 }
 
 // set limit to -1 (or anything < 0) to read all lines
-func analyzeAll(path string, limit, offset int, unique bool, dbMode *bool) (h statHelper, cache map[string]struct{}, err error) {
-  db, err := server.GetDevDB()
-  if err != nil {
-    return
-  }
-  defer db.Close()
-  err = db.Ping()
-  if err != nil {
-    return
-  }
+func analyzeAll(db *sql.DB, backend, path string, limit, offset int, unique bool, dbMode *bool) (h statHelper, cache map[string]struct{}, err error) {
   file, err := os.Open(path)
   if err != nil {
     return
@@ -149,8 +155,7 @@ func analyzeAll(path string, limit, offset int, unique bool, dbMode *bool) (h st
       continue
     }
     // cache too big, use db to check uniqueness
-    _, err = db.Exec("INSERT INTO " + pwDataTable + " (pw) VALUES (?)", pw)
-    if err == nil {
+    if isNew, _ := insertPW(db, backend, pw); isNew {
       d := ccds.AnalyzePW(pw)
       updateStats(&h, &d)
     }
@@ -161,6 +166,16 @@ func analyzeAll(path string, limit, offset int, unique bool, dbMode *bool) (h st
   return
 }
 
+// adds pw to pwDataTable; reports whether it wasn't there already
+func insertPW(db *sql.DB, backend, pw string) (bool, error) {
+  res, err := db.Exec(pwDataInsert[backend], pw)
+  if err != nil {
+    return false, err
+  }
+  inserted, err := res.RowsAffected()
+  return inserted > 0, err
+}
+
 // logic for incrementing stats by "a" amount
 func incrementHelper(h *statHelper, d *ccds.PWData, a int) {
   h.totUniquePW += a
@@ -301,13 +316,16 @@ func parseFlags() (opt options) {
   var t, threads int
   var c, cache int
   var u, unique bool
-  pDefault := dataPath
+  var dsn string
+  var configPath string
+  var printConfig bool
+  pDefault := ""
   lDefault := 0
   oDefault := 0
   tDefault := 1
   cDefault := 100000
   uDefault := false
-  pDesc := "Path to the data file."
+  pDesc := "Path to the data file; overrides data.creds in the config."
   lDesc := "Limit on the number of credentials to read."
   oDesc := "Offset the line to start reading from (0-indexed)."
   tDesc := "Number of threads to parallelize reading of the file."
@@ -325,8 +343,14 @@ func parseFlags() (opt options) {
   flag.IntVar(&threads, "threads", tDefault, tDesc)
   flag.IntVar(&cache, "cache", cDefault, cDesc)
   flag.BoolVar(&unique, "unique", uDefault, uDesc)
+  flag.StringVar(&dsn, "db", "", "Database holding the " + pwDataTable + " table: mysql://user:pw@host/name, postgres://user:pw@host/name or sqlite:path.db. Overrides db.dev in the config.")
+  flag.StringVar(&configPath, "config", "", "YAML config file shared with the server; defaults to CCDS_CONFIG.")
+  flag.BoolVar(&printConfig, "print-config", false, "Print the effective config, with secrets redacted, then exit.")
   flag.Parse()
   opt = options{
+    config: configPath,
+    print: printConfig,
+    dsn: dsn,
     path: p,
     limit: l,
     offset: o,
@@ -414,7 +438,24 @@ func writeStats(s *stat, path string) (err error) {
 
 func main() {
   o := parseFlags()
-  path := o.path
+  cfg, err := server.LoadConfig(o.config)
+  if err != nil {
+    log.Fatal(err)
+  }
+  if o.path != "" {
+    cfg.Data.Creds = o.path
+  }
+  if o.dsn != "" {
+    cfg.DB.Dev = o.dsn
+  }
+  if o.print {
+    err = cfg.Print(os.Stdout)
+    if err != nil {
+      log.Fatal(err)
+    }
+    return
+  }
+  path := cfg.Data.Creds
   limit := o.limit
   offset := o.offset
   threads := o.threads
@@ -430,6 +471,21 @@ func main() {
   if threads <= 0 {
     log.Fatal("Threads should be at least 1.")
   }
+  db, backend, err := server.OpenDB(cfg.DB.Dev)
+  if err != nil {
+    log.Fatal(err)
+  }
+  defer db.Close()
+  err = db.Ping()
+  if err != nil {
+    log.Fatal(err)
+  }
+  if unique {
+    _, err = db.Exec(pwDataTableCreate[backend])
+    if err != nil {
+      log.Fatal(err)
+    }
+  }
   if limit < 0 {
     fmt.Println("Calculating number of credentials...")
     lines, err := ccds.CountLines(path)
@@ -454,7 +510,7 @@ func main() {
       extra = 1
     }
     numLines := step + extra
-    go analysisThread(path, numLines, lastLine + offset, unique, &dbMode, helperChan, cacheChan, errChan)
+    go analysisThread(db, backend, path, numLines, lastLine + offset, unique, &dbMode, helperChan, cacheChan, errChan)
     lastLine += numLines
   }
   if !dbMode && cacheLimit >= 0 {
@@ -486,7 +542,7 @@ func main() {
     }
   }
   updatePercentages(s, helper)
-  err = writeStats(s, statsPath)
+  err = writeStats(s, cfg.Data.Stats)
   if err != nil {
     fmt.Println(err)
   }
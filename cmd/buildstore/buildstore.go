@@ -0,0 +1,111 @@
+// converts a parameter set's table, or the raw hashes written by
+// encrypt -raw-out, into a sorted flat file for server -store=file:<path>
+package main
+
+import (
+  "bufio"
+  "errors"
+  "flag"
+  "fmt"
+  "io"
+  "log"
+  "os"
+  "time"
+
+  _ "github.com/go-sql-driver/mysql"
+  _ "github.com/lib/pq"
+  "github.com/korlando/ccds/server"
+  _ "modernc.org/sqlite"
+)
+
+func main() {
+  var production bool
+  var params string
+  var in string
+  var out string
+  var tmpDir string
+  var runSize int
+  var configPath string
+  var printConfig bool
+  flag.BoolVar(&production, "production", false, "Read from the production DB.")
+  flag.StringVar(&params, "params", server.DefaultParamSet.Name, "Argon2 parameter set of the hashes.")
+  flag.StringVar(&in, "in", "", "File of raw hashes written by encrypt -raw-out; empty reads the parameter set's table.")
+  flag.StringVar(&out, "o", "ccds.hashes", "Path to write the hash file to.")
+  flag.StringVar(&tmpDir, "tmp", "", "Directory for sorted runs; defaults to the system temp directory.")
+  flag.IntVar(&runSize, "run-size", server.DefaultFlatFileRunSize, "Number of hashes to sort in memory at once.")
+  flag.StringVar(&configPath, "config", "", "YAML config file shared with the server; defaults to CCDS_CONFIG.")
+  flag.BoolVar(&printConfig, "print-config", false, "Print the effective config, with secrets redacted, then exit.")
+  flag.Parse()
+  cfg, err := server.LoadConfig(configPath)
+  if err != nil {
+    log.Fatal(err)
+  }
+  if printConfig {
+    err = cfg.Print(os.Stdout)
+    if err != nil {
+      log.Fatal(err)
+    }
+    return
+  }
+  p, err := server.ParseParamSet(params)
+  if err != nil {
+    log.Fatal(err)
+  }
+  b := server.NewFlatFileBuilder(int(p.KeyLen))
+  b.TmpDir = tmpDir
+  b.RunSize = runSize
+  start := time.Now()
+  if in != "" {
+    err = addFile(b, in, int(p.KeyLen))
+  } else {
+    err = addTable(b, cfg.DSN(production), p)
+  }
+  if err != nil {
+    log.Fatal(err)
+  }
+  fmt.Println("Read hashes in", time.Since(start))
+  count, err := b.WriteFile(out)
+  if err != nil {
+    log.Fatal(err)
+  }
+  fmt.Println("Wrote", count, "hashes to", out, "in", time.Since(start))
+}
+
+// the stored hashes are already peppered, so they are copied as they are
+func addTable(b *server.FlatFileBuilder, dsn string, p server.ParamSet) error {
+  db, backend, err := server.OpenDB(dsn)
+  if err != nil {
+    return err
+  }
+  defer db.Close()
+  store, ok := server.NewDBStore(db, backend, p).(server.Scanner)
+  if !ok {
+    return server.ErrScanUnsupported
+  }
+  return store.Scan(b.Add)
+}
+
+func addFile(b *server.FlatFileBuilder, path string, hashLen int) error {
+  f, err := os.Open(path)
+  if err != nil {
+    return err
+  }
+  defer f.Close()
+  r := bufio.NewReader(f)
+  hash := make([]byte, hashLen)
+  for {
+    _, err = io.ReadFull(r, hash)
+    if err == io.EOF {
+      return nil
+    }
+    if err == io.ErrUnexpectedEOF {
+      return errors.New(path + " ends with a partial hash.")
+    }
+    if err != nil {
+      return err
+    }
+    if err = b.Add(hash); err != nil {
+      return err
+    }
+  }
+}
@@ -7,25 +7,23 @@ import (
   "fmt"
   "log"
   "os"
-  "regexp"
   "strconv"
   "strings"
+  "sync"
   "time"
 
-  "golang.org/x/crypto/argon2"
   _ "github.com/go-sql-driver/mysql"
+  _ "github.com/lib/pq"
   "github.com/korlando/ccds"
   "github.com/korlando/ccds/server"
+  _ "modernc.org/sqlite"
 )
 
 const ParseFailed = "Parse"
 const CredInsertFailed = "CredInsert"
 const IncrementFailed = "Increment"
+const PasswordInsertFailed = "PasswordInsert"
 
-const dataPath = "../../data/data.tsv"
-const failuresPath = "../../data/failures.txt"
-
-const dupeRegexp = "^Error 1062: Duplicate entry.+$"
 
 type failure struct {
   line string
@@ -33,8 +31,121 @@ type failure struct {
   err error
 }
 
+// replaces each hash with its OPRF output before inserting it
+type oprfStore struct {
+  server.Store
+  key *server.OPRFKey
+}
+
+func (s *oprfStore) Insert(hash []byte) error {
+  return s.Store.Insert(s.key.Evaluate(hash))
+}
+
+// appends each hash to a file for buildstore instead of a table; duplicates
+// are removed when the file is sorted
+type rawFileStore struct {
+  server.Store
+  mu sync.Mutex
+  file *os.File
+  w *bufio.Writer
+}
+
+func newRawFileStore(path string) (*rawFileStore, error) {
+  file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+  if err != nil {
+    return nil, err
+  }
+  return &rawFileStore{file: file, w: bufio.NewWriter(file)}, nil
+}
+
+func (s *rawFileStore) Insert(hash []byte) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  _, err := s.w.Write(hash)
+  return err
+}
+
+func (s *rawFileStore) Close() error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if err := s.w.Flush(); err != nil {
+    s.file.Close()
+    return err
+  }
+  return s.file.Close()
+}
+
+// records every insert as an occurrence in one breach source
+type sourcedStore struct {
+  server.Store
+  sourceID int64
+}
+
+func (s *sourcedStore) Insert(hash []byte) error {
+  return s.Store.(server.SourcedStore).InsertSourced(hash, s.sourceID, 0)
+}
+
+// number of new hashes matched against watchlists at once
+const watchBatch = 500
+
+// queues watchlist deliveries for the hashes that an import adds;
+// duplicates were already compromised, so they aren't news
+type watchingStore struct {
+  server.Store
+  watches server.WatchStore
+  params string
+  // while a pepper rotation is under way, a hash stored under an older
+  // key is inserted again under the current one without being a duplicate,
+  // so every key has to be checked first
+  rotating bool
+  mu sync.Mutex
+  pending [][]byte
+  matched int
+}
+
+func (s *watchingStore) Insert(hash []byte) error {
+  known := false
+  if s.rotating {
+    var err error
+    known, err = s.Store.Lookup(hash)
+    if err != nil {
+      return err
+    }
+  }
+  err := s.Store.Insert(hash)
+  if err != nil || known {
+    return err
+  }
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  s.pending = append(s.pending, hash)
+  if len(s.pending) >= watchBatch {
+    s.flush()
+  }
+  return nil
+}
+
+// the hashes are stored either way, so failures are only logged; must hold mu
+func (s *watchingStore) flush() {
+  matched, err := server.NotifyWatches(s.watches, s.params, s.pending)
+  if err != nil {
+    log.Println("Matching watchlists:", err)
+  }
+  s.matched += matched
+  s.pending = nil
+}
+
+func (s *watchingStore) Close() error {
+  s.mu.Lock()
+  s.flush()
+  s.mu.Unlock()
+  fmt.Println(s.matched, "watched credentials matched")
+  return s.Store.Close()
+}
+
 // set limit to -1 (or anything < 0) to read all lines
-func encryptAndInsertAll(db *sql.DB, path string, limit, offset int) (encryptTime int64, encryptNum int, failures []failure, err error) {
+// passwords may be nil
+func encryptAndInsertAll(store server.Store, passwords server.PasswordStore, params ccds.Argon2Params, path string, limit, offset int) (encryptTime int64, encryptNum int, failures []failure, err error) {
   start := time.Now()
   file, err := os.Open(path)
   if err != nil {
@@ -54,15 +165,22 @@ func encryptAndInsertAll(db *sql.DB, path string, limit, offset int) (encryptTim
       failures = append(failures, failure{line, ParseFailed, err})
       continue
     }
-    credHash, execTime := ccds.DefaultArgon2([]byte(password), []byte(strings.ToLower(username)))
+    credHash, execTime := params.Hash([]byte(password), []byte(strings.ToLower(username)))
     encryptTime += execTime.Nanoseconds()
     encryptNum += 1
-    _, err = db.Exec("INSERT INTO " + server.CredHashTable + " (hash) VALUES (?)", credHash)
-    if err != nil {
-      // skip dupe errors
-      matched, _ := regexp.MatchString(dupeRegexp, err.Error())
-      if !matched {
-        failures = append(failures, failure{line, CredInsertFailed, err})
+    err = store.Insert(credHash)
+    // skip dupe errors
+    if err != nil && err != server.ErrDuplicate {
+      failures = append(failures, failure{line, CredInsertFailed, err})
+    }
+    // a password counts once per credential it was leaked with, so that
+    // running an import again, or a pair repeated in a dump or found in
+    // another breach, doesn't inflate its count
+    if passwords != nil && err == nil {
+      pwHash, _ := params.Hash([]byte(password), server.PasswordSalt)
+      err = passwords.AddPassword(pwHash, 0)
+      if err != nil {
+        failures = append(failures, failure{line, PasswordInsertFailed, err})
       }
     }
     if encryptNum > 0 && encryptNum % 10000 == 0 {
@@ -76,9 +194,19 @@ func encryptAndInsertAll(db *sql.DB, path string, limit, offset int) (encryptTim
   return
 }
 
-func encryptionThread(db *sql.DB, path string, limit, offset int, errChan chan error, failureChan chan []failure) {
+// the store to count passwords in, or nil if they aren't counted; a
+// password counts once per credential new to the main table, which an
+// -oprf import doesn't write to, so every credential would count again
+func passwordStore(db *sql.DB, backend string, p server.ParamSet, keys server.Keyring, countPasswords, oprf bool) server.PasswordStore {
+  if !countPasswords || oprf {
+    return nil
+  }
+  return server.NewPepperedPasswordStore(server.NewDBPasswordStore(db, backend, p), keys)
+}
+
+func encryptionThread(store server.Store, passwords server.PasswordStore, params ccds.Argon2Params, path string, limit, offset int, errChan chan error, failureChan chan []failure) {
   start := time.Now()
-  encryptTime, encryptNum, failures, err := encryptAndInsertAll(db, path, limit, offset)
+  encryptTime, encryptNum, failures, err := encryptAndInsertAll(store, passwords, params, path, limit, offset)
   if err != nil {
     errChan <- err
     failureChan <- failures
@@ -134,24 +262,145 @@ func writeFailures(failures []failure, path string) {
 }
 
 func main() {
-  db, err := server.GetDevDB()
-  if err != nil {
-    log.Fatal(err)
-  }
-  defer db.Close()
-  err = db.Ping()
-  if err != nil {
-    log.Fatal(err)
-  }
   var path string
   var limit int
   var offset int
   var threads int
-  flag.StringVar(&path, "path", dataPath, "Path to the data file.")
-  flag.IntVar(&limit, "limit", 0, "Limit on the number of credentials to read.")
+  var paramSet string
+  var oprf bool
+  var source string
+  var sourceDate string
+  var sourceDesc string
+  var watch bool
+  var countPasswords bool
+  var rawOut string
+  var dsn string
+  var production bool
+  var configPath string
+  var printConfig bool
+  flag.StringVar(&path, "path", "", "Path to the data file; overrides data.creds in the config.")
+  flag.IntVar(&limit, "limit", -1, "Limit on the number of credentials to read; -1 reads the whole file.")
   flag.IntVar(&offset, "offset", 0, "Offset the line to start reading from (0-indexed).")
   flag.IntVar(&threads, "threads", 1, "Number of threads to parallelize reading of the file (not parallelism to use in argon2id).")
+  flag.StringVar(&paramSet, "params", server.DefaultParamSet.Name, "Argon2 parameter set to hash with; selects the table to insert into.")
+  flag.BoolVar(&oprf, "oprf", false, "Store OPRF outputs under CCDS_OPRF_KEY instead of raw hashes.")
+  flag.StringVar(&source, "source", "", "Name of the breach the data file came from; recorded with every credential.")
+  flag.StringVar(&sourceDate, "source-date", "", "Date of the breach, YYYY-MM-DD.")
+  flag.StringVar(&sourceDesc, "source-desc", "", "Description of the breach.")
+  flag.BoolVar(&watch, "watch", true, "Queue webhook deliveries for newly added credentials that tenants watch; ignored with -raw-out.")
+  flag.BoolVar(&countPasswords, "passwords", true, "Also count each password, once per new credential it was leaked with, in the password-only table; doubles the hashing work. Ignored with -oprf. With -raw-out, duplicates can't be told apart, so every line counts.")
+  flag.StringVar(&rawOut, "raw-out", "", "Append the (peppered) hashes to this file for buildstore instead of inserting them into the table.")
+  flag.BoolVar(&production, "production", false, "Insert into the production DB.")
+  flag.StringVar(&dsn, "db", "", "Database to insert into: mysql://user:pw@host/name, postgres://user:pw@host/name or sqlite:path.db. Overrides db.prod with -production, otherwise db.dev, in the config.")
+  flag.StringVar(&configPath, "config", "", "YAML config file shared with the server; defaults to CCDS_CONFIG.")
+  flag.BoolVar(&printConfig, "print-config", false, "Print the effective config, with secrets redacted, then exit.")
   flag.Parse()
+  cfg, err := server.LoadConfig(configPath)
+  if err != nil {
+    log.Fatal(err)
+  }
+  if path != "" {
+    cfg.Data.Creds = path
+  }
+  if dsn != "" {
+    cfg.SetDSN(production, dsn)
+  }
+  if printConfig {
+    err = cfg.Print(os.Stdout)
+    if err != nil {
+      log.Fatal(err)
+    }
+    return
+  }
+  path = cfg.Data.Creds
+  db, backend, err := server.OpenDB(cfg.DSN(production))
+  if err != nil {
+    log.Fatal(err)
+  }
+  err = db.Ping()
+  if err != nil {
+    log.Fatal(err)
+  }
+  p, err := server.ParseParamSet(paramSet)
+  if err != nil {
+    log.Fatal(err)
+  }
+  params := ccds.Argon2ParamsFor(p)
+  keys, err := server.GetKeyring()
+  if err != nil {
+    log.Fatal(err)
+  }
+  // apply the same pepper the server does
+  var store server.Store = server.NewPepperedStore(server.NewDBStore(db, backend, p), keys)
+  if rawOut != "" {
+    if oprf {
+      log.Fatal("-raw-out can't be combined with -oprf.")
+    }
+    raw, err := newRawFileStore(rawOut)
+    if err != nil {
+      log.Fatal(err)
+    }
+    store = server.NewPepperedStore(raw, keys)
+  }
+  if oprf {
+    key, err := server.GetOPRFKey()
+    if err != nil {
+      log.Fatal(err)
+    }
+    if key == nil {
+      log.Fatal("CCDS_OPRF_KEY must be set to import OPRF outputs.")
+    }
+    store = &oprfStore{server.NewDBOPRFStore(db, backend, p), key}
+  }
+  if source != "" {
+    sourced, ok := store.(server.SourcedStore)
+    if !ok {
+      log.Fatal(server.ErrSourcesUnsupported)
+    }
+    src := server.Source{Name: source, Description: sourceDesc}
+    if sourceDate != "" {
+      src.Date, err = time.Parse("2006-01-02", sourceDate)
+      if err != nil {
+        log.Fatal(err)
+      }
+    }
+    sourceID, err := sourced.AddSource(src)
+    if err != nil {
+      log.Fatal(err)
+    }
+    store = &sourcedStore{store, sourceID}
+  }
+  var watches server.WatchStore
+  // every line of -raw-out looks new, since duplicates are only removed
+  // when the file is sorted
+  if watch && rawOut != "" {
+    fmt.Println("Not matching watchlists, since -raw-out can't tell new credentials apart.")
+  } else if watch {
+    // outermost, so that it sees the hashes before OPRF; watches are
+    // peppered like the table
+    watches = server.NewPepperedWatchStore(server.NewDBWatchStore(db, backend), keys)
+    store = &watchingStore{Store: store, watches: watches, params: p.Name, rotating: !oprf && len(keys) > 1}
+  }
+  defer store.Close()
+  if countPasswords && oprf {
+    fmt.Println("Not counting passwords, since -oprf doesn't add to the table they are counted against.")
+  }
+  passwords := passwordStore(db, backend, p, keys, countPasswords, oprf)
+  // nobody runs server -c on a SQLite file, so its tables are created here
+  if backend == server.BackendSQLite {
+    if rawOut == "" {
+      err = store.CreateTables()
+    }
+    if err == nil && passwords != nil {
+      err = passwords.CreateTables()
+    }
+    if err == nil && watches != nil {
+      err = watches.CreateTables()
+    }
+    if err != nil {
+      log.Fatal(err)
+    }
+  }
   info, err := os.Stat(path)
   if err != nil && os.IsNotExist(err) {
     log.Fatal("File at " + path + " does not exist.")
@@ -162,8 +411,6 @@ func main() {
   if threads <= 0 {
     log.Fatal("Threads should be at least 1.")
   }
-  limit = 700000
-  offset = 31300000
   if limit < 0 {
     fmt.Println("Calculating number of credentials...")
     lines, err := ccds.CountLines(path)
@@ -185,7 +432,7 @@ func main() {
       extra = 1
     }
     numLines := step + extra
-    go encryptionThread(db, path, numLines, lastLine + offset, errChan, failureChan)
+    go encryptionThread(store, passwords, params, path, numLines, lastLine + offset, errChan, failureChan)
     lastLine += numLines
   }
   allFailures := []failure{}
@@ -198,7 +445,7 @@ func main() {
     }
     allFailures = append(allFailures, failures...)
   }
-  writeFailures(allFailures, failuresPath)
+  writeFailures(allFailures, cfg.Data.Failures)
   fmt.Println("Run time:", time.Since(start))
   fmt.Println("Number of failures:", len(allFailures))
 }
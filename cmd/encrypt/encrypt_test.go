@@ -0,0 +1,65 @@
+package main
+
+import (
+  "bytes"
+  "os"
+  "path/filepath"
+  "testing"
+
+  "github.com/korlando/ccds"
+  "github.com/korlando/ccds/server"
+)
+
+func TestEncryptCountsPasswordsOnce(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "creds.tsv")
+  // bob's pair appears twice in the dump
+  os.WriteFile(path, []byte("alice\thunter2\nbob\thunter2\nbob\thunter2\ncarol\tswordfish\n"), 0600)
+  // cheap parameters so the test is fast
+  params := ccds.Argon2Params{Iterations: 1, Memory: 64, Threads: 1, KeyLen: 64}
+  store := server.NewMemStore()
+  passwords := server.NewMemPasswordStore()
+  // importing the same file again must not change the counts
+  for run := 0; run < 2; run += 1 {
+    _, _, failures, err := encryptAndInsertAll(store, passwords, params, path, -1, 0)
+    if err != nil || len(failures) != 0 {
+      t.Fatalf("Run %d: unexpected failures %v, %v\n", run, failures, err)
+    }
+  }
+  for pw, expected := range map[string]int64{"hunter2": 2, "swordfish": 1} {
+    hash, _ := params.Hash([]byte(pw), server.PasswordSalt)
+    if count, _ := passwords.PasswordCount(hash); count != expected {
+      t.Errorf("Expected %s to be counted %d times. Got %d\n", pw, expected, count)
+    }
+  }
+}
+
+func TestWatchingStoreSkipsRotatedDuplicates(t *testing.T) {
+  oldKey := server.PepperKey{ID: 1, Key: bytes.Repeat([]byte{1}, 32)}
+  newKey := server.PepperKey{ID: 2, Key: bytes.Repeat([]byte{2}, 32)}
+  mem := server.NewMemStore()
+  watches := server.NewPepperedWatchStore(server.NewMemWatchStore(), server.Keyring{newKey, oldKey})
+  leaked := bytes.Repeat([]byte{0xaa}, server.CredHashLen)
+  fresh := bytes.Repeat([]byte{0xbb}, server.CredHashLen)
+  watches.AddWatches("acme", server.DefaultParamSet.Name, [][]byte{leaked, fresh})
+  server.NewPepperedStore(mem, server.Keyring{oldKey}).Insert(leaked)
+  // a re-import after rotating stores leaked again under the new key
+  store := &watchingStore{Store: server.NewPepperedStore(mem, server.Keyring{newKey, oldKey}), watches: watches, params: server.DefaultParamSet.Name, rotating: true}
+  for _, hash := range [][]byte{leaked, fresh} {
+    if err := store.Insert(hash); err != nil {
+      t.Fatal(err)
+    }
+  }
+  store.Close()
+  if store.matched != 1 {
+    t.Errorf("Expected only the fresh hash to match. Got %d matches\n", store.matched)
+  }
+}
+
+func TestOPRFImportSkipsPasswords(t *testing.T) {
+  if passwordStore(nil, server.BackendSQLite, server.DefaultParamSet, nil, true, true) != nil {
+    t.Error("Expected -oprf imports not to count passwords")
+  }
+  if passwordStore(nil, server.BackendSQLite, server.DefaultParamSet, nil, true, false) == nil {
+    t.Error("Expected other imports to count passwords")
+  }
+}
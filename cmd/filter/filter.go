@@ -0,0 +1,102 @@
+// exports a parameter set's table as a signed offline filter file
+// for ccds.OfflineChecker
+package main
+
+import (
+  "bufio"
+  "crypto/ed25519"
+  "crypto/rand"
+  "encoding/hex"
+  "flag"
+  "fmt"
+  "log"
+  "os"
+  "time"
+
+  _ "github.com/go-sql-driver/mysql"
+  _ "github.com/lib/pq"
+  "github.com/korlando/ccds/server"
+  _ "modernc.org/sqlite"
+)
+
+func main() {
+  var production bool
+  var params string
+  var fpRate float64
+  var out string
+  var keygen bool
+  var configPath string
+  var printConfig bool
+  flag.BoolVar(&production, "production", false, "Read from the production DB.")
+  flag.StringVar(&params, "params", server.DefaultParamSet.Name, "Argon2 parameter set to export.")
+  flag.Float64Var(&fpRate, "fp", server.DefaultFilterFPRate, "False-positive rate of the filter.")
+  flag.StringVar(&out, "o", "ccds.filter", "Path to write the filter to.")
+  flag.BoolVar(&keygen, "keygen", false, "Print a new CCDS_FILTER_KEY and its public key, then exit.")
+  flag.StringVar(&configPath, "config", "", "YAML config file shared with the server; defaults to CCDS_CONFIG.")
+  flag.BoolVar(&printConfig, "print-config", false, "Print the effective config, with secrets redacted, then exit.")
+  flag.Parse()
+  cfg, err := server.LoadConfig(configPath)
+  if err != nil {
+    log.Fatal(err)
+  }
+  if printConfig {
+    err = cfg.Print(os.Stdout)
+    if err != nil {
+      log.Fatal(err)
+    }
+    return
+  }
+  if keygen {
+    pub, key, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+      log.Fatal(err)
+    }
+    fmt.Println("CCDS_FILTER_KEY=" + hex.EncodeToString(key.Seed()))
+    fmt.Println("public key:", hex.EncodeToString(pub))
+    return
+  }
+  key, err := server.GetFilterKey()
+  if err != nil {
+    log.Fatal(err)
+  }
+  if key == nil {
+    log.Fatal("Set CCDS_FILTER_KEY to sign the filter; run with -keygen to make one.")
+  }
+  p, err := server.ParseParamSet(params)
+  if err != nil {
+    log.Fatal(err)
+  }
+  keys, err := server.GetKeyring()
+  if err != nil {
+    log.Fatal(err)
+  }
+  db, backend, err := server.OpenDB(cfg.DSN(production))
+  if err != nil {
+    log.Fatal(err)
+  }
+  store := server.NewPepperedStore(server.NewDBStore(db, backend, p), keys)
+  defer store.Close()
+  start := time.Now()
+  b, entries, err := server.ExportFilter(store, fpRate)
+  if err != nil {
+    log.Fatal(err)
+  }
+  fmt.Println("Built filter of", entries, "hashes in", time.Since(start))
+  file, err := os.Create(out)
+  if err != nil {
+    log.Fatal(err)
+  }
+  w := bufio.NewWriter(file)
+  err = server.WriteFilter(w, p, b, entries, key)
+  if err == nil {
+    err = w.Flush()
+  }
+  if err == nil {
+    err = file.Close()
+  }
+  if err != nil {
+    log.Fatal(err)
+  }
+  fmt.Println("Wrote", b.Size(), "byte filter to", out)
+  fmt.Println("public key:", hex.EncodeToString(key.Public().(ed25519.PublicKey)))
+}
@@ -0,0 +1,192 @@
+// ccds-mirror keeps a follower's tables up to date with a leader CCDS
+// server's /v1/sync and /v2/oprf/sync endpoints, which the leader serves
+// with -sync. They hand out every stored hash, so CCDS_API_KEY must be an
+// admin key, made on the leader with "server keys create-admin <tenant>".
+// The last sequence number copied from each table is kept in a state file
+// so that it resumes after a restart.
+package main
+
+import (
+  "context"
+  "database/sql"
+  "encoding/hex"
+  "encoding/json"
+  "flag"
+  "fmt"
+  "log"
+  "os"
+  "time"
+
+  _ "github.com/go-sql-driver/mysql"
+  _ "github.com/lib/pq"
+  "github.com/korlando/ccds"
+  "github.com/korlando/ccds/server"
+  _ "modernc.org/sqlite"
+)
+
+// last sequence number copied, keyed by table
+type syncState map[string]uint64
+
+func readState(path string) (state syncState, err error) {
+  state = make(syncState)
+  b, err := os.ReadFile(path)
+  if os.IsNotExist(err) {
+    return state, nil
+  } else if err != nil {
+    return
+  }
+  err = json.Unmarshal(b, &state)
+  return
+}
+
+// writes to a temporary file first so that a crash leaves the old state
+func writeState(path string, state syncState) error {
+  b, err := json.Marshal(state)
+  if err != nil {
+    return err
+  }
+  err = os.WriteFile(path + ".tmp", b, 0644)
+  if err != nil {
+    return err
+  }
+  return os.Rename(path + ".tmp", path)
+}
+
+// copies every page of a table the follower hasn't seen; hashes are
+// inserted as they are stored on the leader, already peppered. The leader
+// numbers a hash when it's inserted, but a concurrent insert can commit
+// after hashes numbered later have been copied, so each sync starts rewind
+// sequence numbers before the last one copied and skips the duplicates.
+func syncTable(ctx context.Context, c *ccds.Client, store server.KeyedStore, table string, p server.ParamSet, oprf bool, state syncState, statePath string, pageSize int, rewind uint64) (copied int, err error) {
+  var since uint64
+  if state[table] > rewind {
+    since = state[table] - rewind
+  }
+  for {
+    res, err := c.Sync(ctx, p.Name, oprf, since, pageSize)
+    if err != nil {
+      return copied, err
+    }
+    for _, e := range res.Entries {
+      hash, err := hex.DecodeString(e.Hash)
+      if err != nil {
+        return copied, err
+      }
+      err = store.InsertKeyed(hash, e.KeyID)
+      // hashes in the rewound window and hashes inserted before a crash
+      // are copied again
+      if err == server.ErrDuplicate {
+        continue
+      } else if err != nil {
+        return copied, err
+      }
+      copied += 1
+    }
+    since = res.Next
+    if since > state[table] {
+      state[table] = since
+      if err = writeState(statePath, state); err != nil {
+        return copied, err
+      }
+    }
+    if !res.More {
+      return copied, nil
+    }
+  }
+}
+
+func syncAll(ctx context.Context, c *ccds.Client, db *sql.DB, backend string, oprf bool, state syncState, statePath string, pageSize int, rewind uint64) error {
+  paramsRes, err := c.ParamSets(ctx)
+  if err != nil {
+    return err
+  }
+  for _, p := range paramsRes.Sets {
+    stores := map[bool]server.Store{false: server.NewDBStore(db, backend, p)}
+    tables := map[bool]string{false: p.Table(), true: p.OPRFTable()}
+    if oprf {
+      stores[true] = server.NewDBOPRFStore(db, backend, p)
+    }
+    for isOPRF, store := range stores {
+      if err = store.CreateTables(); err != nil {
+        return err
+      }
+      copied, err := syncTable(ctx, c, store.(server.KeyedStore), tables[isOPRF], p, isOPRF, state, statePath, pageSize, rewind)
+      if err != nil {
+        return err
+      }
+      if copied > 0 {
+        fmt.Println("Copied", copied, "hashes into", tables[isOPRF])
+      }
+    }
+  }
+  return nil
+}
+
+func main() {
+  var leader string
+  var production bool
+  var statePath string
+  var interval time.Duration
+  var pageSize int
+  var rewind uint64
+  var oprf bool
+  var once bool
+  var configPath string
+  var printConfig bool
+  flag.StringVar(&leader, "leader", "", "Base URL of the server to copy from, e.g. https://ccds.example.com.")
+  flag.BoolVar(&production, "production", false, "Copy into the production DB.")
+  flag.StringVar(&statePath, "state", "ccds-mirror.json", "File recording the last sequence number copied from each table.")
+  flag.DurationVar(&interval, "interval", time.Minute, "How long to wait between syncs.")
+  flag.IntVar(&pageSize, "page", server.DefaultSyncPageSize, "Hashes to request per page.")
+  flag.Uint64Var(&rewind, "rewind", 10000, "Sequence numbers to copy again on each sync, to catch inserts the leader committed late.")
+  flag.BoolVar(&oprf, "oprf", false, "Also copy the OPRF output tables.")
+  flag.BoolVar(&once, "once", false, "Sync once and exit.")
+  flag.StringVar(&configPath, "config", "", "YAML config file shared with the server; defaults to CCDS_CONFIG.")
+  flag.BoolVar(&printConfig, "print-config", false, "Print the effective config, with secrets redacted, then exit.")
+  flag.Parse()
+  cfg, err := server.LoadConfig(configPath)
+  if err != nil {
+    log.Fatal(err)
+  }
+  if printConfig {
+    err = cfg.Print(os.Stdout)
+    if err != nil {
+      log.Fatal(err)
+    }
+    return
+  }
+  if leader == "" {
+    log.Fatal("Expected a -leader URL.")
+  }
+  db, backend, err := server.OpenDB(cfg.DSN(production))
+  if err != nil {
+    log.Fatal(err)
+  }
+  err = db.Ping()
+  if err != nil {
+    log.Fatal(err)
+  }
+  defer db.Close()
+  state, err := readState(statePath)
+  if err != nil {
+    log.Fatal(err)
+  }
+  c := ccds.NewClient(leader)
+  // an admin key; tenant keys can't sync
+  c.APIKey = os.Getenv("CCDS_API_KEY")
+  c.HTTPClient.Timeout = time.Minute
+  ctx := context.Background()
+  for {
+    err = syncAll(ctx, c, db, backend, oprf, state, statePath, pageSize, rewind)
+    if err != nil {
+      log.Println(err)
+    }
+    if once {
+      if err != nil {
+        os.Exit(1)
+      }
+      return
+    }
+    time.Sleep(interval)
+  }
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+  "context"
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "sync"
+  "testing"
+
+  "github.com/korlando/ccds"
+  "github.com/korlando/ccds/server"
+)
+
+// a leader whose visible entries the test controls, standing in for
+// inserts that commit out of sequence order
+type fakeLeader struct{
+  mu      sync.Mutex
+  entries []server.SyncEntryRes
+}
+
+func (l *fakeLeader) commit(seq uint64, hash string) {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  l.entries = append(l.entries, server.SyncEntryRes{Seq: seq, Hash: hash})
+}
+
+func (l *fakeLeader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  since, _ := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+  res := server.SyncRes{Entries: []server.SyncEntryRes{}, Next: since}
+  for _, e := range l.entries {
+    if e.Seq > since {
+      res.Entries = append(res.Entries, e)
+    }
+  }
+  sort.Slice(res.Entries, func(i, j int) bool {
+    return res.Entries[i].Seq < res.Entries[j].Seq
+  })
+  if len(res.Entries) > 0 {
+    res.Next = res.Entries[len(res.Entries) - 1].Seq
+  }
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(res)
+}
+
+func TestSyncTableInterleavedCommits(t *testing.T) {
+  leader := &fakeLeader{}
+  ts := httptest.NewServer(leader)
+  defer ts.Close()
+  c := ccds.NewClient(ts.URL)
+  follower := server.NewMemStore()
+  statePath := filepath.Join(t.TempDir(), "state.json")
+  state := make(syncState)
+  ctx := context.Background()
+  p := server.DefaultParamSet
+  // 2 was numbered before 3 but its transaction hasn't committed yet
+  leader.commit(1, "01")
+  leader.commit(3, "03")
+  copied, err := syncTable(ctx, c, follower, "t", p, false, state, statePath, 10, 10)
+  if err != nil || copied != 2 || state["t"] != 3 {
+    t.Fatalf("Expected to copy 2 hashes up to 3. Got %d, %d, %v\n", copied, state["t"], err)
+  }
+  leader.commit(2, "02")
+  leader.commit(4, "04")
+  copied, err = syncTable(ctx, c, follower, "t", p, false, state, statePath, 10, 10)
+  if err != nil || copied != 2 || state["t"] != 4 {
+    t.Fatalf("Expected to copy the late hash and the new one. Got %d, %d, %v\n", copied, state["t"], err)
+  }
+  if found, _ := follower.Lookup([]byte{2}); !found {
+    t.Error("Expected the late commit to reach the follower")
+  }
+  if count, _ := follower.Count(); count != 4 {
+    t.Errorf("Expected 4 hashes on the follower. Got %d\n", count)
+  }
+}
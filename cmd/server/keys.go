@@ -0,0 +1,52 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "os"
+  "text/tabwriter"
+
+  "github.com/korlando/ccds/server"
+)
+
+const keysUsage = "Usage: server keys create <tenant> | keys create-admin <tenant> | keys list | keys revoke <id>"
+
+// runs the "keys" admin subcommand
+func runKeys(store server.APIKeyStore, args []string) error {
+  if len(args) == 0 {
+    return errors.New(keysUsage)
+  }
+  switch {
+  case (args[0] == "create" || args[0] == "create-admin") && len(args) == 2:
+    create := server.CreateAPIKey
+    if args[0] == "create-admin" {
+      create = server.CreateAdminAPIKey
+    }
+    key, k, err := create(store, args[1])
+    if err != nil {
+      return err
+    }
+    fmt.Println("Created key", k.ID, "for tenant", k.Tenant + ". It will not be shown again:")
+    fmt.Println(key)
+  case args[0] == "list" && len(args) == 1:
+    keys, err := store.ListAPIKeys()
+    if err != nil {
+      return err
+    }
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(w, "ID\tTENANT\tCREATED\tADMIN\tREVOKED")
+    for _, k := range keys {
+      fmt.Fprintf(w, "%s\t%s\t%s\t%v\t%v\n", k.ID, k.Tenant, k.Created.Format("2006-01-02 15:04:05"), k.Admin, k.Revoked)
+    }
+    w.Flush()
+  case args[0] == "revoke" && len(args) == 2:
+    err := store.RevokeAPIKey(args[1])
+    if err != nil {
+      return err
+    }
+    fmt.Println("Revoked key", args[1])
+  default:
+    return errors.New(keysUsage)
+  }
+  return nil
+}
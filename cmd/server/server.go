@@ -1,31 +1,113 @@
 package main
 
 import (
-  "database/sql"
+  "context"
   "flag"
   "fmt"
   "log"
+  "net"
+  "os"
+  "os/signal"
   "strconv"
+  "strings"
+  "syscall"
+  "time"
 
   _ "github.com/go-sql-driver/mysql"
+  _ "github.com/lib/pq"
   "github.com/korlando/ccds/server"
+  _ "modernc.org/sqlite"
 )
 
 func main() {
   var port int
   var production bool
   var create bool
-  flag.IntVar(&port, "port", 8030, "Specify the port to run the server on.")
+  var maxBatchSize int
+  var rangePrefixLen int
+  var rangePadding int
+  var params string
+  var retireKey uint
+  var noAuth bool
+  var rateLimits string
+  var hitRate string
+  var trustProxy bool
+  var filterFP float64
+  var filterRefresh time.Duration
+  var filterCatchUp time.Duration
+  var sync bool
+  var checkedFlush time.Duration
+  var canaryWebhook string
+  var canaryRefresh time.Duration
+  var deadLetters string
+  var webhookAttempts int
+  var jobsDir string
+  var jobWorkers int
+  var maxJobUpload int64
+  var storeSpec string
+  var dsn string
+  var configPath string
+  var printConfig bool
+  var shutdownTimeout time.Duration
+  flag.IntVar(&port, "port", 8030, "Specify the port to run the server on; overrides server.listen in the config.")
   flag.BoolVar(&production, "production", false, "Sets the server to production mode; uses production DB.")
   flag.BoolVar(&create, "c", false, "Run table creation queries.")
+  flag.IntVar(&maxBatchSize, "max-batch", server.DefaultMaxBatchSize, "Maximum number of hashes accepted by /v1/creds.")
+  flag.IntVar(&rangePrefixLen, "range-prefix", server.DefaultRangePrefixLen, "Number of hex characters clients send to /v1/range.")
+  flag.IntVar(&rangePadding, "range-padding", server.DefaultRangePadding, "Pad /v1/range responses to a multiple of this many suffixes.")
+  flag.StringVar(&params, "params", "", "Comma-separated Argon2 parameter sets to serve in addition to " + server.DefaultParamSet.Name + ", e.g. 2_128_8_64; overrides params in the config.")
+  flag.UintVar(&retireKey, "retire-key", 0, "Delete every hash peppered with this key id, then exit.")
+  flag.BoolVar(&noAuth, "no-auth", false, "Serve requests without an API key.")
+  flag.StringVar(&rateLimits, "rate", "", "Per-route request limits for each API key and IP, e.g. default=10:20,/v1/creds=1:5 (tokens per second:burst).")
+  flag.StringVar(&hitRate, "hit-rate", "", "Limit on compromised answers per client, e.g. 0.01:50 (refill per second:max). A batch with more hits than max gets 413.")
+  flag.BoolVar(&trustProxy, "trust-proxy", false, "Take client IPs from the last X-Forwarded-For entry, as appended by a reverse proxy.")
+  flag.Float64Var(&filterFP, "filter-fp", server.DefaultFilterFPRate, "False-positive rate of the in-memory filter in front of each table; 0 disables the filters.")
+  flag.DurationVar(&filterRefresh, "filter-refresh", server.DefaultFilterRefresh, "How often to rebuild the filters from their tables.")
+  flag.DurationVar(&filterCatchUp, "filter-catch-up", server.DefaultFilterCatchUp, "How often to add hashes imported by other processes to the filters; until then they are reported as not found. 0 disables catching up.")
+  flag.BoolVar(&sync, "sync", false, "Serve /v1/sync so that ccds-mirror followers holding an admin API key can copy every stored hash.")
+  flag.DurationVar(&checkedFlush, "checked-flush", 10 * time.Second, "How often to write lookup counts to the checked column; 0 disables counting.")
+  flag.StringVar(&canaryWebhook, "canary-webhook", "", "URL to POST canary alerts to, in addition to the log.")
+  flag.DurationVar(&canaryRefresh, "canary-refresh", server.DefaultCanaryRefresh, "How often to reload the canaries, to see the ones other replicas added.")
+  flag.StringVar(&deadLetters, "dead-letters", "ccds-dead-letters.log", "File to append watchlist deliveries that were given up on to.")
+  flag.IntVar(&webhookAttempts, "webhook-attempts", server.DefaultWebhookAttempts, "Number of times to attempt each watchlist delivery.")
+  flag.StringVar(&jobsDir, "jobs-dir", "", "Directory to keep /v1/jobs uploads and results in; empty disables jobs. Jobs need an API key, so -no-auth refuses them.")
+  flag.IntVar(&jobWorkers, "job-workers", server.DefaultJobWorkers, "Number of jobs to run at once.")
+  flag.Int64Var(&maxJobUpload, "max-job-upload", server.DefaultMaxJobUpload, "Limit on the size of a /v1/jobs upload, in bytes.")
+  flag.StringVar(&storeSpec, "store", "db", "Where the " + server.DefaultParamSet.Name + " hashes are served from: db, the configured database, or file:<path> for a read-only file built by buildstore.")
+  flag.StringVar(&dsn, "db", "", "Database to use: mysql://user:pw@host/name, postgres://user:pw@host/name or sqlite:path.db. Overrides db.prod with -production, otherwise db.dev, in the config.")
+  flag.StringVar(&configPath, "config", "", "YAML config file shared with the tools; defaults to CCDS_CONFIG.")
+  flag.BoolVar(&printConfig, "print-config", false, "Print the effective config, with secrets redacted, then exit.")
+  flag.DurationVar(&shutdownTimeout, "shutdown-timeout", server.DefaultShutdownTimeout, "How long in-flight requests get to finish on SIGINT or SIGTERM; overrides server.shutdownTimeout in the config.")
+  flag.Usage = func() {
+    fmt.Fprintln(flag.CommandLine.Output(), "Usage: server [flags] [keys create <tenant> | keys create-admin <tenant> | keys list | keys revoke <id>]")
+    flag.PrintDefaults()
+  }
   flag.Parse()
-  var db *sql.DB
-  var err error
-  if production {
-    db, err = server.GetProdDB()
-  } else {
-    db, err = server.GetDevDB()
+  cfg, err := server.LoadConfig(configPath)
+  if err != nil {
+    log.Fatal(err)
   }
+  // flags given on the command line win over the config
+  flag.Visit(func(f *flag.Flag) {
+    switch f.Name {
+    case "port":
+      cfg.Server.Listen = ":" + strconv.Itoa(port)
+    case "shutdown-timeout":
+      cfg.Server.ShutdownTimeout = shutdownTimeout
+    case "params":
+      cfg.Params = strings.Split(params, ",")
+    case "db":
+      cfg.SetDSN(production, dsn)
+    }
+  })
+  if printConfig {
+    err = cfg.Print(os.Stdout)
+    if err != nil {
+      log.Fatal(err)
+    }
+    return
+  }
+  db, backend, err := server.OpenDB(cfg.DSN(production))
   if err != nil {
     log.Fatal(err)
   }
@@ -33,16 +115,265 @@ func main() {
   if err != nil {
     log.Fatal(err)
   }
-  if create {
+  defer db.Close()
+  keys, err := server.GetKeyring()
+  if err != nil {
+    log.Fatal(err)
+  }
+  oprfKey, err := server.GetOPRFKey()
+  if err != nil {
+    log.Fatal(err)
+  }
+  filterKey, err := server.GetFilterKey()
+  if err != nil {
+    log.Fatal(err)
+  }
+  a := server.App{
+    MaxBatchSize: maxBatchSize,
+    RangePrefixLen: rangePrefixLen,
+    RangePadding: rangePadding,
+    OPRFKey: oprfKey,
+    FilterKey: filterKey,
+    Sync: sync,
+    ReadTimeout: cfg.Server.ReadTimeout,
+    WriteTimeout: cfg.Server.WriteTimeout,
+    IdleTimeout: cfg.Server.IdleTimeout,
+    ShutdownTimeout: cfg.Server.ShutdownTimeout,
+  }
+  if filterFP > 0 {
+    a.FilterFPRate = filterFP
+  }
+  routes, err := server.ParseRateLimits(rateLimits)
+  if err != nil {
+    log.Fatal(err)
+  }
+  limits := &server.RateLimiter{Routes: routes, TrustProxy: trustProxy}
+  if hitRate != "" {
+    limits.Hits, err = server.ParseRate(hitRate)
+    if err != nil {
+      log.Fatal(err)
+    }
+  }
+  if len(routes) > 0 || hitRate != "" {
+    a.Limits = limits
+  }
+  var filters []*server.FilteredStore
+  filtered := func(store server.Store) server.Store {
+    if filterFP <= 0 {
+      return store
+    }
+    f := server.NewFilteredStore(store, filterFP)
+    filters = append(filters, f)
+    return f
+  }
+  var checked *server.CheckedCounter
+  if checkedFlush > 0 {
+    checked = server.NewCheckedCounter(db, backend)
+  }
+  var fileStore *server.FlatFileStore
+  switch {
+  case strings.HasPrefix(storeSpec, "file:"):
+    fileStore, err = server.OpenFlatFileStore(strings.TrimPrefix(storeSpec, "file:"))
+    if err != nil {
+      log.Fatal(err)
+    }
+    defer fileStore.Close()
+    if fileStore.HashLen != server.DefaultParamSet.KeyLen {
+      log.Fatal("The hash file holds ", fileStore.HashLen, " byte hashes; expected ", server.DefaultParamSet.KeyLen, ".")
+    }
+  case storeSpec != "db":
+    log.Fatal("Unknown -store " + storeSpec + "; expected db or file:<path>.")
+  }
+  credStore := func(p server.ParamSet) server.Store {
+    // the file is already sorted and indexed, so it needs no filter
+    if fileStore != nil && p == server.DefaultParamSet {
+      return server.NewPepperedStore(fileStore, keys)
+    }
+    store := server.NewDBStore(db, backend, p)
+    switch s := store.(type) {
+    case *server.MySQLStore:
+      s.Checked = checked
+    case *server.PostgresStore:
+      s.Checked = checked
+    case *server.SQLiteStore:
+      s.Checked = checked
+    }
+    return server.NewPepperedStore(filtered(store), keys)
+  }
+  apiKeys := server.NewDBAPIKeyStore(db, backend)
+  canaryStore := server.NewDBCanaryStore(db, backend)
+  watchStore := server.NewDBWatchStore(db, backend)
+  jobStore := server.NewDBJobStore(db, backend)
+  blocklistStore := server.NewDBBlocklistStore(db, backend)
+  if !noAuth {
+    a.APIKeys = apiKeys
+  }
+  var passwordStores []server.PasswordStore
+  passwordStore := func(p server.ParamSet) server.PasswordStore {
+    store := server.NewDBPasswordStore(db, backend, p)
+    passwordStores = append(passwordStores, store)
+    return server.NewPepperedPasswordStore(store, keys)
+  }
+  a.Initialize(credStore(server.DefaultParamSet))
+  a.RegisterOPRF(server.DefaultParamSet, filtered(server.NewDBOPRFStore(db, backend, server.DefaultParamSet)))
+  a.RegisterPasswords(server.DefaultParamSet, passwordStore(server.DefaultParamSet))
+  for _, name := range cfg.Params {
+    if name == "" || name == server.DefaultParamSet.Name {
+      continue
+    }
+    p, err := server.ParseParamSet(name)
+    if err != nil {
+      log.Fatal(err)
+    }
+    a.Register(p, credStore(p))
+    a.RegisterOPRF(p, filtered(server.NewDBOPRFStore(db, backend, p)))
+    a.RegisterPasswords(p, passwordStore(p))
+  }
+  // a longer prefix than a hash has hex characters can't select a range
+  for _, p := range a.Params.ParamSets() {
+    err = server.CheckRangePrefixLen(rangePrefixLen, 2 * int(p.KeyLen))
+    if err != nil {
+      log.Fatal(err)
+    }
+  }
+  // a SQLite file is set up on every start, so there is nothing to run -c on
+  if create || backend == server.BackendSQLite {
     // attempt to create the tables
     fmt.Println("Creating tables...")
-    err = server.CreateTables(db)
+    for _, store := range append(a.Params.Stores(), a.OPRF.Stores()...) {
+      err = store.CreateTables()
+      if err != nil {
+        log.Fatal(err)
+      }
+    }
+    for _, store := range passwordStores {
+      err = store.CreateTables()
+      if err != nil {
+        log.Fatal(err)
+      }
+    }
+    err = apiKeys.CreateTables()
+    if err != nil {
+      log.Fatal(err)
+    }
+    err = canaryStore.CreateTables()
+    if err != nil {
+      log.Fatal(err)
+    }
+    err = watchStore.CreateTables()
+    if err != nil {
+      log.Fatal(err)
+    }
+    err = jobStore.CreateTables()
+    if err != nil {
+      log.Fatal(err)
+    }
+    err = blocklistStore.CreateTables()
+    if err != nil {
+      log.Fatal(err)
+    }
+    if create {
+      return
+    }
+  }
+  if flag.Arg(0) == "keys" {
+    err = runKeys(apiKeys, flag.Args()[1:])
     if err != nil {
       log.Fatal(err)
     }
     return
   }
-  a := server.App{}
-  a.Initialize(db)
-  a.Run(":" + strconv.Itoa(port))
+  if retireKey > 0 {
+    fmt.Println("Deleting hashes peppered with key", retireKey, "...")
+    for _, store := range a.Params.Stores() {
+      retirer, ok := store.(server.KeyRetirer)
+      if !ok {
+        log.Fatal("Store does not record pepper key ids.")
+      }
+      deleted, err := retirer.DeleteKey(uint16(retireKey))
+      if err != nil {
+        log.Fatal(err)
+      }
+      fmt.Println("Deleted", deleted, "hashes")
+    }
+    for _, store := range passwordStores {
+      retirer, ok := store.(server.KeyRetirer)
+      if !ok {
+        log.Fatal("Password store does not record pepper key ids.")
+      }
+      deleted, err := retirer.DeleteKey(uint16(retireKey))
+      if err != nil {
+        log.Fatal(err)
+      }
+      fmt.Println("Deleted", deleted, "password hashes")
+    }
+    return
+  }
+  // the background work outlives the signal until requests have drained
+  background, stopBackground := context.WithCancel(context.Background())
+  defer stopBackground()
+  alerters := []server.Alerter{server.LogAlerter{}}
+  if canaryWebhook != "" {
+    alerters = append(alerters, server.NewWebhookAlerter(canaryWebhook))
+  }
+  a.Canaries, err = server.NewCanaries(canaryStore, alerters...)
+  if err != nil {
+    log.Fatal(err)
+  }
+  a.Canaries.TrustProxy = trustProxy
+  go a.Canaries.Refresh(background, canaryRefresh)
+  a.Watches = server.NewPepperedWatchStore(watchStore, keys)
+  a.Blocklist = blocklistStore
+  deadLetterFile, err := os.OpenFile(deadLetters, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+  if err != nil {
+    log.Fatal(err)
+  }
+  defer deadLetterFile.Close()
+  notifier := server.NewNotifier(watchStore, deadLetterFile)
+  notifier.MaxAttempts = webhookAttempts
+  go notifier.Run(background, 10 * time.Second)
+  if jobsDir != "" {
+    a.Jobs = server.NewJobs(jobStore, jobsDir, a.Params)
+    a.Jobs.Canaries = a.Canaries
+    a.Jobs.Workers = jobWorkers
+    a.Jobs.MaxUpload = maxJobUpload
+    a.Jobs.TrustProxy = trustProxy
+    // bulk matches count against the same budget as lookups
+    a.Jobs.Hits = limits.HitLimiter()
+    err = a.Jobs.Start(background)
+    if err != nil {
+      log.Fatal(err)
+    }
+  }
+  for _, f := range filters {
+    err = f.Rebuild()
+    if err != nil {
+      log.Fatal(err)
+    }
+    stats := f.Stats()
+    fmt.Println("Built filter of", stats.Entries, "hashes in", stats.BuildMillis, "ms")
+    go f.Refresh(background, filterRefresh, filterCatchUp)
+  }
+  // lookups counted since the last flush are written on the way out
+  flushed := make(chan struct{})
+  if checked != nil {
+    go func() {
+      checked.Run(background, checkedFlush)
+      close(flushed)
+    }()
+  } else {
+    close(flushed)
+  }
+  l, err := net.Listen("tcp", cfg.Server.Listen)
+  if err != nil {
+    log.Fatal(err)
+  }
+  ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+  defer stop()
+  err = a.Serve(ctx, l)
+  stopBackground()
+  <-flushed
+  if err != nil {
+    log.Fatal(err)
+  }
 }
@@ -1,58 +1,170 @@
 package main_test
 
 import (
+  "bytes"
+  "encoding/base64"
+  "encoding/hex"
+  "encoding/json"
   "net/http"
   "net/http/httptest"
-  "log"
   "os"
   "testing"
 
   "github.com/korlando/ccds/server"
 )
 
-const credhashTableCreationQuery = `
-  CREATE TABLE IF NOT EXISTS cred_hash_1_64_8_64 (
-    hash varbinary(64) NOT NULL,
-    checked int(11) DEFAULT '0',
-    PRIMARY KEY (hash),
-    UNIQUE KEY hash_UNIQUE (hash)
-  ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
-`
+var compromisedHash = bytes.Repeat([]byte{0xff}, server.CredHashLen)
+var safeHash = bytes.Repeat([]byte{0x01}, server.CredHashLen)
 
-var a main.App
+var a server.App
 
 func TestMain(m *testing.M) {
-  a = main.App{}
-  a.Initialize(
-    os.Getenv("CCDS_DB_USER"),
-    os.Getenv("CCDS_DB_PW"),
-    os.Getenv("CCDS_DB_NAME"),
-  )
-  ensureTableExists()
+  store := server.NewMemStore()
+  store.Insert(compromisedHash)
+  a = server.App{}
+  a.Initialize(store)
   code := m.Run()
   os.Exit(code)
 }
 
 func TestSearch(t *testing.T) {
-  req, _ := http.NewRequest("GET", "/credhash", nil)
-  response := executeRequest(req)
-  checkResponseCode(t, http.StatusOK, response.Code)
+  res := searchCred(t, hex.EncodeToString(compromisedHash), "hex")
+  checkResponseCode(t, http.StatusOK, res.Code)
+  checkCompromised(t, true, res)
+  res = searchCred(t, hex.EncodeToString(safeHash), "hex")
+  checkResponseCode(t, http.StatusOK, res.Code)
+  checkCompromised(t, false, res)
 }
 
-func checkResponseCode(t *testing.T, expected, actual int) {
-  if expected != actual {
-    t.Errorf("Expected response code %d. Got %d\n", expected, actual)
+func TestSearchEncodings(t *testing.T) {
+  encoded := map[string]string{
+    "hex": hex.EncodeToString(compromisedHash),
+    "base64": base64.StdEncoding.EncodeToString(compromisedHash),
+    "base64url": base64.RawURLEncoding.EncodeToString(compromisedHash),
+  }
+  for encoding, hash := range encoded {
+    res := searchCred(t, hash, encoding)
+    checkResponseCode(t, http.StatusOK, res.Code)
+    checkCompromised(t, true, res)
+  }
+  // invalid utf8 is mangled by JSON, so the decoded length is wrong
+  res := searchCred(t, string(compromisedHash), "utf8")
+  checkResponseCode(t, http.StatusBadRequest, res.Code)
+}
+
+func TestSearchBadEncoding(t *testing.T) {
+  res := searchCred(t, hex.EncodeToString(compromisedHash), "rot13")
+  checkResponseCode(t, http.StatusBadRequest, res.Code)
+  res = searchCred(t, hex.EncodeToString(compromisedHash[1:]), "hex")
+  checkResponseCode(t, http.StatusBadRequest, res.Code)
+  res = searchCred(t, "zz", "hex")
+  checkResponseCode(t, http.StatusBadRequest, res.Code)
+}
+
+func TestSearchBatch(t *testing.T) {
+  hashes := []string{
+    hex.EncodeToString(safeHash),
+    hex.EncodeToString(compromisedHash),
+    hex.EncodeToString(safeHash),
+  }
+  res := searchCreds(t, hashes, "hex")
+  checkResponseCode(t, http.StatusOK, res.Code)
+  var credsRes server.CredsRes
+  err := json.Unmarshal(res.Body.Bytes(), &credsRes)
+  if err != nil {
+    t.Fatal(err)
+  }
+  expected := []bool{false, true, false}
+  if len(credsRes.Results) != len(expected) {
+    t.Fatalf("Expected %d results. Got %d\n", len(expected), len(credsRes.Results))
+  }
+  for i, r := range credsRes.Results {
+    if r.Compromised != expected[i] {
+      t.Errorf("Expected result %d to be %v. Got %v\n", i, expected[i], r.Compromised)
+    }
+  }
+}
+
+func TestSearchBatchTooLarge(t *testing.T) {
+  hashes := make([]string, a.MaxBatchSize + 1)
+  for i := range hashes {
+    hashes[i] = hex.EncodeToString(safeHash)
+  }
+  res := searchCreds(t, hashes, "hex")
+  checkResponseCode(t, http.StatusRequestEntityTooLarge, res.Code)
+}
+
+func TestRange(t *testing.T) {
+  hexHash := hex.EncodeToString(compromisedHash)
+  prefix := hexHash[:a.RangePrefixLen]
+  req, _ := http.NewRequest("GET", "/v1/range/" + prefix, nil)
+  res := executeRequest(req)
+  checkResponseCode(t, http.StatusOK, res.Code)
+  var rangeRes server.RangeRes
+  err := json.Unmarshal(res.Body.Bytes(), &rangeRes)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(rangeRes.Suffixes) == 0 || len(rangeRes.Suffixes) % a.RangePadding != 0 {
+    t.Errorf("Expected a multiple of %d suffixes. Got %d\n", a.RangePadding, len(rangeRes.Suffixes))
+  }
+  found := false
+  for _, suffix := range rangeRes.Suffixes {
+    if prefix + suffix == hexHash {
+      found = true
+    }
+  }
+  if !found {
+    t.Errorf("Expected suffix of %s in range response\n", hexHash)
+  }
+  req, _ = http.NewRequest("GET", "/v1/range/" + prefix + "0", nil)
+  res = executeRequest(req)
+  checkResponseCode(t, http.StatusBadRequest, res.Code)
+}
+
+func TestSearchBadBody(t *testing.T) {
+  req, _ := http.NewRequest("POST", "/v1/cred", bytes.NewBufferString("{"))
+  res := executeRequest(req)
+  checkResponseCode(t, http.StatusBadRequest, res.Code)
+}
+
+func checkCompromised(t *testing.T, expected bool, res *httptest.ResponseRecorder) {
+  var credRes server.CredRes
+  err := json.Unmarshal(res.Body.Bytes(), &credRes)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if credRes.Compromised != expected {
+    t.Errorf("Expected compromised to be %v. Got %v\n", expected, credRes.Compromised)
   }
 }
 
-func ensureTableExists() {
-  if _, err := a.DB.Exec(credhashTableCreationQuery); err != nil {
-    log.Fatal(err)
+func checkResponseCode(t *testing.T, expected, actual int) {
+  if expected != actual {
+    t.Errorf("Expected response code %d. Got %d\n", expected, actual)
   }
 }
 
 func executeRequest(req *http.Request) *httptest.ResponseRecorder {
   rr := httptest.NewRecorder()
-  a.Router.ServeHTTP(rr, req)
+  a.RouterV1.ServeHTTP(rr, req)
   return rr
 }
+
+func searchCred(t *testing.T, hash, encoding string) *httptest.ResponseRecorder {
+  b, err := json.Marshal(server.CredReqBody{Hash: hash, Encoding: encoding})
+  if err != nil {
+    t.Fatal(err)
+  }
+  req, _ := http.NewRequest("POST", "/v1/cred", bytes.NewBuffer(b))
+  return executeRequest(req)
+}
+
+func searchCreds(t *testing.T, hashes []string, encoding string) *httptest.ResponseRecorder {
+  b, err := json.Marshal(server.CredsReqBody{Hashes: hashes, Encoding: encoding})
+  if err != nil {
+    t.Fatal(err)
+  }
+  req, _ := http.NewRequest("POST", "/v1/creds", bytes.NewBuffer(b))
+  return executeRequest(req)
+}
@@ -3,9 +3,25 @@ package ccds
 import (
   "time"
 
+  "github.com/korlando/ccds/server"
   "golang.org/x/crypto/argon2"
 )
 
+// Argon2id cost parameters
+type Argon2Params struct{
+  Iterations uint32
+  Memory     uint32 // KiB
+  Threads    uint8
+  KeyLen     uint32
+}
+
+// parameters of the hashes in server.CredHashTable
+var DefaultArgon2Params = Argon2ParamsFor(server.DefaultParamSet)
+
+func Argon2ParamsFor(p server.ParamSet) Argon2Params {
+  return Argon2Params{p.Iterations, p.Memory, p.Threads, p.KeyLen}
+}
+
 func Argon2id(password, salt []byte, iterations, memory uint32, threads uint8, keyLen uint32) (key []byte, execTime time.Duration) {
   start := time.Now()
   // https://github.com/golang/crypto/blob/master/argon2/argon2.go
@@ -15,5 +31,9 @@ func Argon2id(password, salt []byte, iterations, memory uint32, threads uint8, k
 }
 
 func DefaultArgon2(password, salt []byte) ([]byte, time.Duration) {
-  return Argon2id(password, salt, 1, 64*1024, 8, 64)
+  return DefaultArgon2Params.Hash(password, salt)
+}
+
+func (p Argon2Params) Hash(password, salt []byte) ([]byte, time.Duration) {
+  return Argon2id(password, salt, p.Iterations, p.Memory, p.Threads, p.KeyLen)
 }
@@ -0,0 +1,51 @@
+package ccds
+
+import (
+  "bufio"
+  "crypto/ed25519"
+  "io"
+  "os"
+  "strings"
+
+  "github.com/korlando/ccds/server"
+)
+
+// OfflineChecker answers Compromised from a filter file downloaded from
+// /v1/filter or written by cmd/filter, without calling the server. Like
+// any Bloom filter it has no false negatives and a small false-positive
+// rate, given by Header.FPRate.
+type OfflineChecker struct{
+  Header server.FilterHeader
+  // parameters of the filtered hashes
+  Params Argon2Params
+  filter *server.Bloom
+}
+
+// reads a filter and checks that it was signed by pub
+func LoadOfflineChecker(r io.Reader, pub ed25519.PublicKey) (*OfflineChecker, error) {
+  header, filter, err := server.ReadFilter(r, pub)
+  if err != nil {
+    return nil, err
+  }
+  return &OfflineChecker{header, Argon2ParamsFor(header.Params), filter}, nil
+}
+
+func OpenOfflineChecker(path string, pub ed25519.PublicKey) (*OfflineChecker, error) {
+  f, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+  return LoadOfflineChecker(bufio.NewReader(f), pub)
+}
+
+// hashes the credential like DefaultArgon2, or with the filter's
+// parameters if they differ, and tests it against the filter
+func (c *OfflineChecker) Compromised(u, pw string) bool {
+  hash, _ := c.Params.Hash([]byte(pw), []byte(strings.ToLower(u)))
+  return c.CompromisedHash(hash)
+}
+
+func (c *OfflineChecker) CompromisedHash(hash []byte) bool {
+  return c.filter.Test(hash)
+}
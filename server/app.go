@@ -2,59 +2,390 @@ package server
 
 import (
 	"context"
-	"database/sql"
+	"crypto/ed25519"
 	"log"
+	"net"
 	"net/http"
-	"os"
-	"os/signal"
-	"syscall"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
 )
 
 type App struct {
+	Router   *mux.Router
 	RouterV1 *mux.Router
-	DB       *sql.DB
+	RouterV2 *mux.Router
+	// requires an admin API key
+	RouterAdmin *mux.Router
+	// parameter sets and their stores
+	Params   *Registry
+	// nil disables the /v2/oprf endpoints
+	OPRFKey  *OPRFKey
+	// parameter sets and the stores of their OPRF outputs
+	OPRF     *Registry
+	// nil disables authentication
+	APIKeys  APIKeyStore
+	// nil disables rate limiting
+	Limits   *RateLimiter
+	// nil disables canary alerts and /admin/canaries
+	Canaries *Canaries
+	// nil disables /v1/watch
+	Watches  WatchStore
+	// nil disables /v1/jobs; set Jobs.Hits to the hit limiter of Limits
+	// so that jobs are charged the same as lookups
+	Jobs     *Jobs
+	// nil disables /v1/blocklist and tenant matches
+	Blocklist BlocklistStore
+	// password-only stores by parameter set name; see RegisterPasswords
+	Passwords map[string]PasswordStore
+	// signs /v1/filter downloads; nil disables them
+	FilterKey ed25519.PrivateKey
+	// false-positive rate of /v1/filter downloads built from scratch
+	FilterFPRate float64
+	// serves /v1/sync and /v2/oprf/sync, which hand every stored hash to
+	// any client with an admin API key
+	Sync bool
+	// limit on the number of hashes in one /v1/creds request
+	MaxBatchSize int
+	// number of hex characters clients send to /v1/range
+	RangePrefixLen int
+	// /v1/range responses are padded to a multiple of this many suffixes
+	RangePadding int
+	// limits of the http.Server; 0 means none
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	// time Serve gives in-flight requests to finish once its context is
+	// done; 0 means DefaultShutdownTimeout
+	ShutdownTimeout time.Duration
+	// the server started by Serve, and whether Shutdown has been called,
+	// so that a Serve that starts after it returns at once
+	mu           sync.Mutex
+	srv          *http.Server
+	shuttingDown bool
 }
 
-func (a *App) Initialize(db *sql.DB) {
-	a.DB = db
-	r := mux.NewRouter()
-	s := r.
+const DefaultShutdownTimeout = 15 * time.Second
+
+// store holds the hashes of DefaultParamSet; more sets can be added
+// with Register
+func (a *App) Initialize(store Store) {
+	a.Params = NewRegistry()
+	a.Params.Register(DefaultParamSet, store)
+	a.OPRF = NewRegistry()
+	if a.MaxBatchSize <= 0 {
+		a.MaxBatchSize = DefaultMaxBatchSize
+	}
+	if a.RangePrefixLen <= 0 {
+		a.RangePrefixLen = DefaultRangePrefixLen
+	}
+	if a.RangePadding <= 0 {
+		a.RangePadding = DefaultRangePadding
+	}
+	if a.FilterFPRate <= 0 {
+		a.FilterFPRate = DefaultFilterFPRate
+	}
+	a.Router = mux.NewRouter()
+	a.RouterV1 = a.Router.
 		PathPrefix("/v1").
 		Subrouter()
-	a.RouterV1 = s
+	a.RouterV2 = a.Router.
+		PathPrefix("/v2").
+		Subrouter()
+	a.RouterAdmin = a.Router.
+		PathPrefix("/admin").
+		Subrouter()
+	a.RouterV1.Use(a.rateLimitIP, a.authenticate, a.rateLimit)
+	a.RouterV2.Use(a.rateLimitIP, a.authenticate, a.rateLimit)
+	a.RouterAdmin.Use(a.rateLimitIP, a.authenticate, AdminMiddleware, a.rateLimit)
 	a.initializeRoutes()
 }
 
-func (a *App) Run(addr string) {
+func (a *App) Register(p ParamSet, store Store) {
+	a.Params.Register(p, store)
+}
+
+// store counts the password-only hashes made with p
+func (a *App) RegisterPasswords(p ParamSet, store PasswordStore) {
+	if a.Passwords == nil {
+		a.Passwords = make(map[string]PasswordStore)
+	}
+	a.Passwords[p.Name] = store
+}
+
+// store holds the OPRF outputs of hashes made with p
+func (a *App) RegisterOPRF(p ParamSet, store Store) {
+	a.OPRF.Register(p, store)
+}
+
+// listens on addr and serves until Shutdown is called
+func (a *App) Run(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return a.Serve(context.Background(), l)
+}
+
+// serves requests on l until ctx is done, then stops accepting new ones
+// and waits up to ShutdownTimeout for the rest to finish. Returns nil once
+// shut down, whether by ctx or by Shutdown; after Shutdown, it returns
+// without waiting for the requests Shutdown is draining.
+func (a *App) Serve(ctx context.Context, l net.Listener) error {
 	// https://github.com/gorilla/mux#graceful-shutdown
 	srv := &http.Server{
-		Addr:    addr,
-		Handler: a.RouterV1,
+		Handler:      a.Router,
+		ReadTimeout:  a.ReadTimeout,
+		WriteTimeout: a.WriteTimeout,
+		IdleTimeout:  a.IdleTimeout,
+	}
+	a.mu.Lock()
+	if a.shuttingDown {
+		a.mu.Unlock()
+		return l.Close()
 	}
-	log.Println("Starting CCDS server on", addr, "...")
+	a.srv = srv
+	a.mu.Unlock()
+	log.Println("Starting CCDS server on", l.Addr(), "...")
+	errc := make(chan error, 1)
 	go func() {
-		if err := srv.ListenAndServe(); err != nil {
-			log.Println(err)
-		}
+		errc <- srv.Serve(l)
 	}()
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-	<-c
-	wait, _ := time.ParseDuration("15s")
-	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	select {
+	case err := <-errc:
+		if err == http.ErrServerClosed {
+			return nil
+		}
+		return err
+	case <-ctx.Done():
+	}
+	wait := a.ShutdownTimeout
+	if wait <= 0 {
+		wait = DefaultShutdownTimeout
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), wait)
 	defer cancel()
+	return a.Shutdown(shutdownCtx)
+}
+
+// stops the server started by Serve: closes its listener, then waits
+// for in-flight requests to finish or for ctx to be done, whichever is
+// first; in the latter case the remaining connections are closed. Called
+// before Serve, it keeps Serve from starting.
+func (a *App) Shutdown(ctx context.Context) error {
+	a.mu.Lock()
+	a.shuttingDown = true
+	srv := a.srv
+	a.mu.Unlock()
+	if srv == nil {
+		return nil
+	}
 	log.Println("Shutting down CCDS server...")
-	srv.Shutdown(ctx)
-	os.Exit(0)
+	err := srv.Shutdown(ctx)
+	if err != nil && err == ctx.Err() {
+		srv.Close()
+	}
+	return err
 }
 
 func (a *App) initializeRoutes() {
 	a.RouterV1.HandleFunc("/cred", a.credHandler).Methods("POST")
+	a.RouterV1.HandleFunc("/creds", a.credsHandler).Methods("POST")
+	a.RouterV1.HandleFunc("/password", a.passwordHandler).Methods("POST")
+	a.RouterV1.HandleFunc("/range/{prefix}", a.rangeHandler).Methods("GET")
+	a.RouterV1.HandleFunc("/params", a.paramsHandler).Methods("GET")
+	a.RouterV1.HandleFunc("/stats", a.statsHandler).Methods("GET")
+	a.RouterV1.HandleFunc("/filter", a.filterHandler).Methods("GET")
+	// under /v1 as documented, but admin-only like the /admin routes
+	a.RouterV1.Handle("/sync", AdminMiddleware(http.HandlerFunc(a.syncHandler))).Methods("GET")
+	a.RouterV1.HandleFunc("/watch", a.watchHandler).Methods("POST")
+	a.RouterV1.HandleFunc("/watch", a.unwatchHandler).Methods("DELETE")
+	a.RouterV1.HandleFunc("/watch/webhook", a.webhookHandler).Methods("PUT")
+	a.RouterV1.HandleFunc("/blocklist", a.blocklistHandler).Methods("GET")
+	a.RouterV1.HandleFunc("/blocklist", a.addBlockedHandler).Methods("POST")
+	a.RouterV1.HandleFunc("/blocklist", a.removeBlockedHandler).Methods("DELETE")
+	a.RouterV1.HandleFunc("/jobs", a.submitJobHandler).Methods("POST")
+	a.RouterV1.HandleFunc("/jobs/{id}", a.jobHandler).Methods("GET")
+	a.RouterV1.HandleFunc("/jobs/{id}", a.deleteJobHandler).Methods("DELETE")
+	a.RouterV1.HandleFunc("/jobs/{id}/results", a.jobResultsHandler).Methods("GET")
+	a.RouterAdmin.HandleFunc("/stats", a.hitStatsHandler).Methods("GET")
+	a.RouterAdmin.HandleFunc("/canaries", a.addCanaryHandler).Methods("POST")
+	a.RouterAdmin.HandleFunc("/canaries", a.listCanariesHandler).Methods("GET")
+	a.RouterAdmin.HandleFunc("/canaries/{id}", a.deleteCanaryHandler).Methods("DELETE")
+	a.RouterV2.HandleFunc("/cred", a.credDetailsHandler).Methods("POST")
+	a.RouterV2.HandleFunc("/oprf/evaluate", a.oprfEvaluateHandler).Methods("POST")
+	a.RouterV2.HandleFunc("/oprf/range/{prefix}", a.oprfRangeHandler).Methods("GET")
+	a.RouterV2.Handle("/oprf/sync", AdminMiddleware(http.HandlerFunc(a.oprfSyncHandler))).Methods("GET")
+}
+
+func (a *App) authenticate(next http.Handler) http.Handler {
+	if a.APIKeys == nil {
+		return next
+	}
+	return AuthMiddleware(a.APIKeys, next)
+}
+
+func (a *App) rateLimitIP(next http.Handler) http.Handler {
+	if a.Limits == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, _ := mux.CurrentRoute(r).GetPathTemplate()
+		a.Limits.IPMiddleware(route, next).ServeHTTP(w, r)
+	})
+}
+
+func (a *App) rateLimit(next http.Handler) http.Handler {
+	if a.Limits == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, _ := mux.CurrentRoute(r).GetPathTemplate()
+		a.Limits.Middleware(route, next).ServeHTTP(w, r)
+	})
 }
 
 func (a *App) credHandler(w http.ResponseWriter, r *http.Request) {
-	CredHandler(w, r, a.DB)
+	CredHandler(w, r, a.Params, a.Canaries, a.Blocklist)
+}
+
+func (a *App) credDetailsHandler(w http.ResponseWriter, r *http.Request) {
+	CredDetailsHandler(w, r, a.Params, a.Canaries, a.Blocklist)
+}
+
+func (a *App) credsHandler(w http.ResponseWriter, r *http.Request) {
+	CredsHandler(w, r, a.Params, a.MaxBatchSize, a.Canaries, a.Blocklist)
+}
+
+func (a *App) passwordHandler(w http.ResponseWriter, r *http.Request) {
+	PasswordHandler(w, r, a.Params, a.Passwords)
+}
+
+func (a *App) rangeHandler(w http.ResponseWriter, r *http.Request) {
+	RangeHandler(w, mux.Vars(r)["prefix"], r.URL.Query().Get("params"), a.Params, 0, a.RangePrefixLen, a.RangePadding)
+}
+
+func (a *App) paramsHandler(w http.ResponseWriter, r *http.Request) {
+	ParamsHandler(w, a.Params)
+}
+
+func (a *App) statsHandler(w http.ResponseWriter, r *http.Request) {
+	StatsHandler(w, a.Params, a.OPRF)
+}
+
+func (a *App) hitStatsHandler(w http.ResponseWriter, r *http.Request) {
+	HitStatsHandler(w, r, a.Params)
+}
+
+func (a *App) addCanaryHandler(w http.ResponseWriter, r *http.Request) {
+	if a.Canaries == nil {
+		respondWithJSON(w, http.StatusNotImplemented, credErr{ErrCanariesDisabled.Error()})
+		return
+	}
+	AddCanaryHandler(w, r, a.Params, a.Canaries)
+}
+
+func (a *App) listCanariesHandler(w http.ResponseWriter, r *http.Request) {
+	if a.Canaries == nil {
+		respondWithJSON(w, http.StatusNotImplemented, credErr{ErrCanariesDisabled.Error()})
+		return
+	}
+	ListCanariesHandler(w, a.Canaries)
+}
+
+func (a *App) deleteCanaryHandler(w http.ResponseWriter, r *http.Request) {
+	if a.Canaries == nil {
+		respondWithJSON(w, http.StatusNotImplemented, credErr{ErrCanariesDisabled.Error()})
+		return
+	}
+	DeleteCanaryHandler(w, r, a.Canaries)
+}
+
+func (a *App) watchHandler(w http.ResponseWriter, r *http.Request) {
+	WatchHandler(w, r, a.Params, a.Watches, a.MaxBatchSize, a.Canaries)
+}
+
+func (a *App) unwatchHandler(w http.ResponseWriter, r *http.Request) {
+	UnwatchHandler(w, r, a.Params, a.Watches, a.MaxBatchSize)
+}
+
+func (a *App) webhookHandler(w http.ResponseWriter, r *http.Request) {
+	WebhookHandler(w, r, a.Watches)
+}
+
+func (a *App) blocklistHandler(w http.ResponseWriter, r *http.Request) {
+	BlocklistHandler(w, r, a.Params, a.Blocklist)
+}
+
+func (a *App) addBlockedHandler(w http.ResponseWriter, r *http.Request) {
+	AddBlockedHandler(w, r, a.Params, a.Blocklist, a.MaxBatchSize)
+}
+
+func (a *App) removeBlockedHandler(w http.ResponseWriter, r *http.Request) {
+	RemoveBlockedHandler(w, r, a.Params, a.Blocklist, a.MaxBatchSize)
+}
+
+func (a *App) submitJobHandler(w http.ResponseWriter, r *http.Request) {
+	if a.Jobs == nil {
+		respondWithJSON(w, http.StatusNotImplemented, credErr{ErrJobsDisabled.Error()})
+		return
+	}
+	SubmitJobHandler(w, r, a.Jobs)
+}
+
+func (a *App) jobHandler(w http.ResponseWriter, r *http.Request) {
+	if a.Jobs == nil {
+		respondWithJSON(w, http.StatusNotImplemented, credErr{ErrJobsDisabled.Error()})
+		return
+	}
+	JobHandler(w, r, a.Jobs)
+}
+
+func (a *App) jobResultsHandler(w http.ResponseWriter, r *http.Request) {
+	if a.Jobs == nil {
+		respondWithJSON(w, http.StatusNotImplemented, credErr{ErrJobsDisabled.Error()})
+		return
+	}
+	JobResultsHandler(w, r, a.Jobs)
+}
+
+func (a *App) deleteJobHandler(w http.ResponseWriter, r *http.Request) {
+	if a.Jobs == nil {
+		respondWithJSON(w, http.StatusNotImplemented, credErr{ErrJobsDisabled.Error()})
+		return
+	}
+	DeleteJobHandler(w, r, a.Jobs)
+}
+
+func (a *App) filterHandler(w http.ResponseWriter, r *http.Request) {
+	FilterHandler(w, r.URL.Query().Get("params"), a.Params, a.FilterKey, a.FilterFPRate)
+}
+
+func (a *App) oprfEvaluateHandler(w http.ResponseWriter, r *http.Request) {
+	OPRFEvaluateHandler(w, r, a.OPRFKey, a.MaxBatchSize)
+}
+
+func (a *App) oprfRangeHandler(w http.ResponseWriter, r *http.Request) {
+	if a.OPRFKey == nil {
+		respondWithJSON(w, http.StatusNotImplemented, credErr{ErrOPRFDisabled.Error()})
+		return
+	}
+	RangeHandler(w, mux.Vars(r)["prefix"], r.URL.Query().Get("params"), a.OPRF, OPRFOutputLen, a.RangePrefixLen, a.RangePadding)
+}
+
+func (a *App) syncHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.Sync {
+		respondWithJSON(w, http.StatusNotImplemented, credErr{ErrSyncDisabled.Error()})
+		return
+	}
+	SyncHandler(w, r, a.Params)
+}
+
+func (a *App) oprfSyncHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.Sync {
+		respondWithJSON(w, http.StatusNotImplemented, credErr{ErrSyncDisabled.Error()})
+		return
+	}
+	SyncHandler(w, r, a.OPRF)
 }
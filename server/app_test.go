@@ -0,0 +1,129 @@
+package server
+
+import (
+  "context"
+  "net"
+  "net/http"
+  "testing"
+  "time"
+)
+
+// serves a on a random port with a /slow route that blocks until release
+// is closed
+func serveSlow(t *testing.T, a *App, ctx context.Context) (addr string, started, release chan struct{}, served chan error) {
+  a.Initialize(NewMemStore())
+  started = make(chan struct{})
+  release = make(chan struct{})
+  a.Router.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+    close(started)
+    <-release
+    w.WriteHeader(http.StatusNoContent)
+  })
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  served = make(chan error, 1)
+  go func() {
+    served <- a.Serve(ctx, l)
+  }()
+  return "http://" + l.Addr().String(), started, release, served
+}
+
+func TestServeDrainsOnCancel(t *testing.T) {
+  var a App
+  ctx, cancel := context.WithCancel(context.Background())
+  addr, started, release, served := serveSlow(t, &a, ctx)
+  codes := make(chan int, 1)
+  go func() {
+    res, err := http.Get(addr + "/slow")
+    if err != nil {
+      codes <- 0
+      return
+    }
+    res.Body.Close()
+    codes <- res.StatusCode
+  }()
+  <-started
+  cancel()
+  select {
+  case err := <-served:
+    t.Fatalf("Expected Serve to wait for the in-flight request. Got %v\n", err)
+  case <-time.After(50 * time.Millisecond):
+  }
+  close(release)
+  if code := <-codes; code != http.StatusNoContent {
+    t.Errorf("Expected the in-flight request to finish with 204. Got %d\n", code)
+  }
+  if err := <-served; err != nil {
+    t.Errorf("Expected a clean shutdown. Got %v\n", err)
+  }
+  if _, err := http.Get(addr + "/slow"); err == nil {
+    t.Error("Expected new connections to be refused after shutdown")
+  }
+}
+
+func TestServeShutdownTimeout(t *testing.T) {
+  a := App{ShutdownTimeout: 20 * time.Millisecond}
+  ctx, cancel := context.WithCancel(context.Background())
+  addr, started, release, served := serveSlow(t, &a, ctx)
+  defer close(release)
+  errs := make(chan error, 1)
+  go func() {
+    res, err := http.Get(addr + "/slow")
+    if err == nil {
+      res.Body.Close()
+    }
+    errs <- err
+  }()
+  <-started
+  cancel()
+  if err := <-served; err != context.DeadlineExceeded {
+    t.Errorf("Expected the drain to time out. Got %v\n", err)
+  }
+  // the request still in flight has its connection closed
+  select {
+  case err := <-errs:
+    if err == nil {
+      t.Error("Expected the in-flight request to fail")
+    }
+  case <-time.After(time.Second):
+    t.Error("Expected the in-flight connection to be closed after the timeout")
+  }
+}
+
+func TestShutdown(t *testing.T) {
+  var a App
+  addr, _, release, served := serveSlow(t, &a, context.Background())
+  close(release)
+  if res, err := http.Get(addr + "/slow"); err != nil {
+    t.Fatal(err)
+  } else {
+    res.Body.Close()
+  }
+  if err := a.Shutdown(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+  if err := <-served; err != nil {
+    t.Errorf("Expected Serve to return nil after Shutdown. Got %v\n", err)
+  }
+}
+
+func TestShutdownBeforeServe(t *testing.T) {
+  var a App
+  if err := a.Shutdown(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+  addr, _, _, served := serveSlow(t, &a, context.Background())
+  select {
+  case err := <-served:
+    if err != nil {
+      t.Errorf("Expected Serve to return nil after Shutdown. Got %v\n", err)
+    }
+  case <-time.After(time.Second):
+    t.Fatal("Expected Serve to return at once after Shutdown")
+  }
+  if _, err := http.Get(addr + "/slow"); err == nil {
+    t.Error("Expected the listener to be closed")
+  }
+}
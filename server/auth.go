@@ -0,0 +1,272 @@
+package server
+
+import (
+  "context"
+  "crypto/rand"
+  "crypto/sha256"
+  "database/sql"
+  "encoding/base64"
+  "encoding/hex"
+  "errors"
+  "net/http"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+)
+
+const APIKeyTable = "api_key"
+const APIKeyTableCreate = `
+  CREATE TABLE IF NOT EXISTS ` + APIKeyTable + ` (
+    id char(16) NOT NULL,
+    tenant varchar(64) NOT NULL,
+    hash binary(32) NOT NULL,
+    created datetime NOT NULL,
+    revoked tinyint(1) NOT NULL DEFAULT '0',
+    admin tinyint(1) NOT NULL DEFAULT '0',
+    PRIMARY KEY (id),
+    UNIQUE KEY hash_UNIQUE (hash)
+  ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+`
+
+// prefix of every API key, so leaked keys are easy to grep for
+const apiKeyPrefix = "ccds_"
+
+var ErrUnknownAPIKey = errors.New("Missing, unknown or revoked API key.")
+
+var ErrNotAdmin = errors.New("This endpoint requires an admin API key.")
+
+type apiKeyKey struct{}
+
+// APIKey identifies a tenant. Only the SHA-256 of the key is stored; the
+// key itself is shown once, when it is created.
+type APIKey struct{
+  ID      string    `json:"id"`
+  Tenant  string    `json:"tenant"`
+  Hash    []byte    `json:"-"`
+  Created time.Time `json:"created"`
+  Revoked bool      `json:"revoked"`
+  // may use the /admin endpoints
+  Admin   bool      `json:"admin"`
+}
+
+type APIKeyStore interface {
+  InsertAPIKey(k APIKey) error
+  // returns ErrUnknownAPIKey unless an unrevoked key has hash
+  LookupAPIKey(hash []byte) (APIKey, error)
+  ListAPIKeys() ([]APIKey, error)
+  RevokeAPIKey(id string) error
+  CreateTables() error
+}
+
+// generates a key for tenant and stores its hash
+func CreateAPIKey(store APIKeyStore, tenant string) (string, APIKey, error) {
+  return createAPIKey(store, tenant, false)
+}
+
+// like CreateAPIKey, but the key may also use the /admin endpoints
+func CreateAdminAPIKey(store APIKeyStore, tenant string) (string, APIKey, error) {
+  return createAPIKey(store, tenant, true)
+}
+
+func createAPIKey(store APIKeyStore, tenant string, admin bool) (key string, k APIKey, err error) {
+  if tenant == "" || len(tenant) > 64 {
+    return "", k, errors.New("Tenant names must be between 1 and 64 characters.")
+  }
+  secret := make([]byte, 32)
+  id := make([]byte, 8)
+  if _, err = rand.Read(secret); err != nil {
+    return
+  }
+  if _, err = rand.Read(id); err != nil {
+    return
+  }
+  key = apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+  k = APIKey{
+    ID: hex.EncodeToString(id),
+    Tenant: tenant,
+    Hash: HashAPIKey(key),
+    Created: time.Now().UTC().Truncate(time.Second),
+    Admin: admin,
+  }
+  err = store.InsertAPIKey(k)
+  return
+}
+
+// keys are random, so an unsalted hash is enough
+func HashAPIKey(key string) []byte {
+  sum := sha256.Sum256([]byte(key))
+  return sum[:]
+}
+
+// returns the key attached by AuthMiddleware, if any
+func APIKeyFromContext(ctx context.Context) (APIKey, bool) {
+  k, ok := ctx.Value(apiKeyKey{}).(APIKey)
+  return k, ok
+}
+
+// returns the tenant of the key attached by AuthMiddleware, if any
+func TenantFromContext(ctx context.Context) (string, bool) {
+  k, ok := APIKeyFromContext(ctx)
+  return k.Tenant, ok
+}
+
+func WithAPIKey(ctx context.Context, k APIKey) context.Context {
+  return context.WithValue(ctx, apiKeyKey{}, k)
+}
+
+// rejects requests without a valid "Authorization: Bearer <key>" header and
+// attaches the key, and so its tenant, to the request context
+func AuthMiddleware(store APIKeyStore, next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    auth := r.Header.Get("Authorization")
+    if !strings.HasPrefix(auth, "Bearer ") {
+      respondUnauthorized(w)
+      return
+    }
+    k, err := store.LookupAPIKey(HashAPIKey(strings.TrimPrefix(auth, "Bearer ")))
+    if err == ErrUnknownAPIKey {
+      respondUnauthorized(w)
+      return
+    }
+    if err != nil {
+      respondWithJSON(w, http.StatusInternalServerError, credErr{err.Error()})
+      return
+    }
+    next.ServeHTTP(w, r.WithContext(WithAPIKey(r.Context(), k)))
+  })
+}
+
+// rejects requests that AuthMiddleware didn't attach an admin key to;
+// so with authentication disabled, every request is rejected
+func AdminMiddleware(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    k, ok := APIKeyFromContext(r.Context())
+    if !ok || !k.Admin {
+      respondWithJSON(w, http.StatusForbidden, credErr{ErrNotAdmin.Error()})
+      return
+    }
+    next.ServeHTTP(w, r)
+  })
+}
+
+func respondUnauthorized(w http.ResponseWriter) {
+  w.Header().Set("WWW-Authenticate", "Bearer")
+  respondWithJSON(w, http.StatusUnauthorized, credErr{ErrUnknownAPIKey.Error()})
+}
+
+// MySQLAPIKeyStore keeps API keys in APIKeyTable.
+type MySQLAPIKeyStore struct{
+  DB *sql.DB
+}
+
+func NewMySQLAPIKeyStore(db *sql.DB) *MySQLAPIKeyStore {
+  return &MySQLAPIKeyStore{db}
+}
+
+func (s *MySQLAPIKeyStore) InsertAPIKey(k APIKey) (err error) {
+  _, err = s.DB.Exec("INSERT INTO " + APIKeyTable + " (id, tenant, hash, created, revoked, admin) VALUES (?, ?, ?, ?, ?, ?)", k.ID, k.Tenant, k.Hash, k.Created, k.Revoked, k.Admin)
+  return
+}
+
+func (s *MySQLAPIKeyStore) LookupAPIKey(hash []byte) (k APIKey, err error) {
+  err = s.DB.QueryRow("SELECT id, tenant, hash, created, revoked, admin FROM " + APIKeyTable + " WHERE hash=? AND revoked=0", hash).Scan(&k.ID, &k.Tenant, &k.Hash, &k.Created, &k.Revoked, &k.Admin)
+  if err == sql.ErrNoRows {
+    err = ErrUnknownAPIKey
+  }
+  return
+}
+
+func (s *MySQLAPIKeyStore) ListAPIKeys() (keys []APIKey, err error) {
+  rows, err := s.DB.Query("SELECT id, tenant, hash, created, revoked, admin FROM " + APIKeyTable + " ORDER BY created")
+  if err != nil {
+    return
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var k APIKey
+    if err = rows.Scan(&k.ID, &k.Tenant, &k.Hash, &k.Created, &k.Revoked, &k.Admin); err != nil {
+      return nil, err
+    }
+    keys = append(keys, k)
+  }
+  return keys, rows.Err()
+}
+
+func (s *MySQLAPIKeyStore) RevokeAPIKey(id string) error {
+  res, err := s.DB.Exec("UPDATE " + APIKeyTable + " SET revoked=1 WHERE id=?", id)
+  if err != nil {
+    return err
+  }
+  n, err := res.RowsAffected()
+  if err == nil && n == 0 {
+    err = errors.New("No API key with id " + id + ".")
+  }
+  return err
+}
+
+func (s *MySQLAPIKeyStore) CreateTables() (err error) {
+  _, err = s.DB.Exec(APIKeyTableCreate)
+  if err != nil {
+    return
+  }
+  // tables created before admin keys lack admin
+  return addColumnIfMissing(s.DB, APIKeyTable, "admin", "tinyint(1) NOT NULL DEFAULT '0'")
+}
+
+// MemAPIKeyStore keeps API keys in memory.
+type MemAPIKeyStore struct{
+  mu   sync.RWMutex
+  keys map[string]APIKey // by ID
+}
+
+func NewMemAPIKeyStore() *MemAPIKeyStore {
+  return &MemAPIKeyStore{keys: make(map[string]APIKey)}
+}
+
+func (s *MemAPIKeyStore) InsertAPIKey(k APIKey) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  s.keys[k.ID] = k
+  return nil
+}
+
+func (s *MemAPIKeyStore) LookupAPIKey(hash []byte) (APIKey, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+  for _, k := range s.keys {
+    if !k.Revoked && string(k.Hash) == string(hash) {
+      return k, nil
+    }
+  }
+  return APIKey{}, ErrUnknownAPIKey
+}
+
+func (s *MemAPIKeyStore) ListAPIKeys() ([]APIKey, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+  keys := make([]APIKey, 0, len(s.keys))
+  for _, k := range s.keys {
+    keys = append(keys, k)
+  }
+  sort.Slice(keys, func(i, j int) bool {
+    return keys[i].Created.Before(keys[j].Created)
+  })
+  return keys, nil
+}
+
+func (s *MemAPIKeyStore) RevokeAPIKey(id string) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  k, ok := s.keys[id]
+  if !ok {
+    return errors.New("No API key with id " + id + ".")
+  }
+  k.Revoked = true
+  s.keys[id] = k
+  return nil
+}
+
+func (s *MemAPIKeyStore) CreateTables() error {
+  return nil
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+  "net/http"
+  "net/http/httptest"
+  "testing"
+)
+
+func TestAuthMiddleware(t *testing.T) {
+  store := NewMemAPIKeyStore()
+  key, k, err := CreateAPIKey(store, "acme")
+  if err != nil {
+    t.Fatal(err)
+  }
+  var tenant string
+  h := AuthMiddleware(store, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    tenant, _ = TenantFromContext(r.Context())
+  }))
+  checkAuth := func(header string, expected int) {
+    req := httptest.NewRequest("GET", "/v1/params", nil)
+    if header != "" {
+      req.Header.Set("Authorization", header)
+    }
+    rr := httptest.NewRecorder()
+    h.ServeHTTP(rr, req)
+    if rr.Code != expected {
+      t.Errorf("%q: expected response code %d. Got %d\n", header, expected, rr.Code)
+    }
+  }
+  checkAuth("", http.StatusUnauthorized)
+  checkAuth("Bearer ccds_nope", http.StatusUnauthorized)
+  checkAuth("Bearer " + key, http.StatusOK)
+  if tenant != "acme" {
+    t.Errorf("Expected tenant acme in the request context. Got %q\n", tenant)
+  }
+  err = store.RevokeAPIKey(k.ID)
+  if err != nil {
+    t.Fatal(err)
+  }
+  checkAuth("Bearer " + key, http.StatusUnauthorized)
+}
@@ -0,0 +1,382 @@
+package server
+
+import (
+  "crypto/rand"
+  "database/sql"
+  "errors"
+  "net/http"
+  "strconv"
+  "strings"
+  "sync"
+)
+
+const BlocklistTable = "tenant_blocklist"
+const BlocklistTableCreate = `
+  CREATE TABLE IF NOT EXISTS ` + BlocklistTable + ` (
+    tenant varchar(64) NOT NULL,
+    params varchar(64) NOT NULL,
+    hash varbinary(255) NOT NULL,
+    created datetime NOT NULL,
+    PRIMARY KEY (tenant, params, hash)
+  ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+`
+
+const BlocklistSaltTable = "tenant_salt"
+const BlocklistSaltTableCreate = `
+  CREATE TABLE IF NOT EXISTS ` + BlocklistSaltTable + ` (
+    tenant varchar(64) NOT NULL,
+    salt binary(16) NOT NULL,
+    PRIMARY KEY (tenant)
+  ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+`
+
+// values of CredRes.MatchedBy
+const (
+  MatchedGlobal = "global"
+  MatchedTenant = "tenant"
+)
+
+const blocklistSaltLen = 16
+
+var ErrBlocklistDisabled = errors.New("Blocklists are not enabled on this server.")
+
+// BlocklistStore keeps each tenant's blocked passwords, such as its
+// company and product names, which never show up in public dumps. They are
+// stored as Argon2 hashes of the password alone, salted with a random salt
+// per tenant, so a tenant's hashes are useless against any other's.
+type BlocklistStore interface {
+  // returns tenant's salt, creating it on first use
+  TenantSalt(tenant string) ([]byte, error)
+  AddBlocked(tenant, params string, hashes [][]byte) error
+  RemoveBlocked(tenant, params string, hashes [][]byte) error
+  // returns which of hashes tenant blocks
+  LookupBlocked(tenant, params string, hashes [][]byte) ([]bool, error)
+  CountBlocked(tenant, params string) (int64, error)
+  CreateTables() error
+}
+
+type BlocklistRes struct{
+  // hash passwords with this salt (in the request's encoding) and the
+  // parameter set Params
+  Salt    string `json:"salt"`
+  Params  string `json:"params"`
+  Blocked int64  `json:"blocked"`
+}
+
+// looks up the password hashes of a request in the tenant's blocklist.
+// Returns nil if there is no blocklist, tenant or password hash to check.
+func checkBlocklist(r *http.Request, blocklist BlocklistStore, p ParamSet, encoding string, passwordHashes []string) (blocked []bool, err error) {
+  tenant, ok := TenantFromContext(r.Context())
+  if blocklist == nil || !ok || len(passwordHashes) == 0 {
+    return
+  }
+  var hashes [][]byte
+  var indexes []int
+  for i, encoded := range passwordHashes {
+    if encoded == "" {
+      continue
+    }
+    hash, err := DecodeHash(encoded, encoding, int(p.KeyLen))
+    if err != nil {
+      return nil, errors.New("Password hash " + strconv.Itoa(i) + ": " + err.Error())
+    }
+    hashes = append(hashes, hash)
+    indexes = append(indexes, i)
+  }
+  found, err := blocklist.LookupBlocked(tenant, p.Name, hashes)
+  if err != nil {
+    return
+  }
+  blocked = make([]bool, len(passwordHashes))
+  for i, index := range indexes {
+    blocked[index] = found[i]
+  }
+  return
+}
+
+// global matches take precedence, since they are the stronger signal
+func matchedBy(global, tenant bool) string {
+  switch {
+  case global:
+    return MatchedGlobal
+  case tenant:
+    return MatchedTenant
+  }
+  return ""
+}
+
+// serves ?params=name&encoding=hex with the tenant's salt
+func BlocklistHandler(w http.ResponseWriter, r *http.Request, registry *Registry, blocklist BlocklistStore) {
+  tenant, ok := blocklistTenant(w, r, blocklist)
+  if !ok {
+    return
+  }
+  query := r.URL.Query()
+  p, _, err := registry.Get(query.Get("params"))
+  if err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{err.Error()})
+    return
+  }
+  encoding := query.Get("encoding")
+  if encoding == "" || encoding == EncodingUTF8 {
+    encoding = EncodingHex
+  }
+  salt, err := blocklist.TenantSalt(tenant)
+  if err != nil {
+    respondWithJSON(w, http.StatusInternalServerError, credErr{err.Error()})
+    return
+  }
+  encoded, err := EncodeHash(salt, encoding)
+  if err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{err.Error()})
+    return
+  }
+  blocked, err := blocklist.CountBlocked(tenant, p.Name)
+  if err != nil {
+    respondWithJSON(w, http.StatusInternalServerError, credErr{err.Error()})
+    return
+  }
+  respondWithJSON(w, http.StatusOK, BlocklistRes{encoded, p.Name, blocked})
+}
+
+// adds hashes made with the tenant's salt to its blocklist
+func AddBlockedHandler(w http.ResponseWriter, r *http.Request, registry *Registry, blocklist BlocklistStore, maxBatchSize int) {
+  tenant, p, hashes, ok := decodeBlocklistReq(w, r, registry, blocklist, maxBatchSize)
+  if !ok {
+    return
+  }
+  if err := blocklist.AddBlocked(tenant, p.Name, hashes); err != nil {
+    respondWithJSON(w, http.StatusInternalServerError, credErr{err.Error()})
+    return
+  }
+  w.WriteHeader(http.StatusNoContent)
+}
+
+func RemoveBlockedHandler(w http.ResponseWriter, r *http.Request, registry *Registry, blocklist BlocklistStore, maxBatchSize int) {
+  tenant, p, hashes, ok := decodeBlocklistReq(w, r, registry, blocklist, maxBatchSize)
+  if !ok {
+    return
+  }
+  if err := blocklist.RemoveBlocked(tenant, p.Name, hashes); err != nil {
+    respondWithJSON(w, http.StatusInternalServerError, credErr{err.Error()})
+    return
+  }
+  w.WriteHeader(http.StatusNoContent)
+}
+
+// responds with an error and returns false if blocklists are disabled or
+// the request has no tenant
+func blocklistTenant(w http.ResponseWriter, r *http.Request, blocklist BlocklistStore) (string, bool) {
+  if blocklist == nil {
+    respondWithJSON(w, http.StatusNotImplemented, credErr{ErrBlocklistDisabled.Error()})
+    return "", false
+  }
+  tenant, ok := TenantFromContext(r.Context())
+  if !ok {
+    respondWithJSON(w, http.StatusForbidden, credErr{"Blocklists require an API key."})
+  }
+  return tenant, ok
+}
+
+// responds with an error and returns false if the request is invalid
+func decodeBlocklistReq(w http.ResponseWriter, r *http.Request, registry *Registry, blocklist BlocklistStore, maxBatchSize int) (tenant string, p ParamSet, hashes [][]byte, ok bool) {
+  tenant, ok = blocklistTenant(w, r, blocklist)
+  if !ok {
+    return
+  }
+  ok = false
+  var req CredsReqBody
+  err := DecodeBody(r.Body, &req)
+  if err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{"An error occurred parsing the request body"})
+    return
+  }
+  if len(req.Hashes) > maxBatchSize {
+    respondWithJSON(w, http.StatusRequestEntityTooLarge, credErr{"Expected at most " + strconv.Itoa(maxBatchSize) + " hashes. Got " + strconv.Itoa(len(req.Hashes)) + "."})
+    return
+  }
+  p, _, err = registry.Get(req.Params)
+  if err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{err.Error()})
+    return
+  }
+  hashes = make([][]byte, len(req.Hashes))
+  for i, encoded := range req.Hashes {
+    hashes[i], err = DecodeHash(encoded, req.Encoding, int(p.KeyLen))
+    if err != nil {
+      respondWithJSON(w, http.StatusBadRequest, credErr{"Hash " + strconv.Itoa(i) + ": " + err.Error()})
+      return
+    }
+  }
+  return tenant, p, hashes, true
+}
+
+func newBlocklistSalt() ([]byte, error) {
+  salt := make([]byte, blocklistSaltLen)
+  _, err := rand.Read(salt)
+  return salt, err
+}
+
+// MySQLBlocklistStore keeps blocklists in BlocklistTable and salts in
+// BlocklistSaltTable.
+type MySQLBlocklistStore struct{
+  DB *sql.DB
+}
+
+func NewMySQLBlocklistStore(db *sql.DB) *MySQLBlocklistStore {
+  return &MySQLBlocklistStore{db}
+}
+
+func (s *MySQLBlocklistStore) TenantSalt(tenant string) ([]byte, error) {
+  return tenantSalt(s.DB, "INSERT IGNORE INTO", tenant)
+}
+
+// returns tenant's salt, creating it with insert, which must skip a salt
+// that is already there
+func tenantSalt(db *sql.DB, insert, tenant string) (salt []byte, err error) {
+  err = db.QueryRow("SELECT salt FROM " + BlocklistSaltTable + " WHERE tenant=?", tenant).Scan(&salt)
+  if err != sql.ErrNoRows {
+    return
+  }
+  if salt, err = newBlocklistSalt(); err != nil {
+    return
+  }
+  // a concurrent request may have created it first
+  if _, err = db.Exec(insert + " " + BlocklistSaltTable + " (tenant, salt) VALUES (?, ?)", tenant, salt); err != nil {
+    return
+  }
+  err = db.QueryRow("SELECT salt FROM " + BlocklistSaltTable + " WHERE tenant=?", tenant).Scan(&salt)
+  return
+}
+
+func (s *MySQLBlocklistStore) AddBlocked(tenant, params string, hashes [][]byte) error {
+  return insertTenantHashes(s.DB, "INSERT IGNORE INTO", BlocklistTable, tenant, params, hashes)
+}
+
+func (s *MySQLBlocklistStore) RemoveBlocked(tenant, params string, hashes [][]byte) error {
+  for start := 0; start < len(hashes); start += searchChunkSize {
+    chunk := hashes[start:minInt(start + searchChunkSize, len(hashes))]
+    args := []interface{}{tenant, params}
+    for _, hash := range chunk {
+      args = append(args, hash)
+    }
+    placeholders := strings.TrimSuffix(strings.Repeat("?,", len(chunk)), ",")
+    _, err := s.DB.Exec("DELETE FROM " + BlocklistTable + " WHERE tenant=? AND params=? AND hash IN (" + placeholders + ")", args...)
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func (s *MySQLBlocklistStore) LookupBlocked(tenant, params string, hashes [][]byte) ([]bool, error) {
+  blocked := make(map[string]bool)
+  for start := 0; start < len(hashes); start += searchChunkSize {
+    chunk := hashes[start:minInt(start + searchChunkSize, len(hashes))]
+    args := []interface{}{tenant, params}
+    for _, hash := range chunk {
+      args = append(args, hash)
+    }
+    placeholders := strings.TrimSuffix(strings.Repeat("?,", len(chunk)), ",")
+    rows, err := s.DB.Query("SELECT hash FROM " + BlocklistTable + " WHERE tenant=? AND params=? AND hash IN (" + placeholders + ")", args...)
+    if err != nil {
+      return nil, err
+    }
+    for rows.Next() {
+      var hash []byte
+      if err = rows.Scan(&hash); err != nil {
+        rows.Close()
+        return nil, err
+      }
+      blocked[string(hash)] = true
+    }
+    err = rows.Err()
+    rows.Close()
+    if err != nil {
+      return nil, err
+    }
+  }
+  found := make([]bool, len(hashes))
+  for i, hash := range hashes {
+    found[i] = blocked[string(hash)]
+  }
+  return found, nil
+}
+
+func (s *MySQLBlocklistStore) CountBlocked(tenant, params string) (n int64, err error) {
+  err = s.DB.QueryRow("SELECT COUNT(*) FROM " + BlocklistTable + " WHERE tenant=? AND params=?", tenant, params).Scan(&n)
+  return
+}
+
+func (s *MySQLBlocklistStore) CreateTables() error {
+  return execAll(s.DB, BlocklistTableCreate, BlocklistSaltTableCreate)
+}
+
+// MemBlocklistStore keeps blocklists in memory.
+type MemBlocklistStore struct{
+  mu      sync.Mutex
+  salts   map[string][]byte
+  // by tenant + "/" + params and then string(hash)
+  blocked map[string]map[string]bool
+}
+
+func NewMemBlocklistStore() *MemBlocklistStore {
+  return &MemBlocklistStore{salts: make(map[string][]byte), blocked: make(map[string]map[string]bool)}
+}
+
+func (s *MemBlocklistStore) TenantSalt(tenant string) ([]byte, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if salt, ok := s.salts[tenant]; ok {
+    return salt, nil
+  }
+  salt, err := newBlocklistSalt()
+  if err != nil {
+    return nil, err
+  }
+  s.salts[tenant] = salt
+  return salt, nil
+}
+
+func (s *MemBlocklistStore) AddBlocked(tenant, params string, hashes [][]byte) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  blocked, ok := s.blocked[tenant + "/" + params]
+  if !ok {
+    blocked = make(map[string]bool)
+    s.blocked[tenant + "/" + params] = blocked
+  }
+  for _, hash := range hashes {
+    blocked[string(hash)] = true
+  }
+  return nil
+}
+
+func (s *MemBlocklistStore) RemoveBlocked(tenant, params string, hashes [][]byte) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  for _, hash := range hashes {
+    delete(s.blocked[tenant + "/" + params], string(hash))
+  }
+  return nil
+}
+
+func (s *MemBlocklistStore) LookupBlocked(tenant, params string, hashes [][]byte) ([]bool, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  found := make([]bool, len(hashes))
+  for i, hash := range hashes {
+    found[i] = s.blocked[tenant + "/" + params][string(hash)]
+  }
+  return found, nil
+}
+
+func (s *MemBlocklistStore) CountBlocked(tenant, params string) (int64, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  return int64(len(s.blocked[tenant + "/" + params])), nil
+}
+
+func (s *MemBlocklistStore) CreateTables() error {
+  return nil
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+  "bytes"
+  "encoding/hex"
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+)
+
+func TestBlocklistIsPerTenant(t *testing.T) {
+  apiKeys := NewMemAPIKeyStore()
+  acmeKey, _, _ := CreateAPIKey(apiKeys, "acme")
+  globexKey, _, _ := CreateAPIKey(apiKeys, "globex")
+  blocklist := NewMemBlocklistStore()
+  a := App{APIKeys: apiKeys, Blocklist: blocklist}
+  a.Initialize(NewMemStore())
+  do := func(method, path, key string, body interface{}) *httptest.ResponseRecorder {
+    b, _ := json.Marshal(body)
+    req := httptest.NewRequest(method, path, bytes.NewBuffer(b))
+    req.Header.Set("Authorization", "Bearer " + key)
+    rr := httptest.NewRecorder()
+    a.Router.ServeHTTP(rr, req)
+    return rr
+  }
+  var acme, globex BlocklistRes
+  json.Unmarshal(do("GET", "/v1/blocklist", acmeKey, nil).Body.Bytes(), &acme)
+  json.Unmarshal(do("GET", "/v1/blocklist", globexKey, nil).Body.Bytes(), &globex)
+  if acme.Salt == "" || acme.Salt == globex.Salt {
+    t.Fatalf("Expected a distinct salt per tenant. Got %q and %q\n", acme.Salt, globex.Salt)
+  }
+  blocked := hex.EncodeToString(randomHash(t))
+  if rr := do("POST", "/v1/blocklist", acmeKey, CredsReqBody{Hashes: []string{blocked}, Encoding: EncodingHex}); rr.Code != http.StatusNoContent {
+    t.Fatalf("Expected response code 204. Got %d\n", rr.Code)
+  }
+  check := CredsReqBody{
+    Hashes: []string{hex.EncodeToString(randomHash(t)), hex.EncodeToString(randomHash(t))},
+    PasswordHashes: []string{blocked},
+    Encoding: EncodingHex,
+  }
+  var res CredsRes
+  json.Unmarshal(do("POST", "/v1/creds", acmeKey, check).Body.Bytes(), &res)
+  if !res.Results[0].Compromised || res.Results[0].MatchedBy != MatchedTenant || res.Results[1].Compromised {
+    t.Errorf("Expected only the first credential to match the tenant's blocklist. Got %+v\n", res)
+  }
+  json.Unmarshal(do("POST", "/v1/creds", globexKey, check).Body.Bytes(), &res)
+  if res.Results[0].Compromised {
+    t.Errorf("Expected another tenant's blocklist not to apply. Got %+v\n", res)
+  }
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+  "crypto/sha256"
+  "encoding/binary"
+  "math"
+)
+
+// Bloom is a Bloom filter over fixed-width hashes. Stored hashes are
+// Argon2, HMAC or OPRF outputs and already uniformly distributed, so bit
+// positions are taken straight from their bytes.
+type Bloom struct{
+  bits []uint64
+  // number of bits
+  m    uint64
+  // number of bit positions per hash
+  k    uint32
+}
+
+// sizes a filter for n hashes with the given false-positive rate
+func NewBloom(n int64, fpRate float64) *Bloom {
+  if n < 1 {
+    n = 1
+  }
+  if fpRate <= 0 || fpRate >= 1 {
+    fpRate = DefaultFilterFPRate
+  }
+  m := uint64(math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+  // round up to whole words
+  m = (m + 63) / 64 * 64
+  k := uint32(math.Round(float64(m) / float64(n) * math.Ln2))
+  if k < 1 {
+    k = 1
+  }
+  return &Bloom{make([]uint64, m / 64), m, k}
+}
+
+// uses double hashing over the first 16 bytes of hash; shorter hashes
+// are run through SHA-256 first
+func (b *Bloom) positions(hash []byte, fn func(pos uint64) bool) {
+  if len(hash) < 16 {
+    sum := sha256.Sum256(hash)
+    hash = sum[:]
+  }
+  h1 := binary.LittleEndian.Uint64(hash[:8])
+  h2 := binary.LittleEndian.Uint64(hash[8:16]) | 1
+  for i := uint32(0); i < b.k; i += 1 {
+    if !fn((h1 + uint64(i) * h2) % b.m) {
+      return
+    }
+  }
+}
+
+func (b *Bloom) Add(hash []byte) {
+  b.positions(hash, func(pos uint64) bool {
+    b.bits[pos / 64] |= 1 << (pos % 64)
+    return true
+  })
+}
+
+// false means hash was never added; true means it probably was
+func (b *Bloom) Test(hash []byte) (ok bool) {
+  ok = true
+  b.positions(hash, func(pos uint64) bool {
+    ok = b.bits[pos / 64] & (1 << (pos % 64)) != 0
+    return ok
+  })
+  return
+}
+
+// size of the filter in bytes
+func (b *Bloom) Size() int64 {
+  return int64(len(b.bits)) * 8
+}
+
+// expected false-positive rate once n hashes have been added
+func (b *Bloom) FPRate(n int64) float64 {
+  return math.Pow(1 - math.Exp(-float64(b.k) * float64(n) / float64(b.m)), float64(b.k))
+}
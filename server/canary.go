@@ -0,0 +1,414 @@
+package server
+
+import (
+  "bytes"
+  "context"
+  "crypto/rand"
+  "database/sql"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "log"
+  "net/http"
+  "sort"
+  "sync"
+  "time"
+
+  "github.com/gorilla/mux"
+)
+
+const CanaryTable = "canary"
+const CanaryTableCreate = `
+  CREATE TABLE IF NOT EXISTS ` + CanaryTable + ` (
+    id char(16) NOT NULL,
+    params varchar(64) NOT NULL,
+    hash varbinary(255) NOT NULL,
+    label varchar(255) NOT NULL,
+    created datetime NOT NULL,
+    PRIMARY KEY (id),
+    UNIQUE KEY params_hash_UNIQUE (params, hash)
+  ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+`
+
+var ErrCanariesDisabled = errors.New("Canaries are not enabled on this server.")
+
+// how long a webhook has to accept an alert
+const canaryWebhookTimeout = 10 * time.Second
+
+// default interval between reloads of the canaries, which other replicas
+// may have added or deleted
+const DefaultCanaryRefresh = 30 * time.Second
+
+// Canary is the hash of a credential that was made up and never leaked,
+// so anyone looking it up must have our data. Only /v1/cred, /v1/creds,
+// /v2/cred, /v1/watch and /v1/jobs see whole hashes; range and OPRF
+// lookups can't be caught.
+type Canary struct{
+  ID      string    `json:"id"`
+  // parameter set the hash was made with
+  Params  string    `json:"params"`
+  Hash    []byte    `json:"-"`
+  Label   string    `json:"label"`
+  Created time.Time `json:"created"`
+}
+
+// CanaryAlert is raised when a canary is looked up.
+type CanaryAlert struct{
+  Canary   Canary    `json:"canary"`
+  Tenant   string    `json:"tenant,omitempty"`
+  APIKeyID string    `json:"apiKeyId,omitempty"`
+  IP       string    `json:"ip"`
+  Path     string    `json:"path"`
+  Time     time.Time `json:"time"`
+}
+
+type CanaryStore interface {
+  InsertCanary(c Canary) error
+  ListCanaries() ([]Canary, error)
+  DeleteCanary(id string) error
+  CreateTables() error
+}
+
+// Alerter delivers canary alerts. Alert is called on the request's
+// goroutine, so it must not block.
+type Alerter interface {
+  Alert(alert CanaryAlert)
+}
+
+// LogAlerter writes alerts to the server log.
+type LogAlerter struct{}
+
+func (LogAlerter) Alert(alert CanaryAlert) {
+  b, _ := json.Marshal(alert)
+  log.Println("Canary credential looked up:", string(b))
+}
+
+// WebhookAlerter POSTs each alert as JSON to URL.
+type WebhookAlerter struct{
+  URL        string
+  HTTPClient *http.Client
+}
+
+func NewWebhookAlerter(url string) *WebhookAlerter {
+  return &WebhookAlerter{url, &http.Client{Timeout: canaryWebhookTimeout}}
+}
+
+func (a *WebhookAlerter) Alert(alert CanaryAlert) {
+  go func() {
+    b, _ := json.Marshal(alert)
+    res, err := a.HTTPClient.Post(a.URL, "application/json", bytes.NewBuffer(b))
+    if err != nil {
+      log.Println("Sending canary alert:", err)
+      return
+    }
+    res.Body.Close()
+    if res.StatusCode >= 300 {
+      log.Println("Sending canary alert: webhook responded", res.StatusCode)
+    }
+  }()
+}
+
+// Canaries keeps every canary in memory so that lookups can be checked
+// against them without a query. Canaries added or deleted through other
+// replicas are seen after the next Reload.
+type Canaries struct{
+  Store    CanaryStore
+  Alerters []Alerter
+  // take client IPs from X-Forwarded-For
+  TrustProxy bool
+  mu       sync.RWMutex
+  // by params and then string(hash)
+  byHash   map[string]map[string]Canary
+  // counts Add and Delete calls, so that Reload doesn't swap in a list
+  // read before one of them
+  changes  uint64
+}
+
+// loads the canaries in store
+func NewCanaries(store CanaryStore, alerters ...Alerter) (*Canaries, error) {
+  c := &Canaries{Store: store, Alerters: alerters, byHash: make(map[string]map[string]Canary)}
+  if err := c.Reload(); err != nil {
+    return nil, err
+  }
+  return c, nil
+}
+
+// reads the canaries from Store again
+func (c *Canaries) Reload() error {
+  c.mu.RLock()
+  changes := c.changes
+  c.mu.RUnlock()
+  canaries, err := c.Store.ListCanaries()
+  if err != nil {
+    return err
+  }
+  byHash := make(map[string]map[string]Canary)
+  for _, canary := range canaries {
+    indexCanary(byHash, canary)
+  }
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  // the next reload will have it
+  if c.changes != changes {
+    return nil
+  }
+  c.byHash = byHash
+  return nil
+}
+
+// reloads the canaries every interval until ctx is done
+func (c *Canaries) Refresh(ctx context.Context, every time.Duration) {
+  ticker := time.NewTicker(every)
+  defer ticker.Stop()
+  for {
+    select {
+    case <-ctx.Done():
+      return
+    case <-ticker.C:
+      if err := c.Reload(); err != nil {
+        log.Println("Reloading canaries:", err)
+      }
+    }
+  }
+}
+
+func indexCanary(byHash map[string]map[string]Canary, canary Canary) {
+  hashes, ok := byHash[canary.Params]
+  if !ok {
+    hashes = make(map[string]Canary)
+    byHash[canary.Params] = hashes
+  }
+  hashes[string(canary.Hash)] = canary
+}
+
+func (c *Canaries) Add(params string, hash []byte, label string) (canary Canary, err error) {
+  id := make([]byte, 8)
+  if _, err = rand.Read(id); err != nil {
+    return
+  }
+  canary = Canary{
+    ID: hex.EncodeToString(id),
+    Params: params,
+    Hash: hash,
+    Label: label,
+    Created: time.Now().UTC().Truncate(time.Second),
+  }
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  if _, ok := c.byHash[params][string(hash)]; ok {
+    return canary, errors.New("That hash is already a canary.")
+  }
+  if err = c.Store.InsertCanary(canary); err != nil {
+    return
+  }
+  c.changes += 1
+  indexCanary(c.byHash, canary)
+  return
+}
+
+func (c *Canaries) Delete(id string) error {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  if err := c.Store.DeleteCanary(id); err != nil {
+    return err
+  }
+  c.changes += 1
+  for _, hashes := range c.byHash {
+    for hash, canary := range hashes {
+      if canary.ID == id {
+        delete(hashes, hash)
+      }
+    }
+  }
+  return nil
+}
+
+// alerts on every hash of params that is a canary
+func (c *Canaries) Check(r *http.Request, params string, hashes ...[]byte) {
+  if c == nil {
+    return
+  }
+  origin := CanaryAlert{IP: ClientIP(r, c.TrustProxy), Path: r.URL.Path}
+  if k, ok := APIKeyFromContext(r.Context()); ok {
+    origin.Tenant = k.Tenant
+    origin.APIKeyID = k.ID
+  }
+  c.CheckAs(origin, params, hashes...)
+}
+
+// like Check, for lookups made outside a request; the tenant, key, IP and
+// path of the alerts are taken from origin
+func (c *Canaries) CheckAs(origin CanaryAlert, params string, hashes ...[]byte) {
+  if c == nil {
+    return
+  }
+  c.mu.RLock()
+  var found []Canary
+  for _, hash := range hashes {
+    if canary, ok := c.byHash[params][string(hash)]; ok {
+      found = append(found, canary)
+    }
+  }
+  c.mu.RUnlock()
+  for _, canary := range found {
+    alert := origin
+    alert.Canary = canary
+    alert.Time = time.Now().UTC()
+    for _, alerter := range c.Alerters {
+      alerter.Alert(alert)
+    }
+  }
+}
+
+type CanaryReqBody struct{
+  // hash of the made up credential, made with Params
+  Hash     string `json:"hash"`
+  Encoding string `json:"encoding"`
+  Params   string `json:"params,omitempty"`
+  Label    string `json:"label"`
+}
+
+type CanariesRes struct{
+  Canaries []Canary `json:"canaries"`
+}
+
+func AddCanaryHandler(w http.ResponseWriter, r *http.Request, registry *Registry, canaries *Canaries) {
+  var req CanaryReqBody
+  err := DecodeBody(r.Body, &req)
+  if err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{"An error occurred parsing the request body"})
+    return
+  }
+  if req.Label == "" || len(req.Label) > 255 {
+    respondWithJSON(w, http.StatusBadRequest, credErr{"Labels must be between 1 and 255 characters."})
+    return
+  }
+  p, _, err := registry.Get(req.Params)
+  if err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{err.Error()})
+    return
+  }
+  hash, err := DecodeHash(req.Hash, req.Encoding, int(p.KeyLen))
+  if err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{err.Error()})
+    return
+  }
+  canary, err := canaries.Add(p.Name, hash, req.Label)
+  if err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{err.Error()})
+    return
+  }
+  respondWithJSON(w, http.StatusOK, canary)
+}
+
+func ListCanariesHandler(w http.ResponseWriter, canaries *Canaries) {
+  list, err := canaries.Store.ListCanaries()
+  if err != nil {
+    respondWithJSON(w, http.StatusInternalServerError, credErr{err.Error()})
+    return
+  }
+  if list == nil {
+    list = []Canary{}
+  }
+  respondWithJSON(w, http.StatusOK, CanariesRes{list})
+}
+
+func DeleteCanaryHandler(w http.ResponseWriter, r *http.Request, canaries *Canaries) {
+  err := canaries.Delete(mux.Vars(r)["id"])
+  if err != nil {
+    respondWithJSON(w, http.StatusNotFound, credErr{err.Error()})
+    return
+  }
+  w.WriteHeader(http.StatusNoContent)
+}
+
+// MySQLCanaryStore keeps canaries in CanaryTable.
+type MySQLCanaryStore struct{
+  DB *sql.DB
+}
+
+func NewMySQLCanaryStore(db *sql.DB) *MySQLCanaryStore {
+  return &MySQLCanaryStore{db}
+}
+
+func (s *MySQLCanaryStore) InsertCanary(c Canary) (err error) {
+  _, err = s.DB.Exec("INSERT INTO " + CanaryTable + " (id, params, hash, label, created) VALUES (?, ?, ?, ?, ?)", c.ID, c.Params, c.Hash, c.Label, c.Created)
+  return
+}
+
+func (s *MySQLCanaryStore) ListCanaries() (canaries []Canary, err error) {
+  rows, err := s.DB.Query("SELECT id, params, hash, label, created FROM " + CanaryTable + " ORDER BY created")
+  if err != nil {
+    return
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var c Canary
+    if err = rows.Scan(&c.ID, &c.Params, &c.Hash, &c.Label, &c.Created); err != nil {
+      return nil, err
+    }
+    canaries = append(canaries, c)
+  }
+  return canaries, rows.Err()
+}
+
+func (s *MySQLCanaryStore) DeleteCanary(id string) error {
+  res, err := s.DB.Exec("DELETE FROM " + CanaryTable + " WHERE id=?", id)
+  if err != nil {
+    return err
+  }
+  n, err := res.RowsAffected()
+  if err == nil && n == 0 {
+    err = errors.New("No canary with id " + id + ".")
+  }
+  return err
+}
+
+func (s *MySQLCanaryStore) CreateTables() (err error) {
+  _, err = s.DB.Exec(CanaryTableCreate)
+  return
+}
+
+// MemCanaryStore keeps canaries in memory.
+type MemCanaryStore struct{
+  mu       sync.Mutex
+  canaries map[string]Canary // by ID
+}
+
+func NewMemCanaryStore() *MemCanaryStore {
+  return &MemCanaryStore{canaries: make(map[string]Canary)}
+}
+
+func (s *MemCanaryStore) InsertCanary(c Canary) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  s.canaries[c.ID] = c
+  return nil
+}
+
+func (s *MemCanaryStore) ListCanaries() ([]Canary, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  canaries := make([]Canary, 0, len(s.canaries))
+  for _, c := range s.canaries {
+    canaries = append(canaries, c)
+  }
+  sort.Slice(canaries, func(i, j int) bool {
+    return canaries[i].Created.Before(canaries[j].Created)
+  })
+  return canaries, nil
+}
+
+func (s *MemCanaryStore) DeleteCanary(id string) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if _, ok := s.canaries[id]; !ok {
+    return errors.New("No canary with id " + id + ".")
+  }
+  delete(s.canaries, id)
+  return nil
+}
+
+func (s *MemCanaryStore) CreateTables() error {
+  return nil
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+  "bytes"
+  "encoding/hex"
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+)
+
+type recordingAlerter struct{
+  alerts []CanaryAlert
+}
+
+func (a *recordingAlerter) Alert(alert CanaryAlert) {
+  a.alerts = append(a.alerts, alert)
+}
+
+func TestCanaries(t *testing.T) {
+  apiKeys := NewMemAPIKeyStore()
+  adminKey, _, _ := CreateAdminAPIKey(apiKeys, "ops")
+  userKey, userAPIKey, _ := CreateAPIKey(apiKeys, "acme")
+  alerter := &recordingAlerter{}
+  canaries, err := NewCanaries(NewMemCanaryStore(), alerter)
+  if err != nil {
+    t.Fatal(err)
+  }
+  a := App{APIKeys: apiKeys, Canaries: canaries}
+  a.Initialize(NewMemStore())
+  do := func(method, path, key string, body interface{}) *httptest.ResponseRecorder {
+    b, _ := json.Marshal(body)
+    req := httptest.NewRequest(method, path, bytes.NewBuffer(b))
+    req.Header.Set("Authorization", "Bearer " + key)
+    rr := httptest.NewRecorder()
+    a.Router.ServeHTTP(rr, req)
+    return rr
+  }
+  canaryHash := hex.EncodeToString(randomHash(t))
+  addReq := CanaryReqBody{Hash: canaryHash, Encoding: EncodingHex, Label: "planted in wiki"}
+  if rr := do("POST", "/admin/canaries", userKey, addReq); rr.Code != http.StatusForbidden {
+    t.Errorf("Expected response code 403 for a tenant key. Got %d\n", rr.Code)
+  }
+  rr := do("POST", "/admin/canaries", adminKey, addReq)
+  if rr.Code != http.StatusOK {
+    t.Fatalf("Expected response code 200. Got %d\n", rr.Code)
+  }
+  var canary Canary
+  json.Unmarshal(rr.Body.Bytes(), &canary)
+  safeHash := hex.EncodeToString(randomHash(t))
+  rr = do("POST", "/v1/creds", userKey, CredsReqBody{Hashes: []string{safeHash, canaryHash}, Encoding: EncodingHex})
+  if rr.Code != http.StatusOK {
+    t.Fatalf("Expected response code 200. Got %d\n", rr.Code)
+  }
+  var res CredsRes
+  json.Unmarshal(rr.Body.Bytes(), &res)
+  if len(res.Results) != 2 || res.Results[1].Compromised {
+    t.Errorf("Expected a canary to be answered like any other hash. Got %+v\n", res)
+  }
+  if len(alerter.alerts) != 1 {
+    t.Fatalf("Expected 1 alert. Got %d\n", len(alerter.alerts))
+  }
+  alert := alerter.alerts[0]
+  if alert.Canary.ID != canary.ID || alert.Tenant != "acme" || alert.APIKeyID != userAPIKey.ID || alert.IP == "" || alert.Path != "/v1/creds" {
+    t.Errorf("Unexpected alert %+v\n", alert)
+  }
+  if rr = do("DELETE", "/admin/canaries/" + canary.ID, adminKey, nil); rr.Code != http.StatusNoContent {
+    t.Errorf("Expected response code 204. Got %d\n", rr.Code)
+  }
+  do("POST", "/v1/cred", userKey, CredReqBody{Hash: canaryHash, Encoding: EncodingHex})
+  if len(alerter.alerts) != 1 {
+    t.Error("Expected no alert after the canary was deleted")
+  }
+}
+
+func TestCanariesReload(t *testing.T) {
+  store := NewMemCanaryStore()
+  admin, _ := NewCanaries(store)
+  alerter := &recordingAlerter{}
+  // another replica, started before the canary was added
+  replica, err := NewCanaries(store, alerter)
+  if err != nil {
+    t.Fatal(err)
+  }
+  hash := randomHash(t)
+  canary, err := admin.Add(DefaultParamSet.Name, hash, "planted in wiki")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err = replica.Reload(); err != nil {
+    t.Fatal(err)
+  }
+  replica.CheckAs(CanaryAlert{Path: "/v1/cred"}, DefaultParamSet.Name, hash)
+  if len(alerter.alerts) != 1 {
+    t.Fatalf("Expected the replica to alert after reloading. Got %d alerts\n", len(alerter.alerts))
+  }
+  admin.Delete(canary.ID)
+  replica.Reload()
+  replica.CheckAs(CanaryAlert{Path: "/v1/cred"}, DefaultParamSet.Name, hash)
+  if len(alerter.alerts) != 1 {
+    t.Error("Expected no alert after the canary was deleted elsewhere")
+  }
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+  "context"
+  "database/sql"
+  "errors"
+  "log"
+  "net/http"
+  "strconv"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+// default number of hashes a CheckedCounter holds between flushes
+const DefaultMaxPendingChecked = 100000
+// default and maximum number of days of hits reported by /admin/stats
+const DefaultHitStatsDays = 30
+const maxHitStatsDays = 366
+
+var ErrHitStatsUnsupported = errors.New("Store does not count lookups.")
+
+// lower bounds of the buckets of checked values reported by /admin/stats
+var checkedBuckets = []int64{0, 1, 10, 100, 1000}
+
+// HitStats are aggregate lookup counts of one parameter set. They never
+// include hashes.
+type HitStats struct{
+  Params     string          `json:"params"`
+  HitsPerDay []DayHits       `json:"hitsPerDay"`
+  // number of stored hashes by how often they were found
+  Checked    []CheckedBucket `json:"checked"`
+}
+
+type DayHits struct{
+  // YYYY-MM-DD, UTC
+  Day  string `json:"day"`
+  Hits int64  `json:"hits"`
+}
+
+type CheckedBucket struct{
+  // e.g. "0", "10-99" or "1000+"
+  Range  string `json:"range"`
+  Hashes int64  `json:"hashes"`
+}
+
+// HitReporter is implemented by stores that count positive lookups.
+type HitReporter interface {
+  // hits of the last days days, oldest first, and the distribution of
+  // the checked column
+  HitStats(days int) (HitStats, error)
+}
+
+// CheckedCounter collects positive lookups and adds them to the checked
+// column of each table, and to a daily total, in the background, so that
+// lookups never wait on a write.
+type CheckedCounter struct{
+  DB         *sql.DB
+  // hits beyond this many pending hashes are dropped
+  MaxPending int
+  mu         sync.Mutex
+  // hits by table and then hash
+  pending    map[string]map[string]int64
+  n          int
+  dropped    uint64
+  // writes one table's hits; replaced in tests
+  increment  func(table string, hits map[string]int64) error
+}
+
+// counts the lookups of the stores NewDBStore returns for backend
+func NewCheckedCounter(db *sql.DB, backend string) *CheckedCounter {
+  c := &CheckedCounter{DB: db, MaxPending: DefaultMaxPendingChecked, pending: make(map[string]map[string]int64)}
+  increment := IncrementChecked
+  switch backend {
+  case BackendPostgres:
+    increment = PostgresIncrementChecked
+  case BackendSQLite:
+    increment = SQLiteIncrementChecked
+  }
+  c.increment = func(table string, hits map[string]int64) error {
+    return increment(c.DB, table, hits)
+  }
+  return c
+}
+
+// counts a hit on hash in table
+func (c *CheckedCounter) Add(table string, hash []byte) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  c.add(table, string(hash), 1)
+}
+
+// must be called with mu held
+func (c *CheckedCounter) add(table, hash string, n int64) {
+  hits, ok := c.pending[table]
+  if !ok {
+    hits = make(map[string]int64)
+    c.pending[table] = hits
+  }
+  if _, ok = hits[hash]; !ok {
+    if c.n >= c.MaxPending {
+      atomic.AddUint64(&c.dropped, uint64(n))
+      return
+    }
+    c.n += 1
+  }
+  hits[hash] += n
+}
+
+// number of hits dropped because too many were pending
+func (c *CheckedCounter) Dropped() uint64 {
+  return atomic.LoadUint64(&c.dropped)
+}
+
+// writes the pending hits of each table; the hits of tables that fail to
+// write are kept for the next flush, as far as MaxPending allows
+func (c *CheckedCounter) Flush() error {
+  c.mu.Lock()
+  pending := c.pending
+  c.pending = make(map[string]map[string]int64)
+  c.n = 0
+  c.mu.Unlock()
+  var errs []error
+  for table, hits := range pending {
+    err := c.increment(table, hits)
+    if err == nil {
+      continue
+    }
+    errs = append(errs, errors.New(table + ": " + err.Error()))
+    c.mu.Lock()
+    for hash, n := range hits {
+      c.add(table, hash, n)
+    }
+    c.mu.Unlock()
+  }
+  return errors.Join(errs...)
+}
+
+// flushes every interval until ctx is done, then flushes once more
+func (c *CheckedCounter) Run(ctx context.Context, every time.Duration) {
+  ticker := time.NewTicker(every)
+  defer ticker.Stop()
+  for {
+    select {
+    case <-ctx.Done():
+      if err := c.Flush(); err != nil {
+        log.Println("Counting lookups:", err)
+      }
+      return
+    case <-ticker.C:
+      if err := c.Flush(); err != nil {
+        log.Println("Counting lookups:", err)
+      }
+    }
+  }
+}
+
+// empty buckets labelled with their ranges
+func newCheckedBuckets() []CheckedBucket {
+  buckets := make([]CheckedBucket, len(checkedBuckets))
+  for i, lo := range checkedBuckets {
+    switch {
+    case i == len(checkedBuckets) - 1:
+      buckets[i].Range = strconv.FormatInt(lo, 10) + "+"
+    case checkedBuckets[i + 1] - 1 == lo:
+      buckets[i].Range = strconv.FormatInt(lo, 10)
+    default:
+      buckets[i].Range = strconv.FormatInt(lo, 10) + "-" + strconv.FormatInt(checkedBuckets[i + 1] - 1, 10)
+    }
+  }
+  return buckets
+}
+
+// index into checkedBuckets of checked
+func checkedBucket(checked int64) (i int) {
+  for i = len(checkedBuckets) - 1; i > 0 && checked < checkedBuckets[i]; i -= 1 {
+  }
+  return
+}
+
+// returns the HitReporter in store's chain of wrappers, if any
+func HitReporterOf(store Store) HitReporter {
+  reporter, _ := findStore(store, func(s Store) bool {
+    _, ok := s.(HitReporter)
+    return ok
+  }).(HitReporter)
+  return reporter
+}
+
+// serves ?params=name&days=N
+func HitStatsHandler(w http.ResponseWriter, r *http.Request, registry *Registry) {
+  query := r.URL.Query()
+  days := DefaultHitStatsDays
+  if d := query.Get("days"); d != "" {
+    var err error
+    days, err = strconv.Atoi(d)
+    if err != nil || days < 1 || days > maxHitStatsDays {
+      respondWithJSON(w, http.StatusBadRequest, credErr{"Expected days to be between 1 and " + strconv.Itoa(maxHitStatsDays) + "."})
+      return
+    }
+  }
+  p, store, err := registry.Get(query.Get("params"))
+  if err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{err.Error()})
+    return
+  }
+  reporter := HitReporterOf(store)
+  if reporter == nil {
+    respondWithJSON(w, http.StatusNotImplemented, credErr{ErrHitStatsUnsupported.Error()})
+    return
+  }
+  stats, err := reporter.HitStats(days)
+  if err != nil {
+    respondWithJSON(w, http.StatusInternalServerError, credErr{err.Error()})
+    return
+  }
+  stats.Params = p.Name
+  respondWithJSON(w, http.StatusOK, stats)
+}
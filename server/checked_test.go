@@ -0,0 +1,87 @@
+package server
+
+import (
+  "encoding/json"
+  "errors"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+)
+
+func TestHitStats(t *testing.T) {
+  mem := NewMemStore()
+  apiKeys := NewMemAPIKeyStore()
+  adminKey, _, _ := CreateAdminAPIKey(apiKeys, "ops")
+  userKey, _, _ := CreateAPIKey(apiKeys, "acme")
+  a := App{APIKeys: apiKeys}
+  a.Initialize(NewFilteredStore(mem, 0.01))
+  hot := randomHash(t)
+  mem.Insert(hot)
+  mem.Insert(randomHash(t))
+  for i := 0; i < 12; i += 1 {
+    mem.Lookup(hot)
+  }
+  mem.LookupMany([][]byte{hot, randomHash(t)})
+  get := func(key string) *httptest.ResponseRecorder {
+    req := httptest.NewRequest("GET", "/admin/stats?days=7", nil)
+    req.Header.Set("Authorization", "Bearer " + key)
+    rr := httptest.NewRecorder()
+    a.Router.ServeHTTP(rr, req)
+    return rr
+  }
+  if rr := get(userKey); rr.Code != http.StatusForbidden {
+    t.Errorf("Expected response code 403 for a tenant key. Got %d\n", rr.Code)
+  }
+  rr := get(adminKey)
+  if rr.Code != http.StatusOK {
+    t.Fatalf("Expected response code 200. Got %d\n", rr.Code)
+  }
+  var stats HitStats
+  if err := json.Unmarshal(rr.Body.Bytes(), &stats); err != nil {
+    t.Fatal(err)
+  }
+  if len(stats.HitsPerDay) != 1 || stats.HitsPerDay[0].Hits != 13 {
+    t.Errorf("Expected 13 hits today. Got %+v\n", stats.HitsPerDay)
+  }
+  expected := []CheckedBucket{{"0", 1}, {"1-9", 0}, {"10-99", 1}, {"100-999", 0}, {"1000+", 0}}
+  if len(stats.Checked) != len(expected) {
+    t.Fatalf("Expected %v. Got %v\n", expected, stats.Checked)
+  }
+  for i := range expected {
+    if stats.Checked[i] != expected[i] {
+      t.Errorf("Expected %v. Got %v\n", expected, stats.Checked)
+      break
+    }
+  }
+}
+
+func TestCheckedCounterFlushFailure(t *testing.T) {
+  c := NewCheckedCounter(nil, BackendMySQL)
+  written := make(map[string]int64)
+  fail := true
+  c.increment = func(table string, hits map[string]int64) error {
+    if table == "broken" && fail {
+      return errors.New("Connection refused.")
+    }
+    for _, n := range hits {
+      written[table] += n
+    }
+    return nil
+  }
+  c.Add("broken", []byte("a"))
+  c.Add("broken", []byte("a"))
+  c.Add("working", []byte("b"))
+  if err := c.Flush(); err == nil {
+    t.Fatal("Expected the broken table's error")
+  }
+  if written["working"] != 1 {
+    t.Errorf("Expected the other table to be written. Got %v\n", written)
+  }
+  fail = false
+  if err := c.Flush(); err != nil {
+    t.Fatal(err)
+  }
+  if written["broken"] != 2 || written["working"] != 1 {
+    t.Errorf("Expected the failed hits to be written on the next flush. Got %v\n", written)
+  }
+}
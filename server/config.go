@@ -0,0 +1,184 @@
+package server
+
+import (
+  "bytes"
+  "errors"
+  "io"
+  "net/url"
+  "os"
+  "strings"
+  "time"
+
+  "gopkg.in/yaml.v3"
+)
+
+// Config holds the settings shared by the server and the tools. It is read
+// from a YAML file (see ccds.example.yaml), then environment variables
+// override the file, then each command's flags override both. Pepper,
+// OPRF and filter keys are not part of it; they stay in CCDS_PEPPER_KEYS,
+// CCDS_OPRF_KEY and CCDS_FILTER_KEY.
+type Config struct{
+  DB     DBConfig     `yaml:"db"`
+  Server ServerConfig `yaml:"server"`
+  // Argon2 parameter sets to serve in addition to DefaultParamSet,
+  // e.g. 2_128_8_64
+  Params []string     `yaml:"params"`
+  Data   DataConfig   `yaml:"data"`
+}
+
+// DSNs of the databases, in the forms OpenDB accepts.
+type DBConfig struct{
+  // CCDS_DEV_DB_URL; used without -production
+  Dev  string `yaml:"dev"`
+  // CCDS_DB_URL; used with -production
+  Prod string `yaml:"prod"`
+}
+
+type ServerConfig struct{
+  // CCDS_LISTEN
+  Listen       string        `yaml:"listen"`
+  // CCDS_READ_TIMEOUT, CCDS_WRITE_TIMEOUT and CCDS_IDLE_TIMEOUT; 0, the
+  // default, means no limit. A read timeout also bounds /v1/jobs uploads.
+  ReadTimeout  time.Duration `yaml:"readTimeout"`
+  WriteTimeout time.Duration `yaml:"writeTimeout"`
+  IdleTimeout  time.Duration `yaml:"idleTimeout"`
+  // how long in-flight requests get to finish on SIGINT or SIGTERM;
+  // CCDS_SHUTDOWN_TIMEOUT
+  ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+}
+
+// files read and written by cmd/encrypt and cmd/analyze
+type DataConfig struct{
+  // credentials to import or analyze, one tab-separated pair per line;
+  // CCDS_DATA_PATH
+  Creds    string `yaml:"creds"`
+  // where cmd/analyze writes its statistics; CCDS_STATS_PATH
+  Stats    string `yaml:"stats"`
+  // where cmd/encrypt writes the lines it failed on; CCDS_FAILURES_PATH
+  Failures string `yaml:"failures"`
+}
+
+func DefaultConfig() Config {
+  return Config{
+    Server: ServerConfig{Listen: ":8030", ShutdownTimeout: DefaultShutdownTimeout},
+    Data: DataConfig{
+      Creds: "../../data/data.tsv",
+      Stats: "../../data/pw-stats.json",
+      Failures: "../../data/failures.txt",
+    },
+  }
+}
+
+// reads the file at path, or at CCDS_CONFIG if path is empty, over
+// DefaultConfig and applies the environment; with neither, only the
+// environment is applied. Database DSNs left unset fall back to the
+// CCDS_DB_* and CCDS_DEV_DB_* variables.
+func LoadConfig(path string) (cfg Config, err error) {
+  cfg = DefaultConfig()
+  if path == "" {
+    path = os.Getenv("CCDS_CONFIG")
+  }
+  if path != "" {
+    b, err := os.ReadFile(path)
+    if err != nil {
+      return cfg, err
+    }
+    dec := yaml.NewDecoder(bytes.NewReader(b))
+    // a misspelled setting would otherwise be silently ignored
+    dec.KnownFields(true)
+    if err = dec.Decode(&cfg); err != nil && err != io.EOF {
+      return cfg, errors.New("Invalid config file " + path + ": " + err.Error())
+    }
+  }
+  if err = cfg.applyEnv(); err != nil {
+    return
+  }
+  if cfg.DB.Dev == "" {
+    cfg.DB.Dev = GetDevDSN()
+  }
+  if cfg.DB.Prod == "" {
+    cfg.DB.Prod = GetProdDSN()
+  }
+  return
+}
+
+func (cfg *Config) applyEnv() error {
+  for name, setting := range map[string]*string{
+    "CCDS_DEV_DB_URL": &cfg.DB.Dev,
+    "CCDS_DB_URL": &cfg.DB.Prod,
+    "CCDS_LISTEN": &cfg.Server.Listen,
+    "CCDS_DATA_PATH": &cfg.Data.Creds,
+    "CCDS_STATS_PATH": &cfg.Data.Stats,
+    "CCDS_FAILURES_PATH": &cfg.Data.Failures,
+  } {
+    if v := os.Getenv(name); v != "" {
+      *setting = v
+    }
+  }
+  for name, setting := range map[string]*time.Duration{
+    "CCDS_READ_TIMEOUT": &cfg.Server.ReadTimeout,
+    "CCDS_WRITE_TIMEOUT": &cfg.Server.WriteTimeout,
+    "CCDS_IDLE_TIMEOUT": &cfg.Server.IdleTimeout,
+    "CCDS_SHUTDOWN_TIMEOUT": &cfg.Server.ShutdownTimeout,
+  } {
+    v := os.Getenv(name)
+    if v == "" {
+      continue
+    }
+    d, err := time.ParseDuration(v)
+    if err != nil {
+      return errors.New("Invalid " + name + ": " + err.Error())
+    }
+    *setting = d
+  }
+  if v := os.Getenv("CCDS_PARAMS"); v != "" {
+    cfg.Params = strings.Split(v, ",")
+  }
+  return nil
+}
+
+// returns the DSN of the production or the dev database
+func (cfg Config) DSN(production bool) string {
+  if production {
+    return cfg.DB.Prod
+  }
+  return cfg.DB.Dev
+}
+
+// sets the DSN of the production or the dev database, e.g. from a -db flag
+func (cfg *Config) SetDSN(production bool, dsn string) {
+  if production {
+    cfg.DB.Prod = dsn
+  } else {
+    cfg.DB.Dev = dsn
+  }
+}
+
+// writes cfg as YAML with the database passwords redacted
+func (cfg Config) Print(w io.Writer) error {
+  cfg.DB.Dev = redactDSN(cfg.DB.Dev)
+  cfg.DB.Prod = redactDSN(cfg.DB.Prod)
+  b, err := yaml.Marshal(cfg)
+  if err != nil {
+    return err
+  }
+  _, err = w.Write(b)
+  return err
+}
+
+// hides the password of a URL DSN, including a Postgres password=
+// parameter, or the whole DSN if it can't be parsed
+func redactDSN(dsn string) string {
+  if dsn == "" {
+    return dsn
+  }
+  u, err := url.Parse(dsn)
+  if err != nil {
+    return "xxxxx"
+  }
+  if q := u.Query(); q.Get("password") != "" {
+    q.Set("password", "xxxxx")
+    u.RawQuery = q.Encode()
+  }
+  return u.Redacted()
+}
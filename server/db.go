@@ -2,15 +2,197 @@ package server
 
 import (
   "database/sql"
+  "errors"
+  "net/url"
   "os"
+  "strings"
 )
 
 const CreateDB = "CREATE SCHEMA ccds DEFAULT CHARACTER SET utf8;"
 
+// database backends, chosen by the scheme of a DSN
+const (
+  BackendMySQL    = "mysql"
+  BackendPostgres = "postgres"
+  BackendSQLite   = "sqlite"
+)
+
+var ErrUnknownBackend = errors.New("Unknown database; expected a mysql://, postgres:// or sqlite: DSN.")
+
 func GetDevDB() (*sql.DB, error) {
-  return sql.Open("mysql", os.Getenv("CCDS_DEV_DB_USER") + ":" + os.Getenv("CCDS_DEV_DB_PW") + "@/" + os.Getenv("CCDS_DEV_DB_NAME"))
+  return sql.Open("mysql", os.Getenv("CCDS_DEV_DB_USER") + ":" + os.Getenv("CCDS_DEV_DB_PW") + "@/" + os.Getenv("CCDS_DEV_DB_NAME") + "?parseTime=true")
 }
 
 func GetProdDB() (*sql.DB, error) {
-  return sql.Open("mysql", os.Getenv("CCDS_DB_USER") + ":" + os.Getenv("CCDS_DB_PW") + "@" + os.Getenv("CCDS_DB_ADDRESS") + "/" + os.Getenv("CCDS_DB_NAME"))
+  return sql.Open("mysql", os.Getenv("CCDS_DB_USER") + ":" + os.Getenv("CCDS_DB_PW") + "@" + os.Getenv("CCDS_DB_ADDRESS") + "/" + os.Getenv("CCDS_DB_NAME") + "?parseTime=true")
+}
+
+// returns CCDS_DEV_DB_URL, or failing that a mysql:// DSN built from the
+// CCDS_DEV_DB_* variables GetDevDB reads
+func GetDevDSN() string {
+  if dsn := os.Getenv("CCDS_DEV_DB_URL"); dsn != "" {
+    return dsn
+  }
+  return mysqlURL(os.Getenv("CCDS_DEV_DB_USER"), os.Getenv("CCDS_DEV_DB_PW"), "", os.Getenv("CCDS_DEV_DB_NAME"))
+}
+
+// returns CCDS_DB_URL, or failing that a mysql:// DSN built from the
+// CCDS_DB_* variables GetProdDB reads
+func GetProdDSN() string {
+  if dsn := os.Getenv("CCDS_DB_URL"); dsn != "" {
+    return dsn
+  }
+  return mysqlURL(os.Getenv("CCDS_DB_USER"), os.Getenv("CCDS_DB_PW"), os.Getenv("CCDS_DB_ADDRESS"), os.Getenv("CCDS_DB_NAME"))
+}
+
+// address may be in the driver's tcp(host:port) form
+func mysqlURL(user, pw, address, name string) string {
+  address = strings.TrimSuffix(strings.TrimPrefix(address, "tcp("), ")")
+  u := url.URL{Scheme: "mysql", User: url.UserPassword(user, pw), Host: address, Path: "/" + name}
+  return u.String()
+}
+
+// opens the database dsn points to and returns the backend named by its
+// scheme:
+//
+//   mysql://user:pw@host:port/name
+//   postgres://user:pw@host:port/name?sslmode=disable (or postgresql://)
+//   sqlite:relative/path.db or sqlite:///absolute/path.db
+//
+// The Postgres and SQLite drivers, github.com/lib/pq and
+// modernc.org/sqlite, must be imported by the command.
+func OpenDB(dsn string) (db *sql.DB, backend string, err error) {
+  u, err := url.Parse(dsn)
+  if err != nil {
+    return nil, "", ErrUnknownBackend
+  }
+  switch u.Scheme {
+  case "mysql":
+    db, err = sql.Open("mysql", mysqlDSN(u))
+    return db, BackendMySQL, err
+  case "postgres", "postgresql":
+    db, err = sql.Open("postgres", dsn)
+    return db, BackendPostgres, err
+  case "sqlite":
+    db, err = sql.Open("sqlite", sqliteDSN(u))
+    return db, BackendSQLite, err
+  }
+  return nil, "", ErrUnknownBackend
+}
+
+// converts a mysql:// URL to the DSN format of go-sql-driver/mysql; an
+// empty host is the driver's default address
+func mysqlDSN(u *url.URL) string {
+  dsn := ""
+  if u.User != nil {
+    pw, _ := u.User.Password()
+    dsn = u.User.Username() + ":" + pw + "@"
+  } else {
+    dsn = "@"
+  }
+  if u.Host != "" {
+    dsn += "tcp(" + u.Host + ")"
+  }
+  dsn += "/" + strings.TrimPrefix(u.Path, "/")
+  q := u.Query()
+  if q.Get("parseTime") == "" {
+    q.Set("parseTime", "true")
+  }
+  return dsn + "?" + q.Encode()
+}
+
+// converts a sqlite: URL to the file name and pragmas modernc.org/sqlite
+// expects; concurrent writers wait for the lock instead of failing
+func sqliteDSN(u *url.URL) string {
+  path := u.Opaque
+  if path == "" {
+    path = u.Host + u.Path
+  }
+  q := u.Query()
+  if len(q["_pragma"]) == 0 {
+    q["_pragma"] = []string{"busy_timeout(10000)", "journal_mode(WAL)"}
+  }
+  return path + "?" + q.Encode()
+}
+
+// returns the store of p's hashes on backend
+func NewDBStore(db *sql.DB, backend string, p ParamSet) Store {
+  switch backend {
+  case BackendPostgres:
+    return NewPostgresStore(db, p)
+  case BackendSQLite:
+    return NewSQLiteStore(db, p)
+  }
+  return NewMySQLStore(db, p)
+}
+
+// returns the store of the OPRF outputs of p's hashes on backend
+func NewDBOPRFStore(db *sql.DB, backend string, p ParamSet) Store {
+  switch backend {
+  case BackendPostgres:
+    return NewPostgresOPRFStore(db, p)
+  case BackendSQLite:
+    return NewSQLiteOPRFStore(db, p)
+  }
+  return NewMySQLOPRFStore(db, p)
+}
+
+func NewDBPasswordStore(db *sql.DB, backend string, p ParamSet) PasswordStore {
+  switch backend {
+  case BackendPostgres:
+    return NewPostgresPasswordStore(db, p)
+  case BackendSQLite:
+    return NewSQLitePasswordStore(db, p)
+  }
+  return NewMySQLPasswordStore(db, p)
+}
+
+func NewDBAPIKeyStore(db *sql.DB, backend string) APIKeyStore {
+  switch backend {
+  case BackendPostgres:
+    return NewPostgresAPIKeyStore(db)
+  case BackendSQLite:
+    return NewSQLiteAPIKeyStore(db)
+  }
+  return NewMySQLAPIKeyStore(db)
+}
+
+func NewDBCanaryStore(db *sql.DB, backend string) CanaryStore {
+  switch backend {
+  case BackendPostgres:
+    return NewPostgresCanaryStore(db)
+  case BackendSQLite:
+    return NewSQLiteCanaryStore(db)
+  }
+  return NewMySQLCanaryStore(db)
+}
+
+func NewDBWatchStore(db *sql.DB, backend string) WatchStore {
+  switch backend {
+  case BackendPostgres:
+    return NewPostgresWatchStore(db)
+  case BackendSQLite:
+    return NewSQLiteWatchStore(db)
+  }
+  return NewMySQLWatchStore(db)
+}
+
+func NewDBJobStore(db *sql.DB, backend string) JobStore {
+  switch backend {
+  case BackendPostgres:
+    return NewPostgresJobStore(db)
+  case BackendSQLite:
+    return NewSQLiteJobStore(db)
+  }
+  return NewMySQLJobStore(db)
+}
+
+func NewDBBlocklistStore(db *sql.DB, backend string) BlocklistStore {
+  switch backend {
+  case BackendPostgres:
+    return NewPostgresBlocklistStore(db)
+  case BackendSQLite:
+    return NewSQLiteBlocklistStore(db)
+  }
+  return NewMySQLBlocklistStore(db)
 }
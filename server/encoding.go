@@ -0,0 +1,57 @@
+package server
+
+import (
+  "encoding/base64"
+  "encoding/hex"
+  "errors"
+  "strconv"
+  "strings"
+)
+
+// supported values of CredReqBody.Encoding
+const (
+  EncodingUTF8      = "utf8"
+  EncodingHex       = "hex"
+  EncodingBase64    = "base64"
+  EncodingBase64URL = "base64url"
+)
+
+// decodes a hash sent by a client and checks that it is length bytes;
+// an empty encoding is treated as utf8 for older clients
+func DecodeHash(hash, encoding string, length int) (b []byte, err error) {
+  switch encoding {
+  case EncodingUTF8, "":
+    b = []byte(hash)
+  case EncodingHex:
+    b, err = hex.DecodeString(hash)
+  case EncodingBase64:
+    // accept padded and unpadded input
+    b, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(hash, "="))
+  case EncodingBase64URL:
+    b, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(hash, "="))
+  default:
+    return nil, errors.New("Unknown hash encoding \"" + encoding + "\"; expected one of utf8, hex, base64 or base64url.")
+  }
+  if err != nil {
+    return nil, errors.New("Unable to decode " + encoding + " hash: " + err.Error())
+  }
+  if len(b) != length {
+    return nil, errors.New("Expected a " + strconv.Itoa(length) + " byte hash. Got " + strconv.Itoa(len(b)) + " bytes.")
+  }
+  return b, nil
+}
+
+// inverse of DecodeHash
+func EncodeHash(hash []byte, encoding string) (string, error) {
+  switch encoding {
+  case EncodingUTF8, "":
+    return string(hash), nil
+  case EncodingHex:
+    return hex.EncodeToString(hash), nil
+  case EncodingBase64:
+    return base64.StdEncoding.EncodeToString(hash), nil
+  case EncodingBase64URL:
+    return base64.URLEncoding.EncodeToString(hash), nil
+  }
+  return "", errors.New("Unknown hash encoding \"" + encoding + "\".")
+}
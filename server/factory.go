@@ -2,18 +2,308 @@ package server
 
 import (
   "database/sql"
+  "strconv"
+  "strings"
 )
 
+// max number of hashes per IN (...) query
+const searchChunkSize = 500
+
 type CredHash struct {
   Hash  string `json:"hash"`
   Count int
 }
 
-func SearchCredHash(db *sql.DB, hash []byte) (bool, error) {
+func SearchCredHash(db *sql.DB, table string, hash []byte) (bool, error) {
   var exists bool
-  err := db.QueryRow("SELECT EXISTS(SELECT * FROM " + CredHashTable + " WHERE hash=? LIMIT 1)", hash).Scan(&exists)
+  err := db.QueryRow("SELECT EXISTS(SELECT * FROM " + table + " WHERE hash=? LIMIT 1)", hash).Scan(&exists)
   if err != nil {
     return false, err
   }
   return exists, nil
 }
+
+// returns the subset of hashes that exist, keyed by string(hash);
+// large inputs are split into several IN (...) queries
+func SearchCredHashes(db *sql.DB, table string, hashes [][]byte) (found map[string]struct{}, err error) {
+  found = make(map[string]struct{})
+  for start := 0; start < len(hashes); start += searchChunkSize {
+    end := start + searchChunkSize
+    if end > len(hashes) {
+      end = len(hashes)
+    }
+    chunk := hashes[start:end]
+    args := make([]interface{}, len(chunk))
+    for i, hash := range chunk {
+      args[i] = hash
+    }
+    placeholders := strings.TrimSuffix(strings.Repeat("?,", len(chunk)), ",")
+    rows, err := db.Query("SELECT hash FROM " + table + " WHERE hash IN (" + placeholders + ")", args...)
+    if err != nil {
+      return nil, err
+    }
+    for rows.Next() {
+      var hash []byte
+      if err = rows.Scan(&hash); err != nil {
+        rows.Close()
+        return nil, err
+      }
+      found[string(hash)] = struct{}{}
+    }
+    err = rows.Err()
+    rows.Close()
+    if err != nil {
+      return nil, err
+    }
+  }
+  return found, nil
+}
+
+// returns the hashes with lo <= hash < hi; a nil hi means no upper bound
+func SearchCredHashRange(db *sql.DB, table string, lo, hi []byte) (hashes [][]byte, err error) {
+  var rows *sql.Rows
+  if hi == nil {
+    rows, err = db.Query("SELECT hash FROM " + table + " WHERE hash >= ?", lo)
+  } else {
+    rows, err = db.Query("SELECT hash FROM " + table + " WHERE hash >= ? AND hash < ?", lo, hi)
+  }
+  if err != nil {
+    return
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var hash []byte
+    if err = rows.Scan(&hash); err != nil {
+      return nil, err
+    }
+    hashes = append(hashes, hash)
+  }
+  return hashes, rows.Err()
+}
+
+// keyID is the pepper key the hash was made with, or 0 for none;
+// duplicate reports whether hash was already in table
+func InsertCredHash(db *sql.DB, table string, hash []byte, keyID uint16) (duplicate bool, err error) {
+  res, err := db.Exec("INSERT IGNORE INTO " + table + " (hash, key_id) VALUES (?, ?)", hash, keyID)
+  if err != nil {
+    return
+  }
+  inserted, err := res.RowsAffected()
+  return inserted == 0, err
+}
+
+func DeleteCredHashKey(db *sql.DB, table string, keyID uint16) (int64, error) {
+  _, err := db.Exec("DELETE l FROM " + SourceLinkTable(table) + " l JOIN " + table + " t ON t.hash=l.hash WHERE t.key_id=?", keyID)
+  if err != nil {
+    return 0, err
+  }
+  res, err := db.Exec("DELETE FROM " + table + " WHERE key_id=?", keyID)
+  if err != nil {
+    return 0, err
+  }
+  return res.RowsAffected()
+}
+
+func CountCredHashes(db *sql.DB, table string) (count int64, err error) {
+  err = db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count)
+  return
+}
+
+// calls fn with every hash in table
+func ScanCredHashes(db *sql.DB, table string, fn func(hash []byte) error) error {
+  rows, err := db.Query("SELECT hash FROM " + table)
+  if err != nil {
+    return err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var hash []byte
+    if err = rows.Scan(&hash); err != nil {
+      return err
+    }
+    if err = fn(hash); err != nil {
+      return err
+    }
+  }
+  return rows.Err()
+}
+
+func LastCredHashSeq(db *sql.DB, table string) (seq uint64, err error) {
+  err = db.QueryRow("SELECT COALESCE(MAX(seq), 0) FROM " + table).Scan(&seq)
+  return
+}
+
+// returns up to limit hashes with a sequence number greater than since,
+// in sequence order
+func SearchCredHashesSince(db *sql.DB, table string, since uint64, limit int) (entries []SyncEntry, err error) {
+  rows, err := db.Query("SELECT seq, hash, key_id FROM " + table + " WHERE seq > ? ORDER BY seq LIMIT ?", since, limit)
+  if err != nil {
+    return
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var e SyncEntry
+    if err = rows.Scan(&e.Seq, &e.Hash, &e.KeyID); err != nil {
+      return nil, err
+    }
+    entries = append(entries, e)
+  }
+  return entries, rows.Err()
+}
+
+// returns the id of the source called src.Name, adding it first if needed
+func InsertSource(db *sql.DB, src Source) (id int64, err error) {
+  return insertSource(db, "INSERT IGNORE INTO " + SourceTable + " (name, date, description) VALUES (?, ?, ?)",
+    "SELECT id FROM " + SourceTable + " WHERE name=?", src)
+}
+
+// insert takes the name, date and description and must ignore an existing
+// name; selectID takes the name
+func insertSource(db *sql.DB, insert, selectID string, src Source) (id int64, err error) {
+  var date interface{}
+  if !src.Date.IsZero() {
+    date = src.Date
+  }
+  _, err = db.Exec(insert, src.Name, date, src.Description)
+  if err != nil {
+    return
+  }
+  err = db.QueryRow(selectID, src.Name).Scan(&id)
+  return
+}
+
+// inserts hash if it's new and counts an occurrence of it in the source;
+// duplicate reports whether hash was already in table
+func InsertCredHashSourced(db *sql.DB, table string, hash []byte, sourceID int64, keyID uint16) (duplicate bool, err error) {
+  return insertCredHashSourced(db, "INSERT IGNORE INTO " + table + " (hash, key_id) VALUES (?, ?)",
+    "INSERT INTO " + SourceLinkTable(table) + " (hash, source_id, first_seen, last_seen) VALUES (?, ?, UTC_TIMESTAMP(), UTC_TIMESTAMP()) ON DUPLICATE KEY UPDATE count=count+1, last_seen=UTC_TIMESTAMP()",
+    hash, sourceID, keyID)
+}
+
+// insertHash takes the hash and key id and must ignore an existing hash;
+// upsertLink takes the hash and source id
+func insertCredHashSourced(db *sql.DB, insertHash, upsertLink string, hash []byte, sourceID int64, keyID uint16) (duplicate bool, err error) {
+  tx, err := db.Begin()
+  if err != nil {
+    return
+  }
+  defer tx.Rollback()
+  res, err := tx.Exec(insertHash, hash, int64(keyID))
+  if err != nil {
+    return
+  }
+  inserted, err := res.RowsAffected()
+  if err != nil {
+    return
+  }
+  _, err = tx.Exec(upsertLink, hash, sourceID)
+  if err != nil {
+    return
+  }
+  return inserted == 0, tx.Commit()
+}
+
+func SearchCredHashSightings(db *sql.DB, table string, hash []byte) ([]Sighting, error) {
+  return searchCredHashSightings(db, table, "?", hash)
+}
+
+// placeholder is the driver's placeholder for the hash
+func searchCredHashSightings(db *sql.DB, table, placeholder string, hash []byte) (sightings []Sighting, err error) {
+  rows, err := db.Query("SELECT s.id, s.name, s.date, s.description, l.count, l.first_seen, l.last_seen FROM " + SourceLinkTable(table) + " l JOIN " + SourceTable + " s ON s.id=l.source_id WHERE l.hash=" + placeholder, hash)
+  if err != nil {
+    return
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var s Sighting
+    var date sql.NullTime
+    var description sql.NullString
+    err = rows.Scan(&s.Source.ID, &s.Source.Name, &date, &description, &s.Count, &s.FirstSeen, &s.LastSeen)
+    if err != nil {
+      return nil, err
+    }
+    s.Source.Date = date.Time
+    s.Source.Description = description.String
+    sightings = append(sightings, s)
+  }
+  return sightings, rows.Err()
+}
+
+// adds hits, keyed by string(hash), to the checked column of table and
+// their sum to today's total
+func IncrementChecked(db *sql.DB, table string, hits map[string]int64) error {
+  return incrementChecked(db, "UPDATE " + table + " SET checked=checked+? WHERE hash=?",
+    "INSERT INTO " + HitsTable(table) + " (day, hits) VALUES (UTC_DATE(), ?) ON DUPLICATE KEY UPDATE hits=hits+VALUES(hits)", hits)
+}
+
+// runs update with each hash's hits, then addTotal with their sum, in one
+// transaction
+func incrementChecked(db *sql.DB, update, addTotal string, hits map[string]int64) error {
+  tx, err := db.Begin()
+  if err != nil {
+    return err
+  }
+  defer tx.Rollback()
+  stmt, err := tx.Prepare(update)
+  if err != nil {
+    return err
+  }
+  defer stmt.Close()
+  var total int64
+  for hash, n := range hits {
+    if _, err = stmt.Exec(n, []byte(hash)); err != nil {
+      return err
+    }
+    total += n
+  }
+  if _, err = tx.Exec(addTotal, total); err != nil {
+    return err
+  }
+  return tx.Commit()
+}
+
+// returns the daily totals of the last days days, oldest first
+func SearchHitsPerDay(db *sql.DB, table string, days int) ([]DayHits, error) {
+  return searchHitsPerDay(db, "SELECT DATE_FORMAT(day, '%Y-%m-%d'), hits FROM " + HitsTable(table) + " WHERE day > UTC_DATE() - INTERVAL ? DAY ORDER BY day", days)
+}
+
+// query selects YYYY-MM-DD days and their hits
+func searchHitsPerDay(db *sql.DB, query string, args ...interface{}) (hits []DayHits, err error) {
+  rows, err := db.Query(query, args...)
+  if err != nil {
+    return
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var h DayHits
+    if err = rows.Scan(&h.Day, &h.Hits); err != nil {
+      return nil, err
+    }
+    hits = append(hits, h)
+  }
+  return hits, rows.Err()
+}
+
+// returns the number of hashes in each of checkedBuckets
+func SearchCheckedDistribution(db *sql.DB, table string) ([]CheckedBucket, error) {
+  bucket := "CASE"
+  for i := len(checkedBuckets) - 1; i > 0; i -= 1 {
+    bucket += " WHEN checked >= " + strconv.FormatInt(checkedBuckets[i], 10) + " THEN " + strconv.Itoa(i)
+  }
+  bucket += " ELSE 0 END"
+  rows, err := db.Query("SELECT " + bucket + " AS bucket, COUNT(*) FROM " + table + " GROUP BY bucket")
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  buckets := newCheckedBuckets()
+  for rows.Next() {
+    var i int
+    var n int64
+    if err = rows.Scan(&i, &n); err != nil {
+      return nil, err
+    }
+    buckets[i].Hashes = n
+  }
+  return buckets, rows.Err()
+}
@@ -0,0 +1,349 @@
+package server
+
+import (
+  "context"
+  "errors"
+  "log"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+// default false-positive rate of the filter in front of each store
+const DefaultFilterFPRate = 0.001
+// default interval between filter rebuilds
+const DefaultFilterRefresh = time.Hour
+// default interval between reads of the hashes other processes, such as
+// cmd/encrypt, inserted since the filter was built
+const DefaultFilterCatchUp = 5 * time.Second
+// sequence numbers read again on each catch-up, since an insert can commit
+// after inserts numbered later; see Syncer
+const filterCatchUpRewind = 1000
+
+// FilterStats describes the filter in front of one store.
+type FilterStats struct{
+  Built          bool      `json:"built"`
+  // hashes in the filter when it was built
+  Entries        int64     `json:"entries"`
+  Bytes          int64     `json:"bytes"`
+  // expected false-positive rate for Entries hashes
+  FPRate         float64   `json:"fpRate"`
+  BuildMillis    int64     `json:"buildMillis"`
+  BuiltAt        time.Time `json:"builtAt"`
+  // lookups answered by the filter alone
+  Negatives      uint64    `json:"negatives"`
+  // lookups the filter passed on that the store didn't have
+  FalsePositives uint64    `json:"falsePositives"`
+}
+
+// FilteredStore keeps a Bloom filter of the hashes in Store so that
+// lookups of hashes that aren't stored, which are nearly all of them,
+// never reach the database. Lookups go straight to Store until the first
+// Rebuild. Hashes inserted through the FilteredStore are added at once;
+// if Store is a Syncer, CatchUp adds the ones inserted by other processes.
+// Until then a lookup of such a hash answers that it isn't stored.
+type FilteredStore struct{
+  Store
+  FPRate         float64
+  mu             sync.RWMutex
+  filter         *Bloom
+  // highest sequence number added to filter
+  seq            uint64
+  // hashes inserted while a rebuild is scanning; nil when not rebuilding
+  pending        [][]byte
+  stats          FilterStats
+  // hashes added to filter since it was built
+  inserted       int64
+  negatives      uint64
+  falsePositives uint64
+}
+
+func NewFilteredStore(store Store, fpRate float64) *FilteredStore {
+  return &FilteredStore{Store: store, FPRate: fpRate}
+}
+
+// reads every hash from Store into a new filter and swaps it in
+func (s *FilteredStore) Rebuild() error {
+  scanner, ok := s.Store.(Scanner)
+  if !ok {
+    return ErrScanUnsupported
+  }
+  start := time.Now()
+  count, err := s.Store.Count()
+  if err != nil {
+    return err
+  }
+  // taken before the scan, so that CatchUp adds whatever the scan misses
+  var seq uint64
+  if syncer := SyncerOf(s.Store); syncer != nil {
+    if seq, err = syncer.LastSeq(); err != nil {
+      return err
+    }
+  }
+  s.mu.Lock()
+  s.pending = [][]byte{}
+  s.mu.Unlock()
+  filter, entries, err := buildBloom(scanner, count, s.FPRate)
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if err != nil {
+    s.pending = nil
+    return err
+  }
+  for _, hash := range s.pending {
+    filter.Add(hash)
+  }
+  entries += int64(len(s.pending))
+  s.pending = nil
+  s.inserted = 0
+  s.filter = filter
+  s.seq = seq
+  elapsed := time.Since(start)
+  s.stats = FilterStats{
+    Built: true,
+    Entries: entries,
+    Bytes: filter.Size(),
+    FPRate: filter.FPRate(entries),
+    BuildMillis: elapsed.Milliseconds(),
+    BuiltAt: start,
+  }
+  return nil
+}
+
+// adds the hashes numbered after the last ones added to the filter, which
+// other processes inserted into Store; returns how many were new to it
+func (s *FilteredStore) CatchUp() (added int, err error) {
+  syncer := SyncerOf(s.Store)
+  if syncer == nil {
+    return 0, ErrSyncUnsupported
+  }
+  s.mu.RLock()
+  built := s.filter != nil
+  var since uint64
+  if s.seq > filterCatchUpRewind {
+    since = s.seq - filterCatchUpRewind
+  }
+  s.mu.RUnlock()
+  if !built {
+    return 0, nil
+  }
+  for {
+    entries, err := syncer.Since(since, DefaultSyncPageSize)
+    if err != nil || len(entries) == 0 {
+      return added, err
+    }
+    s.mu.Lock()
+    for _, e := range entries {
+      if !s.filter.Test(e.Hash) {
+        s.filter.Add(e.Hash)
+        s.inserted += 1
+        added += 1
+      }
+      if e.Seq > s.seq {
+        s.seq = e.Seq
+      }
+    }
+    s.mu.Unlock()
+    since = entries[len(entries) - 1].Seq
+    if len(entries) < DefaultSyncPageSize {
+      return added, nil
+    }
+  }
+}
+
+// rebuilds the filter every interval, and catches up with other processes'
+// inserts every catchUp if Store is a Syncer, until ctx is done
+func (s *FilteredStore) Refresh(ctx context.Context, every, catchUp time.Duration) {
+  ticker := time.NewTicker(every)
+  defer ticker.Stop()
+  var catchUpC <-chan time.Time
+  if SyncerOf(s.Store) != nil && catchUp > 0 {
+    catchUpTicker := time.NewTicker(catchUp)
+    defer catchUpTicker.Stop()
+    catchUpC = catchUpTicker.C
+  }
+  for {
+    select {
+    case <-ctx.Done():
+      return
+    case <-ticker.C:
+      if err := s.Rebuild(); err != nil {
+        log.Println("Rebuilding filter:", err)
+      }
+    case <-catchUpC:
+      if _, err := s.CatchUp(); err != nil {
+        log.Println("Catching up filter:", err)
+      }
+    }
+  }
+}
+
+func (s *FilteredStore) Stats() FilterStats {
+  s.mu.RLock()
+  stats := s.stats
+  s.mu.RUnlock()
+  stats.Negatives = atomic.LoadUint64(&s.negatives)
+  stats.FalsePositives = atomic.LoadUint64(&s.falsePositives)
+  return stats
+}
+
+// returns a copy of the filter and the number of hashes in it, or nil
+// before the first Rebuild
+func (s *FilteredStore) Snapshot() (*Bloom, int64) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+  if s.filter == nil {
+    return nil, 0
+  }
+  b := *s.filter
+  b.bits = append([]uint64{}, s.filter.bits...)
+  return &b, s.stats.Entries + s.inserted
+}
+
+// false if hash is certainly not stored
+func (s *FilteredStore) mayContain(hash []byte) bool {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+  return s.filter == nil || s.filter.Test(hash)
+}
+
+func (s *FilteredStore) Lookup(hash []byte) (bool, error) {
+  if !s.mayContain(hash) {
+    atomic.AddUint64(&s.negatives, 1)
+    return false, nil
+  }
+  found, err := s.Store.Lookup(hash)
+  if err == nil && !found {
+    atomic.AddUint64(&s.falsePositives, 1)
+  }
+  return found, err
+}
+
+// only the hashes the filter can't rule out are passed to Store
+func (s *FilteredStore) LookupMany(hashes [][]byte) ([]bool, error) {
+  results := make([]bool, len(hashes))
+  var maybe [][]byte
+  var indices []int
+  for i, hash := range hashes {
+    if s.mayContain(hash) {
+      maybe = append(maybe, hash)
+      indices = append(indices, i)
+    }
+  }
+  atomic.AddUint64(&s.negatives, uint64(len(hashes) - len(maybe)))
+  if len(maybe) == 0 {
+    return results, nil
+  }
+  found, err := s.Store.LookupMany(maybe)
+  if err != nil {
+    return nil, err
+  }
+  for i, ok := range found {
+    results[indices[i]] = ok
+    if !ok {
+      atomic.AddUint64(&s.falsePositives, 1)
+    }
+  }
+  return results, nil
+}
+
+func (s *FilteredStore) Insert(hash []byte) error {
+  return s.added(hash, s.Store.Insert(hash))
+}
+
+// drops keyID if Store doesn't record pepper key ids
+func (s *FilteredStore) InsertKeyed(hash []byte, keyID uint16) error {
+  keyed, ok := s.Store.(KeyedStore)
+  if !ok {
+    return s.Insert(hash)
+  }
+  return s.added(hash, keyed.InsertKeyed(hash, keyID))
+}
+
+func (s *FilteredStore) AddSource(src Source) (int64, error) {
+  sourced, ok := s.Store.(SourcedStore)
+  if !ok {
+    return 0, ErrSourcesUnsupported
+  }
+  return sourced.AddSource(src)
+}
+
+func (s *FilteredStore) InsertSourced(hash []byte, sourceID int64, keyID uint16) error {
+  sourced, ok := s.Store.(SourcedStore)
+  if !ok {
+    return ErrSourcesUnsupported
+  }
+  return s.added(hash, sourced.InsertSourced(hash, sourceID, keyID))
+}
+
+func (s *FilteredStore) Sightings(hash []byte) ([]Sighting, error) {
+  sourced, ok := s.Store.(SourcedStore)
+  if !ok {
+    return nil, ErrSourcesUnsupported
+  }
+  return sourced.Sightings(hash)
+}
+
+// adds hash to the filter if it's now in Store
+func (s *FilteredStore) added(hash []byte, err error) error {
+  if err != nil && err != ErrDuplicate {
+    return err
+  }
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if s.filter != nil {
+    s.filter.Add(hash)
+    if err == nil {
+      s.inserted += 1
+    }
+  }
+  if s.pending != nil {
+    s.pending = append(s.pending, hash)
+  }
+  return err
+}
+
+// deleted hashes stay in the filter until the next rebuild
+func (s *FilteredStore) DeleteKey(keyID uint16) (int64, error) {
+  keyed, ok := s.Store.(KeyedStore)
+  if !ok {
+    return 0, errors.New("Store does not record pepper key ids.")
+  }
+  return keyed.DeleteKey(keyID)
+}
+
+func (s *FilteredStore) Scan(fn func(hash []byte) error) error {
+  scanner, ok := s.Store.(Scanner)
+  if !ok {
+    return ErrScanUnsupported
+  }
+  return scanner.Scan(fn)
+}
+
+// scans every hash into a filter sized for count, with room for the
+// hashes inserted before the next rebuild
+func buildBloom(scanner Scanner, count int64, fpRate float64) (b *Bloom, entries int64, err error) {
+  b = NewBloom(count + count / 10, fpRate)
+  err = scanner.Scan(func(hash []byte) error {
+    b.Add(hash)
+    entries += 1
+    return nil
+  })
+  if err != nil {
+    return nil, 0, err
+  }
+  return
+}
+
+func (s *FilteredStore) Unwrap() Store {
+  return s.Store
+}
+
+// returns the FilteredStore in store's chain of wrappers, if any
+func FilterOf(store Store) *FilteredStore {
+  f, _ := findStore(store, func(s Store) bool {
+    _, ok := s.(*FilteredStore)
+    return ok
+  }).(*FilteredStore)
+  return f
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+  "crypto/rand"
+  "testing"
+)
+
+func randomHash(t *testing.T) []byte {
+  hash := make([]byte, CredHashLen)
+  if _, err := rand.Read(hash); err != nil {
+    t.Fatal(err)
+  }
+  return hash
+}
+
+func TestBloomFPRate(t *testing.T) {
+  b := NewBloom(10000, 0.01)
+  for i := 0; i < 10000; i += 1 {
+    b.Add(randomHash(t))
+  }
+  positives := 0
+  for i := 0; i < 10000; i += 1 {
+    if b.Test(randomHash(t)) {
+      positives += 1
+    }
+  }
+  // expect about 100
+  if positives > 200 {
+    t.Errorf("Expected a false-positive rate near 1%%. Got %d in 10000\n", positives)
+  }
+  short := []byte("short")
+  b.Add(short)
+  if !b.Test(short) {
+    t.Error("Expected a short hash to be found after adding it")
+  }
+}
+
+func TestFilteredStore(t *testing.T) {
+  mem := NewMemStore()
+  stored := make([][]byte, 100)
+  for i := range stored {
+    stored[i] = randomHash(t)
+    mem.Insert(stored[i])
+  }
+  s := NewFilteredStore(mem, 0.001)
+  if err := s.Rebuild(); err != nil {
+    t.Fatal(err)
+  }
+  for _, hash := range stored {
+    found, _ := s.Lookup(hash)
+    if !found {
+      t.Fatal("Expected every stored hash to be found")
+    }
+  }
+  // inserts after the build must be visible right away
+  inserted := randomHash(t)
+  if err := s.Insert(inserted); err != nil {
+    t.Fatal(err)
+  }
+  safe := randomHash(t)
+  results, err := s.LookupMany([][]byte{safe, inserted, stored[0]})
+  if err != nil {
+    t.Fatal(err)
+  }
+  if results[0] || !results[1] || !results[2] {
+    t.Errorf("Expected [false true true]. Got %v\n", results)
+  }
+  stats := s.Stats()
+  if !stats.Built || stats.Entries != 100 || stats.Bytes == 0 || stats.FPRate <= 0 {
+    t.Errorf("Unexpected stats %+v\n", stats)
+  }
+  if stats.Negatives + stats.FalsePositives != 1 {
+    t.Errorf("Expected the one safe hash to be counted. Got %+v\n", stats)
+  }
+  if FilterOf(NewPepperedStore(s, Keyring{{1, make([]byte, 32)}})) != s {
+    t.Error("Expected to find the filter under a PepperedStore")
+  }
+}
+
+func TestFilteredStoreCatchUp(t *testing.T) {
+  mem := NewMemStore()
+  mem.Insert(randomHash(t))
+  s := NewFilteredStore(mem, 0.001)
+  if err := s.Rebuild(); err != nil {
+    t.Fatal(err)
+  }
+  // imported by another process, behind the filter's back
+  imported := randomHash(t)
+  mem.Insert(imported)
+  added, err := s.CatchUp()
+  if err != nil || added != 1 {
+    t.Fatalf("Expected to add 1 hash. Got %d, %v\n", added, err)
+  }
+  if found, _ := s.Lookup(imported); !found {
+    t.Error("Expected the imported hash to be found after catching up")
+  }
+  if added, _ = s.CatchUp(); added != 0 {
+    t.Errorf("Expected nothing new on the next catch-up. Got %d\n", added)
+  }
+}
@@ -0,0 +1,366 @@
+package server
+
+import (
+  "bufio"
+  "bytes"
+  "container/heap"
+  "encoding/binary"
+  "errors"
+  "io"
+  "os"
+  "path/filepath"
+  "sort"
+  "strconv"
+)
+
+// A flat file holds a read-only set of fixed-width hashes:
+//
+//   header, flatHeaderLen bytes:
+//     "CCDSH", version byte, 2 reserved bytes,
+//     hash length as a little-endian uint32, 4 reserved bytes,
+//     number of hashes as a little-endian uint64, reserved zeros
+//   fan-out index, flatFanout little-endian uint64s: entry i is the number
+//     of hashes whose first two bytes are at most i
+//   the hashes, sorted and without duplicates
+//
+// so a lookup is a binary search within the run of hashes sharing its
+// first two bytes.
+const flatMagic = "CCDSH"
+const flatVersion = 1
+const flatHeaderLen = 64
+const flatFanout = 1 << 16
+const flatIndexLen = flatFanout * 8
+
+// default number of hashes FlatFileBuilder sorts in memory at once
+const DefaultFlatFileRunSize = 1 << 22
+
+var ErrReadOnly = errors.New("Store is read-only.")
+
+var ErrBadFlatFile = errors.New("Not a CCDS hash file, or it is truncated.")
+
+// FlatFileStore answers lookups from a file written by FlatFileBuilder,
+// mapped into memory.
+type FlatFileStore struct{
+  HashLen uint32
+  count   int64
+  // the whole file
+  data    []byte
+  index   []byte
+  hashes  []byte
+}
+
+func OpenFlatFileStore(path string) (*FlatFileStore, error) {
+  f, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+  info, err := f.Stat()
+  if err != nil {
+    return nil, err
+  }
+  if info.Size() < flatHeaderLen + flatIndexLen {
+    return nil, ErrBadFlatFile
+  }
+  data, err := mmapFile(f, int(info.Size()))
+  if err != nil {
+    return nil, err
+  }
+  s := &FlatFileStore{data: data}
+  if err = s.parse(); err != nil {
+    munmapFile(data)
+    return nil, err
+  }
+  return s, nil
+}
+
+func (s *FlatFileStore) parse() error {
+  header := s.data[:flatHeaderLen]
+  if string(header[:len(flatMagic)]) != flatMagic {
+    return ErrBadFlatFile
+  }
+  if header[5] != flatVersion {
+    return errors.New("Unsupported hash file version " + strconv.Itoa(int(header[5])) + ".")
+  }
+  s.HashLen = binary.LittleEndian.Uint32(header[8:12])
+  s.count = int64(binary.LittleEndian.Uint64(header[16:24]))
+  if s.HashLen < 2 || s.count < 0 || int64(len(s.data)) != flatHeaderLen + flatIndexLen + s.count * int64(s.HashLen) {
+    return ErrBadFlatFile
+  }
+  s.index = s.data[flatHeaderLen:flatHeaderLen + flatIndexLen]
+  s.hashes = s.data[flatHeaderLen + flatIndexLen:]
+  // lookups slice s.hashes by these, so a corrupt entry must not get past
+  // here
+  var prev int64
+  for i := 0; i < flatFanout; i += 1 {
+    n := s.fanout(i)
+    if n < prev || n > s.count {
+      return ErrBadFlatFile
+    }
+    prev = n
+  }
+  if prev != s.count {
+    return ErrBadFlatFile
+  }
+  return nil
+}
+
+func (s *FlatFileStore) fanout(i int) int64 {
+  return int64(binary.LittleEndian.Uint64(s.index[i * 8:]))
+}
+
+func (s *FlatFileStore) hash(i int64) []byte {
+  n := int64(s.HashLen)
+  return s.hashes[i * n:(i + 1) * n]
+}
+
+// index of the first hash >= target within [lo, hi)
+func (s *FlatFileStore) search(lo, hi int64, target []byte) int64 {
+  return lo + int64(sort.Search(int(hi - lo), func(i int) bool {
+    return bytes.Compare(s.hash(lo + int64(i)), target) >= 0
+  }))
+}
+
+func (s *FlatFileStore) Lookup(hash []byte) (bool, error) {
+  if len(hash) != int(s.HashLen) {
+    return false, nil
+  }
+  prefix := int(hash[0]) << 8 | int(hash[1])
+  var lo int64
+  if prefix > 0 {
+    lo = s.fanout(prefix - 1)
+  }
+  hi := s.fanout(prefix)
+  i := s.search(lo, hi, hash)
+  return i < hi && bytes.Equal(s.hash(i), hash), nil
+}
+
+func (s *FlatFileStore) LookupMany(hashes [][]byte) ([]bool, error) {
+  results := make([]bool, len(hashes))
+  for i, hash := range hashes {
+    results[i], _ = s.Lookup(hash)
+  }
+  return results, nil
+}
+
+func (s *FlatFileStore) LookupRange(prefix string) (hashes [][]byte, err error) {
+  lo, hi, err := RangeBounds(prefix)
+  if err != nil {
+    return
+  }
+  for i := s.search(0, s.count, lo); i < s.count && InRange(s.hash(i), lo, hi); i += 1 {
+    hashes = append(hashes, append([]byte(nil), s.hash(i)...))
+  }
+  return
+}
+
+func (s *FlatFileStore) Scan(fn func(hash []byte) error) error {
+  for i := int64(0); i < s.count; i += 1 {
+    if err := fn(append([]byte(nil), s.hash(i)...)); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// the file is rebuilt with FlatFileBuilder instead
+func (s *FlatFileStore) Insert(hash []byte) error {
+  return ErrReadOnly
+}
+
+func (s *FlatFileStore) Count() (int64, error) {
+  return s.count, nil
+}
+
+func (s *FlatFileStore) CreateTables() error {
+  return nil
+}
+
+func (s *FlatFileStore) Close() error {
+  data := s.data
+  s.data, s.index, s.hashes, s.count = nil, nil, nil, 0
+  return munmapFile(data)
+}
+
+// FlatFileBuilder writes a flat file of hashes added in any order. Hashes
+// are sorted in runs of RunSize, which are spilled to TmpDir and merged,
+// so the set may be far larger than memory.
+type FlatFileBuilder struct{
+  HashLen int
+  RunSize int
+  // empty means os.TempDir()
+  TmpDir  string
+  buf     []byte
+  runs    []string
+}
+
+func NewFlatFileBuilder(hashLen int) *FlatFileBuilder {
+  return &FlatFileBuilder{HashLen: hashLen, RunSize: DefaultFlatFileRunSize}
+}
+
+func (b *FlatFileBuilder) Add(hash []byte) error {
+  if len(hash) != b.HashLen {
+    return errors.New("Expected a " + strconv.Itoa(b.HashLen) + " byte hash. Got " + strconv.Itoa(len(hash)) + " bytes.")
+  }
+  b.buf = append(b.buf, hash...)
+  if len(b.buf) >= b.RunSize * b.HashLen {
+    return b.spill()
+  }
+  return nil
+}
+
+// sorts the buffered hashes into a run file
+func (b *FlatFileBuilder) spill() (err error) {
+  sort.Sort(hashRun{b.buf, b.HashLen, make([]byte, b.HashLen)})
+  f, err := os.CreateTemp(b.TmpDir, "ccds-run-")
+  if err != nil {
+    return
+  }
+  b.runs = append(b.runs, f.Name())
+  w := bufio.NewWriter(f)
+  if _, err = w.Write(b.buf); err == nil {
+    err = w.Flush()
+  }
+  if closeErr := f.Close(); err == nil {
+    err = closeErr
+  }
+  b.buf = b.buf[:0]
+  return
+}
+
+// writes the sorted, deduplicated hashes to path and removes the runs;
+// returns the number written
+func (b *FlatFileBuilder) WriteFile(path string) (count int64, err error) {
+  defer func() {
+    for _, run := range b.runs {
+      os.Remove(run)
+    }
+    b.runs = nil
+  }()
+  if len(b.buf) > 0 || len(b.runs) == 0 {
+    if err = b.spill(); err != nil {
+      return
+    }
+  }
+  tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path) + ".tmp-")
+  if err != nil {
+    return
+  }
+  defer os.Remove(tmp.Name())
+  count, err = b.merge(tmp)
+  if closeErr := tmp.Close(); err == nil {
+    err = closeErr
+  }
+  if err != nil {
+    return
+  }
+  return count, os.Rename(tmp.Name(), path)
+}
+
+// merges the runs into f after a placeholder header and index, then fills
+// them in
+func (b *FlatFileBuilder) merge(f *os.File) (count int64, err error) {
+  if _, err = f.Write(make([]byte, flatHeaderLen + flatIndexLen)); err != nil {
+    return
+  }
+  h := &runHeap{}
+  for _, run := range b.runs {
+    r, err := os.Open(run)
+    if err != nil {
+      return 0, err
+    }
+    defer r.Close()
+    cursor := &runCursor{r: bufio.NewReader(r), hash: make([]byte, b.HashLen)}
+    if err = cursor.next(); err == nil {
+      heap.Push(h, cursor)
+    } else if err != io.EOF {
+      return 0, err
+    }
+  }
+  counts := make([]uint64, flatFanout)
+  w := bufio.NewWriter(f)
+  last := make([]byte, 0, b.HashLen)
+  for h.Len() > 0 {
+    cursor := (*h)[0]
+    if count == 0 || !bytes.Equal(cursor.hash, last) {
+      if _, err = w.Write(cursor.hash); err != nil {
+        return
+      }
+      counts[int(cursor.hash[0]) << 8 | int(cursor.hash[1])] += 1
+      last = append(last[:0], cursor.hash...)
+      count += 1
+    }
+    if err = cursor.next(); err == io.EOF {
+      heap.Pop(h)
+    } else if err != nil {
+      return
+    } else {
+      heap.Fix(h, 0)
+    }
+  }
+  if err = w.Flush(); err != nil {
+    return
+  }
+  header := make([]byte, flatHeaderLen + flatIndexLen)
+  copy(header, flatMagic)
+  header[5] = flatVersion
+  binary.LittleEndian.PutUint32(header[8:12], uint32(b.HashLen))
+  binary.LittleEndian.PutUint64(header[16:24], uint64(count))
+  var total uint64
+  for i, n := range counts {
+    total += n
+    binary.LittleEndian.PutUint64(header[flatHeaderLen + i * 8:], total)
+  }
+  if _, err = f.WriteAt(header, 0); err != nil {
+    return
+  }
+  return count, f.Sync()
+}
+
+// hashRun sorts the fixed-width hashes in buf in place.
+type hashRun struct{
+  buf []byte
+  n   int
+  tmp []byte
+}
+
+func (r hashRun) Len() int {
+  return len(r.buf) / r.n
+}
+
+func (r hashRun) Less(i, j int) bool {
+  return bytes.Compare(r.buf[i * r.n:(i + 1) * r.n], r.buf[j * r.n:(j + 1) * r.n]) < 0
+}
+
+func (r hashRun) Swap(i, j int) {
+  a, b := r.buf[i * r.n:(i + 1) * r.n], r.buf[j * r.n:(j + 1) * r.n]
+  copy(r.tmp, a)
+  copy(a, b)
+  copy(b, r.tmp)
+}
+
+// runCursor is the next unmerged hash of a run.
+type runCursor struct{
+  r    *bufio.Reader
+  hash []byte
+}
+
+func (c *runCursor) next() error {
+  _, err := io.ReadFull(c.r, c.hash)
+  return err
+}
+
+// runHeap orders cursors by their current hash.
+type runHeap []*runCursor
+
+func (h runHeap) Len() int { return len(h) }
+func (h runHeap) Less(i, j int) bool { return bytes.Compare(h[i].hash, h[j].hash) < 0 }
+func (h runHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(*runCursor)) }
+
+func (h *runHeap) Pop() interface{} {
+  old := *h
+  c := old[len(old) - 1]
+  *h = old[:len(old) - 1]
+  return c
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+  "bytes"
+  "encoding/binary"
+  "encoding/hex"
+  "os"
+  "path/filepath"
+  "sort"
+  "testing"
+)
+
+func TestFlatFileStore(t *testing.T) {
+  dir := t.TempDir()
+  b := NewFlatFileBuilder(CredHashLen)
+  b.TmpDir = dir
+  // force several runs to merge
+  b.RunSize = 100
+  var hashes [][]byte
+  for i := 0; i < 1000; i += 1 {
+    hash := randomHash(t)
+    hashes = append(hashes, hash)
+    b.Add(hash)
+  }
+  // duplicates across runs are written once
+  for _, hash := range hashes[:50] {
+    b.Add(hash)
+  }
+  // and hashes sharing their first two bytes land in one fan-out bucket
+  shared := append([]byte{0, 0}, randomHash(t)[2:]...)
+  hashes = append(hashes, shared)
+  b.Add(shared)
+  path := filepath.Join(dir, "hashes")
+  count, err := b.WriteFile(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if count != int64(len(hashes)) {
+    t.Errorf("Expected %d hashes. Got %d\n", len(hashes), count)
+  }
+  if runs, _ := filepath.Glob(filepath.Join(dir, "ccds-run-*")); len(runs) != 0 {
+    t.Errorf("Expected the runs to be removed. Got %v\n", runs)
+  }
+
+  s, err := OpenFlatFileStore(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer s.Close()
+  found, _ := s.LookupMany(hashes)
+  for i, ok := range found {
+    if !ok {
+      t.Errorf("Expected hash %d to be found\n", i)
+    }
+  }
+  if ok, _ := s.Lookup(randomHash(t)); ok {
+    t.Error("Expected a missing hash not to be found")
+  }
+  if err = s.Insert(randomHash(t)); err != ErrReadOnly {
+    t.Errorf("Expected ErrReadOnly. Got %v\n", err)
+  }
+
+  prefix := hex.EncodeToString(hashes[0][:2])[:3]
+  inRange, err := s.LookupRange(prefix)
+  if err != nil {
+    t.Fatal(err)
+  }
+  expected := 0
+  for _, hash := range hashes {
+    if hex.EncodeToString(hash)[:3] == prefix {
+      expected += 1
+    }
+  }
+  if len(inRange) != expected {
+    t.Errorf("Expected %d hashes with prefix %s. Got %d\n", expected, prefix, len(inRange))
+  }
+
+  var scanned [][]byte
+  s.Scan(func(hash []byte) error {
+    scanned = append(scanned, hash)
+    return nil
+  })
+  sort.Slice(hashes, func(i, j int) bool {
+    return bytes.Compare(hashes[i], hashes[j]) < 0
+  })
+  for i := range hashes {
+    if !bytes.Equal(scanned[i], hashes[i]) {
+      t.Fatalf("Expected hashes to be scanned in order. Mismatch at %d\n", i)
+    }
+  }
+
+  data, _ := os.ReadFile(path)
+  // an index entry past the count, and one below the entry before it
+  for _, corrupt := range []uint64{uint64(count) + 1, 0} {
+    bad := append([]byte(nil), data...)
+    binary.LittleEndian.PutUint64(bad[flatHeaderLen + 100 * 8:], corrupt)
+    os.WriteFile(path, bad, 0600)
+    if _, err = OpenFlatFileStore(path); err != ErrBadFlatFile {
+      t.Errorf("Expected a fan-out entry of %d to be rejected. Got %v\n", corrupt, err)
+    }
+  }
+  os.WriteFile(path, data[:len(data) - 1], 0600)
+  if _, err = OpenFlatFileStore(path); err != ErrBadFlatFile {
+    t.Errorf("Expected a truncated file to be rejected. Got %v\n", err)
+  }
+}
+
+func TestFlatFileStoreEmpty(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "hashes")
+  if _, err := NewFlatFileBuilder(CredHashLen).WriteFile(path); err != nil {
+    t.Fatal(err)
+  }
+  s, err := OpenFlatFileStore(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer s.Close()
+  if ok, _ := s.Lookup(randomHash(t)); ok {
+    t.Error("Expected nothing to be found in an empty file")
+  }
+}
@@ -1,45 +1,139 @@
 package server
 
 import (
-  "database/sql"
   "encoding/json"
   "io"
   "net/http"
+  "strconv"
 )
 
+// default limit on the number of hashes in one /creds request
+const DefaultMaxBatchSize = 1000
+
 type CredReqBody struct{
   Hash     string `json:"hash"`
   Encoding string `json:"encoding"`
+  // name of the ParamSet the hash was made with; empty means the default
+  Params   string `json:"params,omitempty"`
+  // optional hash of the password alone with the tenant's blocklist salt
+  PasswordHash string `json:"passwordHash,omitempty"`
 }
 
 type CredRes struct{
-  Compromised bool `json:"compromised"`
+  Compromised bool   `json:"compromised"`
+  // MatchedGlobal or MatchedTenant if compromised
+  MatchedBy   string `json:"matchedBy,omitempty"`
+}
+
+type CredsReqBody struct{
+  Hashes   []string `json:"hashes"`
+  Encoding string   `json:"encoding"`
+  Params   string   `json:"params,omitempty"`
+  // optional; PasswordHashes[i] is the blocklist hash for Hashes[i]
+  PasswordHashes []string `json:"passwordHashes,omitempty"`
+}
+
+// Results[i] is the result for Hashes[i] of the request
+type CredsRes struct{
+  Results []CredRes `json:"results"`
 }
 
 type credErr struct{
   Err string `json:"err"`
 }
 
-func CredHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+// canaries and blocklist may be nil
+func CredHandler(w http.ResponseWriter, r *http.Request, registry *Registry, canaries *Canaries, blocklist BlocklistStore) {
   var req CredReqBody
   err := DecodeBody(r.Body, &req)
   if err != nil {
     respondWithJSON(w, http.StatusBadRequest, credErr{"An error occurred parsing the request body"})
     return
   }
-  var hash []byte
-  switch req.Encoding {
-  case "utf8":
-    hash = []byte(req.Hash)
-  default:
-    hash = []byte(req.Hash)
+  p, store, err := registry.Get(req.Params)
+  if err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{err.Error()})
+    return
+  }
+  hash, err := DecodeHash(req.Hash, req.Encoding, int(p.KeyLen))
+  if err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{err.Error()})
+    return
+  }
+  canaries.Check(r, p.Name, hash)
+  compromised, err := store.Lookup(hash)
+  if err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{err.Error()})
+    return
+  }
+  if compromised && !chargeHits(w, r, 1) {
+    return
+  }
+  blocked, err := checkBlocklist(r, blocklist, p, req.Encoding, []string{req.PasswordHash})
+  if err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{err.Error()})
+    return
+  }
+  tenantMatch := blocked != nil && blocked[0]
+  respondWithJSON(w, http.StatusOK, CredRes{compromised || tenantMatch, matchedBy(compromised, tenantMatch)})
+}
+
+func CredsHandler(w http.ResponseWriter, r *http.Request, registry *Registry, maxBatchSize int, canaries *Canaries, blocklist BlocklistStore) {
+  var req CredsReqBody
+  err := DecodeBody(r.Body, &req)
+  if err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{"An error occurred parsing the request body"})
+    return
+  }
+  if len(req.Hashes) > maxBatchSize {
+    respondWithJSON(w, http.StatusRequestEntityTooLarge, credErr{"Expected at most " + strconv.Itoa(maxBatchSize) + " hashes. Got " + strconv.Itoa(len(req.Hashes)) + "."})
+    return
+  }
+  p, store, err := registry.Get(req.Params)
+  if err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{err.Error()})
+    return
+  }
+  hashes := make([][]byte, len(req.Hashes))
+  for i, encoded := range req.Hashes {
+    hashes[i], err = DecodeHash(encoded, req.Encoding, int(p.KeyLen))
+    if err != nil {
+      respondWithJSON(w, http.StatusBadRequest, credErr{"Hash " + strconv.Itoa(i) + ": " + err.Error()})
+      return
+    }
   }
-  compromised, err := SearchCredHash(db, hash)
+  if len(req.PasswordHashes) > len(req.Hashes) {
+    respondWithJSON(w, http.StatusBadRequest, credErr{"Expected at most one password hash per hash."})
+    return
+  }
+  canaries.Check(r, p.Name, hashes...)
+  found, err := store.LookupMany(hashes)
+  if err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{err.Error()})
+    return
+  }
+  blocked, err := checkBlocklist(r, blocklist, p, req.Encoding, req.PasswordHashes)
   if err != nil {
     respondWithJSON(w, http.StatusBadRequest, credErr{err.Error()})
-  } else {
-    respondWithJSON(w, http.StatusOK, CredRes{compromised})
+    return
+  }
+  res := CredsRes{make([]CredRes, len(found))}
+  hits := 0
+  for i, compromised := range found {
+    tenantMatch := i < len(blocked) && blocked[i]
+    res.Results[i] = CredRes{compromised || tenantMatch, matchedBy(compromised, tenantMatch)}
+    if compromised {
+      hits += 1
+    }
+  }
+  if !chargeHits(w, r, hits) {
+    return
   }
+  respondWithJSON(w, http.StatusOK, res)
+}
+
+func ParamsHandler(w http.ResponseWriter, registry *Registry) {
+  respondWithJSON(w, http.StatusOK, ParamsRes{registry.Default, registry.ParamSets()})
 }
 
 func DecodeBody(body io.ReadCloser, v interface{}) error {
@@ -0,0 +1,788 @@
+package server
+
+import (
+  "bufio"
+  "context"
+  "crypto/rand"
+  "database/sql"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "io"
+  "log"
+  "net/http"
+  "os"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "sync"
+  "time"
+
+  "github.com/gorilla/mux"
+)
+
+const JobTable = "audit_job"
+const JobTableCreate = `
+  CREATE TABLE IF NOT EXISTS ` + JobTable + ` (
+    id char(16) NOT NULL,
+    tenant varchar(64) NOT NULL,
+    api_key_id varchar(16) NOT NULL,
+    ip varchar(64) NOT NULL,
+    params varchar(64) NOT NULL,
+    encoding varchar(16) NOT NULL,
+    status varchar(16) NOT NULL,
+    total bigint unsigned NOT NULL,
+    processed bigint unsigned NOT NULL DEFAULT '0',
+    matched bigint unsigned NOT NULL DEFAULT '0',
+    result_bytes bigint unsigned NOT NULL DEFAULT '0',
+    error text,
+    created datetime NOT NULL,
+    finished datetime NULL,
+    heartbeat datetime NULL,
+    PRIMARY KEY (id),
+    KEY status_created (status, created)
+  ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+`
+
+// values of Job.Status
+const (
+  JobQueued  = "queued"
+  JobRunning = "running"
+  JobDone    = "done"
+  JobFailed  = "failed"
+)
+
+// supported upload formats
+const (
+  // one {"hash": "..."} object per line, in the job's encoding
+  JobFormatNDJSON = "ndjson"
+  // hashes of the parameter set's key length, back to back
+  JobFormatBinary = "binary"
+)
+
+const DefaultJobWorkers = 2
+const DefaultMaxJobUpload = 1 << 30
+// hashes looked up between checkpoints
+const jobChunk = 1000
+// how often idle workers look for queued jobs they weren't woken for
+const jobPoll = 5 * time.Second
+// a running job whose heartbeat is older than this is taken to have lost
+// its worker, e.g. to a crash, and is queued again
+const jobLease = 10 * time.Minute
+
+var ErrJobsDisabled = errors.New("Jobs are not enabled on this server.")
+
+// without auth every job would share tenant "", so anyone could read
+// anyone else's results by ID
+var ErrJobNoTenant = errors.New("Jobs require an API key.")
+
+var ErrUnknownJob = errors.New("No such job.")
+
+var ErrJobNotDone = errors.New("The job has not finished.")
+
+// the Error of a job stopped early; its results stop at Processed
+var ErrJobHitLimit = errors.New("Stopped at the hit limit; the results cover the hashes up to processed.")
+
+// Job is an audit of an uploaded file of hashes, looked up in the
+// background. Uploads are stored as raw hashes, so a job interrupted by a
+// restart resumes from its last checkpoint.
+type Job struct{
+  ID          string     `json:"id"`
+  Tenant      string     `json:"-"`
+  // of the submitting key and client, for canary alerts
+  APIKeyID    string     `json:"-"`
+  IP          string     `json:"-"`
+  Params      string     `json:"params"`
+  // of the results
+  Encoding    string     `json:"encoding"`
+  Status      string     `json:"status"`
+  // hashes uploaded
+  Total       int64      `json:"total"`
+  Processed   int64      `json:"processed"`
+  Matched     int64      `json:"matched"`
+  // size of the results file at the last checkpoint
+  ResultBytes int64      `json:"-"`
+  Error       string     `json:"error,omitempty"`
+  Created     time.Time  `json:"created"`
+  Finished    *time.Time `json:"finished,omitempty"`
+  // set by the worker running the job at each checkpoint
+  Heartbeat   *time.Time `json:"-"`
+}
+
+// JobMatch is a line of a job's results: a compromised hash and its
+// position in the upload.
+type JobMatch struct{
+  Index int64  `json:"index"`
+  Hash  string `json:"hash"`
+}
+
+type JobStore interface {
+  InsertJob(job Job) error
+  // returns ErrUnknownJob if there is no job with id
+  GetJob(id string) (Job, error)
+  UpdateJob(job Job) error
+  DeleteJob(id string) error
+  // returns up to limit jobs with status, oldest first
+  JobsWithStatus(status string, limit int) ([]Job, error)
+  // marks the queued job id running with a heartbeat of now; false if it
+  // isn't queued, e.g. because another server claimed it first
+  ClaimJob(id string, now time.Time) (bool, error)
+  // queues the running jobs whose heartbeat is before stale, or missing
+  RequeueStaleJobs(stale time.Time) (int64, error)
+  CreateTables() error
+}
+
+// Jobs runs queued jobs on a fixed number of workers, keeping uploads and
+// results in Dir. Several servers may share the Store, but then also need
+// to share Dir.
+type Jobs struct{
+  Store      JobStore
+  Dir        string
+  Params     *Registry
+  // may be nil
+  Canaries   *Canaries
+  // the hit limit, see RateLimiter.HitLimiter; a job's matches are
+  // charged to the client that submitted it, and the job stops when the
+  // client runs out. nil means no limit.
+  Hits       *Limiter
+  Workers    int
+  // limit on the size of an upload, in bytes
+  MaxUpload  int64
+  // whether to take the submitter's IP from X-Forwarded-For, see ClientIP
+  TrustProxy bool
+  // held while deleting a job
+  mu         sync.Mutex
+  wake       chan struct{}
+}
+
+func NewJobs(store JobStore, dir string, params *Registry) *Jobs {
+  return &Jobs{
+    Store: store,
+    Dir: dir,
+    Params: params,
+    Workers: DefaultJobWorkers,
+    MaxUpload: DefaultMaxJobUpload,
+    wake: make(chan struct{}, 1),
+  }
+}
+
+// starts the workers, which stop when ctx is done and queue the jobs they
+// were running again, so that any server sharing the Store resumes them.
+// Jobs whose worker died without doing so are queued again once their
+// heartbeat is jobLease old.
+func (j *Jobs) Start(ctx context.Context) error {
+  if err := os.MkdirAll(j.Dir, 0700); err != nil {
+    return err
+  }
+  for i := 0; i < j.Workers; i += 1 {
+    go j.work(ctx)
+  }
+  return nil
+}
+
+func (j *Jobs) work(ctx context.Context) {
+  for {
+    job, ok, err := j.claim()
+    if err != nil {
+      log.Println("Claiming job:", err)
+    }
+    if !ok {
+      select {
+      case <-ctx.Done():
+        return
+      case <-j.wake:
+      case <-time.After(jobPoll):
+      }
+      continue
+    }
+    err = j.run(ctx, job)
+    if ctx.Err() != nil {
+      j.release(job.ID)
+      return
+    }
+    if err != nil {
+      log.Println("Job", job.ID, "failed:", err)
+    }
+  }
+}
+
+// marks the oldest queued job that no other worker claims first running
+func (j *Jobs) claim() (job Job, ok bool, err error) {
+  now := time.Now().UTC().Truncate(time.Second)
+  requeued, err := j.Store.RequeueStaleJobs(now.Add(-jobLease))
+  if err != nil {
+    return
+  }
+  if requeued > 0 {
+    log.Println("Resuming", requeued, "interrupted jobs")
+  }
+  queued, err := j.Store.JobsWithStatus(JobQueued, j.Workers + 1)
+  if err != nil {
+    return
+  }
+  for _, job = range queued {
+    ok, err = j.Store.ClaimJob(job.ID, now)
+    if err != nil {
+      return Job{}, false, err
+    }
+    if ok {
+      job.Status = JobRunning
+      job.Heartbeat = &now
+      return job, true, nil
+    }
+  }
+  return Job{}, false, nil
+}
+
+// queues a job stopped by shutdown again, from its last checkpoint
+func (j *Jobs) release(id string) {
+  job, err := j.Store.GetJob(id)
+  if err == nil && job.Status == JobRunning {
+    job.Status = JobQueued
+    err = j.Store.UpdateJob(job)
+  }
+  if err != nil {
+    log.Println("Requeueing job", id + ":", err)
+  }
+}
+
+// looks up the rest of job's hashes, checkpointing after each chunk
+func (j *Jobs) run(ctx context.Context, job Job) (err error) {
+  defer func() {
+    if err != nil && ctx.Err() == nil {
+      job.Status = JobFailed
+      job.Error = err.Error()
+      finished := time.Now().UTC().Truncate(time.Second)
+      job.Finished = &finished
+      if updateErr := j.Store.UpdateJob(job); updateErr != nil {
+        log.Println("Saving job", job.ID + ":", updateErr)
+      }
+    }
+    // the upload holds the raw hashes, which aren't needed once the job ends
+    if job.Status == JobDone || job.Status == JobFailed {
+      if rmErr := os.Remove(j.inputPath(job.ID)); rmErr != nil && !os.IsNotExist(rmErr) {
+        log.Println("Removing job upload", job.ID + ":", rmErr)
+      }
+    }
+  }()
+  p, store, err := j.Params.Get(job.Params)
+  if err != nil {
+    return
+  }
+  keyLen := int64(p.KeyLen)
+  in, err := os.Open(j.inputPath(job.ID))
+  if err != nil {
+    return
+  }
+  defer in.Close()
+  out, err := os.OpenFile(j.resultsPath(job.ID), os.O_RDWR|os.O_CREATE, 0600)
+  if err != nil {
+    return
+  }
+  defer out.Close()
+  // drop results written after the last checkpoint
+  if err = out.Truncate(job.ResultBytes); err != nil {
+    return
+  }
+  if _, err = out.Seek(job.ResultBytes, io.SeekStart); err != nil {
+    return
+  }
+  if _, err = in.Seek(job.Processed * keyLen, io.SeekStart); err != nil {
+    return
+  }
+  origin := CanaryAlert{Tenant: job.Tenant, APIKeyID: job.APIKeyID, IP: job.IP, Path: "/v1/jobs/" + job.ID}
+  client := hitClient(job.APIKeyID, job.IP)
+  r := bufio.NewReader(in)
+  for job.Processed < job.Total {
+    if err = ctx.Err(); err != nil {
+      return
+    }
+    n := job.Total - job.Processed
+    if n > jobChunk {
+      n = jobChunk
+    }
+    buf := make([]byte, n * keyLen)
+    if _, err = io.ReadFull(r, buf); err != nil {
+      return
+    }
+    hashes := make([][]byte, n)
+    for i := range hashes {
+      hashes[i] = buf[int64(i) * keyLen:int64(i + 1) * keyLen]
+    }
+    j.Canaries.CheckAs(origin, p.Name, hashes...)
+    found, err := store.LookupMany(hashes)
+    if err != nil {
+      return err
+    }
+    var matches []int
+    for i, compromised := range found {
+      if compromised {
+        matches = append(matches, i)
+      }
+    }
+    granted := len(matches)
+    if j.Hits != nil && granted > 0 {
+      granted = j.Hits.TakeUpTo(client, granted)
+    }
+    w := bufio.NewWriter(out)
+    enc := json.NewEncoder(w)
+    for _, i := range matches[:granted] {
+      encoded, err := EncodeHash(hashes[i], job.Encoding)
+      if err != nil {
+        return err
+      }
+      if err = enc.Encode(JobMatch{job.Processed + int64(i), encoded}); err != nil {
+        return err
+      }
+      job.Matched += 1
+    }
+    if granted < len(matches) {
+      // the hashes from the first unreported match on are left out
+      n = int64(matches[granted])
+      job.Status = JobDone
+      job.Error = ErrJobHitLimit.Error()
+    }
+    if err = w.Flush(); err != nil {
+      return err
+    }
+    if err = out.Sync(); err != nil {
+      return err
+    }
+    if job.ResultBytes, err = out.Seek(0, io.SeekCurrent); err != nil {
+      return err
+    }
+    job.Processed += n
+    now := time.Now().UTC().Truncate(time.Second)
+    job.Heartbeat = &now
+    if job.Status == JobDone {
+      job.Finished = &now
+      return j.Store.UpdateJob(job)
+    }
+    if err = j.Store.UpdateJob(job); err != nil {
+      return err
+    }
+  }
+  job.Status = JobDone
+  finished := time.Now().UTC().Truncate(time.Second)
+  job.Finished = &finished
+  return j.Store.UpdateJob(job)
+}
+
+// stores an upload of hashes made with params and queues a job for it
+func (j *Jobs) Submit(r *http.Request, params, format, encoding string, body io.Reader) (job Job, err error) {
+  p, _, err := j.Params.Get(params)
+  if err != nil {
+    return
+  }
+  if encoding == "" {
+    encoding = EncodingHex
+  }
+  if _, err = EncodeHash(nil, encoding); err != nil {
+    return
+  }
+  id := make([]byte, 8)
+  if _, err = rand.Read(id); err != nil {
+    return
+  }
+  job = Job{
+    ID: hex.EncodeToString(id),
+    IP: ClientIP(r, j.TrustProxy),
+    Params: p.Name,
+    Encoding: encoding,
+    Status: JobQueued,
+    Created: time.Now().UTC().Truncate(time.Second),
+  }
+  if k, ok := APIKeyFromContext(r.Context()); ok {
+    job.Tenant = k.Tenant
+    job.APIKeyID = k.ID
+  }
+  tmp := j.inputPath(job.ID) + ".tmp"
+  f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+  if err != nil {
+    return
+  }
+  defer os.Remove(tmp)
+  job.Total, err = writeJobInput(f, body, format, encoding, int(p.KeyLen))
+  if closeErr := f.Close(); err == nil {
+    err = closeErr
+  }
+  if err != nil {
+    return
+  }
+  if err = os.Rename(tmp, j.inputPath(job.ID)); err != nil {
+    return
+  }
+  if err = j.Store.InsertJob(job); err != nil {
+    os.Remove(j.inputPath(job.ID))
+    return
+  }
+  select {
+  case j.wake <- struct{}{}:
+  default:
+  }
+  return job, nil
+}
+
+// decodes an upload into raw hashes of keyLen bytes; returns their number
+func writeJobInput(f io.Writer, body io.Reader, format, encoding string, keyLen int) (total int64, err error) {
+  w := bufio.NewWriter(f)
+  switch format {
+  case JobFormatNDJSON, "":
+    scanner := bufio.NewScanner(body)
+    line := 0
+    for scanner.Scan() {
+      line += 1
+      if len(scanner.Bytes()) == 0 {
+        continue
+      }
+      var req CredReqBody
+      if err = json.Unmarshal(scanner.Bytes(), &req); err != nil {
+        return 0, errors.New("Line " + strconv.Itoa(line) + ": " + err.Error())
+      }
+      hash, err := DecodeHash(req.Hash, encoding, keyLen)
+      if err != nil {
+        return 0, errors.New("Line " + strconv.Itoa(line) + ": " + err.Error())
+      }
+      w.Write(hash)
+      total += 1
+    }
+    if err = scanner.Err(); err != nil {
+      return
+    }
+  case JobFormatBinary:
+    n, err := io.Copy(w, body)
+    if err != nil {
+      return 0, err
+    }
+    if n % int64(keyLen) != 0 {
+      return 0, errors.New("Expected a multiple of " + strconv.Itoa(keyLen) + " bytes. Got " + strconv.FormatInt(n, 10) + ".")
+    }
+    total = n / int64(keyLen)
+  default:
+    return 0, errors.New("Unknown job format \"" + format + "\"; expected ndjson or binary.")
+  }
+  return total, w.Flush()
+}
+
+// returns tenant's job with id
+func (j *Jobs) Get(tenant, id string) (job Job, err error) {
+  job, err = j.Store.GetJob(id)
+  if err == nil && job.Tenant != tenant {
+    err = ErrUnknownJob
+  }
+  return
+}
+
+// deletes a job that isn't running, with its files
+func (j *Jobs) Delete(tenant, id string) error {
+  j.mu.Lock()
+  defer j.mu.Unlock()
+  job, err := j.Get(tenant, id)
+  if err != nil {
+    return err
+  }
+  if job.Status == JobRunning {
+    return errors.New("Running jobs can't be deleted.")
+  }
+  if err = j.Store.DeleteJob(id); err != nil {
+    return err
+  }
+  os.Remove(j.inputPath(id))
+  os.Remove(j.resultsPath(id))
+  return nil
+}
+
+func (j *Jobs) inputPath(id string) string {
+  return filepath.Join(j.Dir, id + ".in")
+}
+
+func (j *Jobs) resultsPath(id string) string {
+  return filepath.Join(j.Dir, id + ".ndjson")
+}
+
+// responds with an error and returns false if the request has no tenant
+func jobTenant(w http.ResponseWriter, r *http.Request) (string, bool) {
+  tenant, ok := TenantFromContext(r.Context())
+  if !ok {
+    respondWithJSON(w, http.StatusForbidden, credErr{ErrJobNoTenant.Error()})
+  }
+  return tenant, ok
+}
+
+// serves ?params=name&format=ndjson|binary&encoding=hex with the upload as
+// the body
+func SubmitJobHandler(w http.ResponseWriter, r *http.Request, jobs *Jobs) {
+  if _, ok := jobTenant(w, r); !ok {
+    return
+  }
+  body := http.MaxBytesReader(w, r.Body, jobs.MaxUpload)
+  query := r.URL.Query()
+  job, err := jobs.Submit(r, query.Get("params"), query.Get("format"), query.Get("encoding"), body)
+  var tooLarge *http.MaxBytesError
+  if errors.As(err, &tooLarge) {
+    respondWithJSON(w, http.StatusRequestEntityTooLarge, credErr{"Uploads are limited to " + strconv.FormatInt(jobs.MaxUpload, 10) + " bytes."})
+    return
+  }
+  if err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{err.Error()})
+    return
+  }
+  w.Header().Set("Location", "/v1/jobs/" + job.ID)
+  respondWithJSON(w, http.StatusAccepted, job)
+}
+
+func JobHandler(w http.ResponseWriter, r *http.Request, jobs *Jobs) {
+  tenant, ok := jobTenant(w, r)
+  if !ok {
+    return
+  }
+  job, err := jobs.Get(tenant, mux.Vars(r)["id"])
+  if err != nil {
+    respondWithJSON(w, jobErrStatus(err), credErr{err.Error()})
+    return
+  }
+  respondWithJSON(w, http.StatusOK, job)
+}
+
+// serves the JobMatch lines of a finished job
+func JobResultsHandler(w http.ResponseWriter, r *http.Request, jobs *Jobs) {
+  tenant, ok := jobTenant(w, r)
+  if !ok {
+    return
+  }
+  job, err := jobs.Get(tenant, mux.Vars(r)["id"])
+  if err != nil {
+    respondWithJSON(w, jobErrStatus(err), credErr{err.Error()})
+    return
+  }
+  if job.Status != JobDone {
+    respondWithJSON(w, http.StatusConflict, credErr{ErrJobNotDone.Error()})
+    return
+  }
+  f, err := os.Open(jobs.resultsPath(job.ID))
+  if err != nil {
+    respondWithJSON(w, http.StatusInternalServerError, credErr{err.Error()})
+    return
+  }
+  defer f.Close()
+  w.Header().Set("Content-Type", "application/x-ndjson")
+  w.Header().Set("Content-Length", strconv.FormatInt(job.ResultBytes, 10))
+  io.CopyN(w, f, job.ResultBytes)
+}
+
+func DeleteJobHandler(w http.ResponseWriter, r *http.Request, jobs *Jobs) {
+  tenant, ok := jobTenant(w, r)
+  if !ok {
+    return
+  }
+  err := jobs.Delete(tenant, mux.Vars(r)["id"])
+  if err != nil {
+    status := jobErrStatus(err)
+    if status == http.StatusInternalServerError {
+      status = http.StatusConflict
+    }
+    respondWithJSON(w, status, credErr{err.Error()})
+    return
+  }
+  w.WriteHeader(http.StatusNoContent)
+}
+
+func jobErrStatus(err error) int {
+  if err == ErrUnknownJob {
+    return http.StatusNotFound
+  }
+  return http.StatusInternalServerError
+}
+
+// MySQLJobStore keeps job state in JobTable.
+type MySQLJobStore struct{
+  DB *sql.DB
+}
+
+func NewMySQLJobStore(db *sql.DB) *MySQLJobStore {
+  return &MySQLJobStore{db}
+}
+
+const jobColumns = "id, tenant, api_key_id, ip, params, encoding, status, total, processed, matched, result_bytes, error, created, finished, heartbeat"
+
+func (s *MySQLJobStore) InsertJob(job Job) (err error) {
+  _, err = s.DB.Exec("INSERT INTO " + JobTable + " (" + jobColumns + ") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+    job.ID, job.Tenant, job.APIKeyID, job.IP, job.Params, job.Encoding, job.Status, job.Total,
+    job.Processed, job.Matched, job.ResultBytes, job.Error, job.Created, job.Finished, job.Heartbeat)
+  return
+}
+
+func (s *MySQLJobStore) GetJob(id string) (job Job, err error) {
+  job, err = scanJob(s.DB.QueryRow("SELECT " + jobColumns + " FROM " + JobTable + " WHERE id=?", id))
+  if err == sql.ErrNoRows {
+    err = ErrUnknownJob
+  }
+  return
+}
+
+func (s *MySQLJobStore) UpdateJob(job Job) (err error) {
+  _, err = s.DB.Exec("UPDATE " + JobTable + " SET status=?, processed=?, matched=?, result_bytes=?, error=?, finished=?, heartbeat=? WHERE id=?",
+    job.Status, job.Processed, job.Matched, job.ResultBytes, job.Error, job.Finished, job.Heartbeat, job.ID)
+  return
+}
+
+// the UPDATE only matches while the job is queued, so of several servers
+// claiming it at once, one sees a row affected
+func (s *MySQLJobStore) ClaimJob(id string, now time.Time) (bool, error) {
+  res, err := s.DB.Exec("UPDATE " + JobTable + " SET status=?, heartbeat=? WHERE id=? AND status=?", JobRunning, now, id, JobQueued)
+  if err != nil {
+    return false, err
+  }
+  n, err := res.RowsAffected()
+  return n == 1, err
+}
+
+func (s *MySQLJobStore) RequeueStaleJobs(stale time.Time) (int64, error) {
+  res, err := s.DB.Exec("UPDATE " + JobTable + " SET status=? WHERE status=? AND (heartbeat IS NULL OR heartbeat < ?)", JobQueued, JobRunning, stale)
+  if err != nil {
+    return 0, err
+  }
+  return res.RowsAffected()
+}
+
+func (s *MySQLJobStore) DeleteJob(id string) (err error) {
+  _, err = s.DB.Exec("DELETE FROM " + JobTable + " WHERE id=?", id)
+  return
+}
+
+func (s *MySQLJobStore) JobsWithStatus(status string, limit int) (jobs []Job, err error) {
+  rows, err := s.DB.Query("SELECT " + jobColumns + " FROM " + JobTable + " WHERE status=? ORDER BY created, id LIMIT ?", status, limit)
+  if err != nil {
+    return
+  }
+  defer rows.Close()
+  for rows.Next() {
+    job, err := scanJob(rows)
+    if err != nil {
+      return nil, err
+    }
+    jobs = append(jobs, job)
+  }
+  return jobs, rows.Err()
+}
+
+func (s *MySQLJobStore) CreateTables() (err error) {
+  _, err = s.DB.Exec(JobTableCreate)
+  if err != nil {
+    return
+  }
+  // tables created before jobs were leased lack heartbeat
+  return addColumnIfMissing(s.DB, JobTable, "heartbeat", "datetime NULL")
+}
+
+// *sql.Row or *sql.Rows
+type rowScanner interface {
+  Scan(dest ...interface{}) error
+}
+
+func scanJob(row rowScanner) (job Job, err error) {
+  var jobErr sql.NullString
+  var finished, heartbeat sql.NullTime
+  err = row.Scan(&job.ID, &job.Tenant, &job.APIKeyID, &job.IP, &job.Params, &job.Encoding, &job.Status, &job.Total,
+    &job.Processed, &job.Matched, &job.ResultBytes, &jobErr, &job.Created, &finished, &heartbeat)
+  job.Error = jobErr.String
+  if finished.Valid {
+    job.Finished = &finished.Time
+  }
+  if heartbeat.Valid {
+    job.Heartbeat = &heartbeat.Time
+  }
+  return
+}
+
+// MemJobStore keeps job state in memory, so jobs don't survive restarts.
+type MemJobStore struct{
+  mu   sync.Mutex
+  jobs map[string]Job // by ID
+}
+
+func NewMemJobStore() *MemJobStore {
+  return &MemJobStore{jobs: make(map[string]Job)}
+}
+
+func (s *MemJobStore) InsertJob(job Job) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  s.jobs[job.ID] = job
+  return nil
+}
+
+func (s *MemJobStore) GetJob(id string) (Job, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  job, ok := s.jobs[id]
+  if !ok {
+    return job, ErrUnknownJob
+  }
+  return job, nil
+}
+
+func (s *MemJobStore) UpdateJob(job Job) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  s.jobs[job.ID] = job
+  return nil
+}
+
+func (s *MemJobStore) DeleteJob(id string) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  delete(s.jobs, id)
+  return nil
+}
+
+func (s *MemJobStore) JobsWithStatus(status string, limit int) ([]Job, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  var jobs []Job
+  for _, job := range s.jobs {
+    if job.Status == status {
+      jobs = append(jobs, job)
+    }
+  }
+  sort.Slice(jobs, func(i, j int) bool {
+    if jobs[i].Created.Equal(jobs[j].Created) {
+      return jobs[i].ID < jobs[j].ID
+    }
+    return jobs[i].Created.Before(jobs[j].Created)
+  })
+  if len(jobs) > limit {
+    jobs = jobs[:limit]
+  }
+  return jobs, nil
+}
+
+func (s *MemJobStore) ClaimJob(id string, now time.Time) (bool, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  job, ok := s.jobs[id]
+  if !ok || job.Status != JobQueued {
+    return false, nil
+  }
+  job.Status = JobRunning
+  job.Heartbeat = &now
+  s.jobs[id] = job
+  return true, nil
+}
+
+func (s *MemJobStore) RequeueStaleJobs(stale time.Time) (n int64, err error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  for id, job := range s.jobs {
+    if job.Status == JobRunning && (job.Heartbeat == nil || job.Heartbeat.Before(stale)) {
+      job.Status = JobQueued
+      s.jobs[id] = job
+      n += 1
+    }
+  }
+  return n, nil
+}
+
+func (s *MemJobStore) CreateTables() error {
+  return nil
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+  "bufio"
+  "bytes"
+  "context"
+  "encoding/hex"
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "testing"
+  "time"
+)
+
+func TestJobs(t *testing.T) {
+  apiKeys := NewMemAPIKeyStore()
+  key, _, _ := CreateAPIKey(apiKeys, "acme")
+  otherKey, _, _ := CreateAPIKey(apiKeys, "globex")
+  store := NewMemStore()
+  a := App{APIKeys: apiKeys}
+  a.Initialize(store)
+  jobStore := NewMemJobStore()
+  a.Jobs = NewJobs(jobStore, t.TempDir(), a.Params)
+  ctx, cancel := context.WithCancel(context.Background())
+  defer cancel()
+  if err := a.Jobs.Start(ctx); err != nil {
+    t.Fatal(err)
+  }
+  do := func(method, path, key string, body []byte) *httptest.ResponseRecorder {
+    req := httptest.NewRequest(method, path, bytes.NewBuffer(body))
+    req.Header.Set("Authorization", "Bearer " + key)
+    rr := httptest.NewRecorder()
+    a.Router.ServeHTTP(rr, req)
+    return rr
+  }
+  wait := func(id string) (job Job) {
+    for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+      rr := do("GET", "/v1/jobs/" + id, key, nil)
+      json.Unmarshal(rr.Body.Bytes(), &job)
+      if job.Status == JobDone || job.Status == JobFailed {
+        return
+      }
+    }
+    t.Fatalf("Job %s didn't finish. Last status %q\n", id, job.Status)
+    return
+  }
+
+  var hashes [][]byte
+  var upload bytes.Buffer
+  for i := 0; i < 2500; i += 1 {
+    hash := randomHash(t)
+    hashes = append(hashes, hash)
+    if i % 1000 == 7 {
+      store.Insert(hash)
+    }
+    line, _ := json.Marshal(CredReqBody{Hash: hex.EncodeToString(hash)})
+    upload.Write(append(line, '\n'))
+  }
+  rr := do("POST", "/v1/jobs?format=ndjson&encoding=hex", key, upload.Bytes())
+  if rr.Code != http.StatusAccepted {
+    t.Fatalf("Expected response code 202. Got %d: %s\n", rr.Code, rr.Body.String())
+  }
+  var job Job
+  json.Unmarshal(rr.Body.Bytes(), &job)
+  if job.Total != 2500 || rr.Header().Get("Location") != "/v1/jobs/" + job.ID {
+    t.Fatalf("Expected a job of 2500 hashes. Got %+v\n", job)
+  }
+  if rr := do("GET", "/v1/jobs/" + job.ID, otherKey, nil); rr.Code != http.StatusNotFound {
+    t.Errorf("Expected another tenant's job to be hidden. Got %d\n", rr.Code)
+  }
+  job = wait(job.ID)
+  if job.Status != JobDone || job.Processed != 2500 || job.Matched != 3 {
+    t.Fatalf("Expected 3 matches in 2500 hashes. Got %+v\n", job)
+  }
+  if _, err := os.Stat(a.Jobs.inputPath(job.ID)); !os.IsNotExist(err) {
+    t.Errorf("Expected the upload to be deleted once the job finished. Got %v\n", err)
+  }
+  rr = do("GET", "/v1/jobs/" + job.ID + "/results", key, nil)
+  var matches []JobMatch
+  scanner := bufio.NewScanner(rr.Body)
+  for scanner.Scan() {
+    var m JobMatch
+    json.Unmarshal(scanner.Bytes(), &m)
+    matches = append(matches, m)
+  }
+  for i, m := range matches {
+    index := int64(i * 1000 + 7)
+    if m.Index != index || m.Hash != hex.EncodeToString(hashes[index]) {
+      t.Errorf("Expected match %d to be hash %d. Got %+v\n", i, index, m)
+    }
+  }
+  if len(matches) != 3 {
+    t.Errorf("Expected 3 result lines. Got %d\n", len(matches))
+  }
+
+  // binary uploads must be whole hashes
+  binary := bytes.Join(hashes[:10], nil)
+  if rr := do("POST", "/v1/jobs?format=binary", key, binary[1:]); rr.Code != http.StatusBadRequest {
+    t.Errorf("Expected response code 400 for a partial hash. Got %d\n", rr.Code)
+  }
+
+  // a job interrupted after its first checkpoint resumes from it, dropping
+  // the results written after the checkpoint
+  cancel()
+  interrupted, err := a.Jobs.Submit(httptest.NewRequest("POST", "/v1/jobs", nil), "", JobFormatBinary, EncodingHex, bytes.NewReader(bytes.Join(hashes[:1500], nil)))
+  if err != nil {
+    t.Fatal(err)
+  }
+  interrupted.Status = JobRunning
+  interrupted.Processed = 1000
+  interrupted.Matched = 1
+  checkpoint := []byte(`{"index":7,"hash":"` + hex.EncodeToString(hashes[7]) + "\"}\n")
+  interrupted.ResultBytes = int64(len(checkpoint))
+  jobStore.UpdateJob(interrupted)
+  os.WriteFile(a.Jobs.resultsPath(interrupted.ID), append(checkpoint, "partial"...), 0600)
+  ctx, cancel = context.WithCancel(context.Background())
+  defer cancel()
+  if err = a.Jobs.Start(ctx); err != nil {
+    t.Fatal(err)
+  }
+  for deadline := time.Now().Add(5 * time.Second); interrupted.Status != JobDone && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+    interrupted, _ = jobStore.GetJob(interrupted.ID)
+  }
+  if interrupted.Status != JobDone || interrupted.Matched != 2 {
+    t.Fatalf("Expected the resumed job to find 2 matches. Got %+v\n", interrupted)
+  }
+  results, _ := os.ReadFile(a.Jobs.resultsPath(interrupted.ID))
+  expected := string(checkpoint) + `{"index":1007,"hash":"` + hex.EncodeToString(hashes[1007]) + "\"}\n"
+  if string(results) != expected {
+    t.Errorf("Expected results %q. Got %q\n", expected, results)
+  }
+
+  if rr := do("DELETE", "/v1/jobs/" + job.ID, key, nil); rr.Code != http.StatusNoContent {
+    t.Errorf("Expected response code 204. Got %d\n", rr.Code)
+  }
+  if _, err := os.Stat(a.Jobs.resultsPath(job.ID)); !os.IsNotExist(err) {
+    t.Errorf("Expected the results to be deleted. Got %v\n", err)
+  }
+}
+
+func TestJobsFailedDeletesUpload(t *testing.T) {
+  jobStore := NewMemJobStore()
+  jobs := NewJobs(jobStore, t.TempDir(), NewRegistry())
+  jobs.Params.Register(DefaultParamSet, NewMemStore())
+  job, err := jobs.Submit(httptest.NewRequest("POST", "/v1/jobs", nil), "", JobFormatBinary, EncodingHex, bytes.NewReader(randomHash(t)))
+  if err != nil {
+    t.Fatal(err)
+  }
+  job.Params = "unregistered"
+  jobStore.UpdateJob(job)
+  ctx, cancel := context.WithCancel(context.Background())
+  defer cancel()
+  if err = jobs.Start(ctx); err != nil {
+    t.Fatal(err)
+  }
+  for deadline := time.Now().Add(5 * time.Second); job.Status != JobFailed && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+    job, _ = jobStore.GetJob(job.ID)
+  }
+  if job.Status != JobFailed {
+    t.Fatalf("Expected the job to fail. Got %+v\n", job)
+  }
+  if _, err := os.Stat(jobs.inputPath(job.ID)); !os.IsNotExist(err) {
+    t.Errorf("Expected the upload to be deleted once the job failed. Got %v\n", err)
+  }
+}
+
+func TestJobsTrustProxy(t *testing.T) {
+  jobs := NewJobs(NewMemJobStore(), t.TempDir(), NewRegistry())
+  jobs.Params.Register(DefaultParamSet, NewMemStore())
+  jobs.TrustProxy = true
+  r := httptest.NewRequest("POST", "/v1/jobs", nil)
+  r.Header.Set("X-Forwarded-For", "198.51.100.7")
+  // without canaries
+  job, err := jobs.Submit(r, "", JobFormatBinary, EncodingHex, bytes.NewReader(randomHash(t)))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if job.IP != "198.51.100.7" {
+    t.Errorf("Expected the forwarded IP. Got %s\n", job.IP)
+  }
+}
+
+func TestJobsNoAuth(t *testing.T) {
+  a := App{}
+  a.Initialize(NewMemStore())
+  a.Jobs = NewJobs(NewMemJobStore(), t.TempDir(), a.Params)
+  for _, r := range []*http.Request{
+    httptest.NewRequest("POST", "/v1/jobs?format=binary", bytes.NewReader(randomHash(t))),
+    httptest.NewRequest("GET", "/v1/jobs/1", nil),
+    httptest.NewRequest("GET", "/v1/jobs/1/results", nil),
+    httptest.NewRequest("DELETE", "/v1/jobs/1", nil),
+  } {
+    rr := httptest.NewRecorder()
+    a.Router.ServeHTTP(rr, r)
+    if rr.Code != http.StatusForbidden {
+      t.Errorf("Expected response code 403 for %s %s without auth. Got %d\n", r.Method, r.URL.Path, rr.Code)
+    }
+  }
+}
+
+func TestJobsHitLimit(t *testing.T) {
+  store := NewMemStore()
+  a := App{}
+  a.Initialize(store)
+  jobs := NewJobs(NewMemJobStore(), t.TempDir(), a.Params)
+  jobs.Hits = NewLimiter(Rate{PerSecond: 0.001, Burst: 2})
+  var hashes [][]byte
+  for i := 0; i < 2500; i += 1 {
+    hash := randomHash(t)
+    hashes = append(hashes, hash)
+    if i % 1000 == 7 {
+      store.Insert(hash)
+    }
+  }
+  r := httptest.NewRequest("POST", "/v1/jobs", nil)
+  r = r.WithContext(WithAPIKey(r.Context(), APIKey{ID: "k1", Tenant: "acme"}))
+  job, err := jobs.Submit(r, "", JobFormatBinary, EncodingHex, bytes.NewReader(bytes.Join(hashes, nil)))
+  if err != nil {
+    t.Fatal(err)
+  }
+  job, ok, err := jobs.claim()
+  if err != nil || !ok {
+    t.Fatalf("Expected to claim the job. Got %v, %v\n", ok, err)
+  }
+  if err = jobs.run(context.Background(), job); err != nil {
+    t.Fatal(err)
+  }
+  job, _ = jobs.Store.GetJob(job.ID)
+  // the third match is past the budget of 2, so the job stops before it
+  if job.Status != JobDone || job.Matched != 2 || job.Processed != 2007 || job.Error != ErrJobHitLimit.Error() {
+    t.Errorf("Expected the job to stop at hash 2007 with 2 matches. Got %+v\n", job)
+  }
+  if ok, _ := jobs.Hits.Check("key:k1"); ok {
+    t.Error("Expected the job to use up the client's hits")
+  }
+}
+
+func TestJobsClaim(t *testing.T) {
+  a := App{}
+  a.Initialize(NewMemStore())
+  jobStore := NewMemJobStore()
+  dir := t.TempDir()
+  // two servers sharing a database
+  first, second := NewJobs(jobStore, dir, a.Params), NewJobs(jobStore, dir, a.Params)
+  job, err := first.Submit(httptest.NewRequest("POST", "/v1/jobs", nil), "", JobFormatBinary, EncodingHex, bytes.NewReader(randomHash(t)))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, ok, _ := first.claim(); !ok {
+    t.Fatal("Expected the first server to claim the job")
+  }
+  if _, ok, _ := second.claim(); ok {
+    t.Fatal("Expected a claimed job not to be claimed again")
+  }
+  // until its heartbeat goes stale, e.g. because the first server died
+  job, _ = jobStore.GetJob(job.ID)
+  stale := time.Now().Add(-2 * jobLease)
+  job.Heartbeat = &stale
+  jobStore.UpdateJob(job)
+  if claimed, ok, _ := second.claim(); !ok || claimed.ID != job.ID {
+    t.Errorf("Expected the stale job to be claimed again. Got %v\n", ok)
+  }
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+  "errors"
+  "sort"
+  "strconv"
+  "sync"
+  "time"
+)
+
+// MemStore keeps hashes in memory. It is meant for tests and for small
+// deployments that load their hashes at startup.
+type MemStore struct {
+  mu     sync.RWMutex
+  hashes  map[string]memHash
+  seq     uint64
+  sources []Source
+  // sightings keyed by hash and then source id
+  sightings map[string]map[int64]*Sighting
+  // positive lookups by hash and by day; guarded by hitsMu since lookups
+  // only hold mu for reading
+  hitsMu  sync.Mutex
+  checked map[string]int64
+  daily   map[string]int64
+}
+
+type memHash struct {
+  keyID uint16
+  seq   uint64
+}
+
+func NewMemStore() *MemStore {
+  return &MemStore{
+    hashes: make(map[string]memHash),
+    sightings: make(map[string]map[int64]*Sighting),
+    checked: make(map[string]int64),
+    daily: make(map[string]int64),
+  }
+}
+
+func (s *MemStore) Lookup(hash []byte) (bool, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+  _, ok := s.hashes[string(hash)]
+  if ok {
+    s.countHit(hash)
+  }
+  return ok, nil
+}
+
+func (s *MemStore) LookupMany(hashes [][]byte) ([]bool, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+  results := make([]bool, len(hashes))
+  for i, hash := range hashes {
+    _, results[i] = s.hashes[string(hash)]
+    if results[i] {
+      s.countHit(hash)
+    }
+  }
+  return results, nil
+}
+
+func (s *MemStore) countHit(hash []byte) {
+  s.hitsMu.Lock()
+  defer s.hitsMu.Unlock()
+  s.checked[string(hash)] += 1
+  s.daily[time.Now().UTC().Format("2006-01-02")] += 1
+}
+
+func (s *MemStore) HitStats(days int) (stats HitStats, err error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+  s.hitsMu.Lock()
+  defer s.hitsMu.Unlock()
+  today := time.Now().UTC()
+  for i := days - 1; i >= 0; i -= 1 {
+    day := today.AddDate(0, 0, -i).Format("2006-01-02")
+    if hits, ok := s.daily[day]; ok {
+      stats.HitsPerDay = append(stats.HitsPerDay, DayHits{day, hits})
+    }
+  }
+  stats.Checked = newCheckedBuckets()
+  for hash := range s.hashes {
+    stats.Checked[checkedBucket(s.checked[hash])].Hashes += 1
+  }
+  return
+}
+
+func (s *MemStore) LookupRange(prefix string) ([][]byte, error) {
+  lo, hi, err := RangeBounds(prefix)
+  if err != nil {
+    return nil, err
+  }
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+  var hashes [][]byte
+  for hash := range s.hashes {
+    if InRange([]byte(hash), lo, hi) {
+      hashes = append(hashes, []byte(hash))
+    }
+  }
+  return hashes, nil
+}
+
+// fn is called without the lock held, so it may use the store
+func (s *MemStore) Scan(fn func(hash []byte) error) error {
+  s.mu.RLock()
+  hashes := make([][]byte, 0, len(s.hashes))
+  for hash := range s.hashes {
+    hashes = append(hashes, []byte(hash))
+  }
+  s.mu.RUnlock()
+  for _, hash := range hashes {
+    if err := fn(hash); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func (s *MemStore) Insert(hash []byte) error {
+  return s.InsertKeyed(hash, 0)
+}
+
+func (s *MemStore) InsertKeyed(hash []byte, keyID uint16) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if _, ok := s.hashes[string(hash)]; ok {
+    return ErrDuplicate
+  }
+  s.seq += 1
+  s.hashes[string(hash)] = memHash{keyID, s.seq}
+  return nil
+}
+
+func (s *MemStore) Since(seq uint64, limit int) ([]SyncEntry, error) {
+  s.mu.RLock()
+  var entries []SyncEntry
+  for hash, h := range s.hashes {
+    if h.seq > seq {
+      entries = append(entries, SyncEntry{h.seq, []byte(hash), h.keyID})
+    }
+  }
+  s.mu.RUnlock()
+  sort.Slice(entries, func(i, j int) bool {
+    return entries[i].Seq < entries[j].Seq
+  })
+  if len(entries) > limit {
+    entries = entries[:limit]
+  }
+  return entries, nil
+}
+
+func (s *MemStore) LastSeq() (uint64, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+  return s.seq, nil
+}
+
+func (s *MemStore) AddSource(src Source) (int64, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  for _, existing := range s.sources {
+    if existing.Name == src.Name {
+      return existing.ID, nil
+    }
+  }
+  src.ID = int64(len(s.sources)) + 1
+  s.sources = append(s.sources, src)
+  return src.ID, nil
+}
+
+func (s *MemStore) InsertSourced(hash []byte, sourceID int64, keyID uint16) error {
+  err := s.InsertKeyed(hash, keyID)
+  if err != nil && err != ErrDuplicate {
+    return err
+  }
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if sourceID < 1 || sourceID > int64(len(s.sources)) {
+    return errors.New("Unknown source id " + strconv.FormatInt(sourceID, 10) + ".")
+  }
+  bySource, ok := s.sightings[string(hash)]
+  if !ok {
+    bySource = make(map[int64]*Sighting)
+    s.sightings[string(hash)] = bySource
+  }
+  now := time.Now().UTC()
+  if sighting, ok := bySource[sourceID]; ok {
+    sighting.Count += 1
+    sighting.LastSeen = now
+  } else {
+    bySource[sourceID] = &Sighting{s.sources[sourceID - 1], 1, now, now}
+  }
+  return err
+}
+
+func (s *MemStore) Sightings(hash []byte) (sightings []Sighting, err error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+  for _, sighting := range s.sightings[string(hash)] {
+    sightings = append(sightings, *sighting)
+  }
+  return
+}
+
+func (s *MemStore) DeleteKey(keyID uint16) (deleted int64, err error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  for hash, h := range s.hashes {
+    if h.keyID == keyID {
+      delete(s.hashes, hash)
+      delete(s.sightings, hash)
+      s.hitsMu.Lock()
+      delete(s.checked, hash)
+      s.hitsMu.Unlock()
+      deleted += 1
+    }
+  }
+  return
+}
+
+func (s *MemStore) Count() (int64, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+  return int64(len(s.hashes)), nil
+}
+
+func (s *MemStore) CreateTables() error {
+  return nil
+}
+
+func (s *MemStore) Close() error {
+  return nil
+}
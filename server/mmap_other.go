@@ -0,0 +1,19 @@
+//go:build !unix
+
+package server
+
+import (
+  "io"
+  "os"
+)
+
+// reads the first size bytes of f where mmap isn't available
+func mmapFile(f *os.File, size int) ([]byte, error) {
+  data := make([]byte, size)
+  _, err := io.ReadFull(f, data)
+  return data, err
+}
+
+func munmapFile(data []byte) error {
+  return nil
+}
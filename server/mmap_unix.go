@@ -0,0 +1,20 @@
+//go:build unix
+
+package server
+
+import (
+  "os"
+  "syscall"
+)
+
+// maps the first size bytes of f read-only
+func mmapFile(f *os.File, size int) ([]byte, error) {
+  return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmapFile(data []byte) error {
+  if data == nil {
+    return nil
+  }
+  return syscall.Munmap(data)
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+  "database/sql"
+)
+
+// MySQLStore keeps the hashes of one parameter set in a MySQL table.
+type MySQLStore struct {
+  DB      *sql.DB
+  Table   string
+  HashLen uint32
+  // counts positive lookups in the checked column; nil disables counting
+  Checked *CheckedCounter
+}
+
+func NewMySQLStore(db *sql.DB, p ParamSet) *MySQLStore {
+  return &MySQLStore{DB: db, Table: p.Table(), HashLen: p.KeyLen}
+}
+
+// a store for the OPRF outputs of hashes made with p
+func NewMySQLOPRFStore(db *sql.DB, p ParamSet) *MySQLStore {
+  return &MySQLStore{DB: db, Table: p.OPRFTable(), HashLen: OPRFOutputLen}
+}
+
+func (s *MySQLStore) Lookup(hash []byte) (bool, error) {
+  found, err := SearchCredHash(s.DB, s.Table, hash)
+  if found && s.Checked != nil {
+    s.Checked.Add(s.Table, hash)
+  }
+  return found, err
+}
+
+func (s *MySQLStore) LookupMany(hashes [][]byte) ([]bool, error) {
+  found, err := SearchCredHashes(s.DB, s.Table, hashes)
+  if err != nil {
+    return nil, err
+  }
+  results := make([]bool, len(hashes))
+  for i, hash := range hashes {
+    _, results[i] = found[string(hash)]
+    if results[i] && s.Checked != nil {
+      s.Checked.Add(s.Table, hash)
+    }
+  }
+  return results, nil
+}
+
+func (s *MySQLStore) LookupRange(prefix string) ([][]byte, error) {
+  lo, hi, err := RangeBounds(prefix)
+  if err != nil {
+    return nil, err
+  }
+  return SearchCredHashRange(s.DB, s.Table, lo, hi)
+}
+
+func (s *MySQLStore) Scan(fn func(hash []byte) error) error {
+  return ScanCredHashes(s.DB, s.Table, fn)
+}
+
+func (s *MySQLStore) Since(seq uint64, limit int) ([]SyncEntry, error) {
+  return SearchCredHashesSince(s.DB, s.Table, seq, limit)
+}
+
+func (s *MySQLStore) LastSeq() (uint64, error) {
+  return LastCredHashSeq(s.DB, s.Table)
+}
+
+func (s *MySQLStore) Insert(hash []byte) error {
+  return s.InsertKeyed(hash, 0)
+}
+
+func (s *MySQLStore) InsertKeyed(hash []byte, keyID uint16) error {
+  duplicate, err := InsertCredHash(s.DB, s.Table, hash, keyID)
+  if err == nil && duplicate {
+    return ErrDuplicate
+  }
+  return err
+}
+
+func (s *MySQLStore) AddSource(src Source) (int64, error) {
+  return InsertSource(s.DB, src)
+}
+
+func (s *MySQLStore) InsertSourced(hash []byte, sourceID int64, keyID uint16) error {
+  duplicate, err := InsertCredHashSourced(s.DB, s.Table, hash, sourceID, keyID)
+  if err == nil && duplicate {
+    return ErrDuplicate
+  }
+  return err
+}
+
+func (s *MySQLStore) Sightings(hash []byte) ([]Sighting, error) {
+  return SearchCredHashSightings(s.DB, s.Table, hash)
+}
+
+func (s *MySQLStore) HitStats(days int) (stats HitStats, err error) {
+  stats.HitsPerDay, err = SearchHitsPerDay(s.DB, s.Table, days)
+  if err != nil {
+    return
+  }
+  stats.Checked, err = SearchCheckedDistribution(s.DB, s.Table)
+  return
+}
+
+func (s *MySQLStore) DeleteKey(keyID uint16) (int64, error) {
+  return DeleteCredHashKey(s.DB, s.Table, keyID)
+}
+
+func (s *MySQLStore) Count() (int64, error) {
+  return CountCredHashes(s.DB, s.Table)
+}
+
+func (s *MySQLStore) CreateTables() error {
+  return CreateTables(s.DB, s.Table, s.HashLen)
+}
+
+func (s *MySQLStore) Close() error {
+  return s.DB.Close()
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+  "bytes"
+  "crypto/ed25519"
+  "crypto/sha256"
+  "encoding/binary"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "io"
+  "log"
+  "net/http"
+  "os"
+  "time"
+)
+
+// version of the offline filter format written by WriteFilter
+const FilterVersion = 1
+
+// limit on the size of a filter file's JSON header
+const maxFilterHeaderLen = 1 << 16
+
+var filterMagic = []byte("CCDSF")
+
+var ErrFilterDisabled = errors.New("Offline filters are not enabled on this server.")
+
+// returned by ExportFilter; a filter of peppered hashes is useless to
+// clients, who can't compute the pepper
+var ErrFilterPeppered = errors.New("Offline filters are not available when the server applies a pepper.")
+
+// FilterHeader describes an offline filter file. It is signed along with
+// the digest of the filter bits that follow it.
+type FilterHeader struct{
+  Version   int       `json:"version"`
+  // parameters the filtered hashes were made with
+  Params    ParamSet  `json:"params"`
+  Entries   int64     `json:"entries"`
+  // expected false-positive rate for Entries hashes
+  FPRate    float64   `json:"fpRate"`
+  Bits      uint64    `json:"bits"`
+  Hashes    uint32    `json:"hashes"`
+  CreatedAt time.Time `json:"createdAt"`
+  // hex SHA-256 of the filter bits
+  Digest    string    `json:"digest"`
+}
+
+// reads the filter signing key from CCDS_FILTER_KEY, a hex ed25519 seed;
+// returns nil if unset
+func GetFilterKey() (ed25519.PrivateKey, error) {
+  seedHex := os.Getenv("CCDS_FILTER_KEY")
+  if seedHex == "" {
+    return nil, nil
+  }
+  seed, err := hex.DecodeString(seedHex)
+  if err != nil || len(seed) != ed25519.SeedSize {
+    return nil, errors.New("CCDS_FILTER_KEY must be 32 hex encoded bytes.")
+  }
+  return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// returns a filter of every hash in store. The filter of a FilteredStore
+// is copied; other stores are scanned into a new filter.
+func ExportFilter(store Store, fpRate float64) (b *Bloom, entries int64, err error) {
+  for s := store; s != nil; {
+    switch st := s.(type) {
+    case *PepperedStore:
+      return nil, 0, ErrFilterPeppered
+    case *FilteredStore:
+      if b, entries = st.Snapshot(); b != nil {
+        return b, entries, nil
+      }
+    }
+    w, ok := s.(interface{ Unwrap() Store })
+    if !ok {
+      break
+    }
+    s = w.Unwrap()
+  }
+  scanner, ok := store.(Scanner)
+  if !ok {
+    return nil, 0, ErrScanUnsupported
+  }
+  count, err := store.Count()
+  if err != nil {
+    return
+  }
+  return buildBloom(scanner, count, fpRate)
+}
+
+// writes the magic, a format version byte, the length of the header,
+// the header, its ed25519 signature and then the filter bits as
+// little-endian 64 bit words
+func WriteFilter(w io.Writer, p ParamSet, b *Bloom, entries int64, key ed25519.PrivateKey) error {
+  body := make([]byte, len(b.bits) * 8)
+  for i, word := range b.bits {
+    binary.LittleEndian.PutUint64(body[i * 8:], word)
+  }
+  digest := sha256.Sum256(body)
+  header, err := json.Marshal(FilterHeader{
+    Version: FilterVersion,
+    Params: p,
+    Entries: entries,
+    FPRate: b.FPRate(entries),
+    Bits: b.m,
+    Hashes: b.k,
+    CreatedAt: time.Now().UTC(),
+    Digest: hex.EncodeToString(digest[:]),
+  })
+  if err != nil {
+    return err
+  }
+  signed := filterPreamble(header)
+  for _, part := range [][]byte{signed, ed25519.Sign(key, signed), body} {
+    if _, err = w.Write(part); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// reads a file written by WriteFilter and checks its signature against pub
+func ReadFilter(r io.Reader, pub ed25519.PublicKey) (header FilterHeader, b *Bloom, err error) {
+  if len(pub) != ed25519.PublicKeySize {
+    return header, nil, errors.New("A public key is required to verify the filter.")
+  }
+  fixed := make([]byte, len(filterMagic) + 5)
+  if _, err = io.ReadFull(r, fixed); err != nil {
+    return
+  }
+  if !bytes.Equal(fixed[:len(filterMagic)], filterMagic) {
+    return header, nil, errors.New("Not a CCDS filter file.")
+  }
+  if fixed[len(filterMagic)] != FilterVersion {
+    return header, nil, errors.New("Unsupported filter version.")
+  }
+  headerLen := binary.BigEndian.Uint32(fixed[len(filterMagic) + 1:])
+  if headerLen > maxFilterHeaderLen {
+    return header, nil, errors.New("Filter header is too large.")
+  }
+  rawHeader := make([]byte, headerLen)
+  if _, err = io.ReadFull(r, rawHeader); err != nil {
+    return
+  }
+  sig := make([]byte, ed25519.SignatureSize)
+  if _, err = io.ReadFull(r, sig); err != nil {
+    return
+  }
+  if !ed25519.Verify(pub, append(fixed, rawHeader...), sig) {
+    return header, nil, errors.New("Filter signature is invalid.")
+  }
+  if err = json.Unmarshal(rawHeader, &header); err != nil {
+    return
+  }
+  if header.Bits == 0 || header.Bits % 64 != 0 || header.Hashes == 0 {
+    return header, nil, errors.New("Filter header is invalid.")
+  }
+  body := make([]byte, header.Bits / 8)
+  if _, err = io.ReadFull(r, body); err != nil {
+    return
+  }
+  digest := sha256.Sum256(body)
+  if hex.EncodeToString(digest[:]) != header.Digest {
+    return header, nil, errors.New("Filter digest does not match its header.")
+  }
+  b = &Bloom{make([]uint64, header.Bits / 64), header.Bits, header.Hashes}
+  for i := range b.bits {
+    b.bits[i] = binary.LittleEndian.Uint64(body[i * 8:])
+  }
+  return header, b, nil
+}
+
+func filterPreamble(header []byte) []byte {
+  preamble := append(append([]byte{}, filterMagic...), FilterVersion, 0, 0, 0, 0)
+  binary.BigEndian.PutUint32(preamble[len(filterMagic) + 1:], uint32(len(header)))
+  return append(preamble, header...)
+}
+
+func FilterHandler(w http.ResponseWriter, params string, registry *Registry, key ed25519.PrivateKey, fpRate float64) {
+  if key == nil {
+    respondWithJSON(w, http.StatusNotImplemented, credErr{ErrFilterDisabled.Error()})
+    return
+  }
+  p, store, err := registry.Get(params)
+  if err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{err.Error()})
+    return
+  }
+  b, entries, err := ExportFilter(store, fpRate)
+  if err == ErrFilterPeppered || err == ErrScanUnsupported {
+    respondWithJSON(w, http.StatusNotImplemented, credErr{err.Error()})
+    return
+  } else if err != nil {
+    respondWithJSON(w, http.StatusInternalServerError, credErr{err.Error()})
+    return
+  }
+  w.Header().Set("Content-Type", "application/octet-stream")
+  w.Header().Set("Content-Disposition", "attachment; filename=\"ccds_" + p.Name + ".filter\"")
+  w.WriteHeader(http.StatusOK)
+  if err = WriteFilter(w, p, b, entries, key); err != nil {
+    log.Println("Writing filter:", err)
+  }
+}
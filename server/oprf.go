@@ -0,0 +1,220 @@
+package server
+
+import (
+  "crypto/rand"
+  "crypto/sha512"
+  "encoding/base64"
+  "encoding/hex"
+  "errors"
+  "net/http"
+  "os"
+  "strconv"
+
+  "github.com/gtank/ristretto255"
+)
+
+// OPRF lookups follow the OPRF mode of RFC 9497 with ristretto255-SHA512:
+// the client blinds its Argon2 hash, the server multiplies the blinded
+// element by its key without learning the hash, and the client unblinds
+// the result into an output it can look up with /v2/oprf/range.
+// https://www.rfc-editor.org/rfc/rfc9497
+const oprfContext = "OPRFV1-\x00-ristretto255-SHA512"
+// length in bytes of an encoded element or scalar
+const oprfElementLen = 32
+// length in bytes of an OPRF output
+const OPRFOutputLen = sha512.Size
+
+var ErrOPRFDisabled = errors.New("OPRF lookups are not enabled on this server.")
+
+// OPRFKey is the server's secret OPRF key.
+type OPRFKey struct{
+  k *ristretto255.Scalar
+}
+
+type OPRFReqBody struct{
+  // base64 encoded blinded elements
+  Elements []string `json:"elements"`
+}
+
+// Elements[i] is the evaluation of Elements[i] of the request
+type OPRFRes struct{
+  Elements []string `json:"elements"`
+}
+
+// reads a hex seed of at least 32 bytes from CCDS_OPRF_KEY; returns nil
+// if it is unset
+func GetOPRFKey() (*OPRFKey, error) {
+  seedHex := os.Getenv("CCDS_OPRF_KEY")
+  if seedHex == "" {
+    return nil, nil
+  }
+  seed, err := hex.DecodeString(seedHex)
+  if err != nil || len(seed) < 32 {
+    return nil, errors.New("CCDS_OPRF_KEY must be at least 32 hex encoded bytes.")
+  }
+  return DeriveOPRFKey(seed, []byte("CCDS"))
+}
+
+// DeriveKeyPair from RFC 9497 section 3.2.1
+func DeriveOPRFKey(seed, info []byte) (*OPRFKey, error) {
+  deriveInput := append(append(append([]byte{}, seed...), i2osp2(len(info))...), info...)
+  for counter := 0; counter < 256; counter += 1 {
+    k := hashToScalar(append(deriveInput, byte(counter)), "DeriveKeyPair" + oprfContext)
+    if k.Equal(ristretto255.NewScalar()) == 0 {
+      return &OPRFKey{k}, nil
+    }
+  }
+  return nil, errors.New("Unable to derive an OPRF key.")
+}
+
+// multiplies an encoded blinded element by the key
+func (k *OPRFKey) BlindEvaluate(blinded []byte) ([]byte, error) {
+  e, err := decodeElement(blinded)
+  if err != nil {
+    return nil, err
+  }
+  return ristretto255.NewElement().ScalarMult(k.k, e).Encode(nil), nil
+}
+
+// computes the OPRF output of input directly; used by the importer
+func (k *OPRFKey) Evaluate(input []byte) []byte {
+  n := ristretto255.NewElement().ScalarMult(k.k, hashToGroup(input))
+  return oprfFinalizeHash(input, n)
+}
+
+// blinds input with a random scalar; the blind is kept by the client and
+// passed to OPRFFinalize
+func OPRFBlind(input []byte) (blind, blinded []byte, err error) {
+  b := make([]byte, 64)
+  for {
+    _, err = rand.Read(b)
+    if err != nil {
+      return
+    }
+    r := ristretto255.NewScalar().FromUniformBytes(b)
+    if r.Equal(ristretto255.NewScalar()) == 0 {
+      return oprfBlindWith(input, r.Encode(nil))
+    }
+  }
+}
+
+func oprfBlindWith(input, blind []byte) ([]byte, []byte, error) {
+  r := ristretto255.NewScalar()
+  err := r.Decode(blind)
+  if err != nil {
+    return nil, nil, err
+  }
+  blinded := ristretto255.NewElement().ScalarMult(r, hashToGroup(input))
+  return blind, blinded.Encode(nil), nil
+}
+
+// unblinds the server's evaluation of OPRFBlind(input) into the OPRF output
+func OPRFFinalize(input, blind, evaluated []byte) ([]byte, error) {
+  r := ristretto255.NewScalar()
+  err := r.Decode(blind)
+  if err != nil {
+    return nil, err
+  }
+  e, err := decodeElement(evaluated)
+  if err != nil {
+    return nil, err
+  }
+  n := ristretto255.NewElement().ScalarMult(ristretto255.NewScalar().Invert(r), e)
+  return oprfFinalizeHash(input, n), nil
+}
+
+func OPRFEvaluateHandler(w http.ResponseWriter, r *http.Request, key *OPRFKey, maxBatchSize int) {
+  if key == nil {
+    respondWithJSON(w, http.StatusNotImplemented, credErr{ErrOPRFDisabled.Error()})
+    return
+  }
+  var req OPRFReqBody
+  err := DecodeBody(r.Body, &req)
+  if err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{"An error occurred parsing the request body"})
+    return
+  }
+  if len(req.Elements) > maxBatchSize {
+    respondWithJSON(w, http.StatusRequestEntityTooLarge, credErr{"Expected at most " + strconv.Itoa(maxBatchSize) + " elements. Got " + strconv.Itoa(len(req.Elements)) + "."})
+    return
+  }
+  res := OPRFRes{make([]string, len(req.Elements))}
+  for i, encoded := range req.Elements {
+    blinded, err := base64.StdEncoding.DecodeString(encoded)
+    if err != nil {
+      respondWithJSON(w, http.StatusBadRequest, credErr{"Element " + strconv.Itoa(i) + ": " + err.Error()})
+      return
+    }
+    evaluated, err := key.BlindEvaluate(blinded)
+    if err != nil {
+      respondWithJSON(w, http.StatusBadRequest, credErr{"Element " + strconv.Itoa(i) + ": " + err.Error()})
+      return
+    }
+    res.Elements[i] = base64.StdEncoding.EncodeToString(evaluated)
+  }
+  respondWithJSON(w, http.StatusOK, res)
+}
+
+func decodeElement(b []byte) (*ristretto255.Element, error) {
+  e := ristretto255.NewElement()
+  if len(b) != oprfElementLen || e.Decode(b) != nil {
+    return nil, errors.New("Invalid ristretto255 element.")
+  }
+  if e.Equal(ristretto255.NewElement().Zero()) == 1 {
+    return nil, errors.New("Element is the identity.")
+  }
+  return e, nil
+}
+
+func oprfFinalizeHash(input []byte, n *ristretto255.Element) []byte {
+  unblinded := n.Encode(nil)
+  h := sha512.New()
+  h.Write(i2osp2(len(input)))
+  h.Write(input)
+  h.Write(i2osp2(len(unblinded)))
+  h.Write(unblinded)
+  h.Write([]byte("Finalize"))
+  return h.Sum(nil)
+}
+
+func hashToGroup(input []byte) *ristretto255.Element {
+  return ristretto255.NewElement().FromUniformBytes(expandMessageXMD(input, "HashToGroup-" + oprfContext, 64))
+}
+
+func hashToScalar(input []byte, dst string) *ristretto255.Scalar {
+  return ristretto255.NewScalar().FromUniformBytes(expandMessageXMD(input, dst, 64))
+}
+
+// expand_message_xmd with SHA-512 from RFC 9380 section 5.3.1
+func expandMessageXMD(msg []byte, dst string, length int) []byte {
+  dstPrime := append([]byte(dst), byte(len(dst)))
+  h := sha512.New()
+  h.Write(make([]byte, h.BlockSize()))
+  h.Write(msg)
+  h.Write(i2osp2(length))
+  h.Write([]byte{0})
+  h.Write(dstPrime)
+  b0 := h.Sum(nil)
+  var out, prev []byte
+  for i := 1; len(out) < length; i += 1 {
+    h.Reset()
+    if prev == nil {
+      h.Write(b0)
+    } else {
+      x := make([]byte, len(b0))
+      for j := range b0 {
+        x[j] = b0[j] ^ prev[j]
+      }
+      h.Write(x)
+    }
+    h.Write([]byte{byte(i)})
+    h.Write(dstPrime)
+    prev = h.Sum(nil)
+    out = append(out, prev...)
+  }
+  return out[:length]
+}
+
+func i2osp2(n int) []byte {
+  return []byte{byte(n >> 8), byte(n)}
+}
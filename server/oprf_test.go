@@ -0,0 +1,68 @@
+package server
+
+import (
+  "bytes"
+  "encoding/hex"
+  "testing"
+)
+
+// RFC 9497 appendix A.1.1, OPRF mode, test vector 1
+func TestOPRFVector(t *testing.T) {
+  seed, _ := hex.DecodeString("a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3")
+  info, _ := hex.DecodeString("74657374206b6579")
+  input := []byte{0}
+  blind, _ := hex.DecodeString("64d37aed22a27f5191de1c1d69fadb899d8862b58eb4220029e036ec4c1f6706")
+  key, err := DeriveOPRFKey(seed, info)
+  if err != nil {
+    t.Fatal(err)
+  }
+  checkHex(t, "skSm", "5ebcea5ee37023ccb9fc2d2019f9d7737be85591ae8652ffa9ef0f4d37063b0e", key.k.Encode(nil))
+  _, blinded, err := oprfBlindWith(input, blind)
+  if err != nil {
+    t.Fatal(err)
+  }
+  checkHex(t, "BlindedElement", "609a0ae68c15a3cf6903766461307e5c8bb2f95e7e6550e1ffa2dc99e412803c", blinded)
+  evaluated, err := key.BlindEvaluate(blinded)
+  if err != nil {
+    t.Fatal(err)
+  }
+  checkHex(t, "EvaluationElement", "7ec6578ae5120958eb2db1745758ff379e77cb64fe77b0b2d8cc917ea0869c7e", evaluated)
+  output, err := OPRFFinalize(input, blind, evaluated)
+  if err != nil {
+    t.Fatal(err)
+  }
+  checkHex(t, "Output", "527759c3d9366f277d8c6020418d96bb393ba2afb20ff90df23fb7708264e2f3ab9135e3bd69955851de4b1f9fe8a0973396719b7912ba9ee8aa7d0b5e24bcf6", output)
+  if !bytes.Equal(output, key.Evaluate(input)) {
+    t.Error("Expected Evaluate to match the blinded protocol")
+  }
+}
+
+func TestOPRFRandomBlind(t *testing.T) {
+  key, _ := DeriveOPRFKey(bytes.Repeat([]byte{1}, 32), nil)
+  input := bytes.Repeat([]byte{0xaa}, CredHashLen)
+  blind, blinded, err := OPRFBlind(input)
+  if err != nil {
+    t.Fatal(err)
+  }
+  evaluated, err := key.BlindEvaluate(blinded)
+  if err != nil {
+    t.Fatal(err)
+  }
+  output, err := OPRFFinalize(input, blind, evaluated)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if !bytes.Equal(output, key.Evaluate(input)) {
+    t.Error("Expected the unblinded output to match Evaluate")
+  }
+  _, err = key.BlindEvaluate(make([]byte, oprfElementLen))
+  if err == nil {
+    t.Error("Expected the identity element to be rejected")
+  }
+}
+
+func checkHex(t *testing.T, name, expected string, actual []byte) {
+  if hex.EncodeToString(actual) != expected {
+    t.Errorf("%s: expected %s. Got %x\n", name, expected, actual)
+  }
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+  "errors"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+// ParamSet is a named set of Argon2id parameters. Each set has its own
+// table, since hashes made with different parameters never match.
+type ParamSet struct{
+  // "<iterations>_<memory MiB>_<threads>_<key length>"
+  Name       string `json:"name"`
+  Iterations uint32 `json:"iterations"`
+  Memory     uint32 `json:"memory"` // KiB
+  Threads    uint8  `json:"threads"`
+  KeyLen     uint32 `json:"keyLen"`
+}
+
+// start of the error message for a set the server doesn't serve
+const UnsupportedParamSet = "Unsupported parameter set"
+
+// longest key length a set may name, in bytes
+const MaxKeyLen = 1024
+
+// parameters of CredHashTable
+var DefaultParamSet = ParamSet{"1_64_8_64", 1, 64*1024, 8, 64}
+
+type ParamsRes struct{
+  // set used when a request doesn't name one
+  Default string     `json:"default"`
+  Sets    []ParamSet `json:"sets"`
+}
+
+// parses a set name such as "1_64_8_64"
+func ParseParamSet(name string) (p ParamSet, err error) {
+  parts := strings.Split(name, "_")
+  if len(parts) != 4 {
+    return p, errors.New("Expected a parameter set of the form iterations_memoryMiB_threads_keyLen. Got \"" + name + "\".")
+  }
+  nums := make([]uint64, 4)
+  for i, part := range parts {
+    nums[i], err = strconv.ParseUint(part, 10, 32)
+    if err != nil || nums[i] == 0 {
+      return p, errors.New("Invalid parameter set \"" + name + "\".")
+    }
+  }
+  if nums[1] > 1 << 22 || nums[2] > 255 || nums[3] > MaxKeyLen {
+    return p, errors.New("Invalid parameter set \"" + name + "\".")
+  }
+  return ParamSet{name, uint32(nums[0]), uint32(nums[1]) * 1024, uint8(nums[2]), uint32(nums[3])}, nil
+}
+
+func (p ParamSet) Table() string {
+  return "cred_hash_" + p.Name
+}
+
+// table of the OPRF outputs of hashes made with p
+func (p ParamSet) OPRFTable() string {
+  return "oprf_hash_" + p.Name
+}
+
+// table of the password-only hashes made with p
+func (p ParamSet) PasswordTable() string {
+  return "password_hash_" + p.Name
+}
+
+// reports whether p costs an attacker more per guess than q
+func (p ParamSet) Stronger(q ParamSet) bool {
+  pCost := uint64(p.Memory) * uint64(p.Iterations)
+  qCost := uint64(q.Memory) * uint64(q.Iterations)
+  if pCost != qCost {
+    return pCost > qCost
+  }
+  return p.KeyLen > q.KeyLen
+}
+
+// Registry maps parameter set names to the stores holding their hashes.
+// It is filled in at startup and read-only afterwards.
+type Registry struct{
+  // name of the set used when a request doesn't name one
+  Default string
+  sets    map[string]ParamSet
+  stores  map[string]Store
+}
+
+func NewRegistry() *Registry {
+  return &Registry{sets: make(map[string]ParamSet), stores: make(map[string]Store)}
+}
+
+// adds a set; the first set registered becomes the default
+func (r *Registry) Register(p ParamSet, store Store) {
+  if r.Default == "" {
+    r.Default = p.Name
+  }
+  r.sets[p.Name] = p
+  r.stores[p.Name] = store
+}
+
+// returns the set called name and its store, or the default set if name is empty
+func (r *Registry) Get(name string) (ParamSet, Store, error) {
+  if name == "" {
+    name = r.Default
+  }
+  p, ok := r.sets[name]
+  if !ok {
+    return p, nil, errors.New(UnsupportedParamSet + " \"" + name + "\".")
+  }
+  return p, r.stores[name], nil
+}
+
+// all registered sets, strongest first
+func (r *Registry) ParamSets() []ParamSet {
+  sets := make([]ParamSet, 0, len(r.sets))
+  for _, p := range r.sets {
+    sets = append(sets, p)
+  }
+  sort.Slice(sets, func(i, j int) bool {
+    return sets[i].Stronger(sets[j])
+  })
+  return sets
+}
+
+func (r *Registry) Stores() []Store {
+  stores := make([]Store, 0, len(r.stores))
+  for _, p := range r.ParamSets() {
+    stores = append(stores, r.stores[p.Name])
+  }
+  return stores
+}
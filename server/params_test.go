@@ -0,0 +1,40 @@
+package server
+
+import (
+  "testing"
+)
+
+func TestParseParamSet(t *testing.T) {
+  p, err := ParseParamSet(DefaultParamSet.Name)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if p != DefaultParamSet || p.Table() != CredHashTable {
+    t.Errorf("Expected %v. Got %v\n", DefaultParamSet, p)
+  }
+  for _, name := range []string{"", "1_64_8", "1_64_8_x", "0_64_8_64", "1_64_256_64", "1_64_8_1025"} {
+    _, err = ParseParamSet(name)
+    if err == nil {
+      t.Errorf("Expected an error parsing \"%s\"\n", name)
+    }
+  }
+}
+
+func TestRegistry(t *testing.T) {
+  strong, _ := ParseParamSet("2_128_8_64")
+  r := NewRegistry()
+  r.Register(DefaultParamSet, NewMemStore())
+  r.Register(strong, NewMemStore())
+  p, _, err := r.Get("")
+  if err != nil || p != DefaultParamSet {
+    t.Errorf("Expected the default set. Got %v, %v\n", p, err)
+  }
+  sets := r.ParamSets()
+  if len(sets) != 2 || sets[0] != strong {
+    t.Errorf("Expected %v first. Got %v\n", strong, sets)
+  }
+  _, _, err = r.Get("9_9_9_9")
+  if err == nil {
+    t.Error("Expected an error for an unregistered set")
+  }
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+  "database/sql"
+  "errors"
+  "net/http"
+  "strconv"
+  "sync"
+)
+
+// PasswordSalt salts every password-only hash. Credential hashes are
+// salted with the lowercased username, so this fixed salt keeps the two
+// kinds of hash apart. Being fixed, it lets anyone precompute guesses;
+// only the pepper protects a leaked password table.
+var PasswordSalt = []byte("ccds-password-v1")
+
+var ErrPasswordsDisabled = errors.New("Password checks are not enabled for this parameter set.")
+
+func PasswordTableCreate(table string, hashLen uint32) string {
+  return `
+  CREATE TABLE IF NOT EXISTS ` + table + ` (
+    hash varbinary(` + strconv.FormatUint(uint64(hashLen), 10) + `) NOT NULL,
+    count bigint unsigned NOT NULL DEFAULT '0',
+    key_id smallint unsigned NOT NULL DEFAULT '0',
+    PRIMARY KEY (hash)
+  ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+`
+}
+
+// PasswordStore counts how many leaked credentials used each password,
+// whoever they belonged to. The stores here are also KeyedStores, so that
+// rows made with a retired pepper key can be deleted.
+type PasswordStore interface {
+  // counts an occurrence of the password hash; keyID is the pepper key it
+  // was made with, or 0 for none
+  AddPassword(hash []byte, keyID uint16) error
+  // returns 0 for passwords never seen
+  PasswordCount(hash []byte) (int64, error)
+  CreateTables() error
+}
+
+type PasswordRes struct{
+  Compromised bool  `json:"compromised"`
+  // number of distinct leaked credentials with the password, across
+  // every breach
+  Count       int64 `json:"count"`
+}
+
+// serves a CredReqBody whose Hash is of the password alone, made with
+// PasswordSalt
+func PasswordHandler(w http.ResponseWriter, r *http.Request, registry *Registry, passwords map[string]PasswordStore) {
+  var req CredReqBody
+  err := DecodeBody(r.Body, &req)
+  if err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{"An error occurred parsing the request body"})
+    return
+  }
+  p, _, err := registry.Get(req.Params)
+  if err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{err.Error()})
+    return
+  }
+  store, ok := passwords[p.Name]
+  if !ok {
+    respondWithJSON(w, http.StatusNotImplemented, credErr{ErrPasswordsDisabled.Error()})
+    return
+  }
+  hash, err := DecodeHash(req.Hash, req.Encoding, int(p.KeyLen))
+  if err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{err.Error()})
+    return
+  }
+  count, err := store.PasswordCount(hash)
+  if err != nil {
+    respondWithJSON(w, http.StatusInternalServerError, credErr{err.Error()})
+    return
+  }
+  if count > 0 && !chargeHits(w, r, 1) {
+    return
+  }
+  respondWithJSON(w, http.StatusOK, PasswordRes{count > 0, count})
+}
+
+// PepperedPasswordStore applies a Keyring to every hash, like PepperedStore.
+type PepperedPasswordStore struct{
+  PasswordStore
+  Keys Keyring
+}
+
+// wraps store with keys, or returns store unchanged if keys is empty
+func NewPepperedPasswordStore(store PasswordStore, keys Keyring) PasswordStore {
+  if len(keys) == 0 {
+    return store
+  }
+  return &PepperedPasswordStore{store, keys}
+}
+
+// counts hash peppered with the current key
+func (s *PepperedPasswordStore) AddPassword(hash []byte, keyID uint16) error {
+  key := s.Keys[0]
+  return s.PasswordStore.AddPassword(key.Apply(hash), key.ID)
+}
+
+// returns the highest count under any key; re-imported credentials are
+// counted under both keys, so adding the counts up would count them twice,
+// while the newest key's count alone restarts at 1 mid-rotation
+func (s *PepperedPasswordStore) PasswordCount(hash []byte) (highest int64, err error) {
+  for _, key := range s.Keys {
+    count, err := s.PasswordStore.PasswordCount(key.Apply(hash))
+    if err != nil {
+      return 0, err
+    }
+    if count > highest {
+      highest = count
+    }
+  }
+  return highest, nil
+}
+
+func (s *PepperedPasswordStore) DeleteKey(keyID uint16) (int64, error) {
+  keyed, ok := s.PasswordStore.(KeyRetirer)
+  if !ok {
+    return 0, errors.New("Password store does not record pepper key ids.")
+  }
+  return keyed.DeleteKey(keyID)
+}
+
+// MySQLPasswordStore keeps the password hashes of one parameter set in
+// ParamSet.PasswordTable.
+type MySQLPasswordStore struct{
+  DB      *sql.DB
+  Table   string
+  HashLen uint32
+}
+
+func NewMySQLPasswordStore(db *sql.DB, p ParamSet) *MySQLPasswordStore {
+  return &MySQLPasswordStore{db, p.PasswordTable(), p.KeyLen}
+}
+
+func (s *MySQLPasswordStore) AddPassword(hash []byte, keyID uint16) (err error) {
+  _, err = s.DB.Exec("INSERT INTO " + s.Table + " (hash, count, key_id) VALUES (?, 1, ?) ON DUPLICATE KEY UPDATE count=count+1", hash, keyID)
+  return
+}
+
+// counts an occurrence, like AddPassword
+func (s *MySQLPasswordStore) InsertKeyed(hash []byte, keyID uint16) error {
+  return s.AddPassword(hash, keyID)
+}
+
+func (s *MySQLPasswordStore) DeleteKey(keyID uint16) (int64, error) {
+  res, err := s.DB.Exec("DELETE FROM " + s.Table + " WHERE key_id=?", keyID)
+  if err != nil {
+    return 0, err
+  }
+  return res.RowsAffected()
+}
+
+func (s *MySQLPasswordStore) PasswordCount(hash []byte) (count int64, err error) {
+  err = s.DB.QueryRow("SELECT count FROM " + s.Table + " WHERE hash=?", hash).Scan(&count)
+  if err == sql.ErrNoRows {
+    return 0, nil
+  }
+  return
+}
+
+func (s *MySQLPasswordStore) CreateTables() (err error) {
+  _, err = s.DB.Exec(PasswordTableCreate(s.Table, s.HashLen))
+  return
+}
+
+// MemPasswordStore keeps password counts in memory.
+type MemPasswordStore struct{
+  mu     sync.Mutex
+  counts map[string]int64
+  keyIDs map[string]uint16
+}
+
+func NewMemPasswordStore() *MemPasswordStore {
+  return &MemPasswordStore{counts: make(map[string]int64), keyIDs: make(map[string]uint16)}
+}
+
+func (s *MemPasswordStore) AddPassword(hash []byte, keyID uint16) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if _, ok := s.counts[string(hash)]; !ok {
+    s.keyIDs[string(hash)] = keyID
+  }
+  s.counts[string(hash)] += 1
+  return nil
+}
+
+func (s *MemPasswordStore) InsertKeyed(hash []byte, keyID uint16) error {
+  return s.AddPassword(hash, keyID)
+}
+
+func (s *MemPasswordStore) DeleteKey(keyID uint16) (deleted int64, err error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  for hash, id := range s.keyIDs {
+    if id == keyID {
+      delete(s.counts, hash)
+      delete(s.keyIDs, hash)
+      deleted += 1
+    }
+  }
+  return
+}
+
+func (s *MemPasswordStore) PasswordCount(hash []byte) (int64, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  return s.counts[string(hash)], nil
+}
+
+func (s *MemPasswordStore) CreateTables() error {
+  return nil
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+  "crypto/hmac"
+  "crypto/sha512"
+  "encoding/hex"
+  "errors"
+  "os"
+  "strconv"
+  "strings"
+)
+
+// returned by PepperedStore.LookupRange; clients can't compute the pepper,
+// so their prefixes never match stored hashes
+var ErrRangeUnsupported = errors.New("Range lookups are not available when the server applies a pepper.")
+
+// PepperKey is a secret HMAC key. ID is stored next to every hash made with
+// it so that rows can be retired when the key is rotated out.
+type PepperKey struct{
+  ID  uint16
+  Key []byte
+}
+
+// Keyring holds the pepper keys in use; the first key peppers new inserts
+// and every key is tried on lookup.
+type Keyring []PepperKey
+
+// KeyedStore is implemented by stores that record which pepper key each
+// hash was made with.
+type KeyedStore interface {
+  KeyRetirer
+  InsertKeyed(hash []byte, keyID uint16) error
+}
+
+type KeyRetirer interface {
+  // deletes every hash made with keyID and returns how many there were
+  DeleteKey(keyID uint16) (int64, error)
+}
+
+// reads the keyring from CCDS_PEPPER_KEYS; returns an empty keyring if unset
+func GetKeyring() (Keyring, error) {
+  return ParseKeyring(os.Getenv("CCDS_PEPPER_KEYS"))
+}
+
+// parses a comma-separated list of id:hexkey pairs, current key first,
+// e.g. "2:9f86d0...,1:60303a..."
+func ParseKeyring(s string) (k Keyring, err error) {
+  if s == "" {
+    return
+  }
+  seen := make(map[uint16]bool)
+  for _, pair := range strings.Split(s, ",") {
+    parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+    if len(parts) != 2 {
+      return nil, errors.New("Expected pepper keys of the form id:hexkey.")
+    }
+    id, err := strconv.ParseUint(parts[0], 10, 16)
+    if err != nil || id == 0 {
+      return nil, errors.New("Pepper key ids must be between 1 and 65535. Got \"" + parts[0] + "\".")
+    }
+    key, err := hex.DecodeString(parts[1])
+    if err != nil || len(key) < 32 {
+      return nil, errors.New("Pepper key " + parts[0] + " must be at least 32 hex encoded bytes.")
+    }
+    if seen[uint16(id)] {
+      return nil, errors.New("Pepper key " + parts[0] + " is listed twice.")
+    }
+    seen[uint16(id)] = true
+    k = append(k, PepperKey{uint16(id), key})
+  }
+  return k, nil
+}
+
+// HMAC-SHA512 of hash under the key, truncated to the length of hash so
+// that it fits the table's column
+func (p PepperKey) Apply(hash []byte) []byte {
+  mac := hmac.New(sha512.New, p.Key)
+  mac.Write(hash)
+  sum := mac.Sum(nil)
+  if len(hash) < len(sum) {
+    return sum[:len(hash)]
+  }
+  return sum
+}
+
+// PepperedStore applies a Keyring to every hash before it reaches Store,
+// so that a leaked table can't be attacked offline without the keys.
+type PepperedStore struct{
+  Store
+  Keys Keyring
+}
+
+// wraps store with keys, or returns store unchanged if keys is empty
+func NewPepperedStore(store Store, keys Keyring) Store {
+  if len(keys) == 0 {
+    return store
+  }
+  return &PepperedStore{store, keys}
+}
+
+func (s *PepperedStore) Lookup(hash []byte) (bool, error) {
+  results, err := s.LookupMany([][]byte{hash})
+  if err != nil {
+    return false, err
+  }
+  return results[0], nil
+}
+
+// looks up every hash under every key in one call to the wrapped store
+func (s *PepperedStore) LookupMany(hashes [][]byte) ([]bool, error) {
+  peppered := make([][]byte, 0, len(hashes) * len(s.Keys))
+  for _, hash := range hashes {
+    for _, key := range s.Keys {
+      peppered = append(peppered, key.Apply(hash))
+    }
+  }
+  found, err := s.Store.LookupMany(peppered)
+  if err != nil {
+    return nil, err
+  }
+  results := make([]bool, len(hashes))
+  for i, ok := range found {
+    if ok {
+      results[i / len(s.Keys)] = true
+    }
+  }
+  return results, nil
+}
+
+func (s *PepperedStore) LookupRange(prefix string) ([][]byte, error) {
+  return nil, ErrRangeUnsupported
+}
+
+// inserts hash peppered with the current key; a hash already stored under
+// an older key is inserted again so that the old key can be retired
+func (s *PepperedStore) Insert(hash []byte) error {
+  key := s.Keys[0]
+  if keyed, ok := s.Store.(KeyedStore); ok {
+    return keyed.InsertKeyed(key.Apply(hash), key.ID)
+  }
+  return s.Store.Insert(key.Apply(hash))
+}
+
+func (s *PepperedStore) DeleteKey(keyID uint16) (int64, error) {
+  keyed, ok := s.Store.(KeyedStore)
+  if !ok {
+    return 0, errors.New("Store does not record pepper key ids.")
+  }
+  return keyed.DeleteKey(keyID)
+}
+
+// the store holding the peppered hashes
+func (s *PepperedStore) Unwrap() Store {
+  return s.Store
+}
+
+func (s *PepperedStore) AddSource(src Source) (int64, error) {
+  sourced, ok := s.Store.(SourcedStore)
+  if !ok {
+    return 0, ErrSourcesUnsupported
+  }
+  return sourced.AddSource(src)
+}
+
+// records hash peppered with the current key
+func (s *PepperedStore) InsertSourced(hash []byte, sourceID int64, keyID uint16) error {
+  sourced, ok := s.Store.(SourcedStore)
+  if !ok {
+    return ErrSourcesUnsupported
+  }
+  key := s.Keys[0]
+  return sourced.InsertSourced(key.Apply(hash), sourceID, key.ID)
+}
+
+// returns the sightings of hash under every key
+func (s *PepperedStore) Sightings(hash []byte) (sightings []Sighting, err error) {
+  sourced, ok := s.Store.(SourcedStore)
+  if !ok {
+    return nil, ErrSourcesUnsupported
+  }
+  for _, key := range s.Keys {
+    found, err := sourced.Sightings(key.Apply(hash))
+    if err != nil {
+      return nil, err
+    }
+    sightings = append(sightings, found...)
+  }
+  return
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+  "bytes"
+  "strings"
+  "testing"
+)
+
+func TestParseKeyring(t *testing.T) {
+  k, err := ParseKeyring("2:" + strings.Repeat("ab", 32) + ",1:" + strings.Repeat("cd", 32))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(k) != 2 || k[0].ID != 2 || k[1].ID != 1 {
+    t.Errorf("Expected keys 2 and 1. Got %v\n", k)
+  }
+  bad := []string{"2", "0:" + strings.Repeat("ab", 32), "1:abcd", "1:" + strings.Repeat("zz", 32), "1:" + strings.Repeat("ab", 32) + ",1:" + strings.Repeat("ab", 32)}
+  for _, s := range bad {
+    _, err = ParseKeyring(s)
+    if err == nil {
+      t.Errorf("Expected an error parsing %s\n", s)
+    }
+  }
+}
+
+func TestPepperedStore(t *testing.T) {
+  oldKey := PepperKey{1, bytes.Repeat([]byte{1}, 32)}
+  newKey := PepperKey{2, bytes.Repeat([]byte{2}, 32)}
+  hash := bytes.Repeat([]byte{0xaa}, CredHashLen)
+  mem := NewMemStore()
+  old := NewPepperedStore(mem, Keyring{oldKey})
+  old.Insert(hash)
+  found, _ := mem.Lookup(hash)
+  if found {
+    t.Error("Expected the unpeppered hash not to be stored")
+  }
+  // rotate: both keys are checked until the old one is retired
+  rotated := NewPepperedStore(mem, Keyring{newKey, oldKey})
+  found, _ = rotated.Lookup(hash)
+  if !found {
+    t.Error("Expected hash peppered with the old key to be found")
+  }
+  rotated.Insert(hash)
+  deleted, err := rotated.(KeyRetirer).DeleteKey(oldKey.ID)
+  if err != nil || deleted != 1 {
+    t.Errorf("Expected 1 hash to be deleted. Got %d, %v\n", deleted, err)
+  }
+  found, _ = NewPepperedStore(mem, Keyring{newKey}).Lookup(hash)
+  if !found {
+    t.Error("Expected hash peppered with the new key to be found")
+  }
+  _, err = rotated.LookupRange("abcde")
+  if err != ErrRangeUnsupported {
+    t.Errorf("Expected ErrRangeUnsupported. Got %v\n", err)
+  }
+}
+
+func TestPepperedPasswordStore(t *testing.T) {
+  oldKey := PepperKey{1, bytes.Repeat([]byte{1}, 32)}
+  newKey := PepperKey{2, bytes.Repeat([]byte{2}, 32)}
+  mem := NewMemPasswordStore()
+  hash := randomHash(t)
+  // seen 3 times under the old key
+  for i := 0; i < 3; i += 1 {
+    NewPepperedPasswordStore(mem, Keyring{oldKey}).AddPassword(hash, 0)
+  }
+  rotated := NewPepperedPasswordStore(mem, Keyring{newKey, oldKey})
+  if count, _ := rotated.PasswordCount(hash); count != 3 {
+    t.Errorf("Expected the count under the old key until the new one has it. Got %d\n", count)
+  }
+  // one credential is imported again after rotating
+  rotated.AddPassword(hash, 0)
+  if count, _ := rotated.PasswordCount(hash); count != 3 {
+    t.Errorf("Expected the larger count under the old key. Got %d\n", count)
+  }
+  // re-imports count under both keys until the new one overtakes the old
+  for i := 0; i < 3; i += 1 {
+    rotated.AddPassword(hash, 0)
+  }
+  if count, _ := rotated.PasswordCount(hash); count != 4 {
+    t.Errorf("Expected the larger count under the new key. Got %d\n", count)
+  }
+  if count, _ := mem.PasswordCount(hash); count != 0 {
+    t.Errorf("Expected only peppered hashes to be stored. Got a count of %d\n", count)
+  }
+  deleted, err := rotated.(KeyRetirer).DeleteKey(oldKey.ID)
+  if err != nil || deleted != 1 {
+    t.Errorf("Expected 1 password hash to be deleted. Got %d, %v\n", deleted, err)
+  }
+  if count, _ := rotated.PasswordCount(hash); count != 4 {
+    t.Errorf("Expected only the count under the new key to remain. Got %d\n", count)
+  }
+}
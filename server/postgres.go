@@ -0,0 +1,811 @@
+package server
+
+import (
+  "database/sql"
+  "errors"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// The Postgres tables mirror the MySQL ones, with bytea in place of
+// varbinary and timestamp, holding UTC, in place of datetime.
+
+func PostgresCredHashTableCreate(table string, hashLen uint32) string {
+  return `
+  CREATE TABLE IF NOT EXISTS ` + table + ` (
+    hash bytea NOT NULL CHECK (octet_length(hash) <= ` + strconv.FormatUint(uint64(hashLen), 10) + `),
+    checked integer DEFAULT 0,
+    key_id integer NOT NULL DEFAULT 0,
+    seq bigserial NOT NULL UNIQUE,
+    PRIMARY KEY (hash)
+  );
+`
+}
+
+const PostgresSourceTableCreate = `
+  CREATE TABLE IF NOT EXISTS ` + SourceTable + ` (
+    id serial NOT NULL,
+    name varchar(255) NOT NULL UNIQUE,
+    date date DEFAULT NULL,
+    description text,
+    PRIMARY KEY (id)
+  );
+`
+
+func PostgresSourceLinkTableCreate(table string, hashLen uint32) string {
+  return `
+  CREATE TABLE IF NOT EXISTS ` + SourceLinkTable(table) + ` (
+    hash bytea NOT NULL CHECK (octet_length(hash) <= ` + strconv.FormatUint(uint64(hashLen), 10) + `),
+    source_id integer NOT NULL,
+    count integer NOT NULL DEFAULT 1,
+    first_seen timestamp NOT NULL,
+    last_seen timestamp NOT NULL,
+    PRIMARY KEY (hash, source_id)
+  );
+`
+}
+
+func PostgresHitsTableCreate(table string) string {
+  return `
+  CREATE TABLE IF NOT EXISTS ` + HitsTable(table) + ` (
+    day date NOT NULL,
+    hits bigint NOT NULL DEFAULT 0,
+    PRIMARY KEY (day)
+  );
+`
+}
+
+const PostgresAPIKeyTableCreate = `
+  CREATE TABLE IF NOT EXISTS ` + APIKeyTable + ` (
+    id char(16) NOT NULL,
+    tenant varchar(64) NOT NULL,
+    hash bytea NOT NULL UNIQUE,
+    created timestamp NOT NULL,
+    revoked boolean NOT NULL DEFAULT false,
+    admin boolean NOT NULL DEFAULT false,
+    PRIMARY KEY (id)
+  );
+`
+
+func PostgresPasswordTableCreate(table string, hashLen uint32) string {
+  return `
+  CREATE TABLE IF NOT EXISTS ` + table + ` (
+    hash bytea NOT NULL CHECK (octet_length(hash) <= ` + strconv.FormatUint(uint64(hashLen), 10) + `),
+    count bigint NOT NULL DEFAULT 0,
+    key_id integer NOT NULL DEFAULT 0,
+    PRIMARY KEY (hash)
+  );
+`
+}
+
+const PostgresCanaryTableCreate = `
+  CREATE TABLE IF NOT EXISTS ` + CanaryTable + ` (
+    id char(16) NOT NULL,
+    params varchar(64) NOT NULL,
+    hash bytea NOT NULL,
+    label varchar(255) NOT NULL,
+    created timestamp NOT NULL,
+    PRIMARY KEY (id),
+    UNIQUE (params, hash)
+  );
+`
+
+const PostgresWatchTableCreate = `
+  CREATE TABLE IF NOT EXISTS ` + WatchTable + ` (
+    tenant varchar(64) NOT NULL,
+    params varchar(64) NOT NULL,
+    hash bytea NOT NULL,
+    created timestamp NOT NULL,
+    PRIMARY KEY (tenant, params, hash)
+  );
+  CREATE INDEX IF NOT EXISTS ` + WatchTable + `_params_hash ON ` + WatchTable + ` (params, hash);
+`
+
+const PostgresWebhookTableCreate = `
+  CREATE TABLE IF NOT EXISTS ` + WebhookTable + ` (
+    tenant varchar(64) NOT NULL,
+    url varchar(2048) NOT NULL,
+    secret char(64) NOT NULL,
+    PRIMARY KEY (tenant)
+  );
+`
+
+const PostgresNotificationTableCreate = `
+  CREATE TABLE IF NOT EXISTS ` + NotificationTable + ` (
+    id bigserial NOT NULL,
+    tenant varchar(64) NOT NULL,
+    payload text NOT NULL,
+    attempts integer NOT NULL DEFAULT 0,
+    next_attempt timestamp NOT NULL,
+    dead boolean NOT NULL DEFAULT false,
+    last_error text,
+    created timestamp NOT NULL,
+    PRIMARY KEY (id)
+  );
+  CREATE INDEX IF NOT EXISTS ` + NotificationTable + `_dead_next_attempt ON ` + NotificationTable + ` (dead, next_attempt);
+`
+
+const PostgresJobTableCreate = `
+  CREATE TABLE IF NOT EXISTS ` + JobTable + ` (
+    id char(16) NOT NULL,
+    tenant varchar(64) NOT NULL,
+    api_key_id varchar(16) NOT NULL,
+    ip varchar(64) NOT NULL,
+    params varchar(64) NOT NULL,
+    encoding varchar(16) NOT NULL,
+    status varchar(16) NOT NULL,
+    total bigint NOT NULL,
+    processed bigint NOT NULL DEFAULT 0,
+    matched bigint NOT NULL DEFAULT 0,
+    result_bytes bigint NOT NULL DEFAULT 0,
+    error text,
+    created timestamp NOT NULL,
+    finished timestamp NULL,
+    heartbeat timestamp NULL,
+    PRIMARY KEY (id)
+  );
+  CREATE INDEX IF NOT EXISTS ` + JobTable + `_status_created ON ` + JobTable + ` (status, created);
+`
+
+const PostgresBlocklistTableCreate = `
+  CREATE TABLE IF NOT EXISTS ` + BlocklistTable + ` (
+    tenant varchar(64) NOT NULL,
+    params varchar(64) NOT NULL,
+    hash bytea NOT NULL,
+    created timestamp NOT NULL,
+    PRIMARY KEY (tenant, params, hash)
+  );
+`
+
+const PostgresBlocklistSaltTableCreate = `
+  CREATE TABLE IF NOT EXISTS ` + BlocklistSaltTable + ` (
+    tenant varchar(64) NOT NULL,
+    salt bytea NOT NULL,
+    PRIMARY KEY (tenant)
+  );
+`
+
+// returns "$start, $start+1, ..." for n parameters
+func pgPlaceholders(start, n int) string {
+  var b strings.Builder
+  for i := 0; i < n; i += 1 {
+    if i > 0 {
+      b.WriteString(", ")
+    }
+    b.WriteString("$" + strconv.Itoa(start + i))
+  }
+  return b.String()
+}
+
+// like IncrementChecked
+func PostgresIncrementChecked(db *sql.DB, table string, hits map[string]int64) error {
+  return incrementChecked(db, "UPDATE " + table + " SET checked=checked+$1 WHERE hash=$2",
+    "INSERT INTO " + HitsTable(table) + " (day, hits) VALUES ((now() AT TIME ZONE 'UTC')::date, $1) ON CONFLICT (day) DO UPDATE SET hits=" + HitsTable(table) + ".hits+excluded.hits", hits)
+}
+
+// like SearchHitsPerDay
+func PostgresSearchHitsPerDay(db *sql.DB, table string, days int) ([]DayHits, error) {
+  return searchHitsPerDay(db, "SELECT to_char(day, 'YYYY-MM-DD'), hits FROM " + HitsTable(table) + " WHERE day > (now() AT TIME ZONE 'UTC')::date - $1::integer ORDER BY day", days)
+}
+
+// PostgresStore keeps the hashes of one parameter set in a Postgres table.
+type PostgresStore struct{
+  DB      *sql.DB
+  Table   string
+  HashLen uint32
+  // counts positive lookups in the checked column; nil disables counting
+  Checked *CheckedCounter
+}
+
+func NewPostgresStore(db *sql.DB, p ParamSet) *PostgresStore {
+  return &PostgresStore{DB: db, Table: p.Table(), HashLen: p.KeyLen}
+}
+
+// a store for the OPRF outputs of hashes made with p
+func NewPostgresOPRFStore(db *sql.DB, p ParamSet) *PostgresStore {
+  return &PostgresStore{DB: db, Table: p.OPRFTable(), HashLen: OPRFOutputLen}
+}
+
+func (s *PostgresStore) Lookup(hash []byte) (exists bool, err error) {
+  err = s.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM " + s.Table + " WHERE hash=$1)", hash).Scan(&exists)
+  if exists && s.Checked != nil {
+    s.Checked.Add(s.Table, hash)
+  }
+  return
+}
+
+func (s *PostgresStore) LookupMany(hashes [][]byte) ([]bool, error) {
+  found := make(map[string]struct{})
+  for start := 0; start < len(hashes); start += searchChunkSize {
+    chunk := hashes[start:minInt(start + searchChunkSize, len(hashes))]
+    args := make([]interface{}, len(chunk))
+    for i, hash := range chunk {
+      args[i] = hash
+    }
+    err := s.queryHashes(func(hash []byte) error {
+      found[string(hash)] = struct{}{}
+      return nil
+    }, "SELECT hash FROM " + s.Table + " WHERE hash IN (" + pgPlaceholders(1, len(chunk)) + ")", args...)
+    if err != nil {
+      return nil, err
+    }
+  }
+  results := make([]bool, len(hashes))
+  for i, hash := range hashes {
+    _, results[i] = found[string(hash)]
+    if results[i] && s.Checked != nil {
+      s.Checked.Add(s.Table, hash)
+    }
+  }
+  return results, nil
+}
+
+func (s *PostgresStore) LookupRange(prefix string) (hashes [][]byte, err error) {
+  lo, hi, err := RangeBounds(prefix)
+  if err != nil {
+    return
+  }
+  add := func(hash []byte) error {
+    hashes = append(hashes, hash)
+    return nil
+  }
+  // bytea compares bytewise, like varbinary
+  if hi == nil {
+    err = s.queryHashes(add, "SELECT hash FROM " + s.Table + " WHERE hash >= $1", lo)
+  } else {
+    err = s.queryHashes(add, "SELECT hash FROM " + s.Table + " WHERE hash >= $1 AND hash < $2", lo, hi)
+  }
+  return
+}
+
+func (s *PostgresStore) Scan(fn func(hash []byte) error) error {
+  return s.queryHashes(fn, "SELECT hash FROM " + s.Table)
+}
+
+// calls fn with the hash of each row query returns
+func (s *PostgresStore) queryHashes(fn func(hash []byte) error, query string, args ...interface{}) error {
+  rows, err := s.DB.Query(query, args...)
+  if err != nil {
+    return err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var hash []byte
+    if err = rows.Scan(&hash); err != nil {
+      return err
+    }
+    if err = fn(hash); err != nil {
+      return err
+    }
+  }
+  return rows.Err()
+}
+
+func (s *PostgresStore) Since(seq uint64, limit int) (entries []SyncEntry, err error) {
+  rows, err := s.DB.Query("SELECT seq, hash, key_id FROM " + s.Table + " WHERE seq > $1 ORDER BY seq LIMIT $2", int64(seq), limit)
+  if err != nil {
+    return
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var e SyncEntry
+    if err = rows.Scan(&e.Seq, &e.Hash, &e.KeyID); err != nil {
+      return nil, err
+    }
+    entries = append(entries, e)
+  }
+  return entries, rows.Err()
+}
+
+func (s *PostgresStore) LastSeq() (uint64, error) {
+  return LastCredHashSeq(s.DB, s.Table)
+}
+
+func (s *PostgresStore) Insert(hash []byte) error {
+  return s.InsertKeyed(hash, 0)
+}
+
+// a conflicting insert affects no rows, which is how a duplicate is told
+// apart without parsing driver errors
+func (s *PostgresStore) InsertKeyed(hash []byte, keyID uint16) error {
+  res, err := s.DB.Exec("INSERT INTO " + s.Table + " (hash, key_id) VALUES ($1, $2) ON CONFLICT (hash) DO NOTHING", hash, int64(keyID))
+  if err != nil {
+    return err
+  }
+  inserted, err := res.RowsAffected()
+  if err == nil && inserted == 0 {
+    return ErrDuplicate
+  }
+  return err
+}
+
+func (s *PostgresStore) AddSource(src Source) (int64, error) {
+  return insertSource(s.DB, "INSERT INTO " + SourceTable + " (name, date, description) VALUES ($1, $2, $3) ON CONFLICT (name) DO NOTHING",
+    "SELECT id FROM " + SourceTable + " WHERE name=$1", src)
+}
+
+func (s *PostgresStore) InsertSourced(hash []byte, sourceID int64, keyID uint16) error {
+  duplicate, err := insertCredHashSourced(s.DB, "INSERT INTO " + s.Table + " (hash, key_id) VALUES ($1, $2) ON CONFLICT (hash) DO NOTHING",
+    "INSERT INTO " + SourceLinkTable(s.Table) + " AS l (hash, source_id, first_seen, last_seen) VALUES ($1, $2, now() AT TIME ZONE 'utc', now() AT TIME ZONE 'utc') ON CONFLICT (hash, source_id) DO UPDATE SET count=l.count+1, last_seen=excluded.last_seen",
+    hash, sourceID, keyID)
+  if err == nil && duplicate {
+    return ErrDuplicate
+  }
+  return err
+}
+
+func (s *PostgresStore) Sightings(hash []byte) ([]Sighting, error) {
+  return searchCredHashSightings(s.DB, s.Table, "$1", hash)
+}
+
+func (s *PostgresStore) DeleteKey(keyID uint16) (int64, error) {
+  _, err := s.DB.Exec("DELETE FROM " + SourceLinkTable(s.Table) + " WHERE hash IN (SELECT hash FROM " + s.Table + " WHERE key_id=$1)", int64(keyID))
+  if err != nil {
+    return 0, err
+  }
+  res, err := s.DB.Exec("DELETE FROM " + s.Table + " WHERE key_id=$1", int64(keyID))
+  if err != nil {
+    return 0, err
+  }
+  return res.RowsAffected()
+}
+
+func (s *PostgresStore) HitStats(days int) (stats HitStats, err error) {
+  stats.HitsPerDay, err = PostgresSearchHitsPerDay(s.DB, s.Table, days)
+  if err != nil {
+    return
+  }
+  stats.Checked, err = SearchCheckedDistribution(s.DB, s.Table)
+  return
+}
+
+func (s *PostgresStore) Count() (count int64, err error) {
+  err = s.DB.QueryRow("SELECT COUNT(*) FROM " + s.Table).Scan(&count)
+  return
+}
+
+func (s *PostgresStore) CreateTables() error {
+  return execAll(s.DB, PostgresCredHashTableCreate(s.Table, s.HashLen), PostgresSourceTableCreate, PostgresSourceLinkTableCreate(s.Table, s.HashLen), PostgresHitsTableCreate(s.Table))
+}
+
+func (s *PostgresStore) Close() error {
+  return s.DB.Close()
+}
+
+// PostgresAPIKeyStore keeps API keys in APIKeyTable.
+type PostgresAPIKeyStore struct{
+  DB *sql.DB
+}
+
+func NewPostgresAPIKeyStore(db *sql.DB) *PostgresAPIKeyStore {
+  return &PostgresAPIKeyStore{db}
+}
+
+func (s *PostgresAPIKeyStore) InsertAPIKey(k APIKey) (err error) {
+  _, err = s.DB.Exec("INSERT INTO " + APIKeyTable + " (id, tenant, hash, created, revoked, admin) VALUES ($1, $2, $3, $4, $5, $6)", k.ID, k.Tenant, k.Hash, k.Created, k.Revoked, k.Admin)
+  return
+}
+
+func (s *PostgresAPIKeyStore) LookupAPIKey(hash []byte) (k APIKey, err error) {
+  err = s.DB.QueryRow("SELECT id, tenant, hash, created, revoked, admin FROM " + APIKeyTable + " WHERE hash=$1 AND NOT revoked", hash).Scan(&k.ID, &k.Tenant, &k.Hash, &k.Created, &k.Revoked, &k.Admin)
+  if err == sql.ErrNoRows {
+    err = ErrUnknownAPIKey
+  }
+  return
+}
+
+func (s *PostgresAPIKeyStore) ListAPIKeys() (keys []APIKey, err error) {
+  rows, err := s.DB.Query("SELECT id, tenant, hash, created, revoked, admin FROM " + APIKeyTable + " ORDER BY created")
+  if err != nil {
+    return
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var k APIKey
+    if err = rows.Scan(&k.ID, &k.Tenant, &k.Hash, &k.Created, &k.Revoked, &k.Admin); err != nil {
+      return nil, err
+    }
+    keys = append(keys, k)
+  }
+  return keys, rows.Err()
+}
+
+func (s *PostgresAPIKeyStore) RevokeAPIKey(id string) error {
+  res, err := s.DB.Exec("UPDATE " + APIKeyTable + " SET revoked=true WHERE id=$1", id)
+  if err != nil {
+    return err
+  }
+  n, err := res.RowsAffected()
+  if err == nil && n == 0 {
+    err = errors.New("No API key with id " + id + ".")
+  }
+  return err
+}
+
+func (s *PostgresAPIKeyStore) CreateTables() (err error) {
+  _, err = s.DB.Exec(PostgresAPIKeyTableCreate)
+  return
+}
+
+// PostgresPasswordStore keeps the password hashes of one parameter set in
+// ParamSet.PasswordTable.
+type PostgresPasswordStore struct{
+  DB      *sql.DB
+  Table   string
+  HashLen uint32
+}
+
+func NewPostgresPasswordStore(db *sql.DB, p ParamSet) *PostgresPasswordStore {
+  return &PostgresPasswordStore{db, p.PasswordTable(), p.KeyLen}
+}
+
+func (s *PostgresPasswordStore) AddPassword(hash []byte, keyID uint16) (err error) {
+  _, err = s.DB.Exec("INSERT INTO " + s.Table + " (hash, count, key_id) VALUES ($1, 1, $2) ON CONFLICT (hash) DO UPDATE SET count=" + s.Table + ".count+1", hash, int64(keyID))
+  return
+}
+
+func (s *PostgresPasswordStore) InsertKeyed(hash []byte, keyID uint16) error {
+  return s.AddPassword(hash, keyID)
+}
+
+func (s *PostgresPasswordStore) DeleteKey(keyID uint16) (int64, error) {
+  res, err := s.DB.Exec("DELETE FROM " + s.Table + " WHERE key_id=$1", int64(keyID))
+  if err != nil {
+    return 0, err
+  }
+  return res.RowsAffected()
+}
+
+func (s *PostgresPasswordStore) PasswordCount(hash []byte) (count int64, err error) {
+  err = s.DB.QueryRow("SELECT count FROM " + s.Table + " WHERE hash=$1", hash).Scan(&count)
+  if err == sql.ErrNoRows {
+    return 0, nil
+  }
+  return
+}
+
+func (s *PostgresPasswordStore) CreateTables() (err error) {
+  _, err = s.DB.Exec(PostgresPasswordTableCreate(s.Table, s.HashLen))
+  return
+}
+
+// PostgresCanaryStore keeps canaries in CanaryTable.
+type PostgresCanaryStore struct{
+  DB *sql.DB
+}
+
+func NewPostgresCanaryStore(db *sql.DB) *PostgresCanaryStore {
+  return &PostgresCanaryStore{db}
+}
+
+func (s *PostgresCanaryStore) InsertCanary(c Canary) (err error) {
+  _, err = s.DB.Exec("INSERT INTO " + CanaryTable + " (id, params, hash, label, created) VALUES ($1, $2, $3, $4, $5)", c.ID, c.Params, c.Hash, c.Label, c.Created)
+  return
+}
+
+func (s *PostgresCanaryStore) ListCanaries() (canaries []Canary, err error) {
+  rows, err := s.DB.Query("SELECT id, params, hash, label, created FROM " + CanaryTable + " ORDER BY created")
+  if err != nil {
+    return
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var c Canary
+    if err = rows.Scan(&c.ID, &c.Params, &c.Hash, &c.Label, &c.Created); err != nil {
+      return nil, err
+    }
+    canaries = append(canaries, c)
+  }
+  return canaries, rows.Err()
+}
+
+func (s *PostgresCanaryStore) DeleteCanary(id string) error {
+  res, err := s.DB.Exec("DELETE FROM " + CanaryTable + " WHERE id=$1", id)
+  if err != nil {
+    return err
+  }
+  n, err := res.RowsAffected()
+  if err == nil && n == 0 {
+    err = errors.New("No canary with id " + id + ".")
+  }
+  return err
+}
+
+func (s *PostgresCanaryStore) CreateTables() (err error) {
+  _, err = s.DB.Exec(PostgresCanaryTableCreate)
+  return
+}
+
+// adds the hashes to table, a watchlist or blocklist, skipping rows already
+// there
+func pgInsertTenantHashes(db *sql.DB, table, tenant, params string, hashes [][]byte) error {
+  now := time.Now().UTC()
+  for start := 0; start < len(hashes); start += searchChunkSize {
+    chunk := hashes[start:minInt(start + searchChunkSize, len(hashes))]
+    args := make([]interface{}, 0, len(chunk) * 4)
+    values := make([]string, len(chunk))
+    for i, hash := range chunk {
+      args = append(args, tenant, params, hash, now)
+      values[i] = "(" + pgPlaceholders(4 * i + 1, 4) + ")"
+    }
+    _, err := db.Exec("INSERT INTO " + table + " (tenant, params, hash, created) VALUES " + strings.Join(values, ", ") + " ON CONFLICT DO NOTHING", args...)
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func pgDeleteTenantHashes(db *sql.DB, table, tenant, params string, hashes [][]byte) error {
+  for start := 0; start < len(hashes); start += searchChunkSize {
+    chunk := hashes[start:minInt(start + searchChunkSize, len(hashes))]
+    args := []interface{}{tenant, params}
+    for _, hash := range chunk {
+      args = append(args, hash)
+    }
+    _, err := db.Exec("DELETE FROM " + table + " WHERE tenant=$1 AND params=$2 AND hash IN (" + pgPlaceholders(3, len(chunk)) + ")", args...)
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// PostgresWatchStore keeps watchlists, webhooks and pending deliveries in
+// WatchTable, WebhookTable and NotificationTable.
+type PostgresWatchStore struct{
+  DB *sql.DB
+}
+
+func NewPostgresWatchStore(db *sql.DB) *PostgresWatchStore {
+  return &PostgresWatchStore{db}
+}
+
+func (s *PostgresWatchStore) AddWatches(tenant, params string, hashes [][]byte) error {
+  return pgInsertTenantHashes(s.DB, WatchTable, tenant, params, hashes)
+}
+
+func (s *PostgresWatchStore) RemoveWatches(tenant, params string, hashes [][]byte) error {
+  return pgDeleteTenantHashes(s.DB, WatchTable, tenant, params, hashes)
+}
+
+func (s *PostgresWatchStore) MatchWatches(params string, hashes [][]byte) (map[string][]string, error) {
+  matches := make(map[string][]string)
+  for start := 0; start < len(hashes); start += searchChunkSize {
+    chunk := hashes[start:minInt(start + searchChunkSize, len(hashes))]
+    args := []interface{}{params}
+    for _, hash := range chunk {
+      args = append(args, hash)
+    }
+    rows, err := s.DB.Query("SELECT hash, tenant FROM " + WatchTable + " WHERE params=$1 AND hash IN (" + pgPlaceholders(2, len(chunk)) + ")", args...)
+    if err != nil {
+      return nil, err
+    }
+    for rows.Next() {
+      var hash []byte
+      var tenant string
+      if err = rows.Scan(&hash, &tenant); err != nil {
+        rows.Close()
+        return nil, err
+      }
+      matches[string(hash)] = append(matches[string(hash)], tenant)
+    }
+    err = rows.Err()
+    rows.Close()
+    if err != nil {
+      return nil, err
+    }
+  }
+  return matches, nil
+}
+
+func (s *PostgresWatchStore) SetWebhook(h Webhook) (err error) {
+  _, err = s.DB.Exec("INSERT INTO " + WebhookTable + " (tenant, url, secret) VALUES ($1, $2, $3) ON CONFLICT (tenant) DO UPDATE SET url=excluded.url, secret=excluded.secret", h.Tenant, h.URL, h.Secret)
+  return
+}
+
+func (s *PostgresWatchStore) GetWebhook(tenant string) (h Webhook, err error) {
+  err = s.DB.QueryRow("SELECT tenant, url, secret FROM " + WebhookTable + " WHERE tenant=$1", tenant).Scan(&h.Tenant, &h.URL, &h.Secret)
+  if err == sql.ErrNoRows {
+    err = ErrNoWebhook
+  }
+  return
+}
+
+// the payload goes in as a string, since lib/pq would send []byte as bytea
+func (s *PostgresWatchStore) EnqueueNotification(n Notification) (err error) {
+  _, err = s.DB.Exec("INSERT INTO " + NotificationTable + " (tenant, payload, attempts, next_attempt, created) VALUES ($1, $2, $3, $4, $5)", n.Tenant, string(n.Payload), n.Attempts, n.NextAttempt, n.Created)
+  return
+}
+
+func (s *PostgresWatchStore) DueNotifications(now time.Time, limit int) (due []Notification, err error) {
+  rows, err := s.DB.Query("SELECT id, tenant, payload, attempts, next_attempt, dead, last_error, created FROM " + NotificationTable + " WHERE NOT dead AND next_attempt <= $1 ORDER BY id LIMIT $2", now, limit)
+  if err != nil {
+    return
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var n Notification
+    var lastError sql.NullString
+    if err = rows.Scan(&n.ID, &n.Tenant, &n.Payload, &n.Attempts, &n.NextAttempt, &n.Dead, &lastError, &n.Created); err != nil {
+      return nil, err
+    }
+    n.LastError = lastError.String
+    due = append(due, n)
+  }
+  return due, rows.Err()
+}
+
+func (s *PostgresWatchStore) ClaimNotification(id int64, now, lease time.Time) (bool, error) {
+  res, err := s.DB.Exec("UPDATE " + NotificationTable + " SET next_attempt=$1 WHERE id=$2 AND NOT dead AND next_attempt <= $3", lease, id, now)
+  if err != nil {
+    return false, err
+  }
+  n, err := res.RowsAffected()
+  return n == 1, err
+}
+
+func (s *PostgresWatchStore) UpdateNotification(n Notification) (err error) {
+  _, err = s.DB.Exec("UPDATE " + NotificationTable + " SET attempts=$1, next_attempt=$2, dead=$3, last_error=$4 WHERE id=$5", n.Attempts, n.NextAttempt, n.Dead, n.LastError, n.ID)
+  return
+}
+
+func (s *PostgresWatchStore) DeleteNotification(id int64) (err error) {
+  _, err = s.DB.Exec("DELETE FROM " + NotificationTable + " WHERE id=$1", id)
+  return
+}
+
+func (s *PostgresWatchStore) CreateTables() error {
+  return execAll(s.DB, PostgresWatchTableCreate, PostgresWebhookTableCreate, PostgresNotificationTableCreate)
+}
+
+// PostgresJobStore keeps job state in JobTable.
+type PostgresJobStore struct{
+  DB *sql.DB
+}
+
+func NewPostgresJobStore(db *sql.DB) *PostgresJobStore {
+  return &PostgresJobStore{db}
+}
+
+func (s *PostgresJobStore) InsertJob(job Job) (err error) {
+  _, err = s.DB.Exec("INSERT INTO " + JobTable + " (" + jobColumns + ") VALUES (" + pgPlaceholders(1, 15) + ")",
+    job.ID, job.Tenant, job.APIKeyID, job.IP, job.Params, job.Encoding, job.Status, job.Total,
+    job.Processed, job.Matched, job.ResultBytes, job.Error, job.Created, job.Finished, job.Heartbeat)
+  return
+}
+
+func (s *PostgresJobStore) GetJob(id string) (job Job, err error) {
+  job, err = scanJob(s.DB.QueryRow("SELECT " + jobColumns + " FROM " + JobTable + " WHERE id=$1", id))
+  if err == sql.ErrNoRows {
+    err = ErrUnknownJob
+  }
+  return
+}
+
+func (s *PostgresJobStore) UpdateJob(job Job) (err error) {
+  _, err = s.DB.Exec("UPDATE " + JobTable + " SET status=$1, processed=$2, matched=$3, result_bytes=$4, error=$5, finished=$6, heartbeat=$7 WHERE id=$8",
+    job.Status, job.Processed, job.Matched, job.ResultBytes, job.Error, job.Finished, job.Heartbeat, job.ID)
+  return
+}
+
+// like MySQLJobStore.ClaimJob, one of several claims sees a row affected
+func (s *PostgresJobStore) ClaimJob(id string, now time.Time) (bool, error) {
+  res, err := s.DB.Exec("UPDATE " + JobTable + " SET status=$1, heartbeat=$2 WHERE id=$3 AND status=$4", JobRunning, now, id, JobQueued)
+  if err != nil {
+    return false, err
+  }
+  n, err := res.RowsAffected()
+  return n == 1, err
+}
+
+func (s *PostgresJobStore) RequeueStaleJobs(stale time.Time) (int64, error) {
+  res, err := s.DB.Exec("UPDATE " + JobTable + " SET status=$1 WHERE status=$2 AND (heartbeat IS NULL OR heartbeat < $3)", JobQueued, JobRunning, stale)
+  if err != nil {
+    return 0, err
+  }
+  return res.RowsAffected()
+}
+
+func (s *PostgresJobStore) DeleteJob(id string) (err error) {
+  _, err = s.DB.Exec("DELETE FROM " + JobTable + " WHERE id=$1", id)
+  return
+}
+
+func (s *PostgresJobStore) JobsWithStatus(status string, limit int) (jobs []Job, err error) {
+  rows, err := s.DB.Query("SELECT " + jobColumns + " FROM " + JobTable + " WHERE status=$1 ORDER BY created, id LIMIT $2", status, limit)
+  if err != nil {
+    return
+  }
+  defer rows.Close()
+  for rows.Next() {
+    job, err := scanJob(rows)
+    if err != nil {
+      return nil, err
+    }
+    jobs = append(jobs, job)
+  }
+  return jobs, rows.Err()
+}
+
+func (s *PostgresJobStore) CreateTables() (err error) {
+  _, err = s.DB.Exec(PostgresJobTableCreate)
+  return
+}
+
+// PostgresBlocklistStore keeps blocklists in BlocklistTable and salts in
+// BlocklistSaltTable.
+type PostgresBlocklistStore struct{
+  DB *sql.DB
+}
+
+func NewPostgresBlocklistStore(db *sql.DB) *PostgresBlocklistStore {
+  return &PostgresBlocklistStore{db}
+}
+
+func (s *PostgresBlocklistStore) TenantSalt(tenant string) (salt []byte, err error) {
+  err = s.DB.QueryRow("SELECT salt FROM " + BlocklistSaltTable + " WHERE tenant=$1", tenant).Scan(&salt)
+  if err != sql.ErrNoRows {
+    return
+  }
+  if salt, err = newBlocklistSalt(); err != nil {
+    return
+  }
+  // a concurrent request may have created it first
+  if _, err = s.DB.Exec("INSERT INTO " + BlocklistSaltTable + " (tenant, salt) VALUES ($1, $2) ON CONFLICT (tenant) DO NOTHING", tenant, salt); err != nil {
+    return
+  }
+  err = s.DB.QueryRow("SELECT salt FROM " + BlocklistSaltTable + " WHERE tenant=$1", tenant).Scan(&salt)
+  return
+}
+
+func (s *PostgresBlocklistStore) AddBlocked(tenant, params string, hashes [][]byte) error {
+  return pgInsertTenantHashes(s.DB, BlocklistTable, tenant, params, hashes)
+}
+
+func (s *PostgresBlocklistStore) RemoveBlocked(tenant, params string, hashes [][]byte) error {
+  return pgDeleteTenantHashes(s.DB, BlocklistTable, tenant, params, hashes)
+}
+
+func (s *PostgresBlocklistStore) LookupBlocked(tenant, params string, hashes [][]byte) ([]bool, error) {
+  blocked := make(map[string]bool)
+  for start := 0; start < len(hashes); start += searchChunkSize {
+    chunk := hashes[start:minInt(start + searchChunkSize, len(hashes))]
+    args := []interface{}{tenant, params}
+    for _, hash := range chunk {
+      args = append(args, hash)
+    }
+    rows, err := s.DB.Query("SELECT hash FROM " + BlocklistTable + " WHERE tenant=$1 AND params=$2 AND hash IN (" + pgPlaceholders(3, len(chunk)) + ")", args...)
+    if err != nil {
+      return nil, err
+    }
+    for rows.Next() {
+      var hash []byte
+      if err = rows.Scan(&hash); err != nil {
+        rows.Close()
+        return nil, err
+      }
+      blocked[string(hash)] = true
+    }
+    err = rows.Err()
+    rows.Close()
+    if err != nil {
+      return nil, err
+    }
+  }
+  found := make([]bool, len(hashes))
+  for i, hash := range hashes {
+    found[i] = blocked[string(hash)]
+  }
+  return found, nil
+}
+
+func (s *PostgresBlocklistStore) CountBlocked(tenant, params string) (n int64, err error) {
+  err = s.DB.QueryRow("SELECT COUNT(*) FROM " + BlocklistTable + " WHERE tenant=$1 AND params=$2", tenant, params).Scan(&n)
+  return
+}
+
+func (s *PostgresBlocklistStore) CreateTables() error {
+  return execAll(s.DB, PostgresBlocklistTableCreate, PostgresBlocklistSaltTableCreate)
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+  "bytes"
+  "crypto/rand"
+  "encoding/hex"
+  "errors"
+  "net/http"
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+// number of hex characters of the hash a client sends to /range
+const DefaultRangePrefixLen = 5
+// range responses are padded to a multiple of this many suffixes
+const DefaultRangePadding = 64
+
+var hexRegexp = regexp.MustCompile("^[0-9a-f]+$")
+
+type RangeRes struct{
+  Prefix   string   `json:"prefix"`
+  // hex encoded remainders of every hash starting with Prefix, sorted,
+  // plus random padding that matches no stored hash
+  Suffixes []string `json:"suffixes"`
+}
+
+// hashLen is the length of the stored hashes, or 0 for the key length of
+// the parameter set
+func RangeHandler(w http.ResponseWriter, prefix, params string, registry *Registry, hashLen, prefixLen, padding int) {
+  prefix = strings.ToLower(prefix)
+  err := checkRangePrefix(prefix, prefixLen)
+  if err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{err.Error()})
+    return
+  }
+  p, store, err := registry.Get(params)
+  if err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{err.Error()})
+    return
+  }
+  hashes, err := store.LookupRange(prefix)
+  if err == ErrRangeUnsupported {
+    respondWithJSON(w, http.StatusNotImplemented, credErr{err.Error()})
+    return
+  }
+  if err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{err.Error()})
+    return
+  }
+  suffixes := make([]string, len(hashes))
+  for i, hash := range hashes {
+    suffixes[i] = hex.EncodeToString(hash)[len(prefix):]
+  }
+  if hashLen == 0 {
+    hashLen = int(p.KeyLen)
+  }
+  suffixes, err = padSuffixes(suffixes, prefix, hashLen, padding)
+  if err != nil {
+    respondWithJSON(w, http.StatusInternalServerError, credErr{err.Error()})
+    return
+  }
+  sort.Strings(suffixes)
+  respondWithJSON(w, http.StatusOK, RangeRes{prefix, suffixes})
+}
+
+// returns the bounds lo <= hash < hi of the hashes whose hex encoding starts
+// with prefix; hi is nil when there is no upper bound
+func RangeBounds(prefix string) (lo, hi []byte, err error) {
+  if !hexRegexp.MatchString(prefix) {
+    return nil, nil, errors.New("Expected a hex prefix. Got \"" + prefix + "\".")
+  }
+  loHex, hiHex := prefix, prefix
+  if len(prefix) % 2 == 1 {
+    loHex += "0"
+    hiHex += "f"
+  }
+  lo, _ = hex.DecodeString(loHex)
+  hi, _ = hex.DecodeString(hiHex)
+  // increment hi, carrying into the more significant bytes
+  for i := len(hi) - 1; i >= 0; i -= 1 {
+    hi[i] += 1
+    if hi[i] != 0 {
+      return lo, hi, nil
+    }
+  }
+  return lo, nil, nil
+}
+
+// reports whether hash lies within the bounds returned by RangeBounds
+func InRange(hash, lo, hi []byte) bool {
+  return bytes.Compare(hash, lo) >= 0 && (hi == nil || bytes.Compare(hash, hi) < 0)
+}
+
+// reports an error unless a prefix of prefixLen hex characters can select a
+// range of hashes hexLen characters long; RangeBounds needs at least one
+func CheckRangePrefixLen(prefixLen, hexLen int) error {
+  if prefixLen < 1 || prefixLen > hexLen {
+    return errors.New("Expected a range prefix of 1 to " + strconv.Itoa(hexLen) + " hex characters. Got " + strconv.Itoa(prefixLen) + ".")
+  }
+  return nil
+}
+
+func checkRangePrefix(prefix string, prefixLen int) error {
+  if len(prefix) != prefixLen || !hexRegexp.MatchString(prefix) {
+    return errors.New("Expected a prefix of " + strconv.Itoa(prefixLen) + " hex characters. Got \"" + prefix + "\".")
+  }
+  return nil
+}
+
+// adds random suffixes until the count is a multiple of padding
+func padSuffixes(suffixes []string, prefix string, hashLen, padding int) ([]string, error) {
+  if padding <= 1 {
+    return suffixes, nil
+  }
+  // a response is never empty, since that alone would reveal a miss
+  target := padding
+  if len(suffixes) > padding {
+    target = (len(suffixes) + padding - 1) / padding * padding
+  }
+  b := make([]byte, hashLen)
+  for len(suffixes) < target {
+    _, err := rand.Read(b)
+    if err != nil {
+      return nil, err
+    }
+    suffixes = append(suffixes, hex.EncodeToString(b)[len(prefix):])
+  }
+  return suffixes, nil
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+  "bytes"
+  "testing"
+)
+
+func TestRangeBounds(t *testing.T) {
+  cases := []struct{
+    prefix string
+    lo     []byte
+    hi     []byte
+  }{
+    {"ab", []byte{0xab}, []byte{0xac}},
+    {"abc", []byte{0xab, 0xc0}, []byte{0xab, 0xd0}},
+    {"0ff", []byte{0x0f, 0xf0}, []byte{0x10, 0x00}},
+    {"fff", []byte{0xff, 0xf0}, nil},
+  }
+  for _, c := range cases {
+    lo, hi, err := RangeBounds(c.prefix)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if !bytes.Equal(lo, c.lo) || !bytes.Equal(hi, c.hi) {
+      t.Errorf("%s: expected [%x, %x). Got [%x, %x)\n", c.prefix, c.lo, c.hi, lo, hi)
+    }
+  }
+  _, _, err := RangeBounds("xyz")
+  if err == nil {
+    t.Error("Expected an error for a non-hex prefix")
+  }
+}
+
+func TestPadSuffixes(t *testing.T) {
+  for _, n := range []int{0, 1, 64, 65} {
+    suffixes, err := padSuffixes(make([]string, n), "abcde", CredHashLen, 64)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if len(suffixes) == 0 || len(suffixes) % 64 != 0 || len(suffixes) < n {
+      t.Errorf("Expected %d suffixes to be padded to a multiple of 64. Got %d\n", n, len(suffixes))
+    }
+  }
+}
@@ -0,0 +1,350 @@
+package server
+
+import (
+  "context"
+  "errors"
+  "math"
+  "net"
+  "net/http"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// Rate is a token bucket refilled at PerSecond up to Burst tokens.
+type Rate struct{
+  PerSecond float64
+  Burst     int
+}
+
+// buckets are swept for idle clients every this many calls
+const sweepEvery = 4096
+
+// Limiter keeps one token bucket per client key.
+type Limiter struct{
+  rate    Rate
+  mu      sync.Mutex
+  buckets map[string]*bucket
+  calls   int
+  // replaced in tests
+  now     func() time.Time
+}
+
+type bucket struct{
+  tokens float64
+  last   time.Time
+}
+
+type hitsKey struct{}
+
+// charges the positive answers a handler gives to client, see RecordHits
+type hitCounter struct{
+  limiter *Limiter
+  client  string
+}
+
+const tooManyHits = "Too many compromised credentials found for this client."
+
+// answered without Retry-After, since waiting won't make the batch fit
+const hitsPastBurst = "More compromised credentials in one batch than this client's hit limit allows; send fewer hashes per request."
+
+func NewLimiter(rate Rate) *Limiter {
+  return &Limiter{rate: rate, buckets: make(map[string]*bucket), now: time.Now}
+}
+
+// parses "<per second>:<burst>", e.g. "10:20" or "0.01:50"
+func ParseRate(s string) (rate Rate, err error) {
+  parts := strings.Split(s, ":")
+  if len(parts) != 2 {
+    return rate, errors.New("Expected a rate of the form perSecond:burst. Got \"" + s + "\".")
+  }
+  rate.PerSecond, err = strconv.ParseFloat(parts[0], 64)
+  if err != nil || rate.PerSecond <= 0 {
+    return rate, errors.New("Invalid rate \"" + s + "\".")
+  }
+  rate.Burst, err = strconv.Atoi(parts[1])
+  if err != nil || rate.Burst < 1 {
+    return rate, errors.New("Invalid burst in rate \"" + s + "\".")
+  }
+  return rate, nil
+}
+
+// parses comma-separated route=rate pairs such as
+// "default=10:20,/v1/creds=1:5"; "default" applies to unlisted routes
+func ParseRateLimits(s string) (map[string]Rate, error) {
+  limits := make(map[string]Rate)
+  if s == "" {
+    return limits, nil
+  }
+  for _, pair := range strings.Split(s, ",") {
+    parts := strings.SplitN(pair, "=", 2)
+    if len(parts) != 2 {
+      return nil, errors.New("Expected route=perSecond:burst. Got \"" + pair + "\".")
+    }
+    rate, err := ParseRate(parts[1])
+    if err != nil {
+      return nil, err
+    }
+    route := parts[0]
+    if route == "default" {
+      route = ""
+    }
+    limits[route] = rate
+  }
+  return limits, nil
+}
+
+// takes a token from key's bucket; if there is none, reports how long
+// until there will be
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  b := l.refill(key)
+  if b.tokens >= 1 {
+    b.tokens -= 1
+    return true, 0
+  }
+  return false, l.wait(b)
+}
+
+// like Allow, but doesn't take a token
+func (l *Limiter) Check(key string) (bool, time.Duration) {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  b := l.refill(key)
+  if b.tokens >= 1 {
+    return true, 0
+  }
+  return false, l.wait(b)
+}
+
+// like Allow, but takes n tokens, and none if the bucket holds fewer, so a
+// batch can't spend past the burst; checking and charging under one lock
+// keeps concurrent requests from all passing on the last tokens. The wait
+// is negative if n is more than the burst, as the bucket never holds n.
+func (l *Limiter) Take(key string, n int) (bool, time.Duration) {
+  if n > l.rate.Burst {
+    return false, -1
+  }
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  b := l.refill(key)
+  if b.tokens >= float64(n) {
+    b.tokens -= float64(n)
+    return true, 0
+  }
+  return false, l.waitFor(b, n)
+}
+
+// takes as many of n tokens as key's bucket holds and returns how many
+func (l *Limiter) TakeUpTo(key string, n int) int {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  b := l.refill(key)
+  if b.tokens < 1 {
+    return 0
+  }
+  if float64(n) > b.tokens {
+    n = int(b.tokens)
+  }
+  b.tokens -= float64(n)
+  return n
+}
+
+// takes n tokens from key's bucket even if that leaves it in debt
+func (l *Limiter) Charge(key string, n int) {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  l.refill(key).tokens -= float64(n)
+}
+
+func (l *Limiter) refill(key string) *bucket {
+  now := l.now()
+  l.calls += 1
+  if l.calls % sweepEvery == 0 {
+    l.sweep(now)
+  }
+  b, ok := l.buckets[key]
+  if !ok {
+    b = &bucket{float64(l.rate.Burst), now}
+    l.buckets[key] = b
+    return b
+  }
+  b.tokens = math.Min(float64(l.rate.Burst), b.tokens + now.Sub(b.last).Seconds() * l.rate.PerSecond)
+  b.last = now
+  return b
+}
+
+func (l *Limiter) wait(b *bucket) time.Duration {
+  return l.waitFor(b, 1)
+}
+
+// how long until b holds n tokens
+func (l *Limiter) waitFor(b *bucket, n int) time.Duration {
+  return time.Duration((float64(n) - b.tokens) / l.rate.PerSecond * float64(time.Second))
+}
+
+// forgets buckets that have refilled, since a new bucket starts full
+func (l *Limiter) sweep(now time.Time) {
+  for key, b := range l.buckets {
+    if b.tokens + now.Sub(b.last).Seconds() * l.rate.PerSecond >= float64(l.rate.Burst) {
+      delete(l.buckets, key)
+    }
+  }
+}
+
+// called by handlers with the number of credentials they are about to
+// report as compromised, before they respond; if the client is out of
+// hits, the handler must not give the answers and should wait retry, or,
+// if retry is negative, can never give them in one response
+func RecordHits(ctx context.Context, n int) (ok bool, retry time.Duration) {
+  c, counted := ctx.Value(hitsKey{}).(*hitCounter)
+  if !counted || n <= 0 {
+    return true, 0
+  }
+  return c.limiter.Take(c.client, n)
+}
+
+// records n hits and answers 429 if the client is out of them
+func chargeHits(w http.ResponseWriter, r *http.Request, n int) bool {
+  ok, retry := RecordHits(r.Context(), n)
+  if ok {
+    return true
+  }
+  if retry < 0 {
+    respondWithJSON(w, http.StatusRequestEntityTooLarge, credErr{hitsPastBurst})
+  } else {
+    respondTooManyRequests(w, retry, tooManyHits)
+  }
+  return false
+}
+
+// the key of a client's bucket: its API key, or its IP if it has none
+func hitClient(apiKeyID, ip string) string {
+  if apiKeyID != "" {
+    return "key:" + apiKeyID
+  }
+  return "ip:" + ip
+}
+
+// the address of the client, taken from X-Forwarded-For if trustProxy;
+// only the rightmost entry, which the trusted proxy appended, is used, as
+// the client can put anything to the left of it
+func ClientIP(r *http.Request, trustProxy bool) string {
+  if trustProxy {
+    fwd := r.Header.Values("X-Forwarded-For")
+    if len(fwd) > 0 {
+      hops := strings.Split(fwd[len(fwd) - 1], ",")
+      if ip := strings.TrimSpace(hops[len(hops) - 1]); ip != "" {
+        return ip
+      }
+    }
+  }
+  host, _, err := net.SplitHostPort(r.RemoteAddr)
+  if err != nil {
+    return r.RemoteAddr
+  }
+  return host
+}
+
+// RateLimiter enforces per-route request limits for each API key and each
+// source IP, and a limit on how many compromised answers each client gets.
+type RateLimiter struct{
+  // per route path template, e.g. "/v1/cred"; "" applies to unlisted routes
+  Routes     map[string]Rate
+  // zero means no limit on hits
+  Hits       Rate
+  TrustProxy bool
+  mu         sync.Mutex
+  limiters   map[string]*Limiter
+  hits       *Limiter
+}
+
+// takes a token from the bucket of the client's IP; it runs before
+// authentication, so that API keys can't be guessed at an unlimited rate
+func (rl *RateLimiter) IPMiddleware(route string, next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if l := rl.limiter(route); l != nil {
+      if ok, retry := l.Allow("ip:" + ClientIP(r, rl.TrustProxy)); !ok {
+        respondTooManyRequests(w, retry, "Rate limit exceeded.")
+        return
+      }
+    }
+    next.ServeHTTP(w, r)
+  })
+}
+
+// takes a token from the bucket of the request's API key and enforces the
+// hit limit; requests without a key are limited by IPMiddleware alone
+func (rl *RateLimiter) Middleware(route string, next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    k, authenticated := APIKeyFromContext(r.Context())
+    client := hitClient(k.ID, ClientIP(r, rl.TrustProxy))
+    if authenticated {
+      if l := rl.limiter(route); l != nil {
+        if ok, retry := l.Allow(client); !ok {
+          respondTooManyRequests(w, retry, "Rate limit exceeded.")
+          return
+        }
+      }
+    }
+    hits := rl.HitLimiter()
+    if hits == nil {
+      next.ServeHTTP(w, r)
+      return
+    }
+    // fails early; handlers charge their hits with RecordHits
+    if ok, retry := hits.Check(client); !ok {
+      respondTooManyRequests(w, retry, tooManyHits)
+      return
+    }
+    counter := &hitCounter{hits, client}
+    next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), hitsKey{}, counter)))
+  })
+}
+
+// the limiter for route, or nil if route is unlimited
+func (rl *RateLimiter) limiter(route string) *Limiter {
+  rate, ok := rl.Routes[route]
+  if !ok {
+    rate, ok = rl.Routes[""]
+  }
+  if !ok {
+    return nil
+  }
+  rl.mu.Lock()
+  defer rl.mu.Unlock()
+  if rl.limiters == nil {
+    rl.limiters = make(map[string]*Limiter)
+  }
+  l, ok := rl.limiters[route]
+  if !ok {
+    l = NewLimiter(rate)
+    rl.limiters[route] = l
+  }
+  return l
+}
+
+// the limiter holding each client's hit budget, or nil if hits aren't
+// limited; Jobs charges it too
+func (rl *RateLimiter) HitLimiter() *Limiter {
+  if rl.Hits.PerSecond <= 0 {
+    return nil
+  }
+  rl.mu.Lock()
+  defer rl.mu.Unlock()
+  if rl.hits == nil {
+    rl.hits = NewLimiter(rl.Hits)
+  }
+  return rl.hits
+}
+
+func respondTooManyRequests(w http.ResponseWriter, retry time.Duration, msg string) {
+  seconds := int(math.Ceil(retry.Seconds()))
+  if seconds < 1 {
+    seconds = 1
+  }
+  w.Header().Set("Retry-After", strconv.Itoa(seconds))
+  respondWithJSON(w, http.StatusTooManyRequests, credErr{msg})
+}
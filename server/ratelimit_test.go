@@ -0,0 +1,159 @@
+package server
+
+import (
+  "net/http"
+  "net/http/httptest"
+  "sync"
+  "testing"
+  "time"
+)
+
+func TestLimiter(t *testing.T) {
+  now := time.Unix(0, 0)
+  l := NewLimiter(Rate{PerSecond: 1, Burst: 2})
+  l.now = func() time.Time { return now }
+  for i := 0; i < 2; i += 1 {
+    if ok, _ := l.Allow("a"); !ok {
+      t.Fatalf("Expected request %d to be allowed", i)
+    }
+  }
+  ok, retry := l.Allow("a")
+  if ok || retry != time.Second {
+    t.Errorf("Expected to wait 1s. Got %v, %v\n", ok, retry)
+  }
+  if ok, _ := l.Allow("b"); !ok {
+    t.Error("Expected other clients to have their own bucket")
+  }
+  now = now.Add(time.Second)
+  if ok, _ := l.Allow("a"); !ok {
+    t.Error("Expected the bucket to refill")
+  }
+  l.Charge("a", 5)
+  ok, retry = l.Check("a")
+  if ok || retry != 6 * time.Second {
+    t.Errorf("Expected to wait 6s after going into debt. Got %v, %v\n", ok, retry)
+  }
+}
+
+func TestRateLimiterHits(t *testing.T) {
+  rl := &RateLimiter{Hits: Rate{PerSecond: 0.001, Burst: 2}}
+  h := rl.Middleware("/v1/cred", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    RecordHits(r.Context(), 1)
+  }))
+  codes := []int{}
+  for i := 0; i < 3; i += 1 {
+    rr := httptest.NewRecorder()
+    h.ServeHTTP(rr, httptest.NewRequest("POST", "/v1/cred", nil))
+    codes = append(codes, rr.Code)
+    if rr.Code == http.StatusTooManyRequests && rr.Header().Get("Retry-After") == "" {
+      t.Error("Expected a Retry-After header")
+    }
+  }
+  if codes[0] != 200 || codes[1] != 200 || codes[2] != http.StatusTooManyRequests {
+    t.Errorf("Expected 200, 200, 429. Got %v\n", codes)
+  }
+}
+
+func TestRateLimiterHitsConcurrent(t *testing.T) {
+  rl := &RateLimiter{Hits: Rate{PerSecond: 0.001, Burst: 10}}
+  // every request has passed the middleware's check before any charges
+  var checked sync.WaitGroup
+  checked.Add(4)
+  h := rl.Middleware("/v1/creds", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    checked.Done()
+    checked.Wait()
+    if !chargeHits(w, r, 10) {
+      return
+    }
+    w.WriteHeader(http.StatusOK)
+  }))
+  codes := make(chan int, 4)
+  for i := 0; i < 4; i += 1 {
+    go func() {
+      rr := httptest.NewRecorder()
+      h.ServeHTTP(rr, httptest.NewRequest("POST", "/v1/creds", nil))
+      codes <- rr.Code
+    }()
+  }
+  answered := 0
+  for i := 0; i < 4; i += 1 {
+    if <-codes == http.StatusOK {
+      answered += 1
+    }
+  }
+  if answered != 1 {
+    t.Errorf("Expected 1 request to spend the last hit. Got %d\n", answered)
+  }
+}
+
+func TestRateLimiterHitsOverBurst(t *testing.T) {
+  rl := &RateLimiter{Hits: Rate{PerSecond: 0.001, Burst: 5}}
+  h := rl.Middleware("/v1/creds", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if !chargeHits(w, r, 100) {
+      return
+    }
+    w.WriteHeader(http.StatusOK)
+  }))
+  rr := httptest.NewRecorder()
+  h.ServeHTTP(rr, httptest.NewRequest("POST", "/v1/creds", nil))
+  if rr.Code != http.StatusRequestEntityTooLarge || rr.Header().Get("Retry-After") != "" {
+    t.Errorf("Expected a batch past the burst to get 413 without Retry-After. Got %d, %q\n", rr.Code, rr.Header().Get("Retry-After"))
+  }
+  if ok, _ := rl.HitLimiter().Take(hitClient("", "192.0.2.1"), 5); !ok {
+    t.Error("Expected the rejected batch not to spend the burst")
+  }
+}
+
+func TestClientIPSpoofed(t *testing.T) {
+  rl := &RateLimiter{Routes: map[string]Rate{"": {PerSecond: 0.001, Burst: 2}}, TrustProxy: true}
+  h := rl.IPMiddleware("/v1/cred", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+  codes := []int{}
+  for _, spoofed := range []string{"1.2.3.4", "5.6.7.8", "9.10.11.12"} {
+    req := httptest.NewRequest("POST", "/v1/cred", nil)
+    // the client sends the first entry, the proxy appends the second
+    req.Header.Set("X-Forwarded-For", spoofed + ", 203.0.113.7")
+    rr := httptest.NewRecorder()
+    h.ServeHTTP(rr, req)
+    codes = append(codes, rr.Code)
+  }
+  if codes[0] != 200 || codes[1] != 200 || codes[2] != http.StatusTooManyRequests {
+    t.Errorf("Expected 200, 200, 429. Got %v\n", codes)
+  }
+  req := httptest.NewRequest("POST", "/v1/cred", nil)
+  req.Header.Set("X-Forwarded-For", "1.2.3.4, 203.0.113.7")
+  if ip := ClientIP(req, true); ip != "203.0.113.7" {
+    t.Errorf("Expected the proxy's entry 203.0.113.7. Got %s\n", ip)
+  }
+}
+
+func TestRateLimitBeforeAuth(t *testing.T) {
+  a := App{APIKeys: NewMemAPIKeyStore(), Limits: &RateLimiter{Routes: map[string]Rate{"": {PerSecond: 0.001, Burst: 2}}}}
+  a.Initialize(NewMemStore())
+  codes := []int{}
+  for i := 0; i < 3; i += 1 {
+    req := httptest.NewRequest("GET", "/v1/params", nil)
+    req.Header.Set("Authorization", "Bearer ccds_guess")
+    rr := httptest.NewRecorder()
+    a.Router.ServeHTTP(rr, req)
+    codes = append(codes, rr.Code)
+  }
+  if codes[0] != http.StatusUnauthorized || codes[1] != http.StatusUnauthorized || codes[2] != http.StatusTooManyRequests {
+    t.Errorf("Expected 401, 401, 429. Got %v\n", codes)
+  }
+}
+
+func TestParseRateLimits(t *testing.T) {
+  limits, err := ParseRateLimits("default=10:20,/v1/creds=0.5:5")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if limits[""] != (Rate{10, 20}) || limits["/v1/creds"] != (Rate{0.5, 5}) {
+    t.Errorf("Unexpected limits %v\n", limits)
+  }
+  for _, s := range []string{"10:20", "default=10", "default=0:1", "default=1:0"} {
+    _, err = ParseRateLimits(s)
+    if err == nil {
+      t.Errorf("Expected an error parsing %s\n", s)
+    }
+  }
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+  "errors"
+  "net/http"
+  "sort"
+  "time"
+)
+
+var ErrSourcesUnsupported = errors.New("Store does not record breach sources.")
+
+// Source is a breach that hashes were imported from.
+type Source struct{
+  ID          int64
+  Name        string
+  // when the breach happened; zero if unknown
+  Date        time.Time
+  Description string
+}
+
+// Sighting is the record of a hash in one source.
+type Sighting struct{
+  Source    Source
+  // times the hash appeared in the source
+  Count     int64
+  // when the hash was first and last imported from the source
+  FirstSeen time.Time
+  LastSeen  time.Time
+}
+
+// SourcedStore is implemented by stores that record which breaches each
+// hash was imported from.
+type SourcedStore interface {
+  // adds src unless a source of the same name exists; returns the id
+  AddSource(src Source) (int64, error)
+  // records an occurrence of hash in the source, inserting the hash if
+  // it's new; returns ErrDuplicate if the hash was already stored.
+  // keyID is the pepper key the hash was made with, or 0 for none.
+  InsertSourced(hash []byte, sourceID int64, keyID uint16) error
+  // returns the sources hash was seen in
+  Sightings(hash []byte) ([]Sighting, error)
+}
+
+type CredDetailsRes struct{
+  Compromised bool       `json:"compromised"`
+  // MatchedGlobal or MatchedTenant if compromised; only global matches
+  // have counts, dates and sources
+  MatchedBy   string     `json:"matchedBy,omitempty"`
+  // times the credential appeared across every source
+  Count       int64      `json:"count"`
+  // breach dates, or import dates for sources without one
+  FirstSeen   *time.Time `json:"firstSeen,omitempty"`
+  LastSeen    *time.Time `json:"lastSeen,omitempty"`
+  Sources     []string   `json:"sources"`
+}
+
+// sums the sightings of a compromised hash into a response; hashes
+// imported without a source count once
+func NewCredDetailsRes(sightings []Sighting) CredDetailsRes {
+  res := CredDetailsRes{Compromised: true, MatchedBy: MatchedGlobal, Sources: []string{}}
+  names := make(map[string]bool)
+  for _, s := range sightings {
+    res.Count += s.Count
+    first, last := s.FirstSeen, s.LastSeen
+    if !s.Source.Date.IsZero() {
+      first, last = s.Source.Date, s.Source.Date
+    }
+    if res.FirstSeen == nil || first.Before(*res.FirstSeen) {
+      res.FirstSeen = &first
+    }
+    if res.LastSeen == nil || last.After(*res.LastSeen) {
+      res.LastSeen = &last
+    }
+    if !names[s.Source.Name] {
+      names[s.Source.Name] = true
+      res.Sources = append(res.Sources, s.Source.Name)
+    }
+  }
+  if res.Count == 0 {
+    res.Count = 1
+  }
+  sort.Strings(res.Sources)
+  return res
+}
+
+// like CredHandler, but with the sources the credential leaked in
+func CredDetailsHandler(w http.ResponseWriter, r *http.Request, registry *Registry, canaries *Canaries, blocklist BlocklistStore) {
+  var req CredReqBody
+  err := DecodeBody(r.Body, &req)
+  if err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{"An error occurred parsing the request body"})
+    return
+  }
+  p, store, err := registry.Get(req.Params)
+  if err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{err.Error()})
+    return
+  }
+  hash, err := DecodeHash(req.Hash, req.Encoding, int(p.KeyLen))
+  if err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{err.Error()})
+    return
+  }
+  canaries.Check(r, p.Name, hash)
+  compromised, err := store.Lookup(hash)
+  if err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{err.Error()})
+    return
+  }
+  if !compromised {
+    blocked, err := checkBlocklist(r, blocklist, p, req.Encoding, []string{req.PasswordHash})
+    if err != nil {
+      respondWithJSON(w, http.StatusBadRequest, credErr{err.Error()})
+      return
+    }
+    res := CredDetailsRes{Sources: []string{}}
+    if blocked != nil && blocked[0] {
+      res.Compromised = true
+      res.MatchedBy = MatchedTenant
+    }
+    respondWithJSON(w, http.StatusOK, res)
+    return
+  }
+  if !chargeHits(w, r, 1) {
+    return
+  }
+  var sightings []Sighting
+  if sourced, ok := store.(SourcedStore); ok {
+    sightings, err = sourced.Sightings(hash)
+    if err != nil && err != ErrSourcesUnsupported {
+      respondWithJSON(w, http.StatusInternalServerError, credErr{err.Error()})
+      return
+    }
+  }
+  respondWithJSON(w, http.StatusOK, NewCredDetailsRes(sightings))
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+  "bytes"
+  "encoding/hex"
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  "time"
+)
+
+func TestCredDetails(t *testing.T) {
+  mem := NewMemStore()
+  store := NewPepperedStore(NewFilteredStore(mem, 0.01), Keyring{{1, bytes.Repeat([]byte{1}, 32)}})
+  a := App{}
+  a.Initialize(store)
+  sourced := store.(SourcedStore)
+  date := time.Date(2019, 1, 17, 0, 0, 0, 0, time.UTC)
+  collection, _ := sourced.AddSource(Source{Name: "Collection #1", Date: date})
+  paste, _ := sourced.AddSource(Source{Name: "paste"})
+  if again, _ := sourced.AddSource(Source{Name: "paste"}); again != paste {
+    t.Errorf("Expected a source to be added once. Got ids %d and %d\n", paste, again)
+  }
+  hash := randomHash(t)
+  if err := sourced.InsertSourced(hash, collection, 0); err != nil {
+    t.Fatal(err)
+  }
+  if err := sourced.InsertSourced(hash, paste, 0); err != ErrDuplicate {
+    t.Errorf("Expected ErrDuplicate. Got %v\n", err)
+  }
+  sourced.InsertSourced(hash, paste, 0)
+  details := credDetails(t, &a, hash)
+  if !details.Compromised || details.Count != 3 {
+    t.Errorf("Expected 3 occurrences. Got %+v\n", details)
+  }
+  if len(details.Sources) != 2 || details.Sources[0] != "Collection #1" || details.Sources[1] != "paste" {
+    t.Errorf("Unexpected sources %v\n", details.Sources)
+  }
+  if details.FirstSeen == nil || !details.FirstSeen.Equal(date) || details.LastSeen == nil || !details.LastSeen.After(date) {
+    t.Errorf("Unexpected dates %v, %v\n", details.FirstSeen, details.LastSeen)
+  }
+  details = credDetails(t, &a, randomHash(t))
+  if details.Compromised || details.Count != 0 {
+    t.Errorf("Expected a safe hash to have no details. Got %+v\n", details)
+  }
+}
+
+func credDetails(t *testing.T, a *App, hash []byte) (details CredDetailsRes) {
+  b, _ := json.Marshal(CredReqBody{Hash: hex.EncodeToString(hash), Encoding: EncodingHex})
+  rr := httptest.NewRecorder()
+  a.Router.ServeHTTP(rr, httptest.NewRequest("POST", "/v2/cred", bytes.NewBuffer(b)))
+  if rr.Code != http.StatusOK {
+    t.Fatalf("Expected response code 200. Got %d\n", rr.Code)
+  }
+  if err := json.Unmarshal(rr.Body.Bytes(), &details); err != nil {
+    t.Fatal(err)
+  }
+  return
+}
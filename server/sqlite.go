@@ -0,0 +1,414 @@
+package server
+
+import (
+  "database/sql"
+  "strconv"
+)
+
+// The SQLite tables live in one file next to the server, for installs
+// without a database server. The driver, modernc.org/sqlite, is pure Go,
+// so the binary still cross-compiles without cgo. Lookups use the same
+// queries as MySQL; inserts, deletes and the schema differ. Times are
+// stored as text, which compares in order since the server writes them all
+// in UTC.
+
+func SQLiteCredHashTableCreate(table string, hashLen uint32) string {
+  return `
+  CREATE TABLE IF NOT EXISTS ` + table + ` (
+    seq INTEGER PRIMARY KEY AUTOINCREMENT,
+    hash BLOB NOT NULL UNIQUE CHECK (length(hash) <= ` + strconv.FormatUint(uint64(hashLen), 10) + `),
+    checked INTEGER DEFAULT 0,
+    key_id INTEGER NOT NULL DEFAULT 0
+  );
+`
+}
+
+const SQLiteSourceTableCreate = `
+  CREATE TABLE IF NOT EXISTS ` + SourceTable + ` (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL UNIQUE,
+    date DATE DEFAULT NULL,
+    description TEXT
+  );
+`
+
+func SQLiteSourceLinkTableCreate(table string, hashLen uint32) string {
+  return `
+  CREATE TABLE IF NOT EXISTS ` + SourceLinkTable(table) + ` (
+    hash BLOB NOT NULL CHECK (length(hash) <= ` + strconv.FormatUint(uint64(hashLen), 10) + `),
+    source_id INTEGER NOT NULL,
+    count INTEGER NOT NULL DEFAULT 1,
+    first_seen DATETIME NOT NULL,
+    last_seen DATETIME NOT NULL,
+    PRIMARY KEY (hash, source_id)
+  );
+`
+}
+
+func SQLiteHitsTableCreate(table string) string {
+  return `
+  CREATE TABLE IF NOT EXISTS ` + HitsTable(table) + ` (
+    day TEXT NOT NULL PRIMARY KEY,
+    hits INTEGER NOT NULL DEFAULT 0
+  );
+`
+}
+
+const SQLiteAPIKeyTableCreate = `
+  CREATE TABLE IF NOT EXISTS ` + APIKeyTable + ` (
+    id TEXT NOT NULL PRIMARY KEY,
+    tenant TEXT NOT NULL,
+    hash BLOB NOT NULL UNIQUE,
+    created DATETIME NOT NULL,
+    revoked INTEGER NOT NULL DEFAULT 0,
+    admin INTEGER NOT NULL DEFAULT 0
+  );
+`
+
+func SQLitePasswordTableCreate(table string, hashLen uint32) string {
+  return `
+  CREATE TABLE IF NOT EXISTS ` + table + ` (
+    hash BLOB NOT NULL PRIMARY KEY CHECK (length(hash) <= ` + strconv.FormatUint(uint64(hashLen), 10) + `),
+    count INTEGER NOT NULL DEFAULT 0,
+    key_id INTEGER NOT NULL DEFAULT 0
+  );
+`
+}
+
+const SQLiteCanaryTableCreate = `
+  CREATE TABLE IF NOT EXISTS ` + CanaryTable + ` (
+    id TEXT NOT NULL PRIMARY KEY,
+    params TEXT NOT NULL,
+    hash BLOB NOT NULL,
+    label TEXT NOT NULL,
+    created DATETIME NOT NULL,
+    UNIQUE (params, hash)
+  );
+`
+
+const SQLiteWatchTableCreate = `
+  CREATE TABLE IF NOT EXISTS ` + WatchTable + ` (
+    tenant TEXT NOT NULL,
+    params TEXT NOT NULL,
+    hash BLOB NOT NULL,
+    created DATETIME NOT NULL,
+    PRIMARY KEY (tenant, params, hash)
+  );
+  CREATE INDEX IF NOT EXISTS ` + WatchTable + `_params_hash ON ` + WatchTable + ` (params, hash);
+`
+
+const SQLiteWebhookTableCreate = `
+  CREATE TABLE IF NOT EXISTS ` + WebhookTable + ` (
+    tenant TEXT NOT NULL PRIMARY KEY,
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL
+  );
+`
+
+const SQLiteNotificationTableCreate = `
+  CREATE TABLE IF NOT EXISTS ` + NotificationTable + ` (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    tenant TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt DATETIME NOT NULL,
+    dead INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    created DATETIME NOT NULL
+  );
+  CREATE INDEX IF NOT EXISTS ` + NotificationTable + `_dead_next_attempt ON ` + NotificationTable + ` (dead, next_attempt);
+`
+
+const SQLiteJobTableCreate = `
+  CREATE TABLE IF NOT EXISTS ` + JobTable + ` (
+    id TEXT NOT NULL PRIMARY KEY,
+    tenant TEXT NOT NULL,
+    api_key_id TEXT NOT NULL,
+    ip TEXT NOT NULL,
+    params TEXT NOT NULL,
+    encoding TEXT NOT NULL,
+    status TEXT NOT NULL,
+    total INTEGER NOT NULL,
+    processed INTEGER NOT NULL DEFAULT 0,
+    matched INTEGER NOT NULL DEFAULT 0,
+    result_bytes INTEGER NOT NULL DEFAULT 0,
+    error TEXT,
+    created DATETIME NOT NULL,
+    finished DATETIME NULL,
+    heartbeat DATETIME NULL
+  );
+  CREATE INDEX IF NOT EXISTS ` + JobTable + `_status_created ON ` + JobTable + ` (status, created);
+`
+
+const SQLiteBlocklistTableCreate = `
+  CREATE TABLE IF NOT EXISTS ` + BlocklistTable + ` (
+    tenant TEXT NOT NULL,
+    params TEXT NOT NULL,
+    hash BLOB NOT NULL,
+    created DATETIME NOT NULL,
+    PRIMARY KEY (tenant, params, hash)
+  );
+`
+
+const SQLiteBlocklistSaltTableCreate = `
+  CREATE TABLE IF NOT EXISTS ` + BlocklistSaltTable + ` (
+    tenant TEXT NOT NULL PRIMARY KEY,
+    salt BLOB NOT NULL
+  );
+`
+
+// like IncrementChecked; date('now') is UTC
+func SQLiteIncrementChecked(db *sql.DB, table string, hits map[string]int64) error {
+  return incrementChecked(db, "UPDATE " + table + " SET checked=checked+? WHERE hash=?",
+    "INSERT INTO " + HitsTable(table) + " (day, hits) VALUES (date('now'), ?) ON CONFLICT (day) DO UPDATE SET hits=hits+excluded.hits", hits)
+}
+
+// like SearchHitsPerDay; days are stored as YYYY-MM-DD
+func SQLiteSearchHitsPerDay(db *sql.DB, table string, days int) ([]DayHits, error) {
+  return searchHitsPerDay(db, "SELECT day, hits FROM " + HitsTable(table) + " WHERE day > date('now', ?) ORDER BY day", "-" + strconv.Itoa(days) + " days")
+}
+
+// SQLiteStore keeps the hashes of one parameter set in a SQLite table.
+type SQLiteStore struct{
+  DB      *sql.DB
+  Table   string
+  HashLen uint32
+  // counts positive lookups in the checked column; nil disables counting
+  Checked *CheckedCounter
+}
+
+func NewSQLiteStore(db *sql.DB, p ParamSet) *SQLiteStore {
+  return &SQLiteStore{DB: db, Table: p.Table(), HashLen: p.KeyLen}
+}
+
+// a store for the OPRF outputs of hashes made with p
+func NewSQLiteOPRFStore(db *sql.DB, p ParamSet) *SQLiteStore {
+  return &SQLiteStore{DB: db, Table: p.OPRFTable(), HashLen: OPRFOutputLen}
+}
+
+func (s *SQLiteStore) Lookup(hash []byte) (bool, error) {
+  found, err := SearchCredHash(s.DB, s.Table, hash)
+  if found && s.Checked != nil {
+    s.Checked.Add(s.Table, hash)
+  }
+  return found, err
+}
+
+func (s *SQLiteStore) LookupMany(hashes [][]byte) ([]bool, error) {
+  found, err := SearchCredHashes(s.DB, s.Table, hashes)
+  if err != nil {
+    return nil, err
+  }
+  results := make([]bool, len(hashes))
+  for i, hash := range hashes {
+    _, results[i] = found[string(hash)]
+    if results[i] && s.Checked != nil {
+      s.Checked.Add(s.Table, hash)
+    }
+  }
+  return results, nil
+}
+
+func (s *SQLiteStore) LookupRange(prefix string) ([][]byte, error) {
+  lo, hi, err := RangeBounds(prefix)
+  if err != nil {
+    return nil, err
+  }
+  // blobs compare bytewise, like varbinary
+  return SearchCredHashRange(s.DB, s.Table, lo, hi)
+}
+
+func (s *SQLiteStore) Scan(fn func(hash []byte) error) error {
+  return ScanCredHashes(s.DB, s.Table, fn)
+}
+
+func (s *SQLiteStore) Since(seq uint64, limit int) ([]SyncEntry, error) {
+  return SearchCredHashesSince(s.DB, s.Table, seq, limit)
+}
+
+func (s *SQLiteStore) LastSeq() (uint64, error) {
+  return LastCredHashSeq(s.DB, s.Table)
+}
+
+func (s *SQLiteStore) Insert(hash []byte) error {
+  return s.InsertKeyed(hash, 0)
+}
+
+func (s *SQLiteStore) InsertKeyed(hash []byte, keyID uint16) error {
+  res, err := s.DB.Exec("INSERT INTO " + s.Table + " (hash, key_id) VALUES (?, ?) ON CONFLICT (hash) DO NOTHING", hash, keyID)
+  if err != nil {
+    return err
+  }
+  inserted, err := res.RowsAffected()
+  if err == nil && inserted == 0 {
+    return ErrDuplicate
+  }
+  return err
+}
+
+func (s *SQLiteStore) AddSource(src Source) (int64, error) {
+  return insertSource(s.DB, "INSERT OR IGNORE INTO " + SourceTable + " (name, date, description) VALUES (?, ?, ?)",
+    "SELECT id FROM " + SourceTable + " WHERE name=?", src)
+}
+
+func (s *SQLiteStore) InsertSourced(hash []byte, sourceID int64, keyID uint16) error {
+  duplicate, err := insertCredHashSourced(s.DB, "INSERT INTO " + s.Table + " (hash, key_id) VALUES (?, ?) ON CONFLICT (hash) DO NOTHING",
+    "INSERT INTO " + SourceLinkTable(s.Table) + " (hash, source_id, first_seen, last_seen) VALUES (?, ?, datetime('now'), datetime('now')) ON CONFLICT (hash, source_id) DO UPDATE SET count=count+1, last_seen=excluded.last_seen",
+    hash, sourceID, keyID)
+  if err == nil && duplicate {
+    return ErrDuplicate
+  }
+  return err
+}
+
+func (s *SQLiteStore) Sightings(hash []byte) ([]Sighting, error) {
+  return searchCredHashSightings(s.DB, s.Table, "?", hash)
+}
+
+func (s *SQLiteStore) DeleteKey(keyID uint16) (int64, error) {
+  _, err := s.DB.Exec("DELETE FROM " + SourceLinkTable(s.Table) + " WHERE hash IN (SELECT hash FROM " + s.Table + " WHERE key_id=?)", keyID)
+  if err != nil {
+    return 0, err
+  }
+  res, err := s.DB.Exec("DELETE FROM " + s.Table + " WHERE key_id=?", keyID)
+  if err != nil {
+    return 0, err
+  }
+  return res.RowsAffected()
+}
+
+func (s *SQLiteStore) HitStats(days int) (stats HitStats, err error) {
+  stats.HitsPerDay, err = SQLiteSearchHitsPerDay(s.DB, s.Table, days)
+  if err != nil {
+    return
+  }
+  stats.Checked, err = SearchCheckedDistribution(s.DB, s.Table)
+  return
+}
+
+func (s *SQLiteStore) Count() (int64, error) {
+  return CountCredHashes(s.DB, s.Table)
+}
+
+func (s *SQLiteStore) CreateTables() error {
+  return execAll(s.DB, SQLiteCredHashTableCreate(s.Table, s.HashLen), SQLiteSourceTableCreate, SQLiteSourceLinkTableCreate(s.Table, s.HashLen), SQLiteHitsTableCreate(s.Table))
+}
+
+func (s *SQLiteStore) Close() error {
+  return s.DB.Close()
+}
+
+// SQLiteAPIKeyStore keeps API keys in APIKeyTable. Only the schema differs
+// from MySQL.
+type SQLiteAPIKeyStore struct{
+  *MySQLAPIKeyStore
+}
+
+func NewSQLiteAPIKeyStore(db *sql.DB) *SQLiteAPIKeyStore {
+  return &SQLiteAPIKeyStore{NewMySQLAPIKeyStore(db)}
+}
+
+func (s *SQLiteAPIKeyStore) CreateTables() (err error) {
+  _, err = s.DB.Exec(SQLiteAPIKeyTableCreate)
+  return
+}
+
+// SQLitePasswordStore keeps the password hashes of one parameter set in
+// ParamSet.PasswordTable.
+type SQLitePasswordStore struct{
+  *MySQLPasswordStore
+}
+
+func NewSQLitePasswordStore(db *sql.DB, p ParamSet) *SQLitePasswordStore {
+  return &SQLitePasswordStore{NewMySQLPasswordStore(db, p)}
+}
+
+func (s *SQLitePasswordStore) AddPassword(hash []byte, keyID uint16) (err error) {
+  _, err = s.DB.Exec("INSERT INTO " + s.Table + " (hash, count, key_id) VALUES (?, 1, ?) ON CONFLICT (hash) DO UPDATE SET count=count+1", hash, keyID)
+  return
+}
+
+// like AddPassword; the embedded store's would use its MySQL upsert
+func (s *SQLitePasswordStore) InsertKeyed(hash []byte, keyID uint16) error {
+  return s.AddPassword(hash, keyID)
+}
+
+func (s *SQLitePasswordStore) CreateTables() (err error) {
+  _, err = s.DB.Exec(SQLitePasswordTableCreate(s.Table, s.HashLen))
+  return
+}
+
+// SQLiteCanaryStore keeps canaries in CanaryTable. Only the schema differs
+// from MySQL.
+type SQLiteCanaryStore struct{
+  *MySQLCanaryStore
+}
+
+func NewSQLiteCanaryStore(db *sql.DB) *SQLiteCanaryStore {
+  return &SQLiteCanaryStore{NewMySQLCanaryStore(db)}
+}
+
+func (s *SQLiteCanaryStore) CreateTables() (err error) {
+  _, err = s.DB.Exec(SQLiteCanaryTableCreate)
+  return
+}
+
+// SQLiteWatchStore keeps watchlists, webhooks and pending deliveries in
+// WatchTable, WebhookTable and NotificationTable.
+type SQLiteWatchStore struct{
+  *MySQLWatchStore
+}
+
+func NewSQLiteWatchStore(db *sql.DB) *SQLiteWatchStore {
+  return &SQLiteWatchStore{NewMySQLWatchStore(db)}
+}
+
+func (s *SQLiteWatchStore) AddWatches(tenant, params string, hashes [][]byte) error {
+  return insertTenantHashes(s.DB, "INSERT OR IGNORE INTO", WatchTable, tenant, params, hashes)
+}
+
+func (s *SQLiteWatchStore) SetWebhook(h Webhook) (err error) {
+  _, err = s.DB.Exec("INSERT INTO " + WebhookTable + " (tenant, url, secret) VALUES (?, ?, ?) ON CONFLICT (tenant) DO UPDATE SET url=excluded.url, secret=excluded.secret", h.Tenant, h.URL, h.Secret)
+  return
+}
+
+func (s *SQLiteWatchStore) CreateTables() error {
+  return execAll(s.DB, SQLiteWatchTableCreate, SQLiteWebhookTableCreate, SQLiteNotificationTableCreate)
+}
+
+// SQLiteJobStore keeps job state in JobTable. Only the schema differs from
+// MySQL.
+type SQLiteJobStore struct{
+  *MySQLJobStore
+}
+
+func NewSQLiteJobStore(db *sql.DB) *SQLiteJobStore {
+  return &SQLiteJobStore{NewMySQLJobStore(db)}
+}
+
+func (s *SQLiteJobStore) CreateTables() (err error) {
+  _, err = s.DB.Exec(SQLiteJobTableCreate)
+  return
+}
+
+// SQLiteBlocklistStore keeps blocklists in BlocklistTable and salts in
+// BlocklistSaltTable.
+type SQLiteBlocklistStore struct{
+  *MySQLBlocklistStore
+}
+
+func NewSQLiteBlocklistStore(db *sql.DB) *SQLiteBlocklistStore {
+  return &SQLiteBlocklistStore{NewMySQLBlocklistStore(db)}
+}
+
+func (s *SQLiteBlocklistStore) TenantSalt(tenant string) ([]byte, error) {
+  return tenantSalt(s.DB, "INSERT OR IGNORE INTO", tenant)
+}
+
+func (s *SQLiteBlocklistStore) AddBlocked(tenant, params string, hashes [][]byte) error {
+  return insertTenantHashes(s.DB, "INSERT OR IGNORE INTO", BlocklistTable, tenant, params, hashes)
+}
+
+func (s *SQLiteBlocklistStore) CreateTables() error {
+  return execAll(s.DB, SQLiteBlocklistTableCreate, SQLiteBlocklistSaltTableCreate)
+}
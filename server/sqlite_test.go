@@ -0,0 +1,165 @@
+package server
+
+import (
+  "bytes"
+  "database/sql"
+  "path/filepath"
+  "testing"
+  "time"
+
+  _ "modernc.org/sqlite"
+)
+
+// opens a fresh SQLite file in the test's temp dir
+func openTestSQLite(t *testing.T) *sql.DB {
+  db, _, err := OpenDB("sqlite:" + filepath.Join(t.TempDir(), "ccds.db"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() { db.Close() })
+  return db
+}
+
+func TestSQLiteStore(t *testing.T) {
+  db := openTestSQLite(t)
+  store := NewSQLiteStore(db, DefaultParamSet)
+  store.Checked = NewCheckedCounter(db, BackendSQLite)
+  if err := store.CreateTables(); err != nil {
+    t.Fatal(err)
+  }
+  // creating the tables again is a no-op
+  if err := store.CreateTables(); err != nil {
+    t.Fatal(err)
+  }
+  hashes := make([][]byte, 3)
+  for i, first := range []byte{0xab, 0xab, 0xac} {
+    hashes[i] = randomHash(t)
+    hashes[i][0] = first
+    if err := store.InsertKeyed(hashes[i], uint16(i)); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if err := store.Insert(hashes[0]); err != ErrDuplicate {
+    t.Errorf("Expected ErrDuplicate. Got %v\n", err)
+  }
+  if count, _ := store.Count(); count != 3 {
+    t.Errorf("Expected 3 hashes. Got %d\n", count)
+  }
+
+  missing := randomHash(t)
+  found, err := store.LookupMany([][]byte{hashes[0], missing, hashes[2]})
+  if err != nil || !found[0] || found[1] || !found[2] {
+    t.Errorf("Expected true, false, true. Got %v, %v\n", found, err)
+  }
+  if found, _ := store.Lookup(hashes[0]); !found {
+    t.Error("Expected the first hash to be found")
+  }
+  inRange, err := store.LookupRange("ab")
+  if err != nil || len(inRange) != 2 {
+    t.Errorf("Expected 2 hashes starting with ab. Got %d, %v\n", len(inRange), err)
+  }
+
+  entries, err := store.Since(1, 10)
+  if err != nil || len(entries) != 2 || entries[0].Seq != 2 || entries[1].KeyID != 2 || !bytes.Equal(entries[1].Hash, hashes[2]) {
+    t.Errorf("Expected the hashes after the first. Got %+v, %v\n", entries, err)
+  }
+  if last, _ := store.LastSeq(); last != 3 {
+    t.Errorf("Expected the last sequence number to be 3. Got %d\n", last)
+  }
+
+  // the first hash was found twice and the third once
+  if err = store.Checked.Flush(); err != nil {
+    t.Fatal(err)
+  }
+  stats, err := store.HitStats(7)
+  if err != nil {
+    t.Fatal(err)
+  }
+  today := time.Now().UTC().Format("2006-01-02")
+  if len(stats.HitsPerDay) != 1 || stats.HitsPerDay[0].Day != today || stats.HitsPerDay[0].Hits != 3 {
+    t.Errorf("Expected 3 hits today. Got %+v\n", stats.HitsPerDay)
+  }
+  if stats.Checked[0].Hashes != 1 || stats.Checked[1].Hashes != 2 {
+    t.Errorf("Expected 1 unchecked hash and 2 checked ones. Got %+v\n", stats.Checked)
+  }
+}
+
+func TestSQLiteNotifications(t *testing.T) {
+  watches := NewSQLiteWatchStore(openTestSQLite(t))
+  if err := watches.CreateTables(); err != nil {
+    t.Fatal(err)
+  }
+  now := time.Now().UTC()
+  for _, next := range []time.Time{now.Add(-time.Minute), now.Add(time.Minute), now.Add(-time.Second)} {
+    err := watches.EnqueueNotification(Notification{Tenant: "acme", Payload: []byte("{}"), NextAttempt: next, Created: now})
+    if err != nil {
+      t.Fatal(err)
+    }
+  }
+  due, err := watches.DueNotifications(now, 10)
+  if err != nil || len(due) != 2 || due[0].ID != 1 || due[1].ID != 3 {
+    t.Fatalf("Expected the first and third notifications to be due. Got %+v, %v\n", due, err)
+  }
+  if string(due[0].Payload) != "{}" || due[0].Tenant != "acme" {
+    t.Errorf("Unexpected notification %+v\n", due[0])
+  }
+  if claimed, err := watches.ClaimNotification(due[0].ID, now, now.Add(time.Hour)); err != nil || !claimed {
+    t.Errorf("Expected to claim the first notification. Got %v, %v\n", claimed, err)
+  }
+  if claimed, _ := watches.ClaimNotification(due[0].ID, now, now.Add(time.Hour)); claimed {
+    t.Error("Expected a claimed notification not to be claimed again")
+  }
+  due[1].Dead = true
+  if err = watches.UpdateNotification(due[1]); err != nil {
+    t.Fatal(err)
+  }
+  if due, _ := watches.DueNotifications(now, 10); len(due) != 0 {
+    t.Errorf("Expected claimed and dead notifications not to be due. Got %+v\n", due)
+  }
+  if due, _ := watches.DueNotifications(now.Add(2 * time.Hour), 10); len(due) != 2 {
+    t.Errorf("Expected the claimed and later notifications to be due later. Got %d\n", len(due))
+  }
+}
+
+func TestSQLiteSources(t *testing.T) {
+  store := NewSQLiteStore(openTestSQLite(t), DefaultParamSet)
+  if err := store.CreateTables(); err != nil {
+    t.Fatal(err)
+  }
+  a := App{}
+  a.Initialize(store)
+  date := time.Date(2019, 1, 17, 0, 0, 0, 0, time.UTC)
+  collection, err := store.AddSource(Source{Name: "Collection #1", Date: date})
+  if err != nil {
+    t.Fatal(err)
+  }
+  paste, _ := store.AddSource(Source{Name: "paste"})
+  if again, _ := store.AddSource(Source{Name: "paste"}); again != paste {
+    t.Errorf("Expected a source to be added once. Got ids %d and %d\n", paste, again)
+  }
+  hash := randomHash(t)
+  if err = store.InsertSourced(hash, collection, 0); err != nil {
+    t.Fatal(err)
+  }
+  if err = store.InsertSourced(hash, paste, 0); err != ErrDuplicate {
+    t.Errorf("Expected ErrDuplicate. Got %v\n", err)
+  }
+  store.InsertSourced(hash, paste, 0)
+  details := credDetails(t, &a, hash)
+  if !details.Compromised || details.Count != 3 {
+    t.Errorf("Expected 3 occurrences. Got %+v\n", details)
+  }
+  if len(details.Sources) != 2 || details.Sources[0] != "Collection #1" || details.Sources[1] != "paste" {
+    t.Errorf("Unexpected sources %v\n", details.Sources)
+  }
+  if details.FirstSeen == nil || !details.FirstSeen.Equal(date) || details.LastSeen == nil || !details.LastSeen.After(date) {
+    t.Errorf("Unexpected dates %v, %v\n", details.FirstSeen, details.LastSeen)
+  }
+  // retiring a key drops the sightings of its hashes
+  if _, err = store.DeleteKey(0); err != nil {
+    t.Fatal(err)
+  }
+  if sightings, _ := store.Sightings(hash); len(sightings) != 0 {
+    t.Errorf("Expected no sightings after deleting the key. Got %v\n", sightings)
+  }
+}
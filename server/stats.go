@@ -0,0 +1,36 @@
+package server
+
+import (
+  "net/http"
+)
+
+type StatsRes struct{
+  Params []ParamStats `json:"params"`
+  OPRF   []ParamStats `json:"oprf,omitempty"`
+}
+
+type ParamStats struct{
+  Name   string       `json:"name"`
+  // nil if the store has no filter
+  Filter *FilterStats `json:"filter,omitempty"`
+}
+
+func StatsHandler(w http.ResponseWriter, params, oprf *Registry) {
+  respondWithJSON(w, http.StatusOK, StatsRes{registryStats(params), registryStats(oprf)})
+}
+
+func registryStats(registry *Registry) (stats []ParamStats) {
+  if registry == nil {
+    return
+  }
+  for _, p := range registry.ParamSets() {
+    _, store, _ := registry.Get(p.Name)
+    s := ParamStats{Name: p.Name}
+    if f := FilterOf(store); f != nil {
+      filterStats := f.Stats()
+      s.Filter = &filterStats
+    }
+    stats = append(stats, s)
+  }
+  return
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+  "errors"
+)
+
+// returned by Store.Insert when the hash is already stored
+var ErrDuplicate = errors.New("Credential hash already exists.")
+
+// returned when a store can't list its hashes
+var ErrScanUnsupported = errors.New("Store can't list its hashes.")
+
+// Store is the set of compromised credential hashes that lookups are
+// answered from. Implementations must be safe for concurrent use.
+type Store interface {
+  // reports whether hash is in the store
+  Lookup(hash []byte) (bool, error)
+  // reports whether each of hashes is in the store, in the same order
+  LookupMany(hashes [][]byte) ([]bool, error)
+  // returns every hash whose hex encoding starts with prefix
+  LookupRange(prefix string) ([][]byte, error)
+  // adds hash to the store; returns ErrDuplicate if it was already there
+  Insert(hash []byte) error
+  // number of hashes in the store
+  Count() (int64, error)
+  // creates any tables or files the store needs; safe to call repeatedly
+  CreateTables() error
+  Close() error
+}
+
+// Scanner is implemented by stores that can list every hash they hold,
+// e.g. to build a FilteredStore.
+type Scanner interface {
+  // calls fn with each stored hash; stops at the first error fn returns
+  Scan(fn func(hash []byte) error) error
+}
+
+// calls match on store and then on each store it wraps, through their
+// Unwrap methods, and returns the first store matched
+func findStore(store Store, match func(Store) bool) Store {
+  for store != nil {
+    if match(store) {
+      return store
+    }
+    w, ok := store.(interface{ Unwrap() Store })
+    if !ok {
+      return nil
+    }
+    store = w.Unwrap()
+  }
+  return nil
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+  "encoding/hex"
+  "errors"
+  "net/http"
+  "strconv"
+)
+
+// default and maximum number of hashes in one /v1/sync page
+const DefaultSyncPageSize = 1000
+
+var ErrSyncDisabled = errors.New("Sync is not enabled on this server.")
+
+var ErrSyncUnsupported = errors.New("Store does not number its hashes.")
+
+// SyncEntry is a stored hash and the sequence number it was inserted
+// with. Hashes are stored peppered, so followers need the same keyring.
+type SyncEntry struct{
+  Seq   uint64
+  Hash  []byte
+  KeyID uint16
+}
+
+// Syncer is implemented by stores that number their hashes in insertion
+// order, so that followers can copy the hashes they don't have yet.
+// Deletions, such as retired pepper keys, are not numbered and have to
+// be repeated on each follower. Numbers are handed out before inserts
+// commit, so a hash can appear after ones numbered later; followers re-read
+// a trailing window of numbers to pick it up.
+type Syncer interface {
+  // returns up to limit hashes numbered after seq, in order
+  Since(seq uint64, limit int) ([]SyncEntry, error)
+  // returns the highest number of a stored hash, or 0 if there are none
+  LastSeq() (uint64, error)
+}
+
+type SyncRes struct{
+  Entries []SyncEntryRes `json:"entries"`
+  // pass as since to get the next page
+  Next    uint64         `json:"next"`
+  // false once the follower has caught up
+  More    bool           `json:"more"`
+}
+
+type SyncEntryRes struct{
+  Seq   uint64 `json:"seq"`
+  // hex
+  Hash  string `json:"hash"`
+  KeyID uint16 `json:"keyId,omitempty"`
+}
+
+// returns the Syncer in store's chain of wrappers, if any
+func SyncerOf(store Store) Syncer {
+  syncer, _ := findStore(store, func(s Store) bool {
+    _, ok := s.(Syncer)
+    return ok
+  }).(Syncer)
+  return syncer
+}
+
+// serves ?since=N&limit=M&params=name from registry
+func SyncHandler(w http.ResponseWriter, r *http.Request, registry *Registry) {
+  query := r.URL.Query()
+  var since uint64
+  var err error
+  if s := query.Get("since"); s != "" {
+    since, err = strconv.ParseUint(s, 10, 64)
+    if err != nil {
+      respondWithJSON(w, http.StatusBadRequest, credErr{"Expected since to be a sequence number. Got \"" + s + "\"."})
+      return
+    }
+  }
+  limit := DefaultSyncPageSize
+  if l := query.Get("limit"); l != "" {
+    limit, err = strconv.Atoi(l)
+    if err != nil || limit < 1 || limit > DefaultSyncPageSize {
+      respondWithJSON(w, http.StatusBadRequest, credErr{"Expected limit to be between 1 and " + strconv.Itoa(DefaultSyncPageSize) + "."})
+      return
+    }
+  }
+  _, store, err := registry.Get(query.Get("params"))
+  if err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{err.Error()})
+    return
+  }
+  syncer := SyncerOf(store)
+  if syncer == nil {
+    respondWithJSON(w, http.StatusNotImplemented, credErr{ErrSyncUnsupported.Error()})
+    return
+  }
+  // one extra to tell whether there are more
+  entries, err := syncer.Since(since, limit + 1)
+  if err != nil {
+    respondWithJSON(w, http.StatusInternalServerError, credErr{err.Error()})
+    return
+  }
+  res := SyncRes{Entries: []SyncEntryRes{}, Next: since}
+  if len(entries) > limit {
+    entries = entries[:limit]
+    res.More = true
+  }
+  for _, e := range entries {
+    res.Entries = append(res.Entries, SyncEntryRes{e.Seq, hex.EncodeToString(e.Hash), e.KeyID})
+    res.Next = e.Seq
+  }
+  respondWithJSON(w, http.StatusOK, res)
+}
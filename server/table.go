@@ -2,20 +2,108 @@ package server
 
 import (
   "database/sql"
+  "strconv"
+
   _ "github.com/go-sql-driver/mysql"
 )
 
+// table of DefaultParamSet
 const CredHashTable = "cred_hash_1_64_8_64"
-const CredHashTableCreate = `
-  CREATE TABLE IF NOT EXISTS ` + CredHashTable + ` (
-    hash varbinary(64) NOT NULL,
+// length in bytes of the hashes in CredHashTable
+const CredHashLen = 64
+
+func CredHashTableCreate(table string, hashLen uint32) string {
+  return `
+  CREATE TABLE IF NOT EXISTS ` + table + ` (
+    hash varbinary(` + strconv.FormatUint(uint64(hashLen), 10) + `) NOT NULL,
     checked int(11) DEFAULT '0',
+    key_id smallint unsigned NOT NULL DEFAULT '0',
+    seq bigint unsigned NOT NULL AUTO_INCREMENT,
     PRIMARY KEY (hash),
-    UNIQUE KEY hash_UNIQUE (hash)
+    UNIQUE KEY hash_UNIQUE (hash),
+    UNIQUE KEY seq_UNIQUE (seq)
+  ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+`
+}
+
+// breaches shared by every parameter set's tables
+const SourceTable = "breach_source"
+
+const SourceTableCreate = `
+  CREATE TABLE IF NOT EXISTS ` + SourceTable + ` (
+    id int unsigned NOT NULL AUTO_INCREMENT,
+    name varchar(255) NOT NULL,
+    date date DEFAULT NULL,
+    description text,
+    PRIMARY KEY (id),
+    UNIQUE KEY name_UNIQUE (name)
+  ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+`
+
+// links the hashes of table to the sources they were seen in
+func SourceLinkTable(table string) string {
+  return table + "_source"
+}
+
+func SourceLinkTableCreate(table string, hashLen uint32) string {
+  return `
+  CREATE TABLE IF NOT EXISTS ` + SourceLinkTable(table) + ` (
+    hash varbinary(` + strconv.FormatUint(uint64(hashLen), 10) + `) NOT NULL,
+    source_id int unsigned NOT NULL,
+    count int unsigned NOT NULL DEFAULT '1',
+    first_seen datetime NOT NULL,
+    last_seen datetime NOT NULL,
+    PRIMARY KEY (hash, source_id)
   ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
 `
+}
+
+// daily totals of positive lookups in table
+func HitsTable(table string) string {
+  return table + "_hits"
+}
+
+func HitsTableCreate(table string) string {
+  return `
+  CREATE TABLE IF NOT EXISTS ` + HitsTable(table) + ` (
+    day date NOT NULL,
+    hits bigint unsigned NOT NULL DEFAULT '0',
+    PRIMARY KEY (day)
+  ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+`
+}
+
+func CreateTables(db *sql.DB, table string, hashLen uint32) (err error) {
+  err = execAll(db, CredHashTableCreate(table, hashLen), SourceTableCreate, SourceLinkTableCreate(table, hashLen), HitsTableCreate(table))
+  if err != nil {
+    return
+  }
+  // tables created before pepper support lack key_id
+  err = addColumnIfMissing(db, table, "key_id", "smallint unsigned NOT NULL DEFAULT '0'")
+  if err != nil {
+    return
+  }
+  // and tables created before sync support lack seq; existing rows are
+  // numbered in no particular order
+  return addColumnIfMissing(db, table, "seq", "bigint unsigned NOT NULL AUTO_INCREMENT UNIQUE")
+}
+
+// runs each of queries in turn
+func execAll(db *sql.DB, queries ...string) error {
+  for _, query := range queries {
+    if _, err := db.Exec(query); err != nil {
+      return err
+    }
+  }
+  return nil
+}
 
-func CreateTables(db *sql.DB) (err error) {
-  _, err = db.Exec(CredHashTableCreate)
-  return
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+  var exists bool
+  err := db.QueryRow("SELECT EXISTS(SELECT * FROM information_schema.columns WHERE table_schema=DATABASE() AND table_name=? AND column_name=?)", table, column).Scan(&exists)
+  if err != nil || exists {
+    return err
+  }
+  _, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+  return err
 }
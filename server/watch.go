@@ -0,0 +1,617 @@
+package server
+
+import (
+  "crypto/rand"
+  "database/sql"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "net/http"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+const WatchTable = "watch"
+const WatchTableCreate = `
+  CREATE TABLE IF NOT EXISTS ` + WatchTable + ` (
+    tenant varchar(64) NOT NULL,
+    params varchar(64) NOT NULL,
+    hash varbinary(255) NOT NULL,
+    created datetime NOT NULL,
+    PRIMARY KEY (tenant, params, hash),
+    KEY params_hash (params, hash)
+  ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+`
+
+const WebhookTable = "watch_webhook"
+const WebhookTableCreate = `
+  CREATE TABLE IF NOT EXISTS ` + WebhookTable + ` (
+    tenant varchar(64) NOT NULL,
+    url varchar(2048) NOT NULL,
+    secret char(64) NOT NULL,
+    PRIMARY KEY (tenant)
+  ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+`
+
+// outbox of webhook deliveries
+const NotificationTable = "watch_notification"
+const NotificationTableCreate = `
+  CREATE TABLE IF NOT EXISTS ` + NotificationTable + ` (
+    id bigint unsigned NOT NULL AUTO_INCREMENT,
+    tenant varchar(64) NOT NULL,
+    payload mediumtext NOT NULL,
+    attempts int unsigned NOT NULL DEFAULT '0',
+    next_attempt datetime NOT NULL,
+    dead tinyint(1) NOT NULL DEFAULT '0',
+    last_error text,
+    created datetime NOT NULL,
+    PRIMARY KEY (id),
+    KEY dead_next_attempt (dead, next_attempt)
+  ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+`
+
+var ErrWatchDisabled = errors.New("Watchlists are not enabled on this server.")
+
+var ErrNoTenant = errors.New("Watchlists require an API key.")
+
+var ErrNoWebhook = errors.New("No webhook is registered for this tenant.")
+
+// Webhook is where a tenant's watchlist matches are delivered. Each
+// delivery is signed with Secret; see SignWebhook.
+type Webhook struct{
+  Tenant string `json:"-"`
+  URL    string `json:"url"`
+  Secret string `json:"secret"`
+}
+
+// WatchEvent is the body of a webhook delivery: the tenant's watched
+// hashes that an import just added.
+type WatchEvent struct{
+  Tenant    string    `json:"tenant"`
+  Params    string    `json:"params"`
+  // hex
+  Hashes    []string  `json:"hashes"`
+  MatchedAt time.Time `json:"matchedAt"`
+}
+
+// Notification is a WatchEvent waiting to be delivered.
+type Notification struct{
+  ID          int64
+  Tenant      string
+  // JSON WatchEvent
+  Payload     []byte
+  Attempts    int
+  NextAttempt time.Time
+  // given up on after too many attempts
+  Dead        bool
+  LastError   string
+  Created     time.Time
+}
+
+type WatchStore interface {
+  AddWatches(tenant, params string, hashes [][]byte) error
+  RemoveWatches(tenant, params string, hashes [][]byte) error
+  // returns the tenants watching each of hashes, keyed by string(hash)
+  MatchWatches(params string, hashes [][]byte) (map[string][]string, error)
+  SetWebhook(h Webhook) error
+  // returns ErrNoWebhook if tenant has none
+  GetWebhook(tenant string) (Webhook, error)
+  EnqueueNotification(n Notification) error
+  // returns up to limit live notifications due by now, oldest first
+  DueNotifications(now time.Time, limit int) ([]Notification, error)
+  // moves the live notification id's next attempt to lease if it is still
+  // due by now; false if it isn't, e.g. because another server claimed it
+  // first
+  ClaimNotification(id int64, now, lease time.Time) (bool, error)
+  // saves Attempts, NextAttempt, Dead and LastError
+  UpdateNotification(n Notification) error
+  DeleteNotification(id int64) error
+  CreateTables() error
+}
+
+// queues one WatchEvent for each tenant watching any of hashes, which an
+// import just added to the params table; returns the number of matches
+func NotifyWatches(store WatchStore, params string, hashes [][]byte) (matched int, err error) {
+  matches, err := store.MatchWatches(params, hashes)
+  if err != nil {
+    return
+  }
+  now := time.Now().UTC().Truncate(time.Second)
+  events := make(map[string]*WatchEvent)
+  for _, hash := range hashes {
+    for _, tenant := range matches[string(hash)] {
+      event, ok := events[tenant]
+      if !ok {
+        event = &WatchEvent{Tenant: tenant, Params: params, MatchedAt: now}
+        events[tenant] = event
+      }
+      event.Hashes = append(event.Hashes, hex.EncodeToString(hash))
+      matched += 1
+    }
+  }
+  for tenant, event := range events {
+    payload, err := json.Marshal(event)
+    if err != nil {
+      return matched, err
+    }
+    err = store.EnqueueNotification(Notification{Tenant: tenant, Payload: payload, NextAttempt: now, Created: now})
+    if err != nil {
+      return matched, err
+    }
+  }
+  return
+}
+
+type WatchReqBody struct{
+  Hashes   []string `json:"hashes"`
+  Encoding string   `json:"encoding"`
+  Params   string   `json:"params,omitempty"`
+}
+
+type WebhookReqBody struct{
+  URL string `json:"url"`
+}
+
+// adds hashes to the tenant's watchlist and answers like /v1/creds, since
+// some of them may already be compromised
+func WatchHandler(w http.ResponseWriter, r *http.Request, registry *Registry, watches WatchStore, maxBatchSize int, canaries *Canaries) {
+  tenant, p, store, hashes, ok := decodeWatchReq(w, r, registry, watches, maxBatchSize)
+  if !ok {
+    return
+  }
+  canaries.Check(r, p.Name, hashes...)
+  found, err := store.LookupMany(hashes)
+  if err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{err.Error()})
+    return
+  }
+  res := CredsRes{make([]CredRes, len(found))}
+  hits := 0
+  for i, compromised := range found {
+    res.Results[i].Compromised = compromised
+    if compromised {
+      hits += 1
+    }
+  }
+  // before saving, so that a request refused for its hits watches nothing
+  if !chargeHits(w, r, hits) {
+    return
+  }
+  if err = watches.AddWatches(tenant, p.Name, hashes); err != nil {
+    respondWithJSON(w, http.StatusInternalServerError, credErr{err.Error()})
+    return
+  }
+  respondWithJSON(w, http.StatusOK, res)
+}
+
+func UnwatchHandler(w http.ResponseWriter, r *http.Request, registry *Registry, watches WatchStore, maxBatchSize int) {
+  tenant, p, _, hashes, ok := decodeWatchReq(w, r, registry, watches, maxBatchSize)
+  if !ok {
+    return
+  }
+  if err := watches.RemoveWatches(tenant, p.Name, hashes); err != nil {
+    respondWithJSON(w, http.StatusInternalServerError, credErr{err.Error()})
+    return
+  }
+  w.WriteHeader(http.StatusNoContent)
+}
+
+// responds with an error and returns false if the request is invalid
+func decodeWatchReq(w http.ResponseWriter, r *http.Request, registry *Registry, watches WatchStore, maxBatchSize int) (tenant string, p ParamSet, store Store, hashes [][]byte, ok bool) {
+  if watches == nil {
+    respondWithJSON(w, http.StatusNotImplemented, credErr{ErrWatchDisabled.Error()})
+    return
+  }
+  tenant, ok = TenantFromContext(r.Context())
+  if !ok {
+    respondWithJSON(w, http.StatusForbidden, credErr{ErrNoTenant.Error()})
+    return
+  }
+  ok = false
+  var req WatchReqBody
+  err := DecodeBody(r.Body, &req)
+  if err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{"An error occurred parsing the request body"})
+    return
+  }
+  if len(req.Hashes) > maxBatchSize {
+    respondWithJSON(w, http.StatusRequestEntityTooLarge, credErr{"Expected at most " + strconv.Itoa(maxBatchSize) + " hashes. Got " + strconv.Itoa(len(req.Hashes)) + "."})
+    return
+  }
+  p, store, err = registry.Get(req.Params)
+  if err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{err.Error()})
+    return
+  }
+  hashes = make([][]byte, len(req.Hashes))
+  for i, encoded := range req.Hashes {
+    hashes[i], err = DecodeHash(encoded, req.Encoding, int(p.KeyLen))
+    if err != nil {
+      respondWithJSON(w, http.StatusBadRequest, credErr{"Hash " + strconv.Itoa(i) + ": " + err.Error()})
+      return
+    }
+  }
+  return tenant, p, store, hashes, true
+}
+
+// registers the tenant's webhook and responds with its new signing secret
+func WebhookHandler(w http.ResponseWriter, r *http.Request, watches WatchStore) {
+  if watches == nil {
+    respondWithJSON(w, http.StatusNotImplemented, credErr{ErrWatchDisabled.Error()})
+    return
+  }
+  tenant, ok := TenantFromContext(r.Context())
+  if !ok {
+    respondWithJSON(w, http.StatusForbidden, credErr{ErrNoTenant.Error()})
+    return
+  }
+  var req WebhookReqBody
+  err := DecodeBody(r.Body, &req)
+  if err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{"An error occurred parsing the request body"})
+    return
+  }
+  if err = checkWebhookURL(req.URL); err != nil {
+    respondWithJSON(w, http.StatusBadRequest, credErr{err.Error()})
+    return
+  }
+  secret := make([]byte, 32)
+  if _, err = rand.Read(secret); err != nil {
+    respondWithJSON(w, http.StatusInternalServerError, credErr{err.Error()})
+    return
+  }
+  h := Webhook{tenant, req.URL, hex.EncodeToString(secret)}
+  if err = watches.SetWebhook(h); err != nil {
+    respondWithJSON(w, http.StatusInternalServerError, credErr{err.Error()})
+    return
+  }
+  respondWithJSON(w, http.StatusOK, h)
+}
+
+// PepperedWatchStore applies a Keyring to watched hashes, like
+// PepperedStore, so that a leaked watch table can't be attacked offline
+// either. Hashes are watched under the current key and matched under
+// every key; watches made under a retired key, or before a pepper was
+// configured, no longer match and have to be added again.
+type PepperedWatchStore struct{
+  WatchStore
+  Keys Keyring
+}
+
+// wraps store with keys, or returns store unchanged if keys is empty
+func NewPepperedWatchStore(store WatchStore, keys Keyring) WatchStore {
+  if len(keys) == 0 {
+    return store
+  }
+  return &PepperedWatchStore{store, keys}
+}
+
+// watches hashes peppered with the current key
+func (s *PepperedWatchStore) AddWatches(tenant, params string, hashes [][]byte) error {
+  key := s.Keys[0]
+  peppered := make([][]byte, len(hashes))
+  for i, hash := range hashes {
+    peppered[i] = key.Apply(hash)
+  }
+  return s.WatchStore.AddWatches(tenant, params, peppered)
+}
+
+// stops watching hashes under every key
+func (s *PepperedWatchStore) RemoveWatches(tenant, params string, hashes [][]byte) error {
+  return s.WatchStore.RemoveWatches(tenant, params, s.pepperAll(hashes))
+}
+
+// matches hashes under every key and keys the tenants by the unpeppered
+// hash
+func (s *PepperedWatchStore) MatchWatches(params string, hashes [][]byte) (map[string][]string, error) {
+  found, err := s.WatchStore.MatchWatches(params, s.pepperAll(hashes))
+  if err != nil {
+    return nil, err
+  }
+  matches := make(map[string][]string)
+  for _, hash := range hashes {
+    // a tenant may watch hash under more than one key
+    seen := make(map[string]bool)
+    for _, key := range s.Keys {
+      for _, tenant := range found[string(key.Apply(hash))] {
+        if !seen[tenant] {
+          seen[tenant] = true
+          matches[string(hash)] = append(matches[string(hash)], tenant)
+        }
+      }
+    }
+    sort.Strings(matches[string(hash)])
+  }
+  return matches, nil
+}
+
+// every hash peppered with every key
+func (s *PepperedWatchStore) pepperAll(hashes [][]byte) [][]byte {
+  peppered := make([][]byte, 0, len(hashes) * len(s.Keys))
+  for _, hash := range hashes {
+    for _, key := range s.Keys {
+      peppered = append(peppered, key.Apply(hash))
+    }
+  }
+  return peppered
+}
+
+// MySQLWatchStore keeps watchlists, webhooks and pending deliveries in
+// WatchTable, WebhookTable and NotificationTable.
+type MySQLWatchStore struct{
+  DB *sql.DB
+}
+
+func NewMySQLWatchStore(db *sql.DB) *MySQLWatchStore {
+  return &MySQLWatchStore{db}
+}
+
+func (s *MySQLWatchStore) AddWatches(tenant, params string, hashes [][]byte) error {
+  return insertTenantHashes(s.DB, "INSERT IGNORE INTO", WatchTable, tenant, params, hashes)
+}
+
+// adds the hashes to table, a watchlist or blocklist, with insert, which
+// must skip rows already there
+func insertTenantHashes(db *sql.DB, insert, table, tenant, params string, hashes [][]byte) error {
+  now := time.Now().UTC()
+  for start := 0; start < len(hashes); start += searchChunkSize {
+    chunk := hashes[start:minInt(start + searchChunkSize, len(hashes))]
+    args := make([]interface{}, 0, len(chunk) * 4)
+    for _, hash := range chunk {
+      args = append(args, tenant, params, hash, now)
+    }
+    placeholders := strings.TrimSuffix(strings.Repeat("(?, ?, ?, ?),", len(chunk)), ",")
+    _, err := db.Exec(insert + " " + table + " (tenant, params, hash, created) VALUES " + placeholders, args...)
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func (s *MySQLWatchStore) RemoveWatches(tenant, params string, hashes [][]byte) error {
+  for start := 0; start < len(hashes); start += searchChunkSize {
+    chunk := hashes[start:minInt(start + searchChunkSize, len(hashes))]
+    args := []interface{}{tenant, params}
+    for _, hash := range chunk {
+      args = append(args, hash)
+    }
+    placeholders := strings.TrimSuffix(strings.Repeat("?,", len(chunk)), ",")
+    _, err := s.DB.Exec("DELETE FROM " + WatchTable + " WHERE tenant=? AND params=? AND hash IN (" + placeholders + ")", args...)
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func (s *MySQLWatchStore) MatchWatches(params string, hashes [][]byte) (map[string][]string, error) {
+  matches := make(map[string][]string)
+  for start := 0; start < len(hashes); start += searchChunkSize {
+    chunk := hashes[start:minInt(start + searchChunkSize, len(hashes))]
+    args := []interface{}{params}
+    for _, hash := range chunk {
+      args = append(args, hash)
+    }
+    placeholders := strings.TrimSuffix(strings.Repeat("?,", len(chunk)), ",")
+    rows, err := s.DB.Query("SELECT hash, tenant FROM " + WatchTable + " WHERE params=? AND hash IN (" + placeholders + ")", args...)
+    if err != nil {
+      return nil, err
+    }
+    for rows.Next() {
+      var hash []byte
+      var tenant string
+      if err = rows.Scan(&hash, &tenant); err != nil {
+        rows.Close()
+        return nil, err
+      }
+      matches[string(hash)] = append(matches[string(hash)], tenant)
+    }
+    err = rows.Err()
+    rows.Close()
+    if err != nil {
+      return nil, err
+    }
+  }
+  return matches, nil
+}
+
+func (s *MySQLWatchStore) SetWebhook(h Webhook) (err error) {
+  _, err = s.DB.Exec("INSERT INTO " + WebhookTable + " (tenant, url, secret) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE url=VALUES(url), secret=VALUES(secret)", h.Tenant, h.URL, h.Secret)
+  return
+}
+
+func (s *MySQLWatchStore) GetWebhook(tenant string) (h Webhook, err error) {
+  err = s.DB.QueryRow("SELECT tenant, url, secret FROM " + WebhookTable + " WHERE tenant=?", tenant).Scan(&h.Tenant, &h.URL, &h.Secret)
+  if err == sql.ErrNoRows {
+    err = ErrNoWebhook
+  }
+  return
+}
+
+func (s *MySQLWatchStore) EnqueueNotification(n Notification) (err error) {
+  _, err = s.DB.Exec("INSERT INTO " + NotificationTable + " (tenant, payload, attempts, next_attempt, created) VALUES (?, ?, ?, ?, ?)", n.Tenant, n.Payload, n.Attempts, n.NextAttempt, n.Created)
+  return
+}
+
+func (s *MySQLWatchStore) DueNotifications(now time.Time, limit int) (due []Notification, err error) {
+  rows, err := s.DB.Query("SELECT id, tenant, payload, attempts, next_attempt, dead, last_error, created FROM " + NotificationTable + " WHERE dead=0 AND next_attempt <= ? ORDER BY id LIMIT ?", now, limit)
+  if err != nil {
+    return
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var n Notification
+    var lastError sql.NullString
+    if err = rows.Scan(&n.ID, &n.Tenant, &n.Payload, &n.Attempts, &n.NextAttempt, &n.Dead, &lastError, &n.Created); err != nil {
+      return nil, err
+    }
+    n.LastError = lastError.String
+    due = append(due, n)
+  }
+  return due, rows.Err()
+}
+
+func (s *MySQLWatchStore) ClaimNotification(id int64, now, lease time.Time) (bool, error) {
+  res, err := s.DB.Exec("UPDATE " + NotificationTable + " SET next_attempt=? WHERE id=? AND dead=0 AND next_attempt <= ?", lease, id, now)
+  if err != nil {
+    return false, err
+  }
+  n, err := res.RowsAffected()
+  return n == 1, err
+}
+
+func (s *MySQLWatchStore) UpdateNotification(n Notification) (err error) {
+  _, err = s.DB.Exec("UPDATE " + NotificationTable + " SET attempts=?, next_attempt=?, dead=?, last_error=? WHERE id=?", n.Attempts, n.NextAttempt, n.Dead, n.LastError, n.ID)
+  return
+}
+
+func (s *MySQLWatchStore) DeleteNotification(id int64) (err error) {
+  _, err = s.DB.Exec("DELETE FROM " + NotificationTable + " WHERE id=?", id)
+  return
+}
+
+func (s *MySQLWatchStore) CreateTables() error {
+  return execAll(s.DB, WatchTableCreate, WebhookTableCreate, NotificationTableCreate)
+}
+
+// MemWatchStore keeps watchlists, webhooks and pending deliveries in memory.
+type MemWatchStore struct{
+  mu            sync.Mutex
+  // tenants by params and then string(hash)
+  watches       map[string]map[string]map[string]bool
+  webhooks      map[string]Webhook
+  notifications map[int64]Notification
+  nextID        int64
+}
+
+func NewMemWatchStore() *MemWatchStore {
+  return &MemWatchStore{
+    watches: make(map[string]map[string]map[string]bool),
+    webhooks: make(map[string]Webhook),
+    notifications: make(map[int64]Notification),
+  }
+}
+
+func (s *MemWatchStore) AddWatches(tenant, params string, hashes [][]byte) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  byHash, ok := s.watches[params]
+  if !ok {
+    byHash = make(map[string]map[string]bool)
+    s.watches[params] = byHash
+  }
+  for _, hash := range hashes {
+    if byHash[string(hash)] == nil {
+      byHash[string(hash)] = make(map[string]bool)
+    }
+    byHash[string(hash)][tenant] = true
+  }
+  return nil
+}
+
+func (s *MemWatchStore) RemoveWatches(tenant, params string, hashes [][]byte) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  for _, hash := range hashes {
+    delete(s.watches[params][string(hash)], tenant)
+  }
+  return nil
+}
+
+func (s *MemWatchStore) MatchWatches(params string, hashes [][]byte) (map[string][]string, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  matches := make(map[string][]string)
+  for _, hash := range hashes {
+    for tenant := range s.watches[params][string(hash)] {
+      matches[string(hash)] = append(matches[string(hash)], tenant)
+    }
+    sort.Strings(matches[string(hash)])
+  }
+  return matches, nil
+}
+
+func (s *MemWatchStore) SetWebhook(h Webhook) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  s.webhooks[h.Tenant] = h
+  return nil
+}
+
+func (s *MemWatchStore) GetWebhook(tenant string) (Webhook, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  h, ok := s.webhooks[tenant]
+  if !ok {
+    return h, ErrNoWebhook
+  }
+  return h, nil
+}
+
+func (s *MemWatchStore) EnqueueNotification(n Notification) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  s.nextID += 1
+  n.ID = s.nextID
+  s.notifications[n.ID] = n
+  return nil
+}
+
+func (s *MemWatchStore) DueNotifications(now time.Time, limit int) ([]Notification, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  var due []Notification
+  for _, n := range s.notifications {
+    if !n.Dead && !n.NextAttempt.After(now) {
+      due = append(due, n)
+    }
+  }
+  sort.Slice(due, func(i, j int) bool {
+    return due[i].ID < due[j].ID
+  })
+  if len(due) > limit {
+    due = due[:limit]
+  }
+  return due, nil
+}
+
+func (s *MemWatchStore) ClaimNotification(id int64, now, lease time.Time) (bool, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  n, ok := s.notifications[id]
+  if !ok || n.Dead || n.NextAttempt.After(now) {
+    return false, nil
+  }
+  n.NextAttempt = lease
+  s.notifications[id] = n
+  return true, nil
+}
+
+func (s *MemWatchStore) UpdateNotification(n Notification) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  s.notifications[n.ID] = n
+  return nil
+}
+
+func (s *MemWatchStore) DeleteNotification(id int64) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  delete(s.notifications, id)
+  return nil
+}
+
+func (s *MemWatchStore) CreateTables() error {
+  return nil
+}
+
+func minInt(a, b int) int {
+  if a < b {
+    return a
+  }
+  return b
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+  "bytes"
+  "context"
+  "encoding/hex"
+  "encoding/json"
+  "io"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "testing"
+  "time"
+)
+
+func TestWatchlists(t *testing.T) {
+  apiKeys := NewMemAPIKeyStore()
+  key, _, _ := CreateAPIKey(apiKeys, "acme")
+  watches := NewMemWatchStore()
+  store := NewMemStore()
+  a := App{APIKeys: apiKeys, Watches: watches}
+  a.Initialize(store)
+  do := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+    b, _ := json.Marshal(body)
+    req := httptest.NewRequest(method, path, bytes.NewBuffer(b))
+    req.Header.Set("Authorization", "Bearer " + key)
+    rr := httptest.NewRecorder()
+    a.Router.ServeHTTP(rr, req)
+    return rr
+  }
+
+  var received [][]byte
+  var signatures []string
+  failures := 1
+  // the test webhook is on loopback
+  checkWebhookURL = func(string) error { return nil }
+  defer func() { checkWebhookURL = CheckWebhookURL }()
+  hook := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if failures > 0 {
+      failures -= 1
+      w.WriteHeader(http.StatusServiceUnavailable)
+      return
+    }
+    b, _ := io.ReadAll(r.Body)
+    received = append(received, b)
+    signatures = append(signatures, r.Header.Get(WebhookSignatureHeader))
+  }))
+  defer hook.Close()
+  rr := do("PUT", "/v1/watch/webhook", WebhookReqBody{hook.URL})
+  if rr.Code != http.StatusOK {
+    t.Fatalf("Expected response code 200. Got %d\n", rr.Code)
+  }
+  var h Webhook
+  json.Unmarshal(rr.Body.Bytes(), &h)
+  if len(h.Secret) != 64 {
+    t.Fatalf("Expected a 32-byte hex secret. Got %q\n", h.Secret)
+  }
+
+  leaked := randomHash(t)
+  store.Insert(leaked)
+  fresh := randomHash(t)
+  rr = do("POST", "/v1/watch", WatchReqBody{Hashes: []string{hex.EncodeToString(leaked), hex.EncodeToString(fresh)}, Encoding: EncodingHex})
+  if rr.Code != http.StatusOK {
+    t.Fatalf("Expected response code 200. Got %d\n", rr.Code)
+  }
+  var res CredsRes
+  json.Unmarshal(rr.Body.Bytes(), &res)
+  if len(res.Results) != 2 || !res.Results[0].Compromised || res.Results[1].Compromised {
+    t.Errorf("Expected the current status of each watched hash. Got %+v\n", res)
+  }
+
+  // an import adds fresh and another hash nobody watches
+  matched, err := NotifyWatches(watches, DefaultParamSet.Name, [][]byte{fresh, randomHash(t)})
+  if err != nil || matched != 1 {
+    t.Fatalf("Expected 1 match. Got %d, %v\n", matched, err)
+  }
+  now := time.Now()
+  var deadLetters bytes.Buffer
+  n := NewNotifier(watches, &deadLetters)
+  n.HTTPClient = hook.Client()
+  n.now = func() time.Time { return now }
+  if delivered, err := n.Deliver(); err != nil || delivered != 0 {
+    t.Fatalf("Expected the first delivery to fail. Got %d, %v\n", delivered, err)
+  }
+  if delivered, _ := n.Deliver(); delivered != 0 {
+    t.Errorf("Expected no retry before the backoff. Got %d deliveries\n", delivered)
+  }
+  now = now.Add(DefaultWebhookRetryBase)
+  if delivered, err := n.Deliver(); err != nil || delivered != 1 {
+    t.Fatalf("Expected the retry to succeed. Got %d, %v\n", delivered, err)
+  }
+  var event WatchEvent
+  json.Unmarshal(received[0], &event)
+  if event.Tenant != "acme" || len(event.Hashes) != 1 || event.Hashes[0] != hex.EncodeToString(fresh) {
+    t.Errorf("Expected an event for the fresh hash. Got %+v\n", event)
+  }
+  if err := VerifyWebhook(h.Secret, signatures[0], received[0], time.Minute); err != nil {
+    t.Errorf("Expected a valid signature. Got %v\n", err)
+  }
+  if err := VerifyWebhook(h.Secret, signatures[0], append(received[0], ' '), time.Minute); err != ErrBadWebhookSignature {
+    t.Errorf("Expected a tampered body to fail verification. Got %v\n", err)
+  }
+
+  // a webhook that never answers ends up in the dead-letter log
+  failures = 1 << 30
+  NotifyWatches(watches, DefaultParamSet.Name, [][]byte{fresh})
+  for i := 0; i < DefaultWebhookAttempts; i += 1 {
+    n.Deliver()
+    now = now.Add(time.Hour)
+  }
+  if due, _ := watches.DueNotifications(now, 10); len(due) != 0 {
+    t.Errorf("Expected the delivery to be given up on. Got %d due\n", len(due))
+  }
+  if !strings.Contains(deadLetters.String(), `"tenant":"acme"`) {
+    t.Errorf("Expected a dead letter. Got %q\n", deadLetters.String())
+  }
+
+  rr = do("DELETE", "/v1/watch", WatchReqBody{Hashes: []string{hex.EncodeToString(fresh)}, Encoding: EncodingHex})
+  if rr.Code != http.StatusNoContent {
+    t.Fatalf("Expected response code 204. Got %d\n", rr.Code)
+  }
+  if matched, _ := NotifyWatches(watches, DefaultParamSet.Name, [][]byte{fresh}); matched != 0 {
+    t.Errorf("Expected no matches after unwatching. Got %d\n", matched)
+  }
+}
+
+func TestWatchOutOfHits(t *testing.T) {
+  watches := NewMemWatchStore()
+  store := NewMemStore()
+  registry := NewRegistry()
+  registry.Register(DefaultParamSet, store)
+  leaked := randomHash(t)
+  store.Insert(leaked)
+  b, _ := json.Marshal(WatchReqBody{Hashes: []string{hex.EncodeToString(leaked)}, Encoding: EncodingHex})
+  r := httptest.NewRequest("POST", "/v1/watch", bytes.NewBuffer(b))
+  // a client with no hits left
+  hits := NewLimiter(Rate{PerSecond: 0.001, Burst: 1})
+  hits.Take("c", 1)
+  ctx := WithAPIKey(r.Context(), APIKey{Tenant: "acme"})
+  r = r.WithContext(context.WithValue(ctx, hitsKey{}, &hitCounter{hits, "c"}))
+  rr := httptest.NewRecorder()
+  WatchHandler(rr, r, registry, watches, 10, nil)
+  if rr.Code != http.StatusTooManyRequests {
+    t.Fatalf("Expected response code 429. Got %d\n", rr.Code)
+  }
+  if matched, _ := NotifyWatches(watches, DefaultParamSet.Name, [][]byte{leaked}); matched != 0 {
+    t.Errorf("Expected a refused request to watch nothing. Got %d matches\n", matched)
+  }
+}
+
+func TestNotifierClaims(t *testing.T) {
+  watches := NewMemWatchStore()
+  var received int32
+  checkWebhookURL = func(string) error { return nil }
+  defer func() { checkWebhookURL = CheckWebhookURL }()
+  hook := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    atomic.AddInt32(&received, 1)
+  }))
+  defer hook.Close()
+  watches.SetWebhook(Webhook{Tenant: "acme", URL: hook.URL, Secret: "secret"})
+  fresh := randomHash(t)
+  watches.AddWatches("acme", DefaultParamSet.Name, [][]byte{fresh})
+  NotifyWatches(watches, DefaultParamSet.Name, [][]byte{fresh})
+  // replicas sharing the store deliver at the same time
+  var wg sync.WaitGroup
+  for i := 0; i < 4; i += 1 {
+    n := NewNotifier(watches, nil)
+    n.HTTPClient = hook.Client()
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      if _, err := n.Deliver(); err != nil {
+        t.Error(err)
+      }
+    }()
+  }
+  wg.Wait()
+  if received != 1 {
+    t.Errorf("Expected the event to be sent once. Got %d\n", received)
+  }
+}
+
+func TestCheckWebhookURL(t *testing.T) {
+  for _, u := range []string{
+    "http://93.184.216.34/hook",
+    "https://127.0.0.1/hook",
+    "https://localhost:8443/hook",
+    "https://169.254.169.254/latest/meta-data",
+    "https://10.1.2.3/hook",
+    "https://192.168.0.1/hook",
+    "https://[::1]/hook",
+    "https://[fe80::1]/hook",
+    "https://0.0.0.0/hook",
+  } {
+    if err := CheckWebhookURL(u); err == nil {
+      t.Errorf("Expected %s to be rejected\n", u)
+    }
+  }
+  if err := CheckWebhookURL("https://93.184.216.34/hook"); err != nil {
+    t.Errorf("Expected a public address to be accepted. Got %v\n", err)
+  }
+}
+
+func TestWebhookClientRefusesPrivate(t *testing.T) {
+  hook := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+  defer hook.Close()
+  _, err := NewWebhookClient().Get(hook.URL)
+  if err == nil || !strings.Contains(err.Error(), ErrPrivateWebhook.Error()) {
+    t.Errorf("Expected the dialer to refuse loopback. Got %v\n", err)
+  }
+}
+
+func TestPepperedWatchStore(t *testing.T) {
+  oldKey := PepperKey{1, bytes.Repeat([]byte{1}, 32)}
+  newKey := PepperKey{2, bytes.Repeat([]byte{2}, 32)}
+  mem := NewMemWatchStore()
+  hash := randomHash(t)
+  NewPepperedWatchStore(mem, Keyring{oldKey}).AddWatches("acme", DefaultParamSet.Name, [][]byte{hash})
+  if matches, _ := mem.MatchWatches(DefaultParamSet.Name, [][]byte{hash}); len(matches) != 0 {
+    t.Error("Expected the unpeppered hash not to be stored")
+  }
+  // rotate: watches made under the old key still match
+  rotated := NewPepperedWatchStore(mem, Keyring{newKey, oldKey})
+  rotated.AddWatches("acme", DefaultParamSet.Name, [][]byte{hash})
+  matched, err := NotifyWatches(rotated, DefaultParamSet.Name, [][]byte{hash})
+  if err != nil || matched != 1 {
+    t.Errorf("Expected 1 match for a hash watched under both keys. Got %d, %v\n", matched, err)
+  }
+  rotated.RemoveWatches("acme", DefaultParamSet.Name, [][]byte{hash})
+  if matches, _ := rotated.MatchWatches(DefaultParamSet.Name, [][]byte{hash}); len(matches) != 0 {
+    t.Errorf("Expected unwatching to remove the hash under every key. Got %v\n", matches)
+  }
+}
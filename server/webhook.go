@@ -0,0 +1,291 @@
+package server
+
+import (
+  "bytes"
+  "context"
+  "crypto/hmac"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "io"
+  "log"
+  "net"
+  "net/http"
+  "net/url"
+  "strconv"
+  "strings"
+  "sync"
+  "syscall"
+  "time"
+)
+
+// header carrying the signature of a watchlist delivery
+const WebhookSignatureHeader = "X-CCDS-Signature"
+
+// defaults for Notifier
+const DefaultWebhookAttempts = 8
+const DefaultWebhookRetryBase = 30 * time.Second
+const maxWebhookRetry = time.Hour
+const webhookTimeout = 10 * time.Second
+// deliveries fetched per poll
+const notifierBatch = 100
+// how long a claimed delivery is left to the server that claimed it; if
+// that server dies mid-send, another retries the delivery after this
+const notifierLease = 5 * time.Minute
+
+var ErrBadWebhookSignature = errors.New("Invalid or expired webhook signature.")
+
+var ErrPrivateWebhook = errors.New("Expected an https webhook URL whose host resolves to public addresses only.")
+
+// checked when a tenant registers a webhook; replaced in tests, which
+// serve webhooks on loopback
+var checkWebhookURL = CheckWebhookURL
+
+// reports ErrPrivateWebhook unless raw is an https URL whose host resolves
+// only to public addresses, so that tenants can't make the server send
+// requests inside its own network. The dialer of NewWebhookClient checks
+// again, since the host may resolve differently by delivery time.
+func CheckWebhookURL(raw string) error {
+  u, err := url.Parse(raw)
+  if err != nil || u.Scheme != "https" || u.Hostname() == "" || len(raw) > 2048 {
+    return ErrPrivateWebhook
+  }
+  ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+  defer cancel()
+  addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+  if err != nil {
+    return errors.New("Resolving the webhook host: " + err.Error())
+  }
+  for _, addr := range addrs {
+    if !publicIP(addr.IP) {
+      return ErrPrivateWebhook
+    }
+  }
+  return nil
+}
+
+// returns a client for tenant webhooks: it only connects to public
+// addresses and doesn't follow redirects, which could point anywhere
+func NewWebhookClient() *http.Client {
+  dialer := &net.Dialer{Timeout: webhookTimeout, Control: dialPublic}
+  return &http.Client{
+    Timeout: webhookTimeout,
+    // no Proxy, so that every connection goes through the dialer's check
+    Transport: &http.Transport{
+      DialContext: dialer.DialContext,
+      TLSHandshakeTimeout: webhookTimeout,
+    },
+    CheckRedirect: func(req *http.Request, via []*http.Request) error {
+      return http.ErrUseLastResponse
+    },
+  }
+}
+
+// a net.Dialer Control that refuses non-public addresses; it runs after
+// name resolution, on the address actually dialed
+func dialPublic(network, address string, c syscall.RawConn) error {
+  host, _, err := net.SplitHostPort(address)
+  if err != nil {
+    return err
+  }
+  if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+    return ErrPrivateWebhook
+  }
+  return nil
+}
+
+func publicIP(ip net.IP) bool {
+  return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+    ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// returns the WebhookSignatureHeader of body sent at t:
+// "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<body>" under secret>"
+func SignWebhook(secret string, t time.Time, body []byte) string {
+  ts := strconv.FormatInt(t.Unix(), 10)
+  return "t=" + ts + ",v1=" + hex.EncodeToString(webhookMAC(secret, ts, body))
+}
+
+// checks header against body for receivers of deliveries; signatures older
+// than tolerance are rejected so that deliveries can't be replayed
+func VerifyWebhook(secret, header string, body []byte, tolerance time.Duration) error {
+  var ts, sig string
+  for _, part := range strings.Split(header, ",") {
+    switch {
+    case strings.HasPrefix(part, "t="):
+      ts = strings.TrimPrefix(part, "t=")
+    case strings.HasPrefix(part, "v1="):
+      sig = strings.TrimPrefix(part, "v1=")
+    }
+  }
+  unix, err := strconv.ParseInt(ts, 10, 64)
+  if err != nil {
+    return ErrBadWebhookSignature
+  }
+  if age := time.Since(time.Unix(unix, 0)); age > tolerance || age < -tolerance {
+    return ErrBadWebhookSignature
+  }
+  mac, err := hex.DecodeString(sig)
+  if err != nil || !hmac.Equal(mac, webhookMAC(secret, ts, body)) {
+    return ErrBadWebhookSignature
+  }
+  return nil
+}
+
+func webhookMAC(secret, ts string, body []byte) []byte {
+  mac := hmac.New(sha256.New, []byte(secret))
+  mac.Write([]byte(ts + "."))
+  mac.Write(body)
+  return mac.Sum(nil)
+}
+
+// deadLetter is a line of the dead-letter log.
+type deadLetter struct{
+  ID        int64           `json:"id"`
+  Tenant    string          `json:"tenant"`
+  Attempts  int             `json:"attempts"`
+  LastError string          `json:"lastError"`
+  Created   time.Time       `json:"created"`
+  Event     json.RawMessage `json:"event"`
+}
+
+// Notifier delivers queued watchlist matches to their tenants' webhooks.
+// HTTPClient should come from NewWebhookClient, since tenants choose the
+// URLs.
+// A failed delivery is retried with exponential backoff; after MaxAttempts
+// it is marked dead and written to DeadLetters. Servers sharing the Store
+// claim each delivery before sending it, so only one of them sends it.
+type Notifier struct{
+  Store       WatchStore
+  HTTPClient  *http.Client
+  MaxAttempts int
+  // delay before the first retry; doubles with each attempt, up to an hour
+  RetryBase   time.Duration
+  // JSON lines of deliveries given up on; may be nil
+  DeadLetters io.Writer
+  mu          sync.Mutex
+  now         func() time.Time
+}
+
+func NewNotifier(store WatchStore, deadLetters io.Writer) *Notifier {
+  return &Notifier{
+    Store: store,
+    HTTPClient: NewWebhookClient(),
+    MaxAttempts: DefaultWebhookAttempts,
+    RetryBase: DefaultWebhookRetryBase,
+    DeadLetters: deadLetters,
+    now: time.Now,
+  }
+}
+
+// attempts every due delivery once; returns the number delivered
+func (n *Notifier) Deliver() (delivered int, err error) {
+  for {
+    due, err := n.Store.DueNotifications(n.now().UTC(), notifierBatch)
+    if err != nil {
+      return delivered, err
+    }
+    for _, note := range due {
+      // other servers sharing the store poll the same rows
+      now := n.now().UTC()
+      claimed, err := n.Store.ClaimNotification(note.ID, now, now.Add(notifierLease))
+      if err != nil {
+        return delivered, err
+      }
+      if !claimed {
+        continue
+      }
+      sendErr := n.send(note)
+      if sendErr == nil {
+        if err = n.Store.DeleteNotification(note.ID); err != nil {
+          return delivered, err
+        }
+        delivered += 1
+        continue
+      }
+      if err = n.retry(note, sendErr); err != nil {
+        return delivered, err
+      }
+    }
+    if len(due) < notifierBatch {
+      return delivered, nil
+    }
+  }
+}
+
+func (n *Notifier) send(note Notification) error {
+  h, err := n.Store.GetWebhook(note.Tenant)
+  if err != nil {
+    return err
+  }
+  // webhooks registered before https was required
+  if !strings.HasPrefix(h.URL, "https://") {
+    return ErrPrivateWebhook
+  }
+  req, err := http.NewRequest("POST", h.URL, bytes.NewReader(note.Payload))
+  if err != nil {
+    return err
+  }
+  req.Header.Set("Content-Type", "application/json")
+  req.Header.Set(WebhookSignatureHeader, SignWebhook(h.Secret, n.now(), note.Payload))
+  res, err := n.HTTPClient.Do(req)
+  if err != nil {
+    return err
+  }
+  io.Copy(io.Discard, io.LimitReader(res.Body, 1 << 16))
+  res.Body.Close()
+  if res.StatusCode < 200 || res.StatusCode >= 300 {
+    return errors.New("Webhook responded " + strconv.Itoa(res.StatusCode) + ".")
+  }
+  return nil
+}
+
+// schedules note's next attempt, or gives up on it
+func (n *Notifier) retry(note Notification, sendErr error) error {
+  note.Attempts += 1
+  note.LastError = sendErr.Error()
+  if note.Attempts >= n.MaxAttempts {
+    note.Dead = true
+    if err := n.Store.UpdateNotification(note); err != nil {
+      return err
+    }
+    n.deadLetter(note)
+    return nil
+  }
+  wait := n.RetryBase << uint(note.Attempts - 1)
+  if wait > maxWebhookRetry || wait <= 0 {
+    wait = maxWebhookRetry
+  }
+  note.NextAttempt = n.now().UTC().Add(wait)
+  return n.Store.UpdateNotification(note)
+}
+
+func (n *Notifier) deadLetter(note Notification) {
+  log.Println("Giving up on webhook delivery", note.ID, "to tenant", note.Tenant + ":", note.LastError)
+  if n.DeadLetters == nil {
+    return
+  }
+  b, _ := json.Marshal(deadLetter{note.ID, note.Tenant, note.Attempts, note.LastError, note.Created, note.Payload})
+  n.mu.Lock()
+  defer n.mu.Unlock()
+  if _, err := n.DeadLetters.Write(append(b, '\n')); err != nil {
+    log.Println("Writing dead letter:", err)
+  }
+}
+
+// delivers every interval until ctx is done
+func (n *Notifier) Run(ctx context.Context, every time.Duration) {
+  ticker := time.NewTicker(every)
+  defer ticker.Stop()
+  for {
+    select {
+    case <-ctx.Done():
+      return
+    case <-ticker.C:
+      if _, err := n.Deliver(); err != nil {
+        log.Println("Delivering webhooks:", err)
+      }
+    }
+  }
+}